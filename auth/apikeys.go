@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// API key scopes, one per route group a key may call.
+const (
+	ScopeEscrowRead    = "escrow:read"
+	ScopeEscrowDeposit = "escrow:deposit"
+	ScopeMailbox       = "mailbox"
+	ScopeTimebox       = "timebox"
+)
+
+var Scopes = []string{ScopeEscrowRead, ScopeEscrowDeposit, ScopeMailbox, ScopeTimebox}
+
+const (
+	APIKeyPrefix     = "sek_"
+	DefaultAPIKeyTTL = 90 * 24 * time.Hour
+	MaxAPIKeyTTL     = 365 * 24 * time.Hour
+
+	apiKeyPrefix      = "auth/apikeys/"
+	apiKeyOwnerPrefix = "auth/apikeys-by-owner/"
+)
+
+var ErrInvalidAPIKey = errors.New("invalid, expired or revoked api key")
+
+// APIKey is a long-lived credential for bots and service accounts. It acts
+// as its owner, but only on the route groups in Scopes and, when Pairs is
+// non-empty, only for those pairs. Only a SHA-256 of the secret is stored.
+type APIKey struct {
+	ID         string   `json:"id"`
+	Owner      string   `json:"owner"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	Pairs      []string `json:"pairs,omitempty"`
+	CreatedAt  int64    `json:"created_at"`
+	ExpiresAt  int64    `json:"expires_at"`
+	Generation int64    `json:"-" cbor:"generation"`
+	SecretHash []byte   `json:"-" cbor:"secret_hash"`
+}
+
+// HasScope reports whether the key may call routes of scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPair reports whether the key may act on pairID.
+func (k *APIKey) AllowsPair(pairID string) bool {
+	if len(k.Pairs) == 0 {
+		return true
+	}
+	for _, p := range k.Pairs {
+		if p == pairID {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyResolver looks up the key a bearer credential belongs to.
+type APIKeyResolver interface {
+	ResolveAPIKey(ctx context.Context, token string) (*APIKey, error)
+}
+
+// APIKeyStore persists API keys. Keys are also invalidated by
+// TokenStore.RevokeAll of their owner.
+type APIKeyStore struct {
+	stor   storage.Storage
+	tokens *TokenStore
+}
+
+func NewAPIKeyStore(stor storage.Storage, tokens *TokenStore) *APIKeyStore {
+	return &APIKeyStore{stor: stor, tokens: tokens}
+}
+
+func secretHash(secret string) []byte {
+	h := sha256.Sum256([]byte(secret))
+	return h[:]
+}
+
+// Create issues a key for owner and returns it together with the token,
+// which is shown only once: sek_<id>_<secret>.
+func (ks *APIKeyStore) Create(ctx context.Context, owner, name string, scopes, pairs []string, ttl time.Duration) (string, *APIKey, error) {
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	for _, s := range scopes {
+		known := false
+		for _, k := range Scopes {
+			known = known || s == k
+		}
+		if !known {
+			return "", nil, fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	if ttl == 0 {
+		ttl = DefaultAPIKeyTTL
+	}
+	if ttl < 0 || ttl > MaxAPIKeyTTL {
+		return "", nil, fmt.Errorf("expiry must be between 0 and %s", MaxAPIKeyTTL)
+	}
+
+	gen, err := ks.tokens.Generation(ctx, owner)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret := randomToken(32)
+	now := time.Now()
+	key := &APIKey{
+		ID:         randomToken(8),
+		Owner:      normalizeSubject(owner),
+		Name:       name,
+		Scopes:     scopes,
+		Pairs:      pairs,
+		CreatedAt:  now.Unix(),
+		ExpiresAt:  now.Add(ttl).Unix(),
+		Generation: gen,
+		SecretHash: secretHash(secret),
+	}
+	put, err := putOp(key)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := storage.Batch(ctx, ks.stor, []storage.Op{
+		put,
+		storage.IndexAddOp(apiKeyOwnerPrefix+key.Owner, key.ID),
+	}); err != nil {
+		return "", nil, err
+	}
+	return APIKeyPrefix + key.ID + "_" + secret, key, nil
+}
+
+func putOp(key *APIKey) (storage.Op, error) {
+	data, err := cbor.Marshal(key)
+	if err != nil {
+		return storage.Op{}, err
+	}
+	return storage.Op{Key: apiKeyPrefix + key.ID, Value: data}, nil
+}
+
+func (ks *APIKeyStore) load(ctx context.Context, id string) (*APIKey, error) {
+	data, err := ks.stor.Get(ctx, apiKeyPrefix+id)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	key := &APIKey{}
+	if err := cbor.Unmarshal(data, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// List returns the keys of owner, without secrets.
+func (ks *APIKeyStore) List(ctx context.Context, owner string) ([]*APIKey, error) {
+	ids, err := storage.IndexList(ctx, ks.stor, apiKeyOwnerPrefix+normalizeSubject(owner))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*APIKey, 0, len(ids))
+	for _, id := range ids {
+		key, err := ks.load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Revoke deletes a key. Only its owner may revoke it; revoking an unknown
+// key is a no-op.
+func (ks *APIKeyStore) Revoke(ctx context.Context, owner, id string) error {
+	key, err := ks.load(ctx, id)
+	if err != nil || key == nil {
+		return err
+	}
+	if key.Owner != normalizeSubject(owner) {
+		return ErrInvalidAPIKey
+	}
+	if err := storage.MigrateIndex(ctx, ks.stor, apiKeyOwnerPrefix+key.Owner); err != nil {
+		return err
+	}
+	return storage.Batch(ctx, ks.stor, []storage.Op{
+		storage.IndexRemoveOp(apiKeyOwnerPrefix+key.Owner, id),
+		{Key: apiKeyPrefix + id, Delete: true},
+	})
+}
+
+// MigrateAPIKeyIndexes converts the legacy per-owner index blobs of stor.
+func MigrateAPIKeyIndexes(ctx context.Context, stor storage.Storage) error {
+	return storage.MigrateIndexes(ctx, stor, apiKeyOwnerPrefix)
+}
+
+// ResolveAPIKey implements APIKeyResolver.
+func (ks *APIKeyStore) ResolveAPIKey(ctx context.Context, token string) (*APIKey, error) {
+	rest, ok := strings.CutPrefix(token, APIKeyPrefix)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return nil, ErrInvalidAPIKey
+	}
+	key, err := ks.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil || subtle.ConstantTimeCompare(key.SecretHash, secretHash(secret)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	if time.Now().Unix() > key.ExpiresAt {
+		return nil, ErrInvalidAPIKey
+	}
+	gen, err := ks.tokens.Generation(ctx, key.Owner)
+	if err != nil {
+		return nil, err
+	}
+	if key.Generation < gen {
+		return nil, ErrInvalidAPIKey
+	}
+	return key, nil
+}
@@ -22,6 +22,9 @@ var (
 
 type Claims struct {
 	Address string `json:"address"`
+	// Generation is the address's session generation at issue time. Revoking
+	// all sessions bumps it, which invalidates every older token at once.
+	Generation int64 `json:"gen,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -60,26 +63,33 @@ func VerifySignature(address, message, signature string) (common.Address, error)
 	return recovered, nil
 }
 
-func GenerateToken(address common.Address, secret []byte, ttl time.Duration) (string, error) {
-	claims := Claims{
-		Address: strings.ToLower(address.Hex()),
+func GenerateToken(address common.Address, keys *KeySet, ttl time.Duration) (string, error) {
+	return SignClaims(NewClaims(strings.ToLower(address.Hex()), 0, ttl), keys)
+}
+
+// NewClaims builds access-token claims with a random token ID (jti), so a
+// single token can be put on the denylist.
+func NewClaims(address string, generation int64, ttl time.Duration) *Claims {
+	now := time.Now()
+	return &Claims{
+		Address:    address,
+		Generation: generation,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        randomToken(16),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(secret)
+func SignClaims(claims *Claims, keys *KeySet) (string, error) {
+	return keys.Sign(claims)
 }
 
-func ValidateToken(tokenString string, secret []byte) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return secret, nil
-	})
+// ValidateToken verifies a token against any key of the set, selected by the
+// kid header.
+func ValidateToken(tokenString string, keys *KeySet) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keys.Keyfunc)
 	if err != nil {
 		return nil, ErrInvalidToken
 	}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Bitcoin message signatures: BIP-322 "simple" signatures for P2WPKH and P2TR
+// addresses and legacy Bitcoin Core signmessage (BIP-137) signatures for
+// P2WPKH. See https://github.com/bitcoin/bips/blob/master/bip-0322.mediawiki.
+
+const bitcoinSignedMessagePrefix = "Bitcoin Signed Message:\n"
+
+var bip322Tag = []byte("BIP0322-signed-message")
+
+// BIP322MessageHash is the tagged hash BIP-322 commits to in to_spend.
+func BIP322MessageHash(message string) []byte {
+	return chainhash.TaggedHash(bip322Tag, []byte(message))[:]
+}
+
+// BIP322Transactions builds the virtual to_spend and unsigned to_sign
+// transactions for message and the output script of the signing address.
+func BIP322Transactions(pkScript []byte, message string) (toSpend, toSign *wire.MsgTx, err error) {
+	scriptSig, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(BIP322MessageHash(message)).
+		Script()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	toSpend = wire.NewMsgTx(0)
+	toSpend.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+		SignatureScript:  scriptSig,
+		Sequence:         0,
+	})
+	toSpend.AddTxOut(wire.NewTxOut(0, pkScript))
+
+	toSign = wire.NewMsgTx(0)
+	toSign.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Hash: toSpend.TxHash(), Index: 0},
+		Sequence:         0,
+	})
+	toSign.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_RETURN}))
+	return toSpend, toSign, nil
+}
+
+// VerifyBitcoin checks a base64 signature of message by a P2WPKH or P2TR
+// address (bare or btc:-prefixed): a BIP-322 simple signature, or for
+// P2WPKH also a legacy 65-byte signmessage signature.
+func VerifyBitcoin(address, message, signature string) error {
+	id, err := ParseIdentity(address)
+	if err != nil || IdentityNamespace(id) != NamespaceBTC {
+		return ErrInvalidAddress
+	}
+	addr, err := decodeBTCAddress(IdentityAddress(id))
+	if err != nil {
+		return ErrInvalidAddress
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+
+	if wpkh, ok := addr.(*btcutil.AddressWitnessPubKeyHash); ok && len(sig) == 65 && sig[0] >= 27 && sig[0] <= 42 {
+		return verifyLegacyBitcoin(wpkh, message, sig)
+	}
+	return verifyBIP322(addr, message, sig)
+}
+
+// verifyLegacyBitcoin checks a compact signature over the signmessage digest.
+// Any header variant is accepted as long as the recovered compressed key
+// hashes to the address.
+func verifyLegacyBitcoin(addr *btcutil.AddressWitnessPubKeyHash, message string, sig []byte) error {
+	var buf bytes.Buffer
+	_ = wire.WriteVarString(&buf, 0, bitcoinSignedMessagePrefix)
+	_ = wire.WriteVarString(&buf, 0, message)
+	hash := chainhash.DoubleHashB(buf.Bytes())
+
+	// RecoverCompact understands headers 27-34; BIP-137 adds 4 for P2SH-P2WPKH
+	// and 8 for P2WPKH, both with compressed keys.
+	compact := append([]byte(nil), sig...)
+	if compact[0] >= 35 {
+		compact[0] = 31 + (compact[0]-27)%4
+	}
+	pub, _, err := ecdsa.RecoverCompact(compact, hash)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !bytes.Equal(btcutil.Hash160(pub.SerializeCompressed()), addr.WitnessProgram()) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// verifyBIP322 runs the to_sign transaction, with sig as its witness, through
+// the script interpreter.
+func verifyBIP322(addr btcutil.Address, message string, sig []byte) error {
+	witness, err := readWitness(sig)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return err
+	}
+	_, toSign, err := BIP322Transactions(pkScript, message)
+	if err != nil {
+		return err
+	}
+	toSign.TxIn[0].Witness = witness
+
+	prevOuts := txscript.NewCannedPrevOutputFetcher(pkScript, 0)
+	vm, err := txscript.NewEngine(pkScript, toSign, 0, txscript.StandardVerifyFlags, nil,
+		txscript.NewTxSigHashes(toSign, prevOuts), 0, prevOuts)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if err := vm.Execute(); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// readWitness decodes a consensus-serialized witness stack.
+func readWitness(data []byte) (wire.TxWitness, error) {
+	r := bytes.NewReader(data)
+	n, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n > uint64(len(data)) {
+		return nil, fmt.Errorf("bad witness item count %d", n)
+	}
+	witness := make(wire.TxWitness, n)
+	for i := range witness {
+		if witness[i], err = wire.ReadVarBytes(r, 0, wire.MaxMessagePayload, "witness item"); err != nil {
+			return nil, err
+		}
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after witness", r.Len())
+	}
+	return witness, nil
+}
+
+// EncodeWitness serializes a witness stack the way BIP-322 simple signatures
+// carry it, before base64 encoding.
+func EncodeWitness(witness wire.TxWitness) []byte {
+	var buf bytes.Buffer
+	_ = wire.WriteVarInt(&buf, 0, uint64(len(witness)))
+	for _, item := range witness {
+		_ = wire.WriteVarBytes(&buf, 0, item)
+	}
+	return buf.Bytes()
+}
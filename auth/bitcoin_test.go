@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Test vectors from BIP-322.
+func TestBIP322Vectors(t *testing.T) {
+	for msg, want := range map[string]string{
+		"":            "c90c269c4f8fcbe6880f72a721ddfbf1914268a794cbb21cfafee13770ae19f1",
+		"Hello World": "f0eb03b1a75ac6d9847f55c624a99169b5dccba2a31f5b23bea77ba270de0a7a",
+	} {
+		if got := hex.EncodeToString(BIP322MessageHash(msg)); got != want {
+			t.Errorf("message hash of %q: %s", msg, got)
+		}
+	}
+
+	const address = "bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l"
+	sigs := map[string]string{
+		"":            "AkcwRAIgM2gBAQqvZX15ZiysmKmQpDrG83avLIT492QBzLnQIxYCIBaTpOaD20qRlEylyxFSeEA2ba9YOixpX8z46TSDtS40ASECx/EgAxlkQpQ9hYjgGu6EBCPMVPwVIVJqO4XCsMvViHI=",
+		"Hello World": "AkcwRAIgZRfIY3p7/DoVTty6YZbWS71bc5Vct9p9Fia83eRmw2QCICK/ENGfwLtptFluMGs2KsqoNSk89pO7F29zJLUx9a/sASECx/EgAxlkQpQ9hYjgGu6EBCPMVPwVIVJqO4XCsMvViHI=",
+	}
+	for msg, sig := range sigs {
+		if err := VerifyBitcoin(address, msg, sig); err != nil {
+			t.Errorf("signature of %q: %v", msg, err)
+		}
+	}
+	if err := VerifyBitcoin(address, "Hello World", sigs[""]); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("signature of another message: %v", err)
+	}
+}
+
+func bip322Sign(t *testing.T, priv *btcec.PrivateKey, addr btcutil.Address, message string) string {
+	t.Helper()
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, toSign, err := BIP322Transactions(pkScript, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevOuts := txscript.NewCannedPrevOutputFetcher(pkScript, 0)
+	sigHashes := txscript.NewTxSigHashes(toSign, prevOuts)
+
+	var witness wire.TxWitness
+	switch addr.(type) {
+	case *btcutil.AddressTaproot:
+		witness, err = txscript.TaprootWitnessSignature(toSign, sigHashes, 0, 0, pkScript,
+			txscript.SigHashDefault, priv)
+	default:
+		witness, err = txscript.WitnessSignature(toSign, sigHashes, 0, 0, pkScript,
+			txscript.SigHashAll, priv, true)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(EncodeWitness(witness))
+}
+
+func TestVerifyBitcoin(t *testing.T) {
+	priv, _ := btcec.NewPrivateKey()
+	params := &chaincfg.MainNetParams
+	wpkh, _ := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(priv.PubKey().SerializeCompressed()), params)
+	tr, _ := btcutil.NewAddressTaproot(schnorr.SerializePubKey(txscript.ComputeTaprootKeyNoScript(priv.PubKey())), params)
+	message := "Sign in to MPC Oven"
+
+	for _, addr := range []btcutil.Address{wpkh, tr} {
+		sig := bip322Sign(t, priv, addr, message)
+		if err := VerifyBitcoin("btc:"+addr.EncodeAddress(), message, sig); err != nil {
+			t.Errorf("%s: %v", addr, err)
+		}
+		if err := VerifyBitcoin(addr.EncodeAddress(), "another message", sig); err == nil {
+			t.Errorf("%s: signature over another message accepted", addr)
+		}
+	}
+
+	// The P2WPKH signature does not verify for the taproot address of the
+	// same key.
+	if err := VerifyBitcoin(tr.EncodeAddress(), message, bip322Sign(t, priv, wpkh, message)); err == nil {
+		t.Error("P2WPKH witness accepted for P2TR address")
+	}
+
+	// Legacy signmessage (BIP-137 header for P2WPKH).
+	var buf bytes.Buffer
+	_ = wire.WriteVarString(&buf, 0, bitcoinSignedMessagePrefix)
+	_ = wire.WriteVarString(&buf, 0, message)
+	legacy, err := ecdsa.SignCompact(priv, chainhash.DoubleHashB(buf.Bytes()), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []byte{0, 8} {
+		sig := append([]byte{legacy[0] + offset}, legacy[1:]...)
+		if err := VerifyBitcoin(wpkh.EncodeAddress(), message, base64.StdEncoding.EncodeToString(sig)); err != nil {
+			t.Errorf("legacy header %d: %v", sig[0], err)
+		}
+	}
+	other, _ := btcec.NewPrivateKey()
+	forged, _ := ecdsa.SignCompact(other, chainhash.DoubleHashB(buf.Bytes()), true)
+	if err := VerifyBitcoin(wpkh.EncodeAddress(), message, base64.StdEncoding.EncodeToString(forged)); err == nil {
+		t.Error("legacy signature by another key accepted")
+	}
+}
+
+func TestParseIdentity(t *testing.T) {
+	for in, want := range map[string]string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed":     "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed",
+		"eth:0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed": "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed",
+		"bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l":     "btc:bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l",
+		"BTC:BC1Q9VZA2E8X573NCZRLZMS0WVX3GSQJX7VAVGKX0L": "btc:bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l",
+	} {
+		got, err := ParseIdentity(in)
+		if err != nil || got != want {
+			t.Errorf("%s: got %q, %v", in, got, err)
+		}
+	}
+	for _, bad := range []string{
+		"",
+		"0x01",
+		"btc:0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"eth:bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l",
+		"btc:1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", // P2PKH is not supported
+		"sol:0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+	} {
+		if _, err := ParseIdentity(bad); !errors.Is(err, ErrInvalidIdentity) {
+			t.Errorf("%q: expected ErrInvalidIdentity, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Identity namespaces. An identity is the string a session, pair, mailbox
+// message or escrow deposit is recorded under.
+//
+// Ethereum identities keep their historical bare form, the lowercase 0x
+// address, so tokens and records created before namespacing stay valid;
+// "eth:0x..." is accepted as input. Bitcoin identities are always prefixed:
+// "btc:bc1...".
+const (
+	NamespaceETH = "eth"
+	NamespaceBTC = "btc"
+)
+
+var ErrInvalidIdentity = errors.New("invalid identity: expected an ETH address or btc:<P2WPKH or P2TR address>")
+
+// btcNetworks are the networks whose addresses are recognized, by bech32
+// human-readable part.
+var btcNetworks = []*chaincfg.Params{
+	&chaincfg.MainNetParams,
+	&chaincfg.TestNet3Params,
+	&chaincfg.RegressionNetParams,
+	&chaincfg.SigNetParams,
+}
+
+// ParseIdentity returns the canonical form of s: a lowercase 0x address for
+// Ethereum, "btc:<address>" for Bitcoin. A bare bech32 Bitcoin address is
+// accepted too.
+func ParseIdentity(s string) (string, error) {
+	ns, addr, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		ns, addr = "", ns
+	}
+	switch strings.ToLower(ns) {
+	case NamespaceETH:
+		if !common.IsHexAddress(addr) {
+			return "", ErrInvalidIdentity
+		}
+		return strings.ToLower(common.HexToAddress(addr).Hex()), nil
+	case NamespaceBTC:
+		a, err := decodeBTCAddress(addr)
+		if err != nil {
+			return "", err
+		}
+		return NamespaceBTC + ":" + a.EncodeAddress(), nil
+	case "":
+		if common.IsHexAddress(addr) {
+			return strings.ToLower(common.HexToAddress(addr).Hex()), nil
+		}
+		if a, err := decodeBTCAddress(addr); err == nil {
+			return NamespaceBTC + ":" + a.EncodeAddress(), nil
+		}
+	}
+	return "", ErrInvalidIdentity
+}
+
+// IdentityNamespace returns NamespaceETH or NamespaceBTC for a canonical
+// identity.
+func IdentityNamespace(id string) string {
+	if strings.HasPrefix(id, NamespaceBTC+":") {
+		return NamespaceBTC
+	}
+	return NamespaceETH
+}
+
+// IdentityAddress returns the chain address of an identity, without the
+// namespace.
+func IdentityAddress(id string) string {
+	if _, addr, ok := strings.Cut(id, ":"); ok {
+		return addr
+	}
+	return id
+}
+
+// decodeBTCAddress decodes a P2WPKH or P2TR address of any known network.
+func decodeBTCAddress(s string) (btcutil.Address, error) {
+	s = strings.ToLower(s)
+	for _, params := range btcNetworks {
+		if !strings.HasPrefix(s, params.Bech32HRPSegwit+"1") {
+			continue
+		}
+		a, err := btcutil.DecodeAddress(s, params)
+		if err != nil {
+			return nil, ErrInvalidIdentity
+		}
+		switch a.(type) {
+		case *btcutil.AddressWitnessPubKeyHash, *btcutil.AddressTaproot:
+			return a, nil
+		}
+		return nil, ErrInvalidIdentity
+	}
+	return nil, ErrInvalidIdentity
+}
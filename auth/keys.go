@@ -0,0 +1,417 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+
+	signingKeyPrefix = "auth/jwks/"
+	// legacyKeyIndex listed the key IDs before storages could list keys.
+	legacyKeyIndex = "auth/jwks-index"
+
+	// retiredKeyGrace keeps a rotated-out key verifiable for longer than any
+	// access token it could have signed.
+	retiredKeyGrace = 2 * AccessTokenTTL
+	reloadInterval  = 10 * time.Second
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// KeySet signs and verifies JWTs. An asymmetric set persists its private keys
+// in storage, rotates them by kid and publishes the public halves as a JWKS;
+// an HMAC set wraps a single shared secret; a verify-only set is built from a
+// published JWKS.
+type KeySet struct {
+	mu         sync.RWMutex
+	alg        string
+	current    string
+	keys       map[string]*signingKey
+	stor       storage.Storage
+	lastReload time.Time
+}
+
+type signingKey struct {
+	ID        string
+	Alg       string
+	CreatedAt int64
+	RetiredAt int64
+	// Private is PKCS#8 DER for ES256/EdDSA and the raw secret for HS256.
+	Private []byte
+
+	signer crypto.PrivateKey
+	public crypto.PublicKey
+}
+
+func (k *signingKey) load() error {
+	switch k.Alg {
+	case AlgHS256:
+		k.signer, k.public = k.Private, k.Private
+		return nil
+	case AlgES256, AlgEdDSA:
+		priv, err := x509.ParsePKCS8PrivateKey(k.Private)
+		if err != nil {
+			return err
+		}
+		switch p := priv.(type) {
+		case *ecdsa.PrivateKey:
+			k.signer, k.public = p, &p.PublicKey
+		case ed25519.PrivateKey:
+			k.signer, k.public = p, p.Public()
+		default:
+			return fmt.Errorf("unsupported private key type %T", priv)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported jwt algorithm %q", k.Alg)
+	}
+}
+
+func signingMethod(alg string) jwt.SigningMethod {
+	switch alg {
+	case AlgES256:
+		return jwt.SigningMethodES256
+	case AlgEdDSA:
+		return jwt.SigningMethodEdDSA
+	default:
+		return jwt.SigningMethodHS256
+	}
+}
+
+// NewHMACKeySet wraps a shared HS256 secret. Nothing is published as JWKS.
+func NewHMACKeySet(secret []byte) *KeySet {
+	k := &signingKey{ID: "", Alg: AlgHS256, Private: secret}
+	_ = k.load()
+	return &KeySet{alg: AlgHS256, keys: map[string]*signingKey{"": k}}
+}
+
+// LoadKeySet loads the asymmetric signing keys kept in stor, generating the
+// first one if there is none yet.
+func LoadKeySet(ctx context.Context, stor storage.Storage, alg string) (*KeySet, error) {
+	if alg != AlgES256 && alg != AlgEdDSA {
+		return nil, fmt.Errorf("unsupported jwt algorithm %q (expected %s or %s)", alg, AlgES256, AlgEdDSA)
+	}
+	ks := &KeySet{alg: alg, stor: stor, keys: make(map[string]*signingKey)}
+	if err := ks.reload(ctx); err != nil {
+		return nil, err
+	}
+	if ks.current == "" {
+		if _, err := ks.Rotate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+func (ks *KeySet) keyIDs(ctx context.Context) ([]string, error) {
+	keys, err := ks.stor.List(ctx, signingKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	ids := keys[:0]
+	for _, k := range keys {
+		if !strings.HasSuffix(k, "/") {
+			ids = append(ids, k)
+		}
+	}
+	return ids, nil
+}
+
+func (ks *KeySet) reload(ctx context.Context) error {
+	ids, err := ks.keyIDs(ctx)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]*signingKey, len(ids))
+	var current *signingKey
+	for _, id := range ids {
+		data, err := ks.stor.Get(ctx, signingKeyPrefix+id)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		k := &signingKey{}
+		if err := cbor.Unmarshal(data, k); err != nil {
+			return err
+		}
+		if err := k.load(); err != nil {
+			return fmt.Errorf("signing key %s: %w", id, err)
+		}
+		keys[k.ID] = k
+		if k.RetiredAt == 0 && k.Alg == ks.alg && (current == nil || k.CreatedAt > current.CreatedAt) {
+			current = k
+		}
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = keys
+	ks.current = ""
+	if current != nil {
+		ks.current = current.ID
+	}
+	ks.lastReload = time.Now()
+	return nil
+}
+
+func newSigningKey(alg string) (*signingKey, error) {
+	var priv any
+	var err error
+	switch alg {
+	case AlgES256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	k := &signingKey{
+		ID:        time.Now().UTC().Format("20060102") + "-" + randomToken(4),
+		Alg:       alg,
+		CreatedAt: time.Now().Unix(),
+		Private:   der,
+	}
+	return k, k.load()
+}
+
+func (ks *KeySet) putKey(ctx context.Context, k *signingKey) error {
+	data, err := cbor.Marshal(k)
+	if err != nil {
+		return err
+	}
+	return ks.stor.Put(ctx, signingKeyPrefix+k.ID, data)
+}
+
+// Rotate generates a new current key. The previous key is retired but stays
+// valid for verification until tokens signed with it have expired.
+func (ks *KeySet) Rotate(ctx context.Context) (string, error) {
+	if ks.stor == nil {
+		return "", errors.New("key set is not rotatable")
+	}
+	if err := ks.reload(ctx); err != nil {
+		return "", err
+	}
+	k, err := newSigningKey(ks.alg)
+	if err != nil {
+		return "", err
+	}
+	if err := ks.putKey(ctx, k); err != nil {
+		return "", err
+	}
+
+	ids, err := ks.keyIDs(ctx)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	for _, id := range ids {
+		old, ok := ks.key(id)
+		if !ok || id == k.ID {
+			continue
+		}
+		if old.RetiredAt != 0 && time.Unix(old.RetiredAt, 0).Add(retiredKeyGrace).Before(time.Now()) {
+			_ = ks.stor.Delete(ctx, signingKeyPrefix+id)
+			continue
+		}
+		if old.RetiredAt == 0 {
+			retired := *old
+			retired.RetiredAt = now
+			if err := ks.putKey(ctx, &retired); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := ks.stor.Delete(ctx, legacyKeyIndex); err != nil {
+		return "", err
+	}
+
+	return k.ID, ks.reload(ctx)
+}
+
+// RotateIfOlder rotates when the current key is older than maxAge.
+func (ks *KeySet) RotateIfOlder(ctx context.Context, maxAge time.Duration) (bool, error) {
+	if ks.stor == nil || maxAge <= 0 {
+		return false, nil
+	}
+	if err := ks.reload(ctx); err != nil {
+		return false, err
+	}
+	cur, ok := ks.key(ks.Current())
+	if ok && time.Since(time.Unix(cur.CreatedAt, 0)) < maxAge {
+		return false, nil
+	}
+	_, err := ks.Rotate(ctx)
+	return err == nil, err
+}
+
+func (ks *KeySet) key(id string) (*signingKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	k, ok := ks.keys[id]
+	return k, ok
+}
+
+// Current returns the kid new tokens are signed with.
+func (ks *KeySet) Current() string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.current
+}
+
+// Alg returns the signing algorithm of the set.
+func (ks *KeySet) Alg() string {
+	return ks.alg
+}
+
+// Sign signs claims with the current key, stamping its kid in the header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	k, ok := ks.key(ks.Current())
+	if !ok || k.signer == nil {
+		return "", errors.New("no signing key available")
+	}
+	token := jwt.NewWithClaims(signingMethod(k.Alg), claims)
+	if k.ID != "" {
+		token.Header["kid"] = k.ID
+	}
+	return token.SignedString(k.signer)
+}
+
+// Keyfunc resolves the verification key for a parsed token. A kid that is not
+// known yet triggers a reload, so keys rotated by another replica sharing the
+// same storage are picked up.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	k, ok := ks.key(kid)
+	if !ok && ks.stor != nil {
+		ks.mu.RLock()
+		stale := time.Since(ks.lastReload) > reloadInterval
+		ks.mu.RUnlock()
+		if stale {
+			if err := ks.reload(context.Background()); err != nil {
+				return nil, err
+			}
+			k, ok = ks.key(kid)
+		}
+	}
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != k.Alg {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	if k.Alg == AlgHS256 {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+	}
+	return k.public, nil
+}
+
+// JWK is one entry of a JSON Web Key Set (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the set. Symmetric keys are never published.
+func (ks *KeySet) JWKS() JWKSet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := JWKSet{Keys: make([]JWK, 0, len(ks.keys))}
+	for _, k := range ks.keys {
+		b64 := base64.RawURLEncoding.EncodeToString
+		switch pub := k.public.(type) {
+		case *ecdsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "EC", Crv: "P-256", Kid: k.ID, Alg: k.Alg, Use: "sig",
+				X: b64(pub.X.FillBytes(make([]byte, 32))),
+				Y: b64(pub.Y.FillBytes(make([]byte, 32))),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP", Crv: "Ed25519", Kid: k.ID, Alg: k.Alg, Use: "sig",
+				X: b64(pub),
+			})
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// ParseJWKS builds a verify-only key set from a published JWKS document.
+func ParseJWKS(data []byte) (*KeySet, error) {
+	var set JWKSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	ks := &KeySet{keys: make(map[string]*signingKey)}
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: %w", j.Kid, err)
+		}
+		k := &signingKey{ID: j.Kid, Alg: j.Alg}
+		switch {
+		case j.Kty == "EC" && j.Crv == "P-256":
+			y, err := base64.RawURLEncoding.DecodeString(j.Y)
+			if err != nil {
+				return nil, fmt.Errorf("jwk %s: %w", j.Kid, err)
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("jwk %s: point not on curve", j.Kid)
+			}
+			k.public = pub
+		case j.Kty == "OKP" && j.Crv == "Ed25519" && len(x) == ed25519.PublicKeySize:
+			k.public = ed25519.PublicKey(x)
+		default:
+			return nil, fmt.Errorf("jwk %s: unsupported key %s/%s", j.Kid, j.Kty, j.Crv)
+		}
+		ks.keys[k.ID] = k
+	}
+	return ks, nil
+}
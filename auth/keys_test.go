@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+func newTestStorage(t *testing.T) storage.Storage {
+	t.Helper()
+	stor, err := storage.NewFileStorage(map[string]string{"path": t.TempDir()}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stor
+}
+
+func TestKeySetSignVerify(t *testing.T) {
+	ctx := context.Background()
+	for _, alg := range []string{AlgES256, AlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			stor := newTestStorage(t)
+			ks, err := LoadKeySet(ctx, stor, alg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := SignClaims(NewClaims("0xabc", 0, time.Minute), ks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := ValidateToken(token, ks)
+			if err != nil || claims.Address != "0xabc" {
+				t.Fatalf("validate: %v %+v", err, claims)
+			}
+
+			// A verifier holding only the published JWKS accepts the token.
+			doc, _ := json.Marshal(ks.JWKS())
+			remote, err := ParseJWKS(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ValidateToken(token, remote); err != nil {
+				t.Fatalf("validate with jwks: %v", err)
+			}
+			if _, err := SignClaims(NewClaims("0xabc", 0, time.Minute), remote); err == nil {
+				t.Fatal("verify-only key set must not sign")
+			}
+
+			// Keys persist across restarts.
+			reloaded, err := LoadKeySet(ctx, stor, alg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reloaded.Current() != ks.Current() {
+				t.Fatalf("kid changed on reload: %s != %s", reloaded.Current(), ks.Current())
+			}
+			if _, err := ValidateToken(token, reloaded); err != nil {
+				t.Fatalf("validate after reload: %v", err)
+			}
+		})
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	ctx := context.Background()
+	stor := newTestStorage(t)
+	ks, err := LoadKeySet(ctx, stor, AlgES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKid := ks.Current()
+	oldToken, _ := SignClaims(NewClaims("0xabc", 0, time.Minute), ks)
+
+	if rotated, err := ks.RotateIfOlder(ctx, time.Hour); err != nil || rotated {
+		t.Fatalf("fresh key rotated: %v %v", rotated, err)
+	}
+	newKid, err := ks.Rotate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKid == oldKid || ks.Current() != newKid {
+		t.Fatalf("current kid not switched: %s -> %s", oldKid, ks.Current())
+	}
+	if _, err := ValidateToken(oldToken, ks); err != nil {
+		t.Fatalf("token signed by retired key rejected: %v", err)
+	}
+	if n := len(ks.JWKS().Keys); n != 2 {
+		t.Fatalf("expected 2 published keys, got %d", n)
+	}
+
+	// Another replica sharing the storage picks up the new key on demand.
+	other, err := LoadKeySet(ctx, stor, AlgES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Current() != newKid {
+		t.Fatalf("replica signs with %s, want %s", other.Current(), newKid)
+	}
+}
+
+func TestKeySetRejectsForeignTokens(t *testing.T) {
+	ctx := context.Background()
+	ks, err := LoadKeySet(ctx, newTestStorage(t), AlgEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hmac := NewHMACKeySet([]byte("secret"))
+	token, _ := SignClaims(NewClaims("0xabc", 0, time.Minute), hmac)
+	if _, err := ValidateToken(token, ks); err == nil {
+		t.Fatal("HS256 token accepted by asymmetric key set")
+	}
+	if len(hmac.JWKS().Keys) != 0 {
+		t.Fatal("HMAC secret published in JWKS")
+	}
+
+	other, _ := LoadKeySet(ctx, newTestStorage(t), AlgEdDSA)
+	token, _ = SignClaims(NewClaims("0xabc", 0, time.Minute), other)
+	if _, err := ValidateToken(token, ks); err == nil {
+		t.Fatal("token from unrelated key set accepted")
+	}
+}
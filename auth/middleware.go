@@ -2,15 +2,29 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 )
 
 type contextKey string
 
-const AddressKey contextKey = "eth_address"
+const (
+	AddressKey contextKey = "eth_address"
+	ClaimsKey  contextKey = "claims"
+	APIKeyKey  contextKey = "api_key"
+)
+
+// Revocation reports whether an otherwise valid token has been revoked.
+type Revocation interface {
+	IsRevoked(ctx context.Context, claims *Claims) (bool, error)
+}
 
-func Middleware(secret []byte) func(http.Handler) http.Handler {
+// Middleware authenticates Bearer JWTs and, when apiKeys is set, Bearer API
+// keys (sek_...). rev may be nil when tokens cannot be revoked. Requests made
+// with an API key carry the owner's address; routes restrict keys with
+// RequireScope and SessionOnly.
+func Middleware(keys *KeySet, rev Revocation, apiKeys APIKeyResolver) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			header := r.Header.Get("Authorization")
@@ -25,13 +39,42 @@ func Middleware(secret []byte) func(http.Handler) http.Handler {
 				return
 			}
 
-			claims, err := ValidateToken(token, secret)
+			if apiKeys != nil && strings.HasPrefix(token, APIKeyPrefix) {
+				key, err := apiKeys.ResolveAPIKey(r.Context(), token)
+				if err != nil {
+					if errors.Is(err, ErrInvalidAPIKey) {
+						http.Error(w, `{"errors":["invalid, expired or revoked api key"]}`, http.StatusUnauthorized)
+					} else {
+						http.Error(w, `{"errors":["api key check failed"]}`, http.StatusInternalServerError)
+					}
+					return
+				}
+				ctx := context.WithValue(r.Context(), AddressKey, key.Owner)
+				ctx = context.WithValue(ctx, APIKeyKey, key)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			claims, err := ValidateToken(token, keys)
 			if err != nil {
 				http.Error(w, `{"errors":["invalid or expired token"]}`, http.StatusUnauthorized)
 				return
 			}
 
+			if rev != nil {
+				revoked, err := rev.IsRevoked(r.Context(), claims)
+				if err != nil {
+					http.Error(w, `{"errors":["token revocation check failed"]}`, http.StatusInternalServerError)
+					return
+				}
+				if revoked {
+					http.Error(w, `{"errors":["token revoked"]}`, http.StatusUnauthorized)
+					return
+				}
+			}
+
 			ctx := context.WithValue(r.Context(), AddressKey, claims.Address)
+			ctx = context.WithValue(ctx, ClaimsKey, claims)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
@@ -41,3 +84,47 @@ func AddressFromContext(ctx context.Context) string {
 	addr, _ := ctx.Value(AddressKey).(string)
 	return addr
 }
+
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(ClaimsKey).(*Claims)
+	return claims
+}
+
+// APIKeyFromContext returns the API key a request was made with, or nil for
+// session (JWT) requests.
+func APIKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(APIKeyKey).(*APIKey)
+	return key
+}
+
+// RequireScope lets API keys through only if they carry scope. Session
+// requests are not affected.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key := APIKeyFromContext(r.Context()); key != nil && !key.HasScope(scope) {
+				http.Error(w, `{"errors":["api key lacks scope `+scope+`"]}`, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SessionOnly rejects API keys, for routes no scope covers.
+func SessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if APIKeyFromContext(r.Context()) != nil {
+			http.Error(w, `{"errors":["api keys are not allowed on this route"]}`, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// PairAllowed reports whether the caller may act on pairID: always for
+// sessions, and for API keys unless they are restricted to other pairs.
+func PairAllowed(ctx context.Context, pairID string) bool {
+	key := APIKeyFromContext(ctx)
+	return key == nil || key.AllowsPair(pairID)
+}
@@ -1,23 +1,53 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/valli0x/signature-escrow/storage"
 )
 
 const (
 	nonceLength = 16
 	nonceTTL    = 5 * time.Minute
+
+	noncePrefix = "auth/nonces/"
 )
 
+// Nonces issues one-time login nonces, one outstanding per address, and
+// redeems them exactly once.
+type Nonces interface {
+	// Issue returns a fresh nonce for address and its (second-truncated)
+	// issue time, which goes into the sign-in message.
+	Issue(ctx context.Context, address string) (nonce string, issuedAt time.Time, err error)
+	// Consume redeems nonce and returns when it was issued, so the exact
+	// sign-in message handed out with it can be rebuilt at login.
+	Consume(ctx context.Context, address, nonce string) (issuedAt time.Time, ok bool, err error)
+	// Sweep removes expired nonces and returns how many it removed.
+	Sweep(ctx context.Context) (int, error)
+}
+
+func newNonce() (string, time.Time, error) {
+	b := make([]byte, nonceLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	return hex.EncodeToString(b), time.Now().UTC().Truncate(time.Second), nil
+}
+
 type nonceEntry struct {
 	nonce     string
+	issuedAt  time.Time
 	expiresAt time.Time
 }
 
+// NonceStore keeps nonces in process memory. Use StorageNonceStore when
+// several replicas serve the same logins.
 type NonceStore struct {
 	mu     sync.RWMutex
 	nonces map[string]nonceEntry
@@ -30,50 +60,190 @@ func NewNonceStore() *NonceStore {
 }
 
 func (ns *NonceStore) Generate(address string) (string, error) {
-	b := make([]byte, nonceLength)
-	if _, err := rand.Read(b); err != nil {
-		return "", err
+	nonce, _, err := ns.Issue(context.Background(), address)
+	return nonce, err
+}
+
+func (ns *NonceStore) Issue(_ context.Context, address string) (string, time.Time, error) {
+	nonce, now, err := newNonce()
+	if err != nil {
+		return "", time.Time{}, err
 	}
-	nonce := hex.EncodeToString(b)
 
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
 
 	ns.nonces[strings.ToLower(address)] = nonceEntry{
 		nonce:     nonce,
-		expiresAt: time.Now().Add(nonceTTL),
+		issuedAt:  now,
+		expiresAt: now.Add(nonceTTL),
 	}
 
-	return nonce, nil
+	return nonce, now, nil
 }
 
 func (ns *NonceStore) Verify(address, nonce string) bool {
+	_, ok, _ := ns.Consume(context.Background(), address, nonce)
+	return ok
+}
+
+func (ns *NonceStore) Consume(_ context.Context, address, nonce string) (time.Time, bool, error) {
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
 
 	key := strings.ToLower(address)
 	entry, ok := ns.nonces[key]
 	if !ok {
-		return false
+		return time.Time{}, false, nil
 	}
 
 	delete(ns.nonces, key)
 
 	if time.Now().After(entry.expiresAt) {
-		return false
+		return time.Time{}, false, nil
 	}
 
-	return entry.nonce == nonce
+	if entry.nonce != nonce {
+		return time.Time{}, false, nil
+	}
+	return entry.issuedAt, true, nil
 }
 
 func (ns *NonceStore) Cleanup() {
+	_, _ = ns.Sweep(context.Background())
+}
+
+func (ns *NonceStore) Sweep(_ context.Context) (int, error) {
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
 
 	now := time.Now()
+	removed := 0
 	for addr, entry := range ns.nonces {
 		if now.After(entry.expiresAt) {
 			delete(ns.nonces, addr)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// StorageNonceStore keeps nonces in a storage.Storage shared by all
+// replicas. Redemption is serialized with storage.Lock, so a nonce is
+// consumed at most once across the cluster. Expired entries are removed by
+// Sweep.
+type StorageNonceStore struct {
+	stor storage.Storage
+}
+
+type storedNonce struct {
+	Nonce     string
+	IssuedAt  int64
+	ExpiresAt int64
+}
+
+func NewStorageNonceStore(stor storage.Storage) *StorageNonceStore {
+	return &StorageNonceStore{stor: stor}
+}
+
+func (ns *StorageNonceStore) Issue(ctx context.Context, address string) (string, time.Time, error) {
+	nonce, now, err := newNonce()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	data, err := cbor.Marshal(&storedNonce{
+		Nonce:     nonce,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(nonceTTL).Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	key := noncePrefix + strings.ToLower(address)
+	unlock, err := storage.Lock(ctx, ns.stor, key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer unlock()
+
+	if err := ns.stor.Put(ctx, key, data); err != nil {
+		return "", time.Time{}, err
+	}
+	return nonce, now, nil
+}
+
+func (ns *StorageNonceStore) Consume(ctx context.Context, address, nonce string) (time.Time, bool, error) {
+	key := noncePrefix + strings.ToLower(address)
+	unlock, err := storage.Lock(ctx, ns.stor, key)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer unlock()
+
+	entry, err := ns.load(ctx, key)
+	if err != nil || entry == nil {
+		return time.Time{}, false, err
+	}
+	// A wrong nonce leaves the pending one alone, so whoever knows an
+	// address cannot keep burning its logins.
+	expired := time.Now().Unix() > entry.ExpiresAt
+	if !expired && entry.Nonce != nonce {
+		return time.Time{}, false, nil
+	}
+	if err := ns.stor.Delete(ctx, key); err != nil {
+		return time.Time{}, false, err
+	}
+	if expired {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(entry.IssuedAt, 0).UTC(), true, nil
+}
+
+func (ns *StorageNonceStore) load(ctx context.Context, key string) (*storedNonce, error) {
+	data, err := ns.stor.Get(ctx, key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	entry := &storedNonce{}
+	if err := cbor.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (ns *StorageNonceStore) Sweep(ctx context.Context) (int, error) {
+	keys, err := ns.stor.List(ctx, noncePrefix)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	removed := 0
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") {
+			continue
 		}
+		ok, err := ns.sweepKey(ctx, noncePrefix+k, now)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (ns *StorageNonceStore) sweepKey(ctx context.Context, key string, now int64) (bool, error) {
+	unlock, err := storage.Lock(ctx, ns.stor, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	entry, err := ns.load(ctx, key)
+	if err != nil || entry == nil || now <= entry.ExpiresAt {
+		return false, err
 	}
+	return true, ns.stor.Delete(ctx, key)
 }
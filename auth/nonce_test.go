@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+func TestStorageNonceWrongGuess(t *testing.T) {
+	ctx := context.Background()
+	ns := NewStorageNonceStore(storage.NewMemoryStorage())
+	nonce, _, err := ns.Issue(ctx, "0xAbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A wrong guess does not burn the pending nonce.
+	if _, ok, err := ns.Consume(ctx, "0xabc", "wrong"); ok || err != nil {
+		t.Fatalf("wrong nonce: %v %v", ok, err)
+	}
+	if _, ok, err := ns.Consume(ctx, "0xabc", nonce); !ok || err != nil {
+		t.Fatalf("nonce after a wrong guess: %v %v", ok, err)
+	}
+	if _, ok, _ := ns.Consume(ctx, "0xabc", nonce); ok {
+		t.Fatal("nonce consumed twice")
+	}
+}
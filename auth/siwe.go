@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// EIP-4361 (Sign-In with Ethereum) message construction, parsing and
+// validation. See https://eips.ethereum.org/EIPS/eip-4361. Bitcoin identities
+// sign the same message with a "Bitcoin account" header, as in CAIP-122.
+
+const (
+	siweHeaderSuffix    = " wants you to sign in with your Ethereum account:"
+	siweBTCHeaderSuffix = " wants you to sign in with your Bitcoin account:"
+	siweVersion         = "1"
+	siweClockSkew       = time.Minute
+)
+
+var (
+	ErrMalformedMessage = errors.New("malformed sign-in message")
+	ErrDomainMismatch   = errors.New("sign-in message domain mismatch")
+	ErrChainMismatch    = errors.New("sign-in message chain id mismatch")
+	ErrNonceMismatch    = errors.New("sign-in message nonce mismatch")
+	ErrAddressMismatch  = errors.New("sign-in message address mismatch")
+	ErrMessageExpired   = errors.New("sign-in message expired")
+	ErrMessageNotYet    = errors.New("sign-in message not yet valid")
+)
+
+type SIWEMessage struct {
+	Domain         string
+	Address        string
+	Statement      string
+	URI            string
+	Version        string
+	ChainID        int64
+	Nonce          string
+	IssuedAt       time.Time
+	ExpirationTime *time.Time
+	NotBefore      *time.Time
+	RequestID      string
+	Resources      []string
+}
+
+// String renders the message in the exact EIP-4361 text form that wallets
+// display and sign.
+func (m *SIWEMessage) String() string {
+	var b strings.Builder
+	if common.IsHexAddress(m.Address) {
+		b.WriteString(m.Domain + siweHeaderSuffix + "\n")
+	} else {
+		b.WriteString(m.Domain + siweBTCHeaderSuffix + "\n")
+	}
+	b.WriteString(m.Address + "\n\n")
+	if m.Statement != "" {
+		b.WriteString(m.Statement + "\n")
+	}
+	b.WriteString("\n")
+	b.WriteString("URI: " + m.URI + "\n")
+	b.WriteString("Version: " + m.Version + "\n")
+	b.WriteString("Chain ID: " + strconv.FormatInt(m.ChainID, 10) + "\n")
+	b.WriteString("Nonce: " + m.Nonce + "\n")
+	b.WriteString("Issued At: " + m.IssuedAt.UTC().Format(time.RFC3339))
+	if m.ExpirationTime != nil {
+		b.WriteString("\nExpiration Time: " + m.ExpirationTime.UTC().Format(time.RFC3339))
+	}
+	if m.NotBefore != nil {
+		b.WriteString("\nNot Before: " + m.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if m.RequestID != "" {
+		b.WriteString("\nRequest ID: " + m.RequestID)
+	}
+	if len(m.Resources) > 0 {
+		b.WriteString("\nResources:")
+		for _, r := range m.Resources {
+			b.WriteString("\n- " + r)
+		}
+	}
+	return b.String()
+}
+
+// ParseSIWEMessage parses the EIP-4361 text form. It is strict about line
+// order so that the parsed message always renders back to the signed text.
+func ParseSIWEMessage(s string) (*SIWEMessage, error) {
+	lines := strings.Split(s, "\n")
+	if len(lines) < 8 {
+		return nil, ErrMalformedMessage
+	}
+
+	m := &SIWEMessage{}
+
+	domain, eth := strings.CutSuffix(lines[0], siweHeaderSuffix)
+	if !eth {
+		var ok bool
+		if domain, ok = strings.CutSuffix(lines[0], siweBTCHeaderSuffix); !ok {
+			domain = ""
+		}
+	}
+	if domain == "" {
+		return nil, fmt.Errorf("%w: bad header", ErrMalformedMessage)
+	}
+	m.Domain = domain
+
+	m.Address = lines[1]
+	if eth && !common.IsHexAddress(m.Address) {
+		return nil, fmt.Errorf("%w: bad address", ErrMalformedMessage)
+	}
+	if !eth {
+		if _, err := decodeBTCAddress(m.Address); err != nil {
+			return nil, fmt.Errorf("%w: bad address", ErrMalformedMessage)
+		}
+	}
+	if lines[2] != "" {
+		return nil, fmt.Errorf("%w: missing blank line after address", ErrMalformedMessage)
+	}
+
+	i := 3
+	if lines[i] != "" {
+		m.Statement = lines[i]
+		i++
+	}
+	if i >= len(lines) || lines[i] != "" {
+		return nil, fmt.Errorf("%w: missing blank line after statement", ErrMalformedMessage)
+	}
+	i++
+
+	field := func(name string, required bool) (string, error) {
+		if i < len(lines) {
+			if v, ok := strings.CutPrefix(lines[i], name+": "); ok {
+				i++
+				return v, nil
+			}
+		}
+		if required {
+			return "", fmt.Errorf("%w: missing %s", ErrMalformedMessage, name)
+		}
+		return "", nil
+	}
+	timeField := func(name string, required bool) (*time.Time, error) {
+		v, err := field(name, required)
+		if err != nil || v == "" {
+			return nil, err
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad %s", ErrMalformedMessage, name)
+		}
+		return &t, nil
+	}
+
+	var err error
+	if m.URI, err = field("URI", true); err != nil {
+		return nil, err
+	}
+	if m.Version, err = field("Version", true); err != nil {
+		return nil, err
+	}
+	if m.Version != siweVersion {
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrMalformedMessage, m.Version)
+	}
+	chainID, err := field("Chain ID", true)
+	if err != nil {
+		return nil, err
+	}
+	if m.ChainID, err = strconv.ParseInt(chainID, 10, 64); err != nil {
+		return nil, fmt.Errorf("%w: bad Chain ID", ErrMalformedMessage)
+	}
+	if m.Nonce, err = field("Nonce", true); err != nil {
+		return nil, err
+	}
+	if len(m.Nonce) < 8 {
+		return nil, fmt.Errorf("%w: nonce too short", ErrMalformedMessage)
+	}
+	issuedAt, err := timeField("Issued At", true)
+	if err != nil {
+		return nil, err
+	}
+	m.IssuedAt = *issuedAt
+	if m.ExpirationTime, err = timeField("Expiration Time", false); err != nil {
+		return nil, err
+	}
+	if m.NotBefore, err = timeField("Not Before", false); err != nil {
+		return nil, err
+	}
+	if m.RequestID, err = field("Request ID", false); err != nil {
+		return nil, err
+	}
+	if i < len(lines) && lines[i] == "Resources:" {
+		i++
+		for ; i < len(lines); i++ {
+			r, ok := strings.CutPrefix(lines[i], "- ")
+			if !ok {
+				break
+			}
+			m.Resources = append(m.Resources, r)
+		}
+	}
+	if i != len(lines) {
+		return nil, fmt.Errorf("%w: unexpected line %q", ErrMalformedMessage, lines[i])
+	}
+
+	return m, nil
+}
+
+// Validate checks the message against the expected domain, chain ID and nonce
+// and its time bounds at now.
+func (m *SIWEMessage) Validate(domain string, chainID int64, nonce string, now time.Time) error {
+	if !strings.EqualFold(m.Domain, domain) {
+		return ErrDomainMismatch
+	}
+	if m.ChainID != chainID {
+		return ErrChainMismatch
+	}
+	if m.Nonce != nonce {
+		return ErrNonceMismatch
+	}
+	if m.IssuedAt.After(now.Add(siweClockSkew)) {
+		return ErrMessageNotYet
+	}
+	if m.NotBefore != nil && now.Add(siweClockSkew).Before(*m.NotBefore) {
+		return ErrMessageNotYet
+	}
+	if m.ExpirationTime != nil && now.After(*m.ExpirationTime) {
+		return ErrMessageExpired
+	}
+	return nil
+}
+
+// SIWEConfig describes what a service puts into, and expects back from, its
+// sign-in messages.
+type SIWEConfig struct {
+	// Domain is the RFC 3986 authority the message is bound to. It comes
+	// from configuration, never from the request: the Host header is the
+	// caller's to choose, so it would bind the message to nothing.
+	Domain string
+	// URI is the resource the session is for. Defaults to https://<domain>.
+	URI string
+	// ChainID is the EIP-155 chain the signer is expected on (default 1).
+	ChainID int64
+	// Statement is the human-readable line wallets show above the fields.
+	Statement string
+	// Legacy issues and accepts the pre-EIP-4361 "Sign in to MPC Oven"
+	// message instead. Kept for older app builds; not replay-safe across
+	// deployments.
+	Legacy bool
+	// TTL bounds the message lifetime; zero means the nonce TTL.
+	TTL time.Duration
+}
+
+// ListenDomain is the domain of a service listening on addr, for a
+// SIWEConfig that names none: its host, localhost for every interface, and
+// port.
+func ListenDomain(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (c *SIWEConfig) chainID() int64 {
+	if c.ChainID != 0 {
+		return c.ChainID
+	}
+	return 1
+}
+
+// NewMessage builds the message a client has to sign for nonce.
+func (c *SIWEConfig) NewMessage(address, nonce string, issuedAt time.Time) *SIWEMessage {
+	uri := c.URI
+	if uri == "" {
+		uri = "https://" + c.Domain
+	}
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = nonceTTL
+	}
+	issuedAt = issuedAt.UTC().Truncate(time.Second)
+	exp := issuedAt.Add(ttl)
+	if id, err := ParseIdentity(address); err == nil {
+		if IdentityNamespace(id) == NamespaceBTC {
+			address = IdentityAddress(id)
+		} else {
+			address = common.HexToAddress(id).Hex()
+		}
+	}
+	return &SIWEMessage{
+		Domain:         c.Domain,
+		Address:        address,
+		Statement:      c.Statement,
+		URI:            uri,
+		Version:        siweVersion,
+		ChainID:        c.chainID(),
+		Nonce:          nonce,
+		IssuedAt:       issuedAt,
+		ExpirationTime: &exp,
+	}
+}
+
+// Message returns the text to hand out from a nonce endpoint.
+func (c *SIWEConfig) Message(address, nonce string, issuedAt time.Time) string {
+	if c.Legacy {
+		return GenerateNonce(address, nonce)
+	}
+	return c.NewMessage(address, nonce, issuedAt).String()
+}
+
+// ResolveMessage returns the exact text whose signature proves the login.
+// message is what the wallet signed; when empty, the message issued for
+// nonce at issuedAt is reconstructed. SIWE messages are validated against the
+// expected domain, chain ID, nonce, address and time bounds.
+func (c *SIWEConfig) ResolveMessage(address, nonce, message string, issuedAt, now time.Time) (string, error) {
+	if message == "" {
+		if c.Legacy {
+			return GenerateNonce(address, nonce), nil
+		}
+		return c.NewMessage(address, nonce, issuedAt).String(), nil
+	}
+
+	if c.Legacy && message == GenerateNonce(address, nonce) {
+		return message, nil
+	}
+
+	m, err := ParseSIWEMessage(message)
+	if err != nil {
+		return "", err
+	}
+	signer, err := ParseIdentity(m.Address)
+	if err != nil {
+		return "", ErrAddressMismatch
+	}
+	if expected, err := ParseIdentity(address); err != nil || signer != expected {
+		return "", ErrAddressMismatch
+	}
+	if err := m.Validate(c.Domain, c.chainID(), nonce, now); err != nil {
+		return "", err
+	}
+	return message, nil
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSIWERoundTrip(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	nb := now.Add(-time.Minute)
+	cfg := SIWEConfig{Domain: "escrow.example", Statement: "Sign in to MPC Oven", ChainID: 10}
+	m := cfg.NewMessage("0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0123456789abcdef", now)
+	m.NotBefore = &nb
+	m.RequestID = "req-1"
+	m.Resources = []string{"https://escrow.example/v1", "ipfs://bafy"}
+
+	text := m.String()
+	parsed, err := ParseSIWEMessage(text)
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, text)
+	}
+	if parsed.String() != text {
+		t.Fatalf("round trip mismatch:\n%s\n---\n%s", parsed.String(), text)
+	}
+	if parsed.Address != "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed" {
+		t.Fatalf("address not checksummed: %s", parsed.Address)
+	}
+	if parsed.ChainID != 10 || parsed.URI != "https://escrow.example" {
+		t.Fatalf("unexpected fields: %+v", parsed)
+	}
+
+	noStatement := cfg.NewMessage(parsed.Address, "0123456789abcdef", now)
+	noStatement.Statement = ""
+	if _, err := ParseSIWEMessage(noStatement.String()); err != nil {
+		t.Fatalf("parse without statement: %v", err)
+	}
+
+	btc := cfg.NewMessage("btc:bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l", "0123456789abcdef", now)
+	text = btc.String()
+	if !strings.HasPrefix(text, "escrow.example wants you to sign in with your Bitcoin account:\nbc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l\n") {
+		t.Fatalf("bitcoin header: %q", text)
+	}
+	if parsed, err = ParseSIWEMessage(text); err != nil || parsed.String() != text {
+		t.Fatalf("bitcoin round trip: %v", err)
+	}
+	swapped := strings.Replace(text, "Bitcoin account", "Ethereum account", 1)
+	if _, err := ParseSIWEMessage(swapped); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("bitcoin address under ethereum header: %v", err)
+	}
+}
+
+func TestSIWEValidate(t *testing.T) {
+	now := time.Now().UTC()
+	cfg := SIWEConfig{Domain: "escrow.example"}
+	m := cfg.NewMessage("0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0123456789abcdef", now)
+
+	if err := m.Validate("escrow.example", 1, "0123456789abcdef", now); err != nil {
+		t.Fatalf("valid message rejected: %v", err)
+	}
+	cases := []struct {
+		domain string
+		chain  int64
+		nonce  string
+		at     time.Time
+		want   error
+	}{
+		{"other.example", 1, "0123456789abcdef", now, ErrDomainMismatch},
+		{"escrow.example", 5, "0123456789abcdef", now, ErrChainMismatch},
+		{"escrow.example", 1, "fedcba9876543210", now, ErrNonceMismatch},
+		{"escrow.example", 1, "0123456789abcdef", now.Add(time.Hour), ErrMessageExpired},
+		{"escrow.example", 1, "0123456789abcdef", now.Add(-time.Hour), ErrMessageNotYet},
+	}
+	for _, c := range cases {
+		if err := m.Validate(c.domain, c.chain, c.nonce, c.at); !errors.Is(err, c.want) {
+			t.Errorf("Validate(%s, %d, %s, %v) = %v, want %v", c.domain, c.chain, c.nonce, c.at, err, c.want)
+		}
+	}
+}
+
+func TestSIWELegacyMessage(t *testing.T) {
+	cfg := SIWEConfig{Legacy: true}
+	addr := "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed"
+	if got := cfg.Message(addr, "0123456789abcdef", time.Now()); got != GenerateNonce(addr, "0123456789abcdef") {
+		t.Fatalf("legacy switch should issue the legacy message, got %q", got)
+	}
+	msg, err := cfg.ResolveMessage(addr, "0123456789abcdef", "", time.Now(), time.Now())
+	if err != nil || msg != GenerateNonce(addr, "0123456789abcdef") {
+		t.Fatalf("legacy resolve: %q, %v", msg, err)
+	}
+}
+
+func TestSIWEParseRejectsGarbage(t *testing.T) {
+	for _, s := range []string{
+		"",
+		GenerateNonce("0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0123456789abcdef"),
+		"example.com wants you to sign in with your Ethereum account:\nnot-an-address\n\n\nURI: x\nVersion: 1\nChain ID: 1\nNonce: 0123456789\nIssued At: 2026-01-01T00:00:00Z",
+	} {
+		if _, err := ParseSIWEMessage(s); !errors.Is(err, ErrMalformedMessage) {
+			t.Errorf("expected ErrMalformedMessage for %q, got %v", s, err)
+		}
+	}
+}
+
+func TestListenDomain(t *testing.T) {
+	for addr, want := range map[string]string{
+		":8080":          "localhost:8080",
+		"0.0.0.0:8282":   "localhost:8282",
+		"10.0.0.2:8282":  "10.0.0.2:8282",
+		"escrow.example": "escrow.example",
+	} {
+		if got := ListenDomain(addr); got != want {
+			t.Errorf("ListenDomain(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
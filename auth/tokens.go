@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+
+	refreshPrefix    = "auth/refresh/"
+	familyPrefix     = "auth/refresh-family/"
+	denyPrefix       = "auth/deny/"
+	generationPrefix = "auth/generation/"
+)
+
+var ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+// TokenStore keeps the server-side half of a session: rotating refresh
+// tokens, the access-token denylist and per-address session generations.
+// Refresh tokens are stored only as SHA-256 digests.
+type TokenStore struct {
+	stor storage.Storage
+}
+
+type refreshRecord struct {
+	Address    string
+	Family     string
+	Generation int64
+	ExpiresAt  int64
+	Used       bool
+}
+
+func NewTokenStore(stor storage.Storage) *TokenStore {
+	return &TokenStore{stor: stor}
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func refreshKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return refreshPrefix + hex.EncodeToString(h[:])
+}
+
+func normalizeSubject(address string) string {
+	return strings.ToLower(address)
+}
+
+// Generation returns the current session generation of address.
+func (ts *TokenStore) Generation(ctx context.Context, address string) (int64, error) {
+	data, err := ts.stor.Get(ctx, generationPrefix+normalizeSubject(address))
+	if err != nil || data == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// IssueRefresh starts a new refresh-token family for address.
+func (ts *TokenStore) IssueRefresh(ctx context.Context, address string, generation int64) (string, error) {
+	return ts.issueRefresh(ctx, address, randomToken(8), generation)
+}
+
+func (ts *TokenStore) issueRefresh(ctx context.Context, address, family string, generation int64) (string, error) {
+	token := randomToken(32)
+	rec := &refreshRecord{
+		Address:    normalizeSubject(address),
+		Family:     family,
+		Generation: generation,
+		ExpiresAt:  time.Now().Add(RefreshTokenTTL).Unix(),
+	}
+	data, err := cbor.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	if err := ts.stor.Put(ctx, refreshKey(token), data); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (ts *TokenStore) loadRefresh(ctx context.Context, token string) (*refreshRecord, error) {
+	data, err := ts.stor.Get(ctx, refreshKey(token))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	rec := &refreshRecord{}
+	if err := cbor.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Rotate exchanges a refresh token for a new one in the same family and
+// returns the address and session generation it belongs to. Presenting an
+// already-rotated token is treated as theft: the whole family is revoked.
+func (ts *TokenStore) Rotate(ctx context.Context, token string) (address string, generation int64, next string, err error) {
+	// Two refreshes with one token must not both see it unused.
+	unlock, err := storage.Lock(ctx, ts.stor, refreshKey(token))
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer unlock()
+
+	rec, err := ts.loadRefresh(ctx, token)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if rec == nil || time.Now().Unix() > rec.ExpiresAt {
+		return "", 0, "", ErrInvalidRefreshToken
+	}
+	if revoked, err := ts.stor.Get(ctx, familyPrefix+rec.Family); err != nil {
+		return "", 0, "", err
+	} else if revoked != nil {
+		return "", 0, "", ErrInvalidRefreshToken
+	}
+	if rec.Used {
+		_ = ts.stor.Put(ctx, familyPrefix+rec.Family, []byte(strconv.FormatInt(rec.ExpiresAt, 10)))
+		return "", 0, "", ErrInvalidRefreshToken
+	}
+	current, err := ts.Generation(ctx, rec.Address)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if rec.Generation < current {
+		return "", 0, "", ErrInvalidRefreshToken
+	}
+
+	rec.Used = true
+	data, err := cbor.Marshal(rec)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if err := ts.stor.Put(ctx, refreshKey(token), data); err != nil {
+		return "", 0, "", err
+	}
+
+	next, err = ts.issueRefresh(ctx, rec.Address, rec.Family, rec.Generation)
+	if err != nil {
+		return "", 0, "", err
+	}
+	return rec.Address, rec.Generation, next, nil
+}
+
+// RevokeRefresh deletes a refresh token. Only its owner may revoke it.
+func (ts *TokenStore) RevokeRefresh(ctx context.Context, address, token string) error {
+	rec, err := ts.loadRefresh(ctx, token)
+	if err != nil || rec == nil {
+		return err
+	}
+	if rec.Address != normalizeSubject(address) {
+		return ErrInvalidRefreshToken
+	}
+	return ts.stor.Delete(ctx, refreshKey(token))
+}
+
+// Deny puts one access token on the denylist until it expires.
+func (ts *TokenStore) Deny(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" {
+		return nil
+	}
+	var exp int64
+	if claims.ExpiresAt != nil {
+		exp = claims.ExpiresAt.Unix()
+	}
+	return ts.stor.Put(ctx, denyPrefix+claims.ID, []byte(strconv.FormatInt(exp, 10)))
+}
+
+// Sweep removes the refresh tokens that can no longer be used: expired, of
+// a revoked family or of an older session generation. A used token stays
+// until then, as presenting it again revokes its family. Revoked families
+// and denied access tokens go once they expire.
+func (ts *TokenStore) Sweep(ctx context.Context) (int, error) {
+	now := time.Now().Unix()
+	removed := 0
+	keys, err := ts.stor.List(ctx, refreshPrefix)
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+		ok, err := ts.sweepRefresh(ctx, refreshPrefix+k, now)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	for _, prefix := range []string{familyPrefix, denyPrefix} {
+		keys, err := ts.stor.List(ctx, prefix)
+		if err != nil {
+			return removed, err
+		}
+		for _, k := range keys {
+			if strings.HasSuffix(k, "/") {
+				continue
+			}
+			data, err := ts.stor.Get(ctx, prefix+k)
+			if err != nil {
+				return removed, err
+			}
+			// An access token without an expiry stays denied.
+			exp, err := strconv.ParseInt(string(data), 10, 64)
+			if data == nil || err != nil || exp == 0 || now <= exp {
+				continue
+			}
+			if err := ts.stor.Delete(ctx, prefix+k); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (ts *TokenStore) sweepRefresh(ctx context.Context, key string, now int64) (bool, error) {
+	unlock, err := storage.Lock(ctx, ts.stor, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	data, err := ts.stor.Get(ctx, key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	rec := &refreshRecord{}
+	if err := cbor.Unmarshal(data, rec); err != nil {
+		return false, err
+	}
+	if now <= rec.ExpiresAt {
+		revoked, err := ts.stor.Get(ctx, familyPrefix+rec.Family)
+		if err != nil {
+			return false, err
+		}
+		current, err := ts.Generation(ctx, rec.Address)
+		if err != nil {
+			return false, err
+		}
+		if revoked == nil && rec.Generation >= current {
+			return false, nil
+		}
+	}
+	return true, ts.stor.Delete(ctx, key)
+}
+
+// RevokeAll invalidates every access and refresh token issued to address so
+// far and returns the new session generation.
+func (ts *TokenStore) RevokeAll(ctx context.Context, address string) (int64, error) {
+	gen, err := ts.Generation(ctx, address)
+	if err != nil {
+		return 0, err
+	}
+	gen++
+	if err := ts.stor.Put(ctx, generationPrefix+normalizeSubject(address), []byte(strconv.FormatInt(gen, 10))); err != nil {
+		return 0, err
+	}
+	return gen, nil
+}
+
+// IsRevoked implements Revocation.
+func (ts *TokenStore) IsRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	if claims.ID != "" {
+		data, err := ts.stor.Get(ctx, denyPrefix+claims.ID)
+		if err != nil {
+			return false, err
+		}
+		if data != nil {
+			return true, nil
+		}
+	}
+	gen, err := ts.Generation(ctx, claims.Address)
+	if err != nil {
+		return false, err
+	}
+	return claims.Generation < gen, nil
+}
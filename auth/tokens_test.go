@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+func TestRotateOnce(t *testing.T) {
+	ctx := context.Background()
+	ts := NewTokenStore(storage.NewMemoryStorage())
+	token, err := ts.IssueRefresh(ctx, "0xabc", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var rotated int
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, err := ts.Rotate(ctx, token); err == nil {
+				mu.Lock()
+				rotated++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if rotated != 1 {
+		t.Fatalf("one refresh token rotated %d times", rotated)
+	}
+}
+
+func TestTokenSweep(t *testing.T) {
+	ctx := context.Background()
+	stor := storage.NewMemoryStorage()
+	ts := NewTokenStore(stor)
+
+	live, _ := ts.IssueRefresh(ctx, "0xabc", 0)
+	expired, _ := ts.IssueRefresh(ctx, "0xabc", 0)
+	rec, _ := ts.loadRefresh(ctx, expired)
+	rec.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	data, _ := cbor.Marshal(rec)
+	_ = stor.Put(ctx, refreshKey(expired), data)
+
+	// Reusing a rotated token revokes its family, which the sweep clears.
+	stolen, _ := ts.IssueRefresh(ctx, "0xdef", 0)
+	_, _, next, err := ts.Rotate(ctx, stolen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ts.Rotate(ctx, stolen); err == nil {
+		t.Fatal("a used refresh token rotated again")
+	}
+
+	exp := time.Now().Add(-time.Minute)
+	_ = ts.Deny(ctx, &Claims{RegisteredClaims: jwtClaims("old", exp)})
+	_ = ts.Deny(ctx, &Claims{RegisteredClaims: jwtClaims("current", time.Now().Add(time.Minute))})
+
+	n, err := ts.Sweep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The expired token, both tokens of the revoked family and the expired
+	// denylist entry.
+	if n != 4 {
+		t.Fatalf("swept %d, want 4", n)
+	}
+	for token, want := range map[string]bool{live: true, expired: false, stolen: false, next: false} {
+		if rec, _ := ts.loadRefresh(ctx, token); (rec != nil) != want {
+			t.Errorf("refresh token kept = %v, want %v", rec != nil, want)
+		}
+	}
+	if revoked, _ := ts.IsRevoked(ctx, &Claims{RegisteredClaims: jwtClaims("current", time.Now())}); !revoked {
+		t.Error("a live denylist entry was swept")
+	}
+}
+
+func jwtClaims(id string, exp time.Time) jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{ID: id, ExpiresAt: jwt.NewNumericDate(exp)}
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/valli0x/signature-escrow/validation"
+)
+
+// EIP-1271: isValidSignature(bytes32,bytes) returns this selector for a valid
+// signature. See https://eips.ethereum.org/EIPS/eip-1271.
+var eip1271MagicValue = []byte{0x16, 0x26, 0xba, 0x7e}
+
+const eip1271ABI = `[{"name":"isValidSignature","type":"function","stateMutability":"view",
+"inputs":[{"name":"hash","type":"bytes32"},{"name":"signature","type":"bytes"}],
+"outputs":[{"name":"magicValue","type":"bytes4"}]}]`
+
+var eip1271 = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(eip1271ABI))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+// ContractCaller is the part of an Ethereum node needed to check contract
+// wallet signatures. *ethclient.Client and the simulated backend implement it.
+type ContractCaller interface {
+	CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error)
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+}
+
+// SharedAccounts resolves MPC shared accounts registered with a service.
+type SharedAccounts interface {
+	// SharedPublicKey returns the compressed secp256k1 key of the shared
+	// account at address, or nil when none is registered.
+	SharedPublicKey(ctx context.Context, address common.Address) ([]byte, error)
+}
+
+// VerifyEIP1271 asks the contract at wallet whether sig is a valid signature
+// of hash. An address without code is not a contract wallet.
+func VerifyEIP1271(ctx context.Context, caller ContractCaller, wallet common.Address, hash, sig []byte) (bool, error) {
+	code, err := caller.CodeAt(ctx, wallet, nil)
+	if err != nil {
+		return false, fmt.Errorf("get code: %w", err)
+	}
+	if len(code) == 0 {
+		return false, nil
+	}
+
+	var digest [32]byte
+	copy(digest[:], hash)
+	input, err := eip1271.Pack("isValidSignature", digest, sig)
+	if err != nil {
+		return false, err
+	}
+	out, err := caller.CallContract(ctx, ethereum.CallMsg{To: &wallet, Data: input}, nil)
+	if err != nil {
+		return false, fmt.Errorf("isValidSignature: %w", err)
+	}
+	return len(out) >= 4 && bytes.Equal(out[:4], eip1271MagicValue), nil
+}
+
+// Verifier checks login signatures. EOA signatures are always accepted;
+// contract wallets (EIP-1271) need Contracts, and MPC shared accounts need
+// Shared. A nil field disables that kind of signer.
+type Verifier struct {
+	Contracts ContractCaller
+	Shared    SharedAccounts
+}
+
+// Verify checks that signature over message was produced by address and
+// returns the canonical identity (see ParseIdentity) it proves. Ethereum
+// signatures are hex and made over the EIP-191 text hash; Bitcoin signatures
+// are base64 BIP-322 or legacy signmessage signatures.
+func (v *Verifier) Verify(ctx context.Context, address, message, signature string) (string, error) {
+	id, err := ParseIdentity(address)
+	if err != nil {
+		return "", ErrInvalidAddress
+	}
+	if IdentityNamespace(id) == NamespaceBTC {
+		if err := VerifyBitcoin(id, message, signature); err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		return "", fmt.Errorf("decode signature: %w", err)
+	}
+	expected := common.HexToAddress(id)
+
+	if len(sig) == 65 {
+		if _, err := VerifySignature(id, message, signature); err == nil {
+			return id, nil
+		}
+	}
+
+	hash := accounts.TextHash([]byte(message))
+
+	if v.Shared != nil {
+		pub, err := v.Shared.SharedPublicKey(ctx, expected)
+		if err != nil {
+			return "", fmt.Errorf("shared account lookup: %w", err)
+		}
+		if pub != nil {
+			if ok, _ := validation.Validate(validation.ECDSA, pub, hash, sig); ok {
+				return id, nil
+			}
+		}
+	}
+
+	if v.Contracts != nil {
+		ok, err := VerifyEIP1271(ctx, v.Contracts, expected, hash, sig)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return id, nil
+		}
+	}
+
+	return "", ErrInvalidSignature
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// approvedHashWallet returns runtime code for a minimal contract wallet whose
+// isValidSignature(bytes32,bytes) returns the EIP-1271 magic value for one
+// pre-approved hash (like a Safe "approved hash") and reverts otherwise.
+func approvedHashWallet(hash []byte) []byte {
+	code := []byte{0x60, 0x04, 0x35, 0x7f} // CALLDATALOAD(4); PUSH32
+	code = append(code, hash...)
+	code = append(code,
+		0x14,             // EQ
+		0x60, 0x2d, 0x57, // JUMPI ok
+		0x60, 0x00, 0x60, 0x00, 0xfd, // REVERT(0, 0)
+		0x5b, // ok: JUMPDEST
+		0x7f, // PUSH32 magic, left-aligned
+	)
+	code = append(code, eip1271MagicValue...)
+	code = append(code, make([]byte, 28)...)
+	code = append(code,
+		0x60, 0x00, 0x52, // MSTORE(0, magic)
+		0x60, 0x20, 0x60, 0x00, 0xf3, // RETURN(0, 32)
+	)
+	return code
+}
+
+func TestVerifyEIP1271(t *testing.T) {
+	ctx := context.Background()
+	message := "Sign in to MPC Oven"
+	hash := accounts.TextHash([]byte(message))
+
+	wallet := common.HexToAddress("0x000000000000000000000000000000000000c0de")
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		wallet: {Code: approvedHashWallet(hash), Balance: big.NewInt(0)},
+	}, 10_000_000)
+	defer sim.Close()
+
+	v := &Verifier{Contracts: sim}
+	sig := "0x" + common.Bytes2Hex(make([]byte, 96)) // Safe-style multi-owner blob
+	got, err := v.Verify(ctx, wallet.Hex(), message, sig)
+	if err != nil || got != strings.ToLower(wallet.Hex()) {
+		t.Fatalf("contract wallet login: %v %s", err, got)
+	}
+
+	if _, err := v.Verify(ctx, wallet.Hex(), "another message", sig); err == nil {
+		t.Fatal("unapproved hash accepted")
+	}
+
+	// An address without code is not a contract wallet.
+	eoa := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	if _, err := v.Verify(ctx, eoa.Hex(), message, sig); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected ErrInvalidSignature for EOA, got %v", err)
+	}
+
+	// Without a contract caller only EOA signatures work.
+	if _, err := (&Verifier{}).Verify(ctx, wallet.Hex(), message, sig); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected ErrInvalidSignature without caller, got %v", err)
+	}
+}
+
+type sharedAccounts map[common.Address][]byte
+
+func (s sharedAccounts) SharedPublicKey(_ context.Context, address common.Address) ([]byte, error) {
+	return s[address], nil
+}
+
+func TestVerifySharedAccount(t *testing.T) {
+	ctx := context.Background()
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	message := "Sign in to MPC Oven"
+
+	// The CMP-native encoding: [33B compressed R][32B S].
+	eth, err := crypto.Sign(accounts.TextHash([]byte(message)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native := append([]byte{0x02 + eth[64]}, eth[:64]...)
+	sig := hexutil.Encode(native)
+
+	if _, err := (&Verifier{}).Verify(ctx, address.Hex(), message, sig); err == nil {
+		t.Fatal("unregistered shared account accepted")
+	}
+
+	v := &Verifier{Shared: sharedAccounts{address: crypto.CompressPubkey(&key.PublicKey)}}
+	got, err := v.Verify(ctx, address.Hex(), message, sig)
+	if err != nil || got != strings.ToLower(address.Hex()) {
+		t.Fatalf("shared account login: %v %s", err, got)
+	}
+	if _, err := v.Verify(ctx, address.Hex(), "another message", sig); err == nil {
+		t.Fatal("signature over another message accepted")
+	}
+
+	// The Ethereum encoding of the same key keeps working as a plain EOA.
+	if _, err := v.Verify(ctx, address.Hex(), message, hexutil.Encode(eth)); err != nil {
+		t.Fatalf("eoa login: %v", err)
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
 )
 
 type AccountMeta struct {
@@ -18,6 +21,79 @@ type AccountMeta struct {
 	PairMyID  string `json:"pair_my_id"`
 	PairOther string `json:"pair_other"`
 	SessionID string `json:"session_id"`
+	// Parties are the IDs of every key holder, this one included, and
+	// Threshold is how many of them sign together. Accounts from before
+	// threshold keys leave both empty: the pair signs alone.
+	Parties   []string `json:"parties,omitempty"`
+	Threshold int      `json:"threshold,omitempty"`
+	// Refreshes lists every refresh of the key shares, oldest first.
+	Refreshes []ShareRefresh `json:"refreshes,omitempty"`
+	// Master is the index of the account this one derives from along Path,
+	// a non-hardened BIP-32 path such as "m/0/5". A derived account keeps
+	// no key share: its parties derive one from the master's when they sign,
+	// and it has the master's key holders.
+	Master int    `json:"master,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// partyIDs returns every key holder of the account.
+func (m *AccountMeta) partyIDs() party.IDSlice {
+	ids := make([]party.ID, 0, len(m.Parties))
+	for _, p := range m.Parties {
+		ids = append(ids, party.ID(p))
+	}
+	if len(ids) == 0 {
+		ids = append(ids, party.ID(m.PairMyID), party.ID(m.PairOther))
+	}
+	return party.NewIDSlice(ids)
+}
+
+// signersNeeded returns how many parties must sign.
+func (m *AccountMeta) signersNeeded() int {
+	if m.Threshold > 0 {
+		return m.Threshold
+	}
+	return 2
+}
+
+// loadAccountMeta returns the metadata of account name ("<net>/<index>"),
+// or nil if it has none.
+func (c *Client) loadAccountMeta(ctx context.Context, name string) (*AccountMeta, error) {
+	data, err := c.stor.Get(ctx, "accounts/"+name+"/meta")
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var meta AccountMeta
+	if err := cbor.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	if meta.Path != "" {
+		master, err := c.loadAccountMeta(ctx, fmt.Sprintf("%s/%d", meta.Network, meta.Master))
+		if err != nil {
+			return nil, err
+		}
+		if master == nil {
+			return nil, fmt.Errorf("master account %s/%d of %s is gone", meta.Network, meta.Master, name)
+		}
+		meta.PairMyID, meta.PairOther = master.PairMyID, master.PairOther
+		meta.Parties, meta.Threshold = master.Parties, master.Threshold
+	}
+	return &meta, nil
+}
+
+// derivedAccounts returns the accounts derived from account master of net.
+func (c *Client) derivedAccounts(ctx context.Context, net string, master int) ([]AccountMeta, error) {
+	metas, err := c.accountMetas(ctx, net)
+	if err != nil {
+		return nil, err
+	}
+	var derived []AccountMeta
+	for _, m := range metas {
+		if m.Path != "" && m.Master == master {
+			derived = append(derived, m)
+		}
+	}
+	return derived, nil
 }
 
 type AccountsListResponse struct {
@@ -35,19 +111,61 @@ type AccountDeleteRequest struct {
 	Address string `json:"address"`
 }
 
+// accountMetas returns the metadata of every account stored for net, by
+// index.
+func (c *Client) accountMetas(ctx context.Context, net string) ([]AccountMeta, error) {
+	keys, err := c.stor.List(ctx, "accounts/"+net+"/")
+	if err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for _, k := range keys {
+		if i, err := strconv.Atoi(strings.TrimSuffix(k, "/")); err == nil && strings.HasSuffix(k, "/") {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	metas := make([]AccountMeta, 0, len(indexes))
+	for _, i := range indexes {
+		data, err := c.stor.Get(ctx, fmt.Sprintf("accounts/%s/%d/meta", net, i))
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		var meta AccountMeta
+		if err := cbor.Unmarshal(data, &meta); err != nil {
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
 // listAccounts lists locally stored accounts.
 //
 // @Summary      List accounts
-// @Description  List all locally stored accounts, optionally filtered by network.
+// @Description  List all locally stored accounts, optionally filtered by network or by the master account they derive from.
 // @Tags         accounts
 // @Produce      json
 // @Param        network  query  string  false  "Filter by network: eth or btc"
+// @Param        master   query  int     false  "Only the accounts derived from this index"
 // @Success      200      {object}  AccountsListResponse
 // @Failure      500      {object}  ErrorResponse
 // @Router       /v1/accounts/list [get]
 func (c *Client) listAccounts() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		network := r.URL.Query().Get("network")
+		master := 0
+		if s := r.URL.Query().Get("master"); s != "" {
+			var err error
+			if master, err = strconv.Atoi(s); err != nil || validateIndex(master) != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("invalid master index"))
+				return
+			}
+		}
 
 		accounts := make([]AccountMeta, 0)
 
@@ -57,17 +175,15 @@ func (c *Client) listAccounts() http.HandlerFunc {
 		}
 
 		for _, net := range networks {
-			for i := 1; i <= 100; i++ {
-				key := fmt.Sprintf("accounts/%s/%d/meta", net, i)
-				data, err := c.stor.Get(context.Background(), key)
-				if err != nil || data == nil {
-					continue
-				}
-				var meta AccountMeta
-				if err := cbor.Unmarshal(data, &meta); err != nil {
-					continue
+			metas, err := c.accountMetas(r.Context(), net)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+			for _, m := range metas {
+				if master == 0 || m.Path != "" && m.Master == master {
+					accounts = append(accounts, m)
 				}
-				accounts = append(accounts, meta)
 			}
 		}
 
@@ -78,7 +194,7 @@ func (c *Client) listAccounts() http.HandlerFunc {
 // deleteAccount permanently removes one shared account's key material from
 // THIS client's storage. The caller must echo the account address as a
 // safety confirmation (it must match the stored meta). This is irreversible —
-// without this share the 2-of-2 key can never sign again.
+// without this share the other parties may no longer reach the threshold.
 //
 // @Summary      Delete account
 // @Description  Permanently remove one shared account's key material from this client's storage. The Address field must match the stored account address as a safety confirmation. Irreversible.
@@ -89,6 +205,7 @@ func (c *Client) listAccounts() http.HandlerFunc {
 // @Success      200   {object}  map[string]interface{}
 // @Failure      400   {object}  ErrorResponse
 // @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
 // @Failure      500   {object}  ErrorResponse
 // @Router       /v1/accounts/delete [post]
 func (c *Client) deleteAccount() http.HandlerFunc {
@@ -127,13 +244,30 @@ func (c *Client) deleteAccount() http.HandlerFunc {
 			return
 		}
 
+		derived, err := c.derivedAccounts(context.Background(), req.Network, req.Index)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if len(derived) > 0 {
+			respondError(w, http.StatusConflict,
+				fmt.Errorf("%d accounts derive from this one, %s/%d first: delete them before it",
+					len(derived), derived[0].Network, derived[0].Index))
+			return
+		}
+
 		keys := []string{
 			metaKey,
 			base + "/conf-ecdsa",
-			base + "/presig-ecdsa",
 			base + "/conf-frost",
 			base + "/presig-frost",
 		}
+		files, _ := c.stor.List(context.Background(), base+"/")
+		for _, f := range files {
+			if isPresigFile(f) {
+				keys = append(keys, base+"/"+f)
+			}
+		}
 		for _, k := range keys {
 			_ = c.stor.Delete(context.Background(), k)
 		}
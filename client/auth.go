@@ -2,20 +2,18 @@ package client
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/fxamacker/cbor/v2"
 	"github.com/valli0x/signature-escrow/auth"
 )
 
-const (
-	clientTokenTTL = 24 * time.Hour
-	ownerKey       = "client/owner"
-)
+const ownerKey = "client/owner"
 
 type NonceRequest struct {
 	Address string `json:"address"`
@@ -30,11 +28,22 @@ type LoginRequest struct {
 	Address   string `json:"address"`
 	Signature string `json:"signature"`
 	Nonce     string `json:"nonce"`
+	Message   string `json:"message,omitempty"`
 }
 
 type LoginResponse struct {
-	Token   string `json:"token"`
-	Address string `json:"address"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Address      string `json:"address"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 type IdentityResponse struct {
@@ -42,6 +51,9 @@ type IdentityResponse struct {
 	HasKeys      bool   `json:"has_keys"`
 	Bound        bool   `json:"bound"`
 	AuthRequired bool   `json:"auth_required"`
+	// TransportKey is the hex X25519 key that key shares are encrypted to
+	// when an account is reshared to this client.
+	TransportKey string `json:"transport_key,omitempty"`
 }
 
 func normAddr(a string) string {
@@ -54,16 +66,11 @@ func normAddr(a string) string {
 
 func (c *Client) keyIdentity() string {
 	for _, net := range []string{"eth", "btc"} {
-		for i := 1; i <= 100; i++ {
-			key := fmt.Sprintf("accounts/%s/%d/meta", net, i)
-			data, err := c.stor.Get(context.Background(), key)
-			if err != nil || data == nil {
-				continue
-			}
-			var meta AccountMeta
-			if err := cbor.Unmarshal(data, &meta); err != nil {
-				continue
-			}
+		metas, err := c.accountMetas(context.Background(), net)
+		if err != nil {
+			continue
+		}
+		for _, meta := range metas {
 			if id := normAddr(meta.PairMyID); id != "" {
 				return id
 			}
@@ -94,7 +101,7 @@ func (c *Client) bindOwner(addr string) error {
 // authNonce issues a one-time nonce for an ETH address to sign.
 //
 // @Summary      Request a client login nonce
-// @Description  Returns a nonce and EIP-191 message for the address to sign, then submit to /v1/auth/login.
+// @Description  Returns a nonce and EIP-4361 (Sign-In with Ethereum) message for the address to sign, then submit to /v1/auth/login.
 // @Tags         auth
 // @Accept       json
 // @Produce      json
@@ -114,12 +121,12 @@ func (c *Client) authNonce() http.HandlerFunc {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("address is required"))
 			return
 		}
-		nonce, err := c.nonceStore.Generate(req.Address)
+		nonce, issuedAt, err := c.nonceStore.Issue(r.Context(), req.Address)
 		if err != nil {
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate nonce: %w", err))
 			return
 		}
-		respondOk(w, NonceResponse{Nonce: nonce, Message: auth.GenerateNonce(req.Address, nonce)})
+		respondOk(w, NonceResponse{Nonce: nonce, Message: c.siwe.Message(req.Address, nonce, issuedAt)})
 	}
 }
 
@@ -127,7 +134,7 @@ func (c *Client) authNonce() http.HandlerFunc {
 // issues a JWT scoped to THIS client.
 //
 // @Summary      Login to this client
-// @Description  Verifies the EIP-191 signature and returns a client JWT (24h). If the client already holds keys (or was bound before), only that owner address is accepted; a fresh client binds to the first successful login.
+// @Description  Verifies the EIP-191 signature over the sign-in message (EIP-4361 domain, nonce, chain ID and time bounds are checked) and returns a short-lived client JWT (15 min) plus a rotating refresh token. If the client already holds keys (or was bound before), only that owner address is accepted; a fresh client binds to the first successful login.
 // @Tags         auth
 // @Accept       json
 // @Produce      json
@@ -148,11 +155,20 @@ func (c *Client) authLogin() http.HandlerFunc {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("address, signature and nonce are required"))
 			return
 		}
-		if !c.nonceStore.Verify(req.Address, req.Nonce) {
+		issuedAt, ok, err := c.nonceStore.Consume(r.Context(), req.Address, req.Nonce)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if !ok {
 			respondError(w, http.StatusUnauthorized, fmt.Errorf("invalid or expired nonce"))
 			return
 		}
-		message := auth.GenerateNonce(req.Address, req.Nonce)
+		message, err := c.siwe.ResolveMessage(req.Address, req.Nonce, req.Message, issuedAt, time.Now())
+		if err != nil {
+			respondError(w, http.StatusUnauthorized, err)
+			return
+		}
 		address, err := auth.VerifySignature(req.Address, message, req.Signature)
 		if err != nil {
 			respondError(w, http.StatusUnauthorized, fmt.Errorf("signature verification failed"))
@@ -174,12 +190,137 @@ func (c *Client) authLogin() http.HandlerFunc {
 			c.logger.Info("client bound to owner", "address", signer)
 		}
 
-		token, err := auth.GenerateToken(address, c.jwtSecret, clientTokenTTL)
+		resp, err := c.issueSession(r.Context(), strings.ToLower(address.Hex()), "")
 		if err != nil {
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate token"))
 			return
 		}
-		respondOk(w, LoginResponse{Token: token, Address: address.Hex()})
+		resp.Address = address.Hex()
+		respondOk(w, resp)
+	}
+}
+
+func (c *Client) issueSession(ctx context.Context, address, refresh string) (*LoginResponse, error) {
+	gen, err := c.tokens.Generation(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	token, err := auth.SignClaims(auth.NewClaims(address, gen, auth.AccessTokenTTL), c.keys)
+	if err != nil {
+		return nil, err
+	}
+	if refresh == "" {
+		if refresh, err = c.tokens.IssueRefresh(ctx, address, gen); err != nil {
+			return nil, err
+		}
+	}
+	return &LoginResponse{
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(auth.AccessTokenTTL.Seconds()),
+		Address:      address,
+	}, nil
+}
+
+// authRefresh rotates a client refresh token.
+//
+// @Summary      Refresh a client session
+// @Description  Exchanges a refresh token for a new client JWT and refresh token. Re-presenting a rotated token revokes its whole family. The owner binding is re-checked.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        body  body      RefreshRequest  true  "Refresh token"
+// @Success      200   {object}  LoginResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Router       /v1/auth/refresh [post]
+func (c *Client) authRefresh() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.RefreshToken == "" {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("refresh_token is required"))
+			return
+		}
+		address, _, next, err := c.tokens.Rotate(r.Context(), req.RefreshToken)
+		if errors.Is(err, auth.ErrInvalidRefreshToken) {
+			respondError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if own := c.owner(); own != "" && normAddr(address) != own {
+			respondError(w, http.StatusForbidden, fmt.Errorf("this client is bound to %s", own))
+			return
+		}
+		resp, err := c.issueSession(r.Context(), address, next)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate token"))
+			return
+		}
+		respondOk(w, resp)
+	}
+}
+
+// authLogout ends the current client session.
+//
+// @Summary      Logout from this client
+// @Description  Denylists the presented client JWT and, if given, revokes the session's refresh token. Returns 204 No Content.
+// @Tags         auth
+// @Accept       json
+// @Param        body  body      LogoutRequest  false  "Refresh token to revoke"
+// @Success      204   "No Content"
+// @Failure      401   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /v1/auth/logout [post]
+func (c *Client) authLogout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LogoutRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		if claims := auth.ClaimsFromContext(r.Context()); claims != nil {
+			if err := c.tokens.Deny(r.Context(), claims); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+		}
+		if req.RefreshToken != "" {
+			addr := auth.AddressFromContext(r.Context())
+			if err := c.tokens.RevokeRefresh(r.Context(), addr, req.RefreshToken); err != nil &&
+				!errors.Is(err, auth.ErrInvalidRefreshToken) {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+		}
+		respondOk(w, nil)
+	}
+}
+
+// authRevokeAll revokes every client session of the owner.
+//
+// @Summary      Revoke all client sessions
+// @Description  Invalidates every client JWT and refresh token issued so far, including the current one.
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  map[string]interface{}
+// @Failure      401  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /v1/auth/revoke-all [post]
+func (c *Client) authRevokeAll() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := auth.AddressFromContext(r.Context())
+		if _, err := c.tokens.RevokeAll(r.Context(), addr); err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		c.logger.Info("all client sessions revoked", "address", addr)
+		respondOk(w, map[string]any{"revoked": true})
 	}
 }
 
@@ -187,7 +328,7 @@ func (c *Client) authLogin() http.HandlerFunc {
 // warn the user before attempting a login it knows will be rejected.
 //
 // @Summary      Client identity
-// @Description  Returns the owner address this client is bound to (from its key material or a prior binding), whether it holds keys, and whether it is bound.
+// @Description  Returns the owner address this client is bound to (from its key material or a prior binding), whether it holds keys, whether it is bound, and the transport key to reshare accounts to it.
 // @Tags         auth
 // @Produce      json
 // @Success      200  {object}  IdentityResponse
@@ -196,7 +337,11 @@ func (c *Client) identity() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := c.keyIdentity()
 		own := c.owner()
-		respondOk(w, IdentityResponse{Address: own, HasKeys: id != "", Bound: own != "", AuthRequired: c.authEnabled})
+		resp := IdentityResponse{Address: own, HasKeys: id != "", Bound: own != "", AuthRequired: c.authEnabled}
+		if key, err := c.transportKey(r.Context()); err == nil {
+			resp.TransportKey = hex.EncodeToString(key.PublicKey().Bytes())
+		}
+		respondOk(w, resp)
 	}
 }
 
@@ -214,3 +359,18 @@ func (c *Client) ownerGuard(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// jwks publishes the public keys access tokens are signed with.
+//
+// @Summary      JSON Web Key Set
+// @Description  Public keys (RFC 7517) for verifying access tokens issued by this client, selected by the token's kid header. Empty when an HS256 secret is used.
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  auth.JWKSet
+// @Router       /.well-known/jwks.json [get]
+func (c *Client) jwks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		respondOk(w, c.keys.JWKS())
+	}
+}
@@ -0,0 +1,571 @@
+package client
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// A backup archive is a CBOR envelope holding the Argon2id parameters and an
+// AES-256-GCM sealed CBOR map of storage keys to values. The envelope header
+// is the associated data, so the archive as a whole is integrity-checked.
+
+const (
+	backupFormat  = "mpcoven-backup"
+	backupVersion = 1
+
+	minBackupPassphrase = 8
+)
+
+// accountFiles are the per-account keys under accounts/<net>/<index>/,
+// besides the ECDSA presignatures (see isPresigFile).
+var accountFiles = []string{"meta", "conf-ecdsa", "conf-frost", "presig-frost"}
+
+// splitAccountKey splits "accounts/<net>/<index>/<file>" into the account
+// name "<net>/<index>" and the file.
+func splitAccountKey(key string) (name, file string, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 4 || parts[0] != "accounts" || (parts[1] != "eth" && parts[1] != "btc") {
+		return "", "", false
+	}
+	if i, err := strconv.Atoi(parts[2]); err != nil || i <= 0 || strconv.Itoa(i) != parts[2] {
+		return "", "", false
+	}
+	if slices.Contains(accountFiles, parts[3]) || isPresigFile(parts[3]) {
+		return parts[1] + "/" + parts[2], parts[3], true
+	}
+	return "", "", false
+}
+
+type backupArchive struct {
+	backupHeader
+	Nonce  []byte `cbor:"nonce"`
+	Sealed []byte `cbor:"sealed"`
+}
+
+type backupHeader struct {
+	Format  string            `cbor:"format"`
+	Version int               `cbor:"version"`
+	KDF     storage.KDFParams `cbor:"kdf"`
+}
+
+type backupContents struct {
+	CreatedAt int64             `cbor:"created_at"`
+	Entries   map[string][]byte `cbor:"entries"`
+}
+
+type BackupExportRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+type BackupExportResponse struct {
+	// Archive is the encrypted backup, base64 in JSON.
+	Archive  []byte   `json:"archive"`
+	Accounts []string `json:"accounts"`
+	// Skipped lists stored accounts left out because their key share does
+	// not check out, with the reason.
+	Skipped   map[string]string `json:"skipped,omitempty"`
+	CreatedAt int64             `json:"created_at"`
+}
+
+type BackupImportRequest struct {
+	Passphrase string `json:"passphrase"`
+	Archive    []byte `json:"archive"`
+	// Force overwrites accounts that already exist in this client.
+	Force bool `json:"force"`
+	// RestorePresignatures also restores presignatures. Only set it if no
+	// account in the archive has signed since the export: signing twice with
+	// one presignature leaks the key share.
+	RestorePresignatures bool `json:"restore_presignatures"`
+}
+
+type BackupImportResponse struct {
+	Accounts []string `json:"accounts"`
+	// WithoutPresignature lists restored ECDSA accounts that need a new
+	// presignature before they can sign.
+	WithoutPresignature []string `json:"without_presignature"`
+	CreatedAt           int64    `json:"created_at"`
+}
+
+func backupAEAD(pass string, params storage.KDFParams) (cipher.AEAD, error) {
+	key, err := params.Key(pass)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealBackup(pass string, contents *backupContents) ([]byte, error) {
+	params, err := storage.NewKDFParams()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := backupAEAD(pass, params)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := cbor.Marshal(contents)
+	if err != nil {
+		return nil, err
+	}
+	archive := backupArchive{
+		backupHeader: backupHeader{Format: backupFormat, Version: backupVersion, KDF: params},
+		Nonce:        make([]byte, aead.NonceSize()),
+	}
+	if _, err := io.ReadFull(rand.Reader, archive.Nonce); err != nil {
+		return nil, err
+	}
+	ad, err := cbor.Marshal(archive.backupHeader)
+	if err != nil {
+		return nil, err
+	}
+	archive.Sealed = aead.Seal(nil, archive.Nonce, plain, ad)
+	return cbor.Marshal(archive)
+}
+
+var errBackupOpen = errors.New("wrong passphrase or damaged archive")
+
+func openBackup(pass string, data []byte) (*backupContents, error) {
+	var archive backupArchive
+	if err := cbor.Unmarshal(data, &archive); err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	if archive.Format != backupFormat {
+		return nil, errors.New("not a backup archive")
+	}
+	if archive.Version != backupVersion {
+		return nil, fmt.Errorf("backup version %d not supported", archive.Version)
+	}
+	aead, err := backupAEAD(pass, archive.KDF)
+	if err != nil {
+		return nil, err
+	}
+	if len(archive.Nonce) != aead.NonceSize() {
+		return nil, errBackupOpen
+	}
+	ad, err := cbor.Marshal(archive.backupHeader)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, archive.Nonce, archive.Sealed, ad)
+	if err != nil {
+		return nil, errBackupOpen
+	}
+	var contents backupContents
+	if err := cbor.Unmarshal(plain, &contents); err != nil {
+		return nil, fmt.Errorf("backup contents: %w", err)
+	}
+	return &contents, nil
+}
+
+// backupEntries collects every account key plus aliases, exchanges and the
+// cosign history.
+func (c *Client) backupEntries(ctx context.Context) (map[string][]byte, error) {
+	entries := map[string][]byte{}
+	err := storage.Walk(ctx, c.stor, "accounts/", func(key string) error {
+		if _, _, ok := splitAccountKey(key); !ok {
+			return nil
+		}
+		value, err := c.stor.Get(ctx, key)
+		if err != nil || value == nil {
+			return err
+		}
+		entries[key] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	exchanges, err := c.loadExchanges()
+	if err != nil {
+		return nil, err
+	}
+	if len(exchanges) > 0 {
+		if entries[exchangesKey], err = cbor.Marshal(exchanges); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range []string{aliasesKey, cosignHistoryKey} {
+		value, err := c.stor.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			entries[key] = value
+		}
+	}
+	return entries, nil
+}
+
+// backupAccount is one account of an archive, keyed by "<net>/<index>".
+type backupAccount struct {
+	name  string
+	base  string
+	meta  AccountMeta
+	files map[string][]byte
+}
+
+// parseBackupAccounts groups the account entries of an archive and checks
+// that every key share matches its public share and the stored public key.
+// Accounts that fail the check are returned in invalid, by name.
+func parseBackupAccounts(entries map[string][]byte) (accounts []*backupAccount, invalid map[string]error, err error) {
+	byName := map[string]*backupAccount{}
+	for key, value := range entries {
+		switch key {
+		case aliasesKey, exchangesKey, cosignHistoryKey:
+			continue
+		}
+		name, file, ok := splitAccountKey(key)
+		if !ok {
+			return nil, nil, fmt.Errorf("unexpected key %q", key)
+		}
+		acc := byName[name]
+		if acc == nil {
+			acc = &backupAccount{name: name, base: "accounts/" + name, files: map[string][]byte{}}
+			byName[name] = acc
+		}
+		acc.files[file] = value
+	}
+
+	invalid = map[string]error{}
+	for _, acc := range byName {
+		if err := acc.check(); err != nil {
+			invalid[acc.name] = err
+			continue
+		}
+		accounts = append(accounts, acc)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].name < accounts[j].name })
+	return accounts, invalid, nil
+}
+
+func (acc *backupAccount) check() error {
+	data, ok := acc.files["meta"]
+	if !ok {
+		return errors.New("no account metadata")
+	}
+	if err := cbor.Unmarshal(data, &acc.meta); err != nil {
+		return fmt.Errorf("metadata: %w", err)
+	}
+	if acc.meta.Network+"/"+strconv.Itoa(acc.meta.Index) != acc.name {
+		return errors.New("metadata does not match its key")
+	}
+
+	var pub []byte
+	switch {
+	case acc.meta.Path != "":
+		// A derived account has no share; its master's is checked.
+		if _, _, err := parseDerivationPath(acc.meta.Path); err != nil {
+			return err
+		}
+		pub, _ = hex.DecodeString(acc.meta.PublicKey)
+	case acc.files["conf-ecdsa"] != nil:
+		config := mpccmp.EmptyConfig()
+		if err := config.UnmarshalBinary(acc.files["conf-ecdsa"]); err != nil {
+			return fmt.Errorf("ecdsa config: %w", err)
+		}
+		if err := mpccmp.CheckShare(config); err != nil {
+			return err
+		}
+		var err error
+		if pub, err = mpccmp.GetPublicKeyByte(config); err != nil {
+			return err
+		}
+	case acc.files["conf-frost"] != nil:
+		config := &frost.TaprootConfig{}
+		if err := cbor.Unmarshal(acc.files["conf-frost"], config); err != nil {
+			return fmt.Errorf("frost config: %w", err)
+		}
+		if err := mpcfrost.CheckShare(config); err != nil {
+			return err
+		}
+		pub, _ = mpcfrost.GetPublicKeyByte(config)
+	default:
+		return errors.New("no key share")
+	}
+	if !strings.EqualFold(hex.EncodeToString(pub), acc.meta.PublicKey) {
+		return errors.New("key share does not match the stored public key")
+	}
+
+	// Archives from before presignature pools hold a single presignature
+	// per set of signers: it goes into the pool.
+	for file, data := range acc.files {
+		if !isPresigFile(file) || strings.Contains(file, ".") {
+			continue
+		}
+		delete(acc.files, file)
+		if entry, err := presigEntry(file, data); err == nil {
+			acc.files[entry] = data
+		}
+	}
+	return nil
+}
+
+// exportBackup writes an encrypted archive of this client's key material.
+//
+// @Summary      Export backup
+// @Description  Return a passphrase-encrypted, integrity-checked archive of all accounts (key shares, presignatures, metadata), aliases, exchanges and cosign history.
+// @Tags         backup
+// @Accept       json
+// @Produce      json
+// @Param        body  body      BackupExportRequest  true  "Archive passphrase"
+// @Success      200   {object}  BackupExportResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /v1/backup/export [post]
+func (c *Client) exportBackup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BackupExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if len(req.Passphrase) < minBackupPassphrase {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("passphrase must be at least %d characters", minBackupPassphrase))
+			return
+		}
+
+		entries, err := c.backupEntries(r.Context())
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		accounts, invalid, err := parseBackupAccounts(entries)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err)
+			return
+		}
+		var skipped map[string]string
+		for name, reason := range invalid {
+			c.logger.Warn("backup: skipping account", "account", name, "error", reason)
+			for key := range entries {
+				if strings.HasPrefix(key, "accounts/"+name+"/") {
+					delete(entries, key)
+				}
+			}
+			if skipped == nil {
+				skipped = map[string]string{}
+			}
+			skipped[name] = reason.Error()
+		}
+
+		contents := &backupContents{CreatedAt: time.Now().Unix(), Entries: entries}
+		archive, err := sealBackup(req.Passphrase, contents)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("seal backup: %w", err))
+			return
+		}
+
+		names := make([]string, len(accounts))
+		for i, acc := range accounts {
+			names[i] = acc.name
+		}
+		c.logger.Info("backup exported", "accounts", len(names))
+		respondOk(w, BackupExportResponse{Archive: archive, Accounts: names, Skipped: skipped, CreatedAt: contents.CreatedAt})
+	}
+}
+
+// importBackup restores an archive made by exportBackup.
+//
+// @Summary      Import backup
+// @Description  Validate and restore an archive from /v1/backup/export. Every key share is checked against its public key. Existing accounts are only overwritten with force. Presignatures are skipped unless restore_presignatures is set.
+// @Tags         backup
+// @Accept       json
+// @Produce      json
+// @Param        body  body      BackupImportRequest  true  "Archive and passphrase"
+// @Success      200   {object}  BackupImportResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /v1/backup/import [post]
+func (c *Client) importBackup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BackupImportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		contents, err := openBackup(req.Passphrase, req.Archive)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		accounts, invalid, err := parseBackupAccounts(contents.Entries)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		for name, reason := range invalid {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("account %s: %w", name, reason))
+			return
+		}
+
+		ctx := r.Context()
+		if !req.Force {
+			var existing []string
+			for _, acc := range accounts {
+				data, err := c.stor.Get(ctx, acc.base+"/meta")
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+					return
+				}
+				if data != nil {
+					existing = append(existing, acc.name)
+				}
+			}
+			if len(existing) > 0 {
+				respondError(w, http.StatusConflict,
+					fmt.Errorf("accounts already exist: %s (set force to overwrite)", strings.Join(existing, ", ")))
+				return
+			}
+		}
+
+		resp := BackupImportResponse{Accounts: []string{}, WithoutPresignature: []string{}, CreatedAt: contents.CreatedAt}
+		for _, acc := range accounts {
+			// Files the archive does not restore are removed, so no share
+			// or presignature of a replaced account is left behind.
+			files := slices.Clone(accountFiles)
+			for file := range acc.files {
+				if isPresigFile(file) {
+					files = append(files, file)
+				}
+			}
+			stored, err := c.stor.List(ctx, acc.base+"/")
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+			for _, file := range stored {
+				if isPresigFile(file) && acc.files[file] == nil {
+					files = append(files, file)
+				}
+			}
+			var ops []storage.Op
+			for _, file := range files {
+				value, ok := acc.files[file]
+				if strings.HasPrefix(file, "presig-") && !req.RestorePresignatures {
+					ok = false
+				}
+				if ok {
+					ops = append(ops, storage.Op{Key: acc.base + "/" + file, Value: value})
+				} else {
+					ops = append(ops, storage.Op{Key: acc.base + "/" + file, Delete: true})
+				}
+			}
+			if err := storage.Batch(ctx, c.stor, ops); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+			resp.Accounts = append(resp.Accounts, acc.name)
+			presigned := slices.ContainsFunc(files, func(file string) bool {
+				return strings.HasPrefix(file, "presig-ecdsa.") && acc.files[file] != nil
+			})
+			ecdsa := acc.files["conf-ecdsa"] != nil || acc.meta.Path != "" && acc.meta.Network == "eth"
+			if ecdsa && (!presigned || !req.RestorePresignatures) {
+				resp.WithoutPresignature = append(resp.WithoutPresignature, acc.name)
+			}
+		}
+
+		if err := c.mergeBackupRecords(ctx, contents.Entries); err != nil {
+			respondError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.logger.Info("backup imported", "accounts", len(resp.Accounts), "force", req.Force,
+			"presignatures", req.RestorePresignatures)
+		respondOk(w, resp)
+	}
+}
+
+// mergeBackupRecords adds the aliases, exchanges and cosign events of an
+// archive that this client does not have. Local entries win.
+func (c *Client) mergeBackupRecords(ctx context.Context, entries map[string][]byte) error {
+	if data := entries[aliasesKey]; data != nil {
+		var restored map[string]string
+		if err := cbor.Unmarshal(data, &restored); err != nil {
+			return fmt.Errorf("backup aliases: %w", err)
+		}
+		m := c.loadAliases()
+		for addr, name := range restored {
+			if _, ok := m[addr]; !ok {
+				m[addr] = name
+			}
+		}
+		c.saveAliases(m)
+	}
+
+	if data := entries[exchangesKey]; data != nil {
+		var restored []Exchange
+		if err := cbor.Unmarshal(data, &restored); err != nil {
+			return fmt.Errorf("backup exchanges: %w", err)
+		}
+		for _, ex := range restored {
+			if validateExchangeID(ex.ID) != nil {
+				continue
+			}
+			have, err := c.loadExchange(ex.ID)
+			if err != nil {
+				return fmt.Errorf("storage error")
+			}
+			if have != nil {
+				continue
+			}
+			if err := c.saveExchange(ex); err != nil {
+				return fmt.Errorf("storage error")
+			}
+		}
+	}
+
+	if data := entries[cosignHistoryKey]; data != nil {
+		var restored []CosignEvent
+		if err := cbor.Unmarshal(data, &restored); err != nil {
+			return fmt.Errorf("backup cosign history: %w", err)
+		}
+		c.histMu.Lock()
+		defer c.histMu.Unlock()
+		list := c.loadCosignHistory()
+		have := map[string]bool{}
+		for _, ev := range list {
+			have[ev.ID] = true
+		}
+		for _, ev := range restored {
+			if !have[ev.ID] {
+				list = append(list, ev)
+			}
+		}
+		sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt > list[j].CreatedAt })
+		if len(list) > cosignHistoryMax {
+			list = list[:cosignHistoryMax]
+		}
+		b, err := cbor.Marshal(list)
+		if err != nil {
+			return err
+		}
+		if err := c.stor.Put(ctx, cosignHistoryKey, b); err != nil {
+			return fmt.Errorf("storage error")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/sample"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/taproot"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+	"github.com/valli0x/signature-escrow/config"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+func mkLocalClient(t *testing.T) (*Client, *httptest.Server) {
+	return mkLocalClientWith(t, storage.NewMemoryStorage())
+}
+
+func mkLocalClientWith(t *testing.T, stor storage.Storage) (*Client, *httptest.Server) {
+	c := NewClient(&ClientConfig{
+		Addr:       ":0",
+		Stor:       stor,
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Env:        &config.Env{},
+		ClientAuth: "none",
+	})
+	ts := httptest.NewServer(c.routes())
+	t.Cleanup(ts.Close)
+	return c, ts
+}
+
+// storeFrostAccount stores a single-party FROST account as keygen would.
+func storeFrostAccount(t *testing.T, c *Client, index int) *frost.TaprootConfig {
+	t.Helper()
+	secret := sample.Scalar(rand.Reader, curve.Secp256k1{})
+	public := secret.ActOnBase().(*curve.Secp256k1Point)
+	id := party.ID("a")
+	cfg := &frost.TaprootConfig{
+		ID:                 id,
+		Threshold:          0,
+		PrivateShare:       secret.(*curve.Secp256k1Scalar),
+		PublicKey:          taproot.PublicKey(public.XBytes()),
+		ChainKey:           make([]byte, 32),
+		VerificationShares: map[party.ID]*curve.Secp256k1Point{id: public},
+	}
+	data, err := cbor.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "accounts/btc/" + strconv.Itoa(index)
+	meta, _ := cbor.Marshal(AccountMeta{Network: "btc", Index: index, PublicKey: hex.EncodeToString(cfg.PublicKey)})
+	ctx := context.Background()
+	_ = c.stor.Put(ctx, base+"/conf-frost", data)
+	_ = c.stor.Put(ctx, base+"/meta", meta)
+	return cfg
+}
+
+func postBackup(t *testing.T, ts *httptest.Server, path string, body, out any) int {
+	t.Helper()
+	b, _ := json.Marshal(body)
+	resp, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	src, srcTS := mkLocalClient(t)
+	storeFrostAccount(t, src, 1)
+	src.saveAliases(map[string]string{"0xabc": "alice"})
+	src.recordCosign(CosignEvent{ID: "ev1", Network: "btc", Index: 1})
+
+	if code := postBackup(t, srcTS, "/v1/backup/export", BackupExportRequest{Passphrase: "short"}, nil); code != http.StatusBadRequest {
+		t.Fatalf("short passphrase: %d", code)
+	}
+	var export BackupExportResponse
+	if code := postBackup(t, srcTS, "/v1/backup/export", BackupExportRequest{Passphrase: "correct horse"}, &export); code != http.StatusOK {
+		t.Fatalf("export: %d", code)
+	}
+	if len(export.Accounts) != 1 || export.Accounts[0] != "btc/1" {
+		t.Fatalf("exported accounts: %v", export.Accounts)
+	}
+
+	dst, dstTS := mkLocalClient(t)
+	if code := postBackup(t, dstTS, "/v1/backup/import", BackupImportRequest{Passphrase: "wrong horse", Archive: export.Archive}, nil); code != http.StatusBadRequest {
+		t.Fatalf("wrong passphrase: %d", code)
+	}
+	tampered := append([]byte(nil), export.Archive...)
+	tampered[len(tampered)-1] ^= 1
+	if code := postBackup(t, dstTS, "/v1/backup/import", BackupImportRequest{Passphrase: "correct horse", Archive: tampered}, nil); code != http.StatusBadRequest {
+		t.Fatalf("tampered archive: %d", code)
+	}
+
+	var imported BackupImportResponse
+	if code := postBackup(t, dstTS, "/v1/backup/import", BackupImportRequest{Passphrase: "correct horse", Archive: export.Archive}, &imported); code != http.StatusOK {
+		t.Fatalf("import: %d", code)
+	}
+	if len(imported.Accounts) != 1 {
+		t.Fatalf("imported: %+v", imported)
+	}
+	ctx := context.Background()
+	want, _ := src.stor.Get(ctx, "accounts/btc/1/conf-frost")
+	if got, _ := dst.stor.Get(ctx, "accounts/btc/1/conf-frost"); !bytes.Equal(got, want) {
+		t.Fatal("key share not restored")
+	}
+	if dst.loadAliases()["0xabc"] != "alice" || len(dst.loadCosignHistory()) != 1 {
+		t.Fatal("aliases or cosign history not restored")
+	}
+
+	// Existing accounts are only overwritten with force.
+	if code := postBackup(t, dstTS, "/v1/backup/import", BackupImportRequest{Passphrase: "correct horse", Archive: export.Archive}, nil); code != http.StatusConflict {
+		t.Fatalf("import over existing account: %d", code)
+	}
+	if code := postBackup(t, dstTS, "/v1/backup/import", BackupImportRequest{Passphrase: "correct horse", Archive: export.Archive, Force: true}, nil); code != http.StatusOK {
+		t.Fatalf("forced import: %d", code)
+	}
+	if len(dst.loadCosignHistory()) != 1 {
+		t.Fatal("cosign history duplicated")
+	}
+}
+
+func TestBackupRejectsMismatchedShare(t *testing.T) {
+	c, _ := mkLocalClient(t)
+	cfg := storeFrostAccount(t, c, 1)
+
+	// A share that does not belong to the verification share.
+	other := sample.Scalar(rand.Reader, curve.Secp256k1{})
+	cfg.PrivateShare = other.(*curve.Secp256k1Scalar)
+	data, _ := cbor.Marshal(cfg)
+	entries := map[string][]byte{"accounts/btc/1/conf-frost": data}
+	entries["accounts/btc/1/meta"], _ = c.stor.Get(context.Background(), "accounts/btc/1/meta")
+	if _, invalid, err := parseBackupAccounts(entries); err != nil || invalid["btc/1"] == nil {
+		t.Fatalf("mismatched share accepted: %v, %v", invalid, err)
+	}
+
+	// A share that does not match the stored public key.
+	storeFrostAccount(t, c, 2)
+	entries = map[string][]byte{}
+	entries["accounts/btc/2/conf-frost"], _ = c.stor.Get(context.Background(), "accounts/btc/2/conf-frost")
+	entries["accounts/btc/2/meta"], _ = cbor.Marshal(AccountMeta{Network: "btc", Index: 2, PublicKey: hex.EncodeToString(make([]byte, 32))})
+	if _, invalid, err := parseBackupAccounts(entries); err != nil || invalid["btc/2"] == nil {
+		t.Fatalf("share for another public key accepted: %v, %v", invalid, err)
+	}
+
+	if _, _, err := parseBackupAccounts(map[string][]byte{"accounts/btc/1/../../x": nil}); err == nil {
+		t.Fatal("unexpected key accepted")
+	}
+}
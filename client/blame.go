@@ -0,0 +1,43 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
+)
+
+// protocolFailure classifies err, from a run of protocolName by self on
+// session with parties, logs it and tells the other parties.
+func (c *Client) protocolFailure(self string, parties party.IDSlice, protocolName, session string, err error) *mpcblame.Failure {
+	f := mpcblame.Classify(party.ID(self), protocolName, session, err)
+	c.logger.Error("MPC protocol failed", "protocol", protocolName, "session", session,
+		"kind", f.Kind, "round", f.Round, "culprits", f.Culprits, "reporter", f.Reporter, "error", err)
+	c.notifyFailure(self, parties, f)
+	return f
+}
+
+// respondFailure answers a failed run with err and its failure f, for the
+// app to show.
+func respondFailure(w http.ResponseWriter, f *mpcblame.Failure, err error) {
+	status := http.StatusBadGateway
+	switch f.Kind {
+	case mpcblame.KindTimeout:
+		status = http.StatusGatewayTimeout
+	case mpcblame.KindLocal:
+		status = http.StatusInternalServerError
+	case mpcblame.KindCancelled:
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ErrorResponse{Errors: []string{err.Error()}, Failure: f})
+}
+
+// cosignFailed records ev as failed with f and answers it with err.
+func (c *Client) cosignFailed(w http.ResponseWriter, ev CosignEvent, f *mpcblame.Failure, err error) {
+	ev.Status, ev.Error, ev.Failure = "failed", err.Error(), f
+	c.recordCosign(ev)
+	respondFailure(w, f, err)
+}
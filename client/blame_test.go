@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/valli0x/signature-escrow/mpc"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+)
+
+func incSigFrom(t *testing.T, from party.ID, hash string) *protocol.Message {
+	t.Helper()
+	inc, err := mpccmp.MsgToHex(&protocol.Message{From: from, Data: []byte("inc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(incSigMsg{IncSig: inc, HashTx: hash, PresigID: "0123456789abcdef"})
+	return &protocol.Message{From: from, Data: data}
+}
+
+func TestCollectIncSigsBlame(t *testing.T) {
+	signers := party.NewIDSlice([]party.ID{"a", "b", "c"})
+
+	hub := mpc.NewPartyHub(signers)
+	hub["a"] <- incSigFrom(t, "b", "aa")
+	_, _, err := collectIncSigs(context.Background(), hub.Net("a"), "a", signers, 50*time.Millisecond)
+	f := mpcblame.Classify("a", "ecdsa-sign", "aa", err)
+	if f == nil || f.Kind != mpcblame.KindTimeout || !slices.Equal(f.Culprits, []string{"c"}) {
+		t.Fatalf("timeout: %+v", f)
+	}
+
+	hub = mpc.NewPartyHub(signers)
+	hub["a"] <- incSigFrom(t, "b", "aa")
+	hub["a"] <- incSigFrom(t, "c", "bb")
+	_, _, err = collectIncSigs(context.Background(), hub.Net("a"), "a", signers, time.Second)
+	if f := mpcblame.Classify("a", "ecdsa-sign", "aa", err); f == nil || f.Kind != mpcblame.KindVerification {
+		t.Fatalf("mismatch: %+v", f)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errSessionCancelled)
+	_, _, err = collectIncSigs(ctx, mpc.NewPartyHub(signers).Net("a"), "a", signers, time.Second)
+	if f := mpcblame.Classify("a", "ecdsa-sign", "aa", err); f == nil || f.Kind != mpcblame.KindCancelled || !errors.Is(err, errSessionCancelled) {
+		t.Fatalf("cancel: %+v", f)
+	}
+}
+
+func TestRespondFailure(t *testing.T) {
+	for kind, code := range map[mpcblame.Kind]int{
+		mpcblame.KindTimeout:        http.StatusGatewayTimeout,
+		mpcblame.KindInvalidMessage: http.StatusBadGateway,
+		mpcblame.KindLocal:          http.StatusInternalServerError,
+		mpcblame.KindCancelled:      http.StatusConflict,
+	} {
+		rec := httptest.NewRecorder()
+		respondFailure(rec, &mpcblame.Failure{Protocol: "frost-sign", Party: "a", Kind: kind}, errors.New("failed"))
+		var resp ErrorResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != code || resp.Failure == nil || resp.Failure.Kind != kind || len(resp.Errors) != 1 {
+			t.Errorf("%s: %d %+v", kind, rec.Code, resp)
+		}
+	}
+}
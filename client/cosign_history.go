@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
 )
 
 const cosignHistoryKey = "cosign-history/all"
@@ -29,9 +30,11 @@ type CosignEvent struct {
 	TxData    string `json:"tx_data,omitempty"`
 	TxHash    string `json:"tx_hash,omitempty"`
 	Error     string `json:"error,omitempty"`
-	EscrowID  string `json:"escrow_id,omitempty"`
-	Pub       string `json:"pub,omitempty"`
-	CreatedAt int64  `json:"created_at"`
+	// Failure classifies the failed MPC run of a "failed" event.
+	Failure   *mpcblame.Failure `json:"failure,omitempty"`
+	EscrowID  string            `json:"escrow_id,omitempty"`
+	Pub       string            `json:"pub,omitempty"`
+	CreatedAt int64             `json:"created_at"`
 }
 
 type CosignHistoryResponse struct {
@@ -0,0 +1,277 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/protocols/cmp"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// maxDerivationDepth bounds a derivation path, as BIP-32 does.
+const maxDerivationDepth = 255
+
+// parseDerivationPath parses a non-hardened BIP-32 path below the master
+// key, such as "m/0/5", and returns its indexes and its canonical form.
+func parseDerivationPath(s string) ([]uint32, string, error) {
+	parts := strings.Split(s, "/")
+	if parts[0] != "m" || len(parts) < 2 {
+		return nil, "", errors.New(`path must look like "m/0/5"`)
+	}
+	if len(parts)-1 > maxDerivationDepth {
+		return nil, "", fmt.Errorf("path is deeper than %d", maxDerivationDepth)
+	}
+	path := make([]uint32, 0, len(parts)-1)
+	for _, p := range parts[1:] {
+		if strings.HasSuffix(p, "'") || strings.HasSuffix(p, "h") {
+			return nil, "", fmt.Errorf("path: %s is hardened, which shares cannot derive", p)
+		}
+		i, err := strconv.ParseUint(p, 10, 31)
+		if err != nil {
+			return nil, "", fmt.Errorf("path: %q is not an index below 2^31", p)
+		}
+		path = append(path, uint32(i))
+	}
+	canonical := "m"
+	for _, i := range path {
+		canonical += "/" + strconv.FormatUint(uint64(i), 10)
+	}
+	return path, canonical, nil
+}
+
+// keyBase returns where the key share of the account at base is stored and
+// the path to derive from it: the account itself, or its master.
+func (c *Client) keyBase(ctx context.Context, base string) (string, []uint32, error) {
+	data, err := c.stor.Get(ctx, base+"/meta")
+	if err != nil {
+		return "", nil, fmt.Errorf("storage error")
+	}
+	var meta AccountMeta
+	if data == nil || cbor.Unmarshal(data, &meta) != nil || meta.Path == "" {
+		return base, nil, nil
+	}
+	path, _, err := parseDerivationPath(meta.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("accounts/%s/%d", meta.Network, meta.Master), path, nil
+}
+
+// loadECDSAConfig reads the ECDSA key share of the account at base, or
+// derives it from its master's.
+func (c *Client) loadECDSAConfig(ctx context.Context, base string) (*cmp.Config, error) {
+	keyBase, path, err := c.keyBase(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.stor.Get(ctx, keyBase+"/conf-ecdsa")
+	if err != nil {
+		return nil, fmt.Errorf("storage error")
+	}
+	if data == nil {
+		return nil, fmt.Errorf("no ECDSA key share for %s", strings.TrimPrefix(keyBase, "accounts/"))
+	}
+	config := mpccmp.EmptyConfig()
+	if err := config.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %v", err)
+	}
+	return mpccmp.Derive(config, path)
+}
+
+// loadFROSTConfig reads the FROST key share of the account at base, or
+// derives it from its master's.
+func (c *Client) loadFROSTConfig(ctx context.Context, base string) (*frost.TaprootConfig, error) {
+	keyBase, path, err := c.keyBase(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.stor.Get(ctx, keyBase+"/conf-frost")
+	if err != nil {
+		return nil, fmt.Errorf("storage error")
+	}
+	if data == nil {
+		return nil, fmt.Errorf("no FROST key share for %s", strings.TrimPrefix(keyBase, "accounts/"))
+	}
+	config := &frost.TaprootConfig{}
+	if err := cbor.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal frost config: %v", err)
+	}
+	return mpcfrost.DeriveTaproot(config, path)
+}
+
+type AccountDeriveRequest struct {
+	Network string `json:"network"`
+	// Index is where the derived account goes; Master is the account it
+	// derives from, along Path.
+	Index  int    `json:"index"`
+	Master int    `json:"master"`
+	Path   string `json:"path"`
+}
+
+// deriveAccount adds an account whose key is a BIP-32 child of another
+// account's key. Every key holder derives it locally, with no round.
+//
+// @Summary      Derive account
+// @Description  Add an account at index whose key is the non-hardened BIP-32 child at path (e.g. m/0/5) of the key of account master. Needs no other party: every key holder derives the same address locally. The account keeps no key share of its own, so refreshing or resharing the master covers it; ECDSA accounts need /v1/presign/ecdsa before they sign.
+// @Tags         accounts
+// @Accept       json
+// @Produce      json
+// @Param        body  body      AccountDeriveRequest  true  "Master account and path"
+// @Success      200   {object}  AccountMeta
+// @Failure      400   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /v1/accounts/derive [post]
+func (c *Client) deriveAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req AccountDeriveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if err := validateNetwork(req.Network); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateIndex(req.Index); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateIndex(req.Master); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("master: %w", err))
+			return
+		}
+		if req.Index == req.Master {
+			respondError(w, http.StatusBadRequest, errors.New("index and master must differ"))
+			return
+		}
+		path, canonical, err := parseDerivationPath(req.Path)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		name := fmt.Sprintf("%s/%d", req.Network, req.Index)
+		unlock, err := storage.Lock(r.Context(), c.stor, "accounts/"+name)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		defer unlock()
+
+		if data, err := c.stor.Get(r.Context(), "accounts/"+name+"/meta"); err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		} else if data != nil {
+			respondError(w, http.StatusConflict, fmt.Errorf("an account already exists at %s", name))
+			return
+		}
+		master, err := c.loadAccountMeta(r.Context(), fmt.Sprintf("%s/%d", req.Network, req.Master))
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if master == nil {
+			respondError(w, http.StatusNotFound, fmt.Errorf("master account not found"))
+			return
+		}
+		if master.Path != "" {
+			respondError(w, http.StatusBadRequest,
+				fmt.Errorf("%s/%d is derived itself: derive from account %d with a longer path", req.Network, req.Master, master.Master))
+			return
+		}
+		derived, err := c.derivedAccounts(r.Context(), req.Network, req.Master)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		for _, d := range derived {
+			if d.Path == canonical {
+				respondError(w, http.StatusConflict, fmt.Errorf("%s is already derived at %s/%d", canonical, d.Network, d.Index))
+				return
+			}
+		}
+
+		masterBase := fmt.Sprintf("accounts/%s/%d", req.Network, req.Master)
+		var address, pubHex string
+		switch req.Network {
+		case "eth":
+			config, err := c.loadECDSAConfig(r.Context(), masterBase)
+			if err != nil {
+				respondError(w, http.StatusNotFound, err)
+				return
+			}
+			child, err := mpccmp.Derive(config, path)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("cannot derive %s: %w", canonical, err))
+				return
+			}
+			if address, err = mpccmp.GetAddress(child); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get address: %w", err))
+				return
+			}
+			pub, err := mpccmp.GetPublicKeyByte(child)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get public key: %w", err))
+				return
+			}
+			pubHex = hex.EncodeToString(pub)
+		case "btc":
+			config, err := c.loadFROSTConfig(r.Context(), masterBase)
+			if err != nil {
+				respondError(w, http.StatusNotFound, err)
+				return
+			}
+			child, err := mpcfrost.DeriveTaproot(config, path)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("cannot derive %s: %w", canonical, err))
+				return
+			}
+			addr, err := mpcfrost.GetAddress(child)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get address: %w", err))
+				return
+			}
+			address = addr.String()
+			pub, _ := mpcfrost.GetPublicKeyByte(child)
+			pubHex = hex.EncodeToString(pub)
+		}
+
+		meta := AccountMeta{
+			Network:   req.Network,
+			Index:     req.Index,
+			Address:   address,
+			PublicKey: pubHex,
+			PairMyID:  master.PairMyID,
+			PairOther: master.PairOther,
+			SessionID: master.SessionID,
+			Parties:   master.Parties,
+			Threshold: master.Threshold,
+			Master:    req.Master,
+			Path:      canonical,
+		}
+		metaB, err := cbor.Marshal(meta)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal metadata: %w", err))
+			return
+		}
+		if err := c.stor.Put(context.Background(), "accounts/"+name+"/meta", metaB); err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+
+		c.logger.Info("Account derived", "account", name, "master", req.Master, "path", canonical, "address", address)
+		respondOk(w, meta)
+	}
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+)
+
+func TestParseDerivationPath(t *testing.T) {
+	path, canonical, err := parseDerivationPath("m/0/05/2147483647")
+	if err != nil || !slices.Equal(path, []uint32{0, 5, 1<<31 - 1}) || canonical != "m/0/5/2147483647" {
+		t.Fatalf("parse: %v %q %v", path, canonical, err)
+	}
+	for _, bad := range []string{"", "m", "0/1", "m/", "m/1'", "m/1h", "m/2147483648", "m/-1", "m/+1", "m/1//2"} {
+		if _, _, err := parseDerivationPath(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestDeriveAccount(t *testing.T) {
+	c, ts := mkLocalClient(t)
+	master := storeFrostAccount(t, c, 1)
+	ctx := context.Background()
+
+	var meta AccountMeta
+	req := AccountDeriveRequest{Network: "btc", Index: 2, Master: 1, Path: "m/0/1"}
+	if code := postBackup(t, ts, "/v1/accounts/derive", req, &meta); code != http.StatusOK {
+		t.Fatalf("derive: %d", code)
+	}
+	if meta.Path != "m/0/1" || meta.Master != 1 || meta.PublicKey == hex.EncodeToString(master.PublicKey) {
+		t.Fatalf("derived account: %+v", meta)
+	}
+	if v, _ := c.stor.Get(ctx, "accounts/btc/2/conf-frost"); v != nil {
+		t.Fatal("a derived account stored a key share")
+	}
+
+	// Signing derives the share again, for the same key.
+	child, err := c.loadFROSTConfig(ctx, "accounts/btc/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(child.PublicKey) != meta.PublicKey || mpcfrost.CheckShare(child) != nil {
+		t.Fatal("loaded share does not match the derived account")
+	}
+
+	for _, bad := range []struct {
+		req  AccountDeriveRequest
+		code int
+	}{
+		{AccountDeriveRequest{Network: "btc", Index: 3, Master: 1, Path: "m/0/01"}, http.StatusConflict},
+		{AccountDeriveRequest{Network: "btc", Index: 2, Master: 1, Path: "m/0/2"}, http.StatusConflict},
+		{AccountDeriveRequest{Network: "btc", Index: 3, Master: 2, Path: "m/0"}, http.StatusBadRequest},
+		{AccountDeriveRequest{Network: "btc", Index: 3, Master: 9, Path: "m/0"}, http.StatusNotFound},
+		{AccountDeriveRequest{Network: "btc", Index: 3, Master: 1, Path: "m/0'"}, http.StatusBadRequest},
+	} {
+		if code := postBackup(t, ts, "/v1/accounts/derive", bad.req, nil); code != bad.code {
+			t.Errorf("%+v: %d, want %d", bad.req, code, bad.code)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/v1/accounts/list?network=btc&master=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list AccountsListResponse
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Accounts) != 1 || list.Accounts[0].Index != 2 {
+		t.Fatalf("derived accounts: %+v", list.Accounts)
+	}
+
+	del := AccountDeleteRequest{Network: "btc", Index: 1}
+	if code := postBackup(t, ts, "/v1/accounts/delete", del, nil); code != http.StatusConflict {
+		t.Fatalf("deleting a master with derived accounts: %d", code)
+	}
+	del.Index = 2
+	if code := postBackup(t, ts, "/v1/accounts/delete", del, nil); code != http.StatusOK {
+		t.Fatalf("delete derived: %d", code)
+	}
+	del.Index = 1
+	if code := postBackup(t, ts, "/v1/accounts/delete", del, nil); code != http.StatusOK {
+		t.Fatalf("delete master: %d", code)
+	}
+	if v, _ := c.stor.Get(ctx, "accounts/btc/1/conf-frost"); v != nil {
+		t.Fatal("master share kept")
+	}
+}
@@ -8,12 +8,23 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
 )
 
-const exchangesKey = "exchanges/all"
+// Each exchange is stored under exchangesPrefix by id. Before schema
+// version 1 they were one CBOR list at exchangesKey; backups still carry
+// them that way.
+const (
+	exchangesPrefix = "exchanges/by-id/"
+	exchangesKey    = "exchanges/all"
+)
+
+var exchangeIDRe = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
 
 type Exchange struct {
 	ID string `json:"id"`
@@ -66,27 +77,59 @@ type ExchangeDeleteRequest struct {
 	ID string `json:"id"`
 }
 
+// loadExchanges returns every stored exchange, newest first.
 func (c *Client) loadExchanges() ([]Exchange, error) {
-	data, err := c.stor.Get(context.Background(), exchangesKey)
+	ctx := context.Background()
+	ids, err := c.stor.List(ctx, exchangesPrefix)
 	if err != nil {
 		return nil, err
 	}
-	if data == nil {
-		return []Exchange{}, nil
+	list := make([]Exchange, 0, len(ids))
+	for _, id := range ids {
+		if strings.HasSuffix(id, "/") {
+			continue
+		}
+		ex, err := c.loadExchange(id)
+		if err != nil {
+			return nil, err
+		}
+		if ex != nil {
+			list = append(list, *ex)
+		}
 	}
-	var list []Exchange
-	if err := cbor.Unmarshal(data, &list); err != nil {
+	sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt > list[j].CreatedAt })
+	return list, nil
+}
+
+// loadExchange returns the exchange with id, or nil if there is none.
+func (c *Client) loadExchange(id string) (*Exchange, error) {
+	data, err := c.stor.Get(context.Background(), exchangesPrefix+id)
+	if err != nil || data == nil {
 		return nil, err
 	}
-	return list, nil
+	var ex Exchange
+	if err := cbor.Unmarshal(data, &ex); err != nil {
+		return nil, err
+	}
+	return &ex, nil
 }
 
-func (c *Client) saveExchanges(list []Exchange) error {
-	data, err := cbor.Marshal(list)
+func (c *Client) saveExchange(ex Exchange) error {
+	data, err := cbor.Marshal(ex)
 	if err != nil {
 		return err
 	}
-	return c.stor.Put(context.Background(), exchangesKey, data)
+	return c.stor.Put(context.Background(), exchangesPrefix+ex.ID, data)
+}
+
+func validateExchangeID(id string) error {
+	if id == "" {
+		return errors.New("id is required")
+	}
+	if !exchangeIDRe.MatchString(id) {
+		return errors.New("invalid exchange id")
+	}
+	return nil
 }
 
 func randID() string {
@@ -131,21 +174,13 @@ func (c *Client) createExchange() http.HandlerFunc {
 		var req ExchangeCreateRequest
 		_ = json.NewDecoder(r.Body).Decode(&req)
 
-		list, err := c.loadExchanges()
-		if err != nil {
-			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
-			return
-		}
-
 		ex := Exchange{
 			ID:        randID(),
 			AddressA:  req.AddressA,
 			AddressB:  req.AddressB,
 			CreatedAt: time.Now().UnixMilli(),
 		}
-		list = append([]Exchange{ex}, list...)
-
-		if err := c.saveExchanges(list); err != nil {
+		if err := c.saveExchange(ex); err != nil {
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to save exchange"))
 			return
 		}
@@ -173,47 +208,40 @@ func (c *Client) updateExchange() http.HandlerFunc {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
 			return
 		}
-		if req.ID == "" {
-			respondError(w, http.StatusBadRequest, errors.New("id is required"))
+		if err := validateExchangeID(req.ID); err != nil {
+			respondError(w, http.StatusBadRequest, err)
 			return
 		}
 
-		list, err := c.loadExchanges()
+		updated, err := c.loadExchange(req.ID)
 		if err != nil {
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
 			return
 		}
-
-		var updated *Exchange
-		for i := range list {
-			if list[i].ID == req.ID {
-				list[i].AddressA = req.AddressA
-				list[i].AddressB = req.AddressB
-				if req.PartnerA != "" {
-					list[i].PartnerA = req.PartnerA
-				}
-				if req.StatusA != "" {
-					list[i].StatusA = req.StatusA
-				}
-				if req.PartnerB != "" {
-					list[i].PartnerB = req.PartnerB
-				}
-				if req.StatusB != "" {
-					list[i].StatusB = req.StatusB
-				}
-				if req.Creator != "" {
-					list[i].Creator = req.Creator
-				}
-				updated = &list[i]
-				break
-			}
-		}
 		if updated == nil {
 			respondError(w, http.StatusNotFound, errors.New("exchange not found"))
 			return
 		}
 
-		if err := c.saveExchanges(list); err != nil {
+		updated.AddressA = req.AddressA
+		updated.AddressB = req.AddressB
+		if req.PartnerA != "" {
+			updated.PartnerA = req.PartnerA
+		}
+		if req.StatusA != "" {
+			updated.StatusA = req.StatusA
+		}
+		if req.PartnerB != "" {
+			updated.PartnerB = req.PartnerB
+		}
+		if req.StatusB != "" {
+			updated.StatusB = req.StatusB
+		}
+		if req.Creator != "" {
+			updated.Creator = req.Creator
+		}
+
+		if err := c.saveExchange(*updated); err != nil {
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to save exchange"))
 			return
 		}
@@ -238,48 +266,28 @@ func (c *Client) upsertExchange() http.HandlerFunc {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
 			return
 		}
-		if req.ID == "" {
-			respondError(w, http.StatusBadRequest, errors.New("id is required"))
+		if err := validateExchangeID(req.ID); err != nil {
+			respondError(w, http.StatusBadRequest, err)
 			return
 		}
 
-		list, err := c.loadExchanges()
+		found, err := c.loadExchange(req.ID)
 		if err != nil {
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
 			return
 		}
-
-		var found *Exchange
-		for i := range list {
-			if list[i].ID == req.ID {
-				list[i].AddressA = req.AddressA
-				list[i].PartnerA = req.PartnerA
-				list[i].StatusA = req.StatusA
-				list[i].AddressB = req.AddressB
-				list[i].PartnerB = req.PartnerB
-				list[i].StatusB = req.StatusB
-				list[i].Creator = req.Creator
-				found = &list[i]
-				break
-			}
-		}
 		if found == nil {
-			ex := Exchange{
-				ID:        req.ID,
-				AddressA:  req.AddressA,
-				PartnerA:  req.PartnerA,
-				StatusA:   req.StatusA,
-				AddressB:  req.AddressB,
-				PartnerB:  req.PartnerB,
-				StatusB:   req.StatusB,
-				Creator:   req.Creator,
-				CreatedAt: time.Now().UnixMilli(),
-			}
-			list = append([]Exchange{ex}, list...)
-			found = &list[0]
+			found = &Exchange{ID: req.ID, CreatedAt: time.Now().UnixMilli()}
 		}
-
-		if err := c.saveExchanges(list); err != nil {
+		found.AddressA = req.AddressA
+		found.PartnerA = req.PartnerA
+		found.StatusA = req.StatusA
+		found.AddressB = req.AddressB
+		found.PartnerB = req.PartnerB
+		found.StatusB = req.StatusB
+		found.Creator = req.Creator
+
+		if err := c.saveExchange(*found); err != nil {
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to save exchange"))
 			return
 		}
@@ -306,24 +314,12 @@ func (c *Client) deleteExchange() http.HandlerFunc {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
 			return
 		}
-		if req.ID == "" {
-			respondError(w, http.StatusBadRequest, errors.New("id is required"))
-			return
-		}
-
-		list, err := c.loadExchanges()
-		if err != nil {
-			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+		if err := validateExchangeID(req.ID); err != nil {
+			respondError(w, http.StatusBadRequest, err)
 			return
 		}
 
-		out := make([]Exchange, 0, len(list))
-		for _, e := range list {
-			if e.ID != req.ID {
-				out = append(out, e)
-			}
-		}
-		if err := c.saveExchanges(out); err != nil {
+		if err := c.stor.Delete(r.Context(), exchangesPrefix+req.ID); err != nil {
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to delete exchange"))
 			return
 		}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+func TestExchangeStorageErrors(t *testing.T) {
+	stor := storage.NewFaultyStorage(storage.NewMemoryStorage())
+	_, ts := mkLocalClientWith(t, stor)
+
+	var ex Exchange
+	if code := postBackup(t, ts, "/v1/exchanges/create", ExchangeCreateRequest{}, &ex); code != http.StatusOK {
+		t.Fatalf("create: %d", code)
+	}
+
+	remove := stor.Inject(storage.Fault{Prefix: exchangesPrefix, Ops: storage.FaultWrite, Fail: true})
+	if code := postBackup(t, ts, "/v1/exchanges/create", ExchangeCreateRequest{}, nil); code != http.StatusInternalServerError {
+		t.Fatalf("create with failing storage: %d", code)
+	}
+	if code := postBackup(t, ts, "/v1/exchanges/update", ExchangeUpdateRequest{ID: ex.ID}, nil); code != http.StatusInternalServerError {
+		t.Fatalf("update with failing storage: %d", code)
+	}
+	if code := postBackup(t, ts, "/v1/exchanges/delete", ExchangeDeleteRequest{ID: ex.ID}, nil); code != http.StatusInternalServerError {
+		t.Fatalf("delete with failing storage: %d", code)
+	}
+	remove()
+
+	stor.Inject(storage.Fault{Prefix: exchangesPrefix, Ops: storage.FaultGet, Fail: true})
+	resp, err := http.Get(ts.URL + "/v1/exchanges/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("list with failing storage: %d", resp.StatusCode)
+	}
+	if code := postBackup(t, ts, "/v1/exchanges/update", ExchangeUpdateRequest{ID: ex.ID}, nil); code != http.StatusInternalServerError {
+		t.Fatalf("update with failing read: %d", code)
+	}
+}
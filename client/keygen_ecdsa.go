@@ -8,6 +8,7 @@ import (
 	"net/http"
 
 	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/ecdsa"
 	"github.com/taurusgroup/multi-party-sig/pkg/party"
 	"github.com/taurusgroup/multi-party-sig/pkg/pool"
 	"github.com/valli0x/signature-escrow/mpc/mpccmp"
@@ -20,27 +21,38 @@ type KeygenECDSARequest struct {
 	Another   string `json:"another_id"`
 	Network   string `json:"network"`
 	Index     int    `json:"index"`
+	// Parties lists the other key holders of a threshold account, for more
+	// than two; it may include my_id. Threshold is how many of all of them
+	// sign together, by default all.
+	Parties   []string `json:"parties,omitempty"`
+	Threshold int      `json:"threshold,omitempty"`
 }
 
 type KeygenECDSAResponse struct {
-	PublicKey string `json:"public_key"`
-	Address   string `json:"address"`
-	SessionID string `json:"session_id"`
-	Network   string `json:"network"`
-	Index     int    `json:"index"`
+	PublicKey string   `json:"public_key"`
+	Address   string   `json:"address"`
+	SessionID string   `json:"session_id"`
+	Network   string   `json:"network"`
+	Index     int      `json:"index"`
+	Parties   []string `json:"parties"`
+	Threshold int      `json:"threshold"`
 }
 
-// keygenECDSA runs the local half of an ECDSA (CMP) 2-of-2 keygen + presign.
+// keygenECDSA runs the local part of an ECDSA (CMP) t-of-n keygen, plus the
+// presign when every party signs.
 //
 // @Summary      ECDSA keygen
-// @Description  Run the local half of an ECDSA (CMP) 2-of-2 distributed key generation and presignature. Saves key material locally and returns the resulting address and public key.
+// @Description  Run the local part of an ECDSA (CMP) distributed key generation: 2-of-2 with another_id, or t-of-n with parties and threshold. When all parties sign it also runs the presignature; otherwise each set of signers runs /v1/presign/ecdsa. Saves key material locally and returns the resulting address and public key.
 // @Tags         keygen
 // @Accept       json
 // @Produce      json
 // @Param        body  body      KeygenECDSARequest  true  "Keygen parameters"
 // @Success      200   {object}  KeygenECDSAResponse
 // @Failure      400   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
 // @Failure      500   {object}  ErrorResponse
+// @Failure      502   {object}  ErrorResponse
+// @Failure      504   {object}  ErrorResponse
 // @Router       /v1/keygen/ecdsa [post]
 func (c *Client) keygenECDSA() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -50,8 +62,8 @@ func (c *Client) keygenECDSA() http.HandlerFunc {
 			return
 		}
 
-		if req.SessionID == "" || req.MyID == "" || req.Another == "" {
-			respondError(w, http.StatusBadRequest, errors.New("session_id, my_id, and another_id are required"))
+		if req.SessionID == "" || req.MyID == "" || (req.Another == "" && len(req.Parties) == 0) {
+			respondError(w, http.StatusBadRequest, errors.New("session_id, my_id, and another_id or parties are required"))
 			return
 		}
 
@@ -63,9 +75,11 @@ func (c *Client) keygenECDSA() http.HandlerFunc {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("my_id: %w", err))
 			return
 		}
-		if err := validateETHAddress(req.Another); err != nil {
-			respondError(w, http.StatusBadRequest, fmt.Errorf("another_id: %w", err))
-			return
+		if req.Another != "" {
+			if err := validateETHAddress(req.Another); err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("another_id: %w", err))
+				return
+			}
 		}
 
 		if req.Network == "" {
@@ -85,13 +99,15 @@ func (c *Client) keygenECDSA() http.HandlerFunc {
 		}
 
 		myid := normalizePartyID(req.MyID)
-		another := normalizePartyID(req.Another)
-		signers := party.NewIDSlice([]party.ID{party.ID(myid), party.ID(another)})
-
-		acceptCh := req.SessionID + "/" + myid
-		sendCh := req.SessionID + "/" + another
+		parties, threshold, err := keygenParties(myid, req.Another, req.Parties, req.Threshold)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		another := pairOther(myid, req.Another, parties)
 
-		net, err := network.NewClient(c.env.Communication, acceptCh, sendCh, c.logger.With("component", "network"), c.Conn)
+		net, err := c.dial(party.ID(myid), parties,
+			func(id party.ID) string { return req.SessionID + "/" + string(id) })
 		if err != nil {
 			c.logger.Error("Failed to setup network", "error", err)
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
@@ -101,27 +117,47 @@ func (c *Client) keygenECDSA() http.HandlerFunc {
 		pl := pool.NewPool(0)
 		defer pl.TearDown()
 
-		c.logger.Info("Starting ECDSA keygen", "session", req.SessionID, "myid", myid, "network", req.Network, "index", req.Index)
-
-		configETH, err := mpccmp.CMPKeygen(party.ID(myid), signers, 1, net, pl)
-		if err != nil {
-			c.logger.Error("ECDSA keygen failed", "error", err)
-			respondError(w, http.StatusInternalServerError, fmt.Errorf("ECDSA keygen failed: %w", err))
-			return
-		}
+		ctx, done := c.startRun(req.SessionID)
+		defer done()
 
-		net2, err := network.NewClient(c.env.Communication, acceptCh+"/presign", sendCh+"/presign", c.logger.With("component", "network"), c.Conn)
-		if err != nil {
-			c.logger.Error("Failed to setup network for presign", "error", err)
-			respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
-			return
-		}
+		c.logger.Info("Starting ECDSA keygen", "session", req.SessionID, "myid", myid, "network", req.Network, "index", req.Index,
+			"parties", len(parties), "threshold", threshold)
 
-		presignature, err := mpccmp.CMPPreSign(configETH, signers, net2, pl)
+		rec, save := c.recordRun(net, network.Transcript{
+			Protocol: "ecdsa-keygen", Session: req.SessionID, Party: party.ID(myid),
+			Account: fmt.Sprintf("%s/%d", req.Network, req.Index), Parties: parties, Threshold: threshold - 1,
+		})
+		configETH, err := mpccmp.CMPKeygenContext(ctx, party.ID(myid), parties, threshold-1, rec, pl)
+		save(err)
 		if err != nil {
-			c.logger.Error("ECDSA presign failed", "error", err)
-			respondError(w, http.StatusInternalServerError, fmt.Errorf("ECDSA presign failed: %w", err))
-			return
+			f := c.protocolFailure(myid, parties, "ecdsa-keygen", req.SessionID, err)
+			respondFailure(w, f, fmt.Errorf("ECDSA keygen failed: %w", err))
+			return
+		}
+
+		// Without a threshold there is one set of signers, so presign now;
+		// otherwise the signers presign once they are chosen.
+		var presignature *ecdsa.PreSignature
+		if threshold == len(parties) {
+			net2, err := c.dial(party.ID(myid), parties,
+				func(id party.ID) string { return req.SessionID + "/" + string(id) + "/presign" })
+			if err != nil {
+				c.logger.Error("Failed to setup network for presign", "error", err)
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
+				return
+			}
+
+			rec, save := c.recordRun(net2, network.Transcript{
+				Protocol: "ecdsa-presign", Session: req.SessionID, Party: party.ID(myid),
+				Account: fmt.Sprintf("%s/%d", req.Network, req.Index), Parties: parties,
+			})
+			presignature, err = mpccmp.CMPPreSignContext(ctx, configETH, parties, rec, pl)
+			save(err)
+			if err != nil {
+				f := c.protocolFailure(myid, parties, "ecdsa-presign", req.SessionID, err)
+				respondFailure(w, f, fmt.Errorf("ECDSA presign failed: %w", err))
+				return
+			}
 		}
 
 		address, err := mpccmp.GetAddress(configETH)
@@ -147,23 +183,24 @@ func (c *Client) keygenECDSA() http.HandlerFunc {
 			return
 		}
 
-		preSignB, err := cbor.Marshal(presignature)
-		if err != nil {
-			c.logger.Error("Failed to marshal presignature", "error", err)
-			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal presign: %w", err))
-			return
-		}
-
 		if err := c.stor.Put(context.Background(), storageBase+"/conf-ecdsa", kb); err != nil {
 			c.logger.Error("Failed to save ECDSA config", "error", err)
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to save config: %w", err))
 			return
 		}
 
-		if err := c.stor.Put(context.Background(), storageBase+"/presig-ecdsa", preSignB); err != nil {
-			c.logger.Error("Failed to save presignature", "error", err)
-			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to save presign: %w", err))
-			return
+		if presignature != nil {
+			op, err := presigOp(storageBase, "presig-ecdsa", presignature)
+			if err != nil {
+				c.logger.Error("Failed to marshal presignature", "error", err)
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := c.stor.Put(context.Background(), op.Key, op.Value); err != nil {
+				c.logger.Error("Failed to save presignature", "error", err)
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to save presign: %w", err))
+				return
+			}
 		}
 
 		meta := AccountMeta{
@@ -174,12 +211,19 @@ func (c *Client) keygenECDSA() http.HandlerFunc {
 			PairMyID:  myid,
 			PairOther: another,
 			SessionID: req.SessionID,
+			Parties:   idStrings(parties),
+			Threshold: threshold,
 		}
 		metaB, _ := cbor.Marshal(meta)
 		if err := c.stor.Put(context.Background(), storageBase+"/meta", metaB); err != nil {
 			c.logger.Error("Failed to save metadata", "error", err)
 		}
 
+		if presignature != nil {
+			c.fillPresigPool(fmt.Sprintf("%s/%d", req.Network, req.Index), myid, parties, configETH,
+				func(id party.ID) string { return req.SessionID + "/" + string(id) })
+		}
+
 		c.logger.Info("ECDSA keygen completed", "address", address, "network", req.Network, "index", req.Index)
 
 		respondOk(w, KeygenECDSAResponse{
@@ -188,6 +232,8 @@ func (c *Client) keygenECDSA() http.HandlerFunc {
 			SessionID: req.SessionID,
 			Network:   req.Network,
 			Index:     req.Index,
+			Parties:   idStrings(parties),
+			Threshold: threshold,
 		})
 	}
 }
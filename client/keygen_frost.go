@@ -18,26 +18,34 @@ type KeygenFROSTRequest struct {
 	MyID      string `json:"my_id"`
 	Another   string `json:"another_id"`
 	Index     int    `json:"index"`
+	// Parties and Threshold are as in KeygenECDSARequest.
+	Parties   []string `json:"parties,omitempty"`
+	Threshold int      `json:"threshold,omitempty"`
 }
 
 type KeygenFROSTResponse struct {
-	PublicKey string `json:"public_key"`
-	Address   string `json:"address"`
-	SessionID string `json:"session_id"`
-	Index     int    `json:"index"`
+	PublicKey string   `json:"public_key"`
+	Address   string   `json:"address"`
+	SessionID string   `json:"session_id"`
+	Index     int      `json:"index"`
+	Parties   []string `json:"parties"`
+	Threshold int      `json:"threshold"`
 }
 
-// keygenFROST runs the local half of a FROST (Taproot) 2-of-2 keygen.
+// keygenFROST runs the local part of a FROST (Taproot) t-of-n keygen.
 //
 // @Summary      FROST keygen
-// @Description  Run the local half of a FROST Taproot 2-of-2 distributed key generation. Saves key material locally and returns the resulting Bitcoin address and public key.
+// @Description  Run the local part of a FROST Taproot distributed key generation: 2-of-2 with another_id, or t-of-n with parties and threshold. Saves key material locally and returns the resulting Bitcoin address and public key.
 // @Tags         keygen
 // @Accept       json
 // @Produce      json
 // @Param        body  body      KeygenFROSTRequest  true  "Keygen parameters"
 // @Success      200   {object}  KeygenFROSTResponse
 // @Failure      400   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
 // @Failure      500   {object}  ErrorResponse
+// @Failure      502   {object}  ErrorResponse
+// @Failure      504   {object}  ErrorResponse
 // @Router       /v1/keygen/frost [post]
 func (c *Client) keygenFROST() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -47,8 +55,8 @@ func (c *Client) keygenFROST() http.HandlerFunc {
 			return
 		}
 
-		if req.SessionID == "" || req.MyID == "" || req.Another == "" {
-			respondError(w, http.StatusBadRequest, errors.New("session_id, my_id, and another_id are required"))
+		if req.SessionID == "" || req.MyID == "" || (req.Another == "" && len(req.Parties) == 0) {
+			respondError(w, http.StatusBadRequest, errors.New("session_id, my_id, and another_id or parties are required"))
 			return
 		}
 
@@ -60,9 +68,11 @@ func (c *Client) keygenFROST() http.HandlerFunc {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("my_id: %w", err))
 			return
 		}
-		if err := validateETHAddress(req.Another); err != nil {
-			respondError(w, http.StatusBadRequest, fmt.Errorf("another_id: %w", err))
-			return
+		if req.Another != "" {
+			if err := validateETHAddress(req.Another); err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("another_id: %w", err))
+				return
+			}
 		}
 
 		if req.Index <= 0 {
@@ -74,25 +84,36 @@ func (c *Client) keygenFROST() http.HandlerFunc {
 		}
 
 		myid := normalizePartyID(req.MyID)
-		another := normalizePartyID(req.Another)
-		signers := party.NewIDSlice([]party.ID{party.ID(myid), party.ID(another)})
-
-		acceptCh := req.SessionID + "/" + myid
-		sendCh := req.SessionID + "/" + another
+		parties, threshold, err := keygenParties(myid, req.Another, req.Parties, req.Threshold)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		another := pairOther(myid, req.Another, parties)
 
-		net, err := network.NewClient(c.env.Communication, acceptCh, sendCh, c.logger.With("component", "network"), c.Conn)
+		net, err := c.dial(party.ID(myid), parties,
+			func(id party.ID) string { return req.SessionID + "/" + string(id) })
 		if err != nil {
 			c.logger.Error("Failed to setup network", "error", err)
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
 			return
 		}
 
-		c.logger.Info("Starting FROST keygen", "session", req.SessionID, "myid", myid, "index", req.Index)
+		ctx, done := c.startRun(req.SessionID)
+		defer done()
 
-		configBTC, err := mpcfrost.FrostKeygenTaproot(party.ID(myid), signers, 1, net)
+		c.logger.Info("Starting FROST keygen", "session", req.SessionID, "myid", myid, "index", req.Index,
+			"parties", len(parties), "threshold", threshold)
+
+		rec, save := c.recordRun(net, network.Transcript{
+			Protocol: "frost-keygen", Session: req.SessionID, Party: party.ID(myid),
+			Account: fmt.Sprintf("btc/%d", req.Index), Parties: parties, Threshold: threshold - 1,
+		})
+		configBTC, err := mpcfrost.FrostKeygenTaprootContext(ctx, party.ID(myid), parties, threshold-1, rec)
+		save(err)
 		if err != nil {
-			c.logger.Error("FROST keygen failed", "error", err)
-			respondError(w, http.StatusInternalServerError, fmt.Errorf("FROST keygen failed: %w", err))
+			f := c.protocolFailure(myid, parties, "frost-keygen", req.SessionID, err)
+			respondFailure(w, f, fmt.Errorf("FROST keygen failed: %w", err))
 			return
 		}
 
@@ -133,6 +154,8 @@ func (c *Client) keygenFROST() http.HandlerFunc {
 			PairMyID:  myid,
 			PairOther: another,
 			SessionID: req.SessionID,
+			Parties:   idStrings(parties),
+			Threshold: threshold,
 		}
 		metaB, _ := cbor.Marshal(meta)
 		c.stor.Put(context.Background(), storageBase+"/meta", metaB)
@@ -144,6 +167,8 @@ func (c *Client) keygenFROST() http.HandlerFunc {
 			Address:   address.String(),
 			SessionID: req.SessionID,
 			Index:     req.Index,
+			Parties:   idStrings(parties),
+			Threshold: threshold,
 		})
 	}
 }
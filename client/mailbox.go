@@ -0,0 +1,128 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
+)
+
+// mpcFailureType is the mailbox message that tells the other parties why
+// an MPC run failed; its body is an mpcblame.Failure.
+const mpcFailureType = "mpc-failure"
+
+// escrowTimeout bounds a request to the escrow server.
+const escrowTimeout = 10 * time.Second
+
+var hexIDRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+type mailboxSendRequest struct {
+	To     string          `json:"to"`
+	PairID string          `json:"pair_id"`
+	Type   string          `json:"type"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// escrowEnabled reports whether the client reaches the escrow server: it
+// needs ESCROW_API_KEY, an API key of this party's address.
+func (c *Client) escrowEnabled() bool {
+	return c.env != nil && c.env.EscrowServer != "" && c.env.EscrowAPIKey != ""
+}
+
+// escrowURL returns the URL of path on the escrow server.
+func (c *Client) escrowURL(path string) string {
+	base := strings.TrimSuffix(c.env.EscrowServer, "/")
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	return base + path
+}
+
+// escrowDo sends a request with body to path on the escrow server and
+// decodes the answer into out, if not nil.
+func (c *Client) escrowDo(ctx context.Context, method, path string, body, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, escrowTimeout)
+	defer cancel()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.escrowURL(path), &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.env.EscrowAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e ErrorResponse
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("escrow server %s: %d %s", path, resp.StatusCode, strings.Join(e.Errors, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// partyIdentity returns the server identity of party id: an ETH address
+// for a bare hex ID, the ID itself otherwise.
+func partyIdentity(id string) string {
+	if hexIDRe.MatchString(id) {
+		return "0x" + id
+	}
+	return id
+}
+
+// pairOf returns the ID of the pair of a and b, as the server names it.
+func pairOf(a, b string) string {
+	a = strings.ToLower(strings.TrimPrefix(a, "0x"))
+	b = strings.ToLower(strings.TrimPrefix(b, "0x"))
+	if a < b {
+		return a + "_" + b
+	}
+	return b + "_" + a
+}
+
+// notifyFailure sends f to every other party of the run as an mpc-failure
+// mailbox message, in the background. A party it is not paired with on
+// the server is skipped with a warning.
+func (c *Client) notifyFailure(self string, parties party.IDSlice, f *mpcblame.Failure) {
+	if !c.escrowEnabled() || f == nil {
+		return
+	}
+	body, err := json.Marshal(f)
+	if err != nil {
+		return
+	}
+	for _, id := range parties {
+		other := string(id)
+		if other == self {
+			continue
+		}
+		go func() {
+			msg := &mailboxSendRequest{
+				To:     partyIdentity(other),
+				PairID: pairOf(self, other),
+				Type:   mpcFailureType,
+				Body:   body,
+			}
+			if err := c.escrowDo(c.background(), http.MethodPost, "/v1/mailbox/send", msg, nil); err != nil {
+				c.logger.Warn("Failed to tell a party of the failure", "party", other, "session", f.Session, "error", err)
+			}
+		}()
+	}
+}
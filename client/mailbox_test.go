@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/valli0x/signature-escrow/auth"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
+	"github.com/valli0x/signature-escrow/server"
+	"github.com/valli0x/signature-escrow/server/servertest"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// newEscrowServer starts an escrow server.
+func newEscrowServer(t *testing.T) *httptest.Server {
+	srv := server.NewServer(&server.ServerConfig{
+		Addr:      ":0",
+		Stor:      storage.NewMemoryStorage(),
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		JWTSecret: []byte("test-secret"),
+		SIWE:      auth.SIWEConfig{Domain: "escrow.example"},
+		State:     server.StateMemory,
+	})
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// escrowAPIKey creates an API key with the mailbox scope as token.
+func escrowAPIKey(t *testing.T, url, token string) string {
+	t.Helper()
+	_, res, err := servertest.PostJSON(url+"/v1/apikeys/create",
+		map[string]any{"name": "client", "scopes": []string{"mailbox"}}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := res["key"].(string)
+	if key == "" {
+		t.Fatal("no api key")
+	}
+	return key
+}
+
+func TestFailureToMailbox(t *testing.T) {
+	ts := newEscrowServer(t)
+	tokA, addrA := servertest.Login(t, ts.URL)
+	tokB, addrB := servertest.Login(t, ts.URL)
+	pairID := servertest.Pair(t, ts.URL, tokA, tokB, addrB)
+
+	c, _ := mkLocalClient(t)
+	c.env.EscrowServer, c.env.EscrowAPIKey = ts.URL, escrowAPIKey(t, ts.URL, tokA)
+	a, b := normalizePartyID(addrA), normalizePartyID(addrB)
+	if pairOf(a, b) != pairID {
+		t.Fatalf("pair %s, server named it %s", pairOf(a, b), pairID)
+	}
+
+	// b sent a bad message: a's failure lands in b's inbox.
+	err := protocol.Error{Culprits: []party.ID{party.ID(b)}, Err: errors.New("round 2: invalid proof")}
+	sent := c.protocolFailure(a, party.NewIDSlice([]party.ID{party.ID(a), party.ID(b)}), "ecdsa-keygen", "s1", err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, res, err := servertest.GetJSON(ts.URL+"/v1/mailbox/pending", tokB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgs, _ := res["messages"].([]interface{}); len(msgs) > 0 {
+			msg := msgs[0].(map[string]interface{})
+			var f mpcblame.Failure
+			body, _ := json.Marshal(msg["body"])
+			if err := json.Unmarshal(body, &f); err != nil {
+				t.Fatal(err)
+			}
+			if msg["type"] != mpcFailureType || msg["from"] != "0x"+a || f.Kind != mpcblame.KindInvalidMessage ||
+				f.Party != a || !slices.Equal(f.Culprits, sent.Culprits) || f.Session != "s1" {
+				t.Fatalf("message %v from %v: %+v", msg["type"], msg["from"], f)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the failure never reached the other party")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,285 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// A refresh or a resharing replaces key shares on every party, and no
+// write spans the parties. So each party first stages its change: it
+// stores its new files and keeps the ones they replace or drop under their
+// retired names, key+".prev", along with a pending record of the change.
+// Once every party acknowledged its new share is stored, each commits and
+// the retired files go. Until then the change can be rolled back to them.
+const (
+	retiredSuffix = ".prev"
+	pendingFile   = "pending"
+)
+
+// pendingChange is a staged refresh or resharing of an account.
+type pendingChange struct {
+	Kind      string `json:"kind"`
+	SessionID string `json:"session_id"`
+	At        int64  `json:"at"`
+	// Retired are the keys whose old values are kept at key+".prev",
+	// Written the keys the change wrote.
+	Retired []string `json:"retired"`
+	Written []string `json:"written"`
+}
+
+// errPending is returned for a change to an account that has one staged.
+var errPending = errors.New("a refresh or resharing of this account is not committed: commit or roll it back first")
+
+// loadPending returns the staged change of the account at base, or nil.
+func (c *Client) loadPending(ctx context.Context, base string) (*pendingChange, error) {
+	data, err := c.stor.Get(ctx, base+"/"+pendingFile)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var p pendingChange
+	if err := cbor.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// stageOps returns the ops that stage a change of the account at base:
+// writes, the deletes of drop and the record of the change. The current
+// values of the keys written or dropped are kept retired.
+func (c *Client) stageOps(ctx context.Context, base, kind, session string, writes []storage.Op, drop []string) ([]storage.Op, error) {
+	p := &pendingChange{Kind: kind, SessionID: session, At: time.Now().Unix()}
+	var ops []storage.Op
+	retire := func(key string) error {
+		if slices.Contains(p.Retired, key) {
+			return nil
+		}
+		value, err := c.stor.Get(ctx, key)
+		if err != nil || value == nil {
+			return err
+		}
+		p.Retired = append(p.Retired, key)
+		ops = append(ops, storage.Op{Key: key + retiredSuffix, Value: value})
+		return nil
+	}
+	for _, op := range writes {
+		if err := retire(op.Key); err != nil {
+			return nil, err
+		}
+		p.Written = append(p.Written, op.Key)
+	}
+	for _, key := range drop {
+		if err := retire(key); err != nil {
+			return nil, err
+		}
+		ops = append(ops, storage.Op{Key: key, Delete: true})
+	}
+	ops = append(ops, writes...)
+
+	data, err := cbor.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops, storage.Op{Key: base + "/" + pendingFile, Value: data}), nil
+}
+
+// commitOps deletes the retired files of p and its record at base.
+func commitOps(base string, p *pendingChange) []storage.Op {
+	ops := make([]storage.Op, 0, len(p.Retired)+1)
+	for _, key := range p.Retired {
+		ops = append(ops, storage.Op{Key: key + retiredSuffix, Delete: true})
+	}
+	return append(ops, storage.Op{Key: base + "/" + pendingFile, Delete: true})
+}
+
+// rollbackOps puts the retired files of p back and deletes the files it
+// wrote and the presignatures made since, which are of the new shares.
+func (c *Client) rollbackOps(ctx context.Context, base string, p *pendingChange) ([]storage.Op, error) {
+	var ops []storage.Op
+	drop := func(key string) {
+		if !slices.Contains(p.Retired, key) {
+			ops = append(ops, storage.Op{Key: key, Delete: true})
+		}
+	}
+	for _, key := range p.Written {
+		drop(key)
+	}
+	if meta, err := c.loadAccountMeta(ctx, accountName(base)); err == nil && meta != nil {
+		presigs, err := c.dropPresigOps(ctx, meta)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range presigs {
+			drop(op.Key)
+		}
+	}
+	for _, key := range p.Retired {
+		value, err := c.stor.Get(ctx, key+retiredSuffix)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			return nil, fmt.Errorf("retired %s is missing", key)
+		}
+		ops = append(ops,
+			storage.Op{Key: key, Value: value},
+			storage.Op{Key: key + retiredSuffix, Delete: true})
+	}
+	return append(ops, storage.Op{Key: base + "/" + pendingFile, Delete: true}), nil
+}
+
+// commitStaged commits the staged change of the account at base, if any.
+// The caller holds the account's lock.
+func (c *Client) commitStaged(ctx context.Context, base string) error {
+	p, err := c.loadPending(ctx, base)
+	if err != nil || p == nil {
+		return err
+	}
+	return storage.Batch(ctx, c.stor, commitOps(base, p))
+}
+
+// commitPending commits the staged change of the account at base, if
+// any: a signature under the new shares verified, so every signer holds
+// them.
+func (c *Client) commitPending(ctx context.Context, base string) {
+	unlock, err := storage.Lock(ctx, c.stor, base)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if err := c.commitStaged(ctx, base); err != nil {
+		c.logger.Warn("Failed to commit the new key share", "account", accountName(base), "error", err)
+	}
+}
+
+// commitAfterSign commits the staged change behind account name after a
+// signature with it verified: its own, or its master's.
+func (c *Client) commitAfterSign(ctx context.Context, name string, meta *AccountMeta) {
+	base := "accounts/" + name
+	if meta != nil && meta.Path != "" {
+		base = fmt.Sprintf("accounts/%s/%d", meta.Network, meta.Master)
+	}
+	c.commitPending(ctx, base)
+}
+
+func accountName(base string) string {
+	return strings.TrimPrefix(base, "accounts/")
+}
+
+type PendingChangeRequest struct {
+	Network string `json:"network"`
+	Index   int    `json:"index"`
+}
+
+type PendingChangeResponse struct {
+	Network   string `json:"network"`
+	Index     int    `json:"index"`
+	Kind      string `json:"kind"`
+	SessionID string `json:"session_id"`
+	// Restored is how many files a rollback put back.
+	Restored int `json:"restored,omitempty"`
+}
+
+// commitChange makes a staged refresh or resharing final.
+//
+// @Summary      Commit a refresh or resharing
+// @Description  Delete the old key share and presignatures kept by a refresh or resharing whose acknowledgements did not all arrive. Call it once every party stored its new share; a signature under the new shares commits it as well.
+// @Tags         accounts
+// @Accept       json
+// @Produce      json
+// @Param        body  body      PendingChangeRequest  true  "Account"
+// @Success      200   {object}  PendingChangeResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /v1/accounts/commit [post]
+func (c *Client) commitChange() http.HandlerFunc {
+	return c.resolveChange(func(ctx context.Context, base string, p *pendingChange) ([]storage.Op, int, error) {
+		return commitOps(base, p), 0, nil
+	})
+}
+
+// rollbackChange undoes a staged refresh or resharing.
+//
+// @Summary      Roll back a refresh or resharing
+// @Description  Put back the key share and presignatures a refresh or resharing replaced, and delete what it wrote, for a change that some party did not store. Every party that stored it must roll back too.
+// @Tags         accounts
+// @Accept       json
+// @Produce      json
+// @Param        body  body      PendingChangeRequest  true  "Account"
+// @Success      200   {object}  PendingChangeResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /v1/accounts/rollback [post]
+func (c *Client) rollbackChange() http.HandlerFunc {
+	return c.resolveChange(func(ctx context.Context, base string, p *pendingChange) ([]storage.Op, int, error) {
+		ops, err := c.rollbackOps(ctx, base, p)
+		return ops, len(p.Retired), err
+	})
+}
+
+// resolveChange answers a commit or rollback of the staged change of an
+// account with the ops resolve returns.
+func (c *Client) resolveChange(resolve func(ctx context.Context, base string, p *pendingChange) ([]storage.Op, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req PendingChangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if err := validateNetwork(req.Network); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateIndex(req.Index); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		base := fmt.Sprintf("accounts/%s/%d", req.Network, req.Index)
+		unlock, err := storage.Lock(r.Context(), c.stor, base)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		defer unlock()
+
+		p, err := c.loadPending(r.Context(), base)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if p == nil {
+			respondError(w, http.StatusNotFound, errors.New("no refresh or resharing of this account is pending"))
+			return
+		}
+		ops, restored, err := resolve(r.Context(), base, p)
+		if err != nil {
+			c.logger.Error("Failed to resolve a pending change", "account", accountName(base), "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if err := storage.Batch(r.Context(), c.stor, ops); err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		c.logger.Info("Pending change resolved", "account", accountName(base), "kind", p.Kind,
+			"session", p.SessionID, "restored", restored)
+		respondOk(w, PendingChangeResponse{
+			Network:   req.Network,
+			Index:     req.Index,
+			Kind:      p.Kind,
+			SessionID: p.SessionID,
+			Restored:  restored,
+		})
+	}
+}
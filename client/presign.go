@@ -0,0 +1,472 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/ecdsa"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/pool"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/taurusgroup/multi-party-sig/protocols/cmp"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/network"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// An ECDSA presignature is made by one set of signers, only signs with them
+// and signs once. Each set keeps a pool of them: the pool of all parties is
+// "presig-ecdsa", the one of a smaller set "presig-ecdsa-<subsetID>", and a
+// presignature in it is "<pool>.<presigID>". Before pools, each set kept a
+// single presignature, named as its pool is now.
+const subsetPresigPrefix = "presig-ecdsa-"
+
+var presigFileRe = regexp.MustCompile(`^presig-ecdsa(-[0-9a-f]{16})?(\.[0-9a-f]{16})?$`)
+
+var presigIDRe = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// defaultPresigPoolSize is the size of a pool without PRESIG_POOL_SIZE.
+const defaultPresigPoolSize = 4
+
+// presigSyncTimeout bounds the wait for the other signers to list their
+// pool.
+const presigSyncTimeout = 30 * time.Second
+
+var errNoPresig = errors.New("no presignature left")
+
+// isPresigFile reports whether file holds ECDSA presignatures: an entry of
+// a pool, or the single presignature kept before pools.
+func isPresigFile(file string) bool {
+	return presigFileRe.MatchString(file)
+}
+
+// presigPool returns the pool of the presignatures of signers.
+func presigPool(meta *AccountMeta, signers party.IDSlice) string {
+	if meta == nil || len(signers) == len(meta.partyIDs()) {
+		return "presig-ecdsa"
+	}
+	return subsetPresigPrefix + subsetID(signers)
+}
+
+// presigID names p the same on every signer: the protocol makes p.ID from
+// a contribution of each of them.
+func presigID(p *ecdsa.PreSignature) string {
+	return hex.EncodeToString(p.ID[:8])
+}
+
+func validatePresigID(id string) error {
+	if !presigIDRe.MatchString(id) {
+		return fmt.Errorf("presig_id must be 16 hex characters")
+	}
+	return nil
+}
+
+// presigEntry returns the pool entry of a presignature stored as file,
+// which may be the single presignature kept before pools.
+func presigEntry(file string, data []byte) (string, error) {
+	if strings.Contains(file, ".") {
+		return file, nil
+	}
+	presign := mpccmp.EmptyPreSign()
+	if err := cbor.Unmarshal(data, presign); err != nil {
+		return "", err
+	}
+	return file + "." + presigID(presign), nil
+}
+
+// resolveSigners returns who signs with myid: the listed signers, or myid
+// and another when none are listed. They must be key holders of the
+// account, at least its threshold, and include myid.
+func resolveSigners(meta *AccountMeta, myid, another string, listed []string) (party.IDSlice, error) {
+	ids := []party.ID{party.ID(myid)}
+	if len(listed) == 0 {
+		if another == "" {
+			return nil, errors.New("another_id or signers is required")
+		}
+		ids = append(ids, party.ID(normalizePartyID(another)))
+	}
+	seen := map[party.ID]bool{party.ID(myid): true}
+	for _, s := range listed {
+		id := party.ID(normalizePartyID(s))
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	signers := party.NewIDSlice(ids)
+	if len(signers) < 2 {
+		return nil, errors.New("signers must include another party")
+	}
+	if meta == nil {
+		return signers, nil
+	}
+	parties := meta.partyIDs()
+	for _, id := range signers {
+		if !parties.Contains(id) {
+			return nil, fmt.Errorf("signer %s does not hold a share of this account", id)
+		}
+	}
+	if len(signers) < meta.signersNeeded() {
+		return nil, fmt.Errorf("%d signers, this account needs %d", len(signers), meta.signersNeeded())
+	}
+	return signers, nil
+}
+
+// presigPoolSize returns how many presignatures a pool is kept at.
+func (c *Client) presigPoolSize() int {
+	if c.env != nil && c.env.PresigPoolSize > 0 {
+		return c.env.PresigPoolSize
+	}
+	return defaultPresigPoolSize
+}
+
+// poolIDs lists the presignatures in pool of the account at base, sorted.
+func (c *Client) poolIDs(ctx context.Context, base, poolName string) ([]string, error) {
+	files, err := c.stor.List(ctx, base+"/")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, f := range files {
+		if id, ok := strings.CutPrefix(f, poolName+"."); ok && presigIDRe.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// takePresig removes presignature id, or with an empty id the first one,
+// from pool and returns it. A presignature must never sign twice, so it is
+// gone before it signs.
+func (c *Client) takePresig(ctx context.Context, base, poolName string, signers party.IDSlice, id string) (*ecdsa.PreSignature, string, error) {
+	unlock, err := storage.Lock(ctx, c.stor, base+"/"+poolName)
+	if err != nil {
+		return nil, "", fmt.Errorf("storage error")
+	}
+	defer unlock()
+
+	ids, err := c.poolIDs(ctx, base, poolName)
+	if err != nil {
+		return nil, "", fmt.Errorf("storage error")
+	}
+	switch {
+	case id == "" && len(ids) == 0:
+		return nil, "", fmt.Errorf("%w for signers %s: run /v1/presign/ecdsa",
+			errNoPresig, strings.Join(idStrings(signers), ","))
+	case id == "":
+		id = ids[0]
+	case !slices.Contains(ids, id):
+		return nil, "", fmt.Errorf("%w: presignature %s is not in the pool of signers %s",
+			errNoPresig, id, strings.Join(idStrings(signers), ","))
+	}
+
+	key := base + "/" + poolName + "." + id
+	data, err := c.stor.Get(ctx, key)
+	if err != nil || data == nil {
+		return nil, "", fmt.Errorf("storage error")
+	}
+	if err := c.stor.Delete(ctx, key); err != nil {
+		return nil, "", fmt.Errorf("storage error")
+	}
+	presign := mpccmp.EmptyPreSign()
+	if err := cbor.Unmarshal(data, presign); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal presign: %v", err)
+	}
+	if !slices.Equal(presign.SignerIDs(), signers) {
+		return nil, "", fmt.Errorf("presignature is not of signers %s", strings.Join(idStrings(signers), ","))
+	}
+	return presign, id, nil
+}
+
+// dropPresigOps deletes the presignatures of the account of meta and of
+// the accounts derived from it, once the shares they come from are gone.
+func (c *Client) dropPresigOps(ctx context.Context, meta *AccountMeta) ([]storage.Op, error) {
+	derived, err := c.derivedAccounts(ctx, meta.Network, meta.Index)
+	if err != nil {
+		return nil, err
+	}
+	var ops []storage.Op
+	for _, m := range append([]AccountMeta{*meta}, derived...) {
+		base := fmt.Sprintf("accounts/%s/%d", m.Network, m.Index)
+		files, err := c.stor.List(ctx, base+"/")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if isPresigFile(f) {
+				ops = append(ops, storage.Op{Key: base + "/" + f, Delete: true})
+			}
+		}
+	}
+	return ops, nil
+}
+
+// presigOp stores presign in pool of the account at base.
+func presigOp(base, poolName string, presign *ecdsa.PreSignature) (storage.Op, error) {
+	b, err := cbor.Marshal(presign)
+	if err != nil {
+		return storage.Op{}, fmt.Errorf("failed to marshal presign: %w", err)
+	}
+	return storage.Op{Key: base + "/" + poolName + "." + presigID(presign), Value: b}, nil
+}
+
+// replenishPresigs fills the pool of signers up to the pool size with every
+// other signer, who calls it at the same time on the same channel (see
+// network.NewPartyClient). The
+// signers first keep only the presignatures all of them hold, so that a
+// presignature one of them lost or used is dropped everywhere. It returns
+// the IDs in the pool.
+func (c *Client) replenishPresigs(ctx context.Context, name, myid string, signers party.IDSlice, config *cmp.Config, channel func(party.ID) string) ([]string, error) {
+	meta, err := c.loadAccountMeta(ctx, name)
+	if err != nil || meta == nil {
+		return nil, fmt.Errorf("account not found")
+	}
+	base := "accounts/" + name
+	poolName := presigPool(meta, signers)
+	newNet := func(suffix string) (network.Network, error) {
+		return c.dial(party.ID(myid), signers,
+			func(id party.ID) string { return channel(id) + "/pool/" + suffix })
+	}
+
+	// One replenishment of a pool at a time.
+	unlock, err := storage.Lock(ctx, c.stor, base+"/"+poolName+"/replenish")
+	if err != nil {
+		return nil, fmt.Errorf("storage error")
+	}
+	defer unlock()
+
+	common, err := c.syncPool(ctx, base, poolName, party.ID(myid), signers, newNet)
+	if err != nil {
+		return nil, err
+	}
+
+	pl := pool.NewPool(0)
+	defer pl.TearDown()
+	digest := configDigest(config)
+	for n := len(common); n < c.presigPoolSize(); n++ {
+		net, err := newNet(strconv.Itoa(n))
+		if err != nil {
+			return common, err
+		}
+		net, save := c.recordRun(net, network.Transcript{
+			Protocol: "ecdsa-presign", Session: channel(party.ID(myid)) + "/pool/" + strconv.Itoa(n),
+			Party: party.ID(myid), Account: name, Parties: signers, Config: digest,
+		})
+		presign, err := mpccmp.CMPPreSignContext(ctx, config, signers, net, pl)
+		save(err)
+		if err != nil {
+			return common, err
+		}
+		op, err := presigOp(base, poolName, presign)
+		if err != nil {
+			return common, err
+		}
+		if err := c.stor.Put(ctx, op.Key, op.Value); err != nil {
+			return common, fmt.Errorf("storage error")
+		}
+		common = append(common, presigID(presign))
+	}
+	slices.Sort(common)
+	return common, nil
+}
+
+// syncPool drops the presignatures of pool that not every signer holds and
+// returns the rest. It holds the pool's lock, which takePresig takes, so no
+// presignature is taken to sign between the listing and the drop; signing
+// waits for the sync, and goes on while the pool is filled.
+func (c *Client) syncPool(ctx context.Context, base, poolName string, self party.ID, signers party.IDSlice, newNet func(string) (network.Network, error)) ([]string, error) {
+	unlock, err := storage.Lock(ctx, c.stor, base+"/"+poolName)
+	if err != nil {
+		return nil, fmt.Errorf("storage error")
+	}
+	defer unlock()
+
+	ids, err := c.poolIDs(ctx, base, poolName)
+	if err != nil {
+		return nil, fmt.Errorf("storage error")
+	}
+	net, err := newNet("sync")
+	if err != nil {
+		return nil, err
+	}
+	common, err := syncPresigPool(net, self, signers, ids, presigSyncTimeout)
+	net.Done()
+	if err != nil {
+		return nil, err
+	}
+	var ops []storage.Op
+	for _, id := range ids {
+		if !slices.Contains(common, id) {
+			ops = append(ops, storage.Op{Key: base + "/" + poolName + "." + id, Delete: true})
+		}
+	}
+	if err := storage.Batch(ctx, c.stor, ops); err != nil {
+		return nil, fmt.Errorf("storage error")
+	}
+	return common, nil
+}
+
+// fillPresigPool replenishes the pool of signers in the background.
+func (c *Client) fillPresigPool(name, myid string, signers party.IDSlice, config *cmp.Config, channel func(party.ID) string) {
+	go func() {
+		ids, err := c.replenishPresigs(c.background(), name, myid, signers, config, channel)
+		if err != nil {
+			c.logger.Warn("presignature pool not replenished", "account", name, "error", err)
+			return
+		}
+		c.logger.Info("presignature pool replenished", "account", name, "pool", len(ids))
+	}()
+}
+
+// presigPoolLow reports whether the pool of signers ran low: down to half
+// of the pool size. Every signer used the same presignatures, so they all
+// find the same.
+func (c *Client) presigPoolLow(ctx context.Context, name string, meta *AccountMeta, signers party.IDSlice) bool {
+	ids, err := c.poolIDs(ctx, "accounts/"+name, presigPool(meta, signers))
+	return err == nil && len(ids) <= c.presigPoolSize()/2
+}
+
+// syncPresigPool sends the presignature IDs self holds to every other
+// signer and returns those that all of them hold.
+func syncPresigPool(net network.Network, self party.ID, signers party.IDSlice, ids []string, timeout time.Duration) ([]string, error) {
+	data, err := cbor.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	net.Send(&protocol.Message{From: self, Broadcast: true, Data: data})
+
+	common := slices.Clone(ids)
+	got := map[party.ID]bool{self: true}
+	deadline := time.After(timeout)
+	for len(got) < len(signers) {
+		select {
+		case msg := <-net.Next():
+			if !signers.Contains(msg.From) || got[msg.From] {
+				continue
+			}
+			var theirs []string
+			if err := cbor.Unmarshal(msg.Data, &theirs); err != nil {
+				return nil, fmt.Errorf("signer %s sent an invalid pool: %w", msg.From, err)
+			}
+			common = slices.DeleteFunc(common, func(id string) bool { return !slices.Contains(theirs, id) })
+			got[msg.From] = true
+		case <-deadline:
+			return nil, fmt.Errorf("timed out waiting for the other signers' presignatures: %d of %d",
+				len(got)-1, len(signers)-1)
+		}
+	}
+	return common, nil
+}
+
+type PresignECDSARequest struct {
+	SessionID string `json:"session_id"`
+	MyID      string `json:"my_id"`
+	Network   string `json:"network"`
+	Index     int    `json:"index"`
+	// Signers are the parties that will sign together, this one included.
+	Signers []string `json:"signers"`
+}
+
+type PresignECDSAResponse struct {
+	Network string   `json:"network"`
+	Index   int      `json:"index"`
+	Signers []string `json:"signers"`
+	// Presignatures are the IDs in the pool of the signers, to pass as
+	// presig_id when signing.
+	Presignatures []string `json:"presignatures"`
+}
+
+// presignECDSA fills the presignature pool of a set of the account's
+// parties.
+//
+// @Summary      ECDSA presign
+// @Description  Fill the ECDSA (CMP) presignature pool of the listed signers, who call it with the same session_id at the same time. The signers first drop presignatures not all of them hold. Every set of signers needs a pool before it can sign; after each signature the pool is replenished in the background once it runs low.
+// @Tags         keygen
+// @Accept       json
+// @Produce      json
+// @Param        body  body      PresignECDSARequest  true  "Presign parameters"
+// @Success      200   {object}  PresignECDSAResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Failure      502   {object}  ErrorResponse
+// @Failure      504   {object}  ErrorResponse
+// @Router       /v1/presign/ecdsa [post]
+func (c *Client) presignECDSA() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req PresignECDSARequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.SessionID == "" || req.MyID == "" || len(req.Signers) == 0 {
+			respondError(w, http.StatusBadRequest, errors.New("session_id, my_id and signers are required"))
+			return
+		}
+		if err := validateSessionID(req.SessionID); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Network == "" {
+			req.Network = "eth"
+		}
+		if err := validateNetwork(req.Network); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateIndex(req.Index); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		name := fmt.Sprintf("%s/%d", req.Network, req.Index)
+		meta, err := c.loadAccountMeta(r.Context(), name)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if meta == nil {
+			respondError(w, http.StatusNotFound, fmt.Errorf("account not found"))
+			return
+		}
+		myid := normalizePartyID(req.MyID)
+		signers, err := resolveSigners(meta, myid, "", req.Signers)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		config, err := c.loadECDSAConfig(r.Context(), "accounts/"+name)
+		if err != nil {
+			respondError(w, http.StatusNotFound, err)
+			return
+		}
+
+		ctx, done := c.startRun(req.SessionID)
+		defer done()
+
+		c.logger.Info("Starting ECDSA presign", "session", req.SessionID, "account", name, "signers", len(signers))
+		ids, err := c.replenishPresigs(ctx, name, myid, signers, config,
+			func(id party.ID) string { return req.SessionID + "/" + string(id) + "/presign" })
+		if err != nil {
+			f := c.protocolFailure(myid, signers, "ecdsa-presign", req.SessionID, err)
+			respondFailure(w, f, fmt.Errorf("ECDSA presign failed: %w", err))
+			return
+		}
+
+		c.logger.Info("ECDSA presign completed", "account", name, "signers", strings.Join(idStrings(signers), ","), "pool", len(ids))
+		respondOk(w, PresignECDSAResponse{Network: req.Network, Index: req.Index, Signers: idStrings(signers), Presignatures: ids})
+	}
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/ecdsa"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/sample"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/valli0x/signature-escrow/mpc"
+	"github.com/valli0x/signature-escrow/network"
+)
+
+// fakePresig returns a presignature of signers whose id starts with b. It
+// only has to round-trip through storage.
+func fakePresig(signers party.IDSlice, b byte) *ecdsa.PreSignature {
+	group := curve.Secp256k1{}
+	points := map[party.ID]curve.Point{}
+	for _, id := range signers {
+		points[id] = sample.Scalar(rand.Reader, group).ActOnBase()
+	}
+	return &ecdsa.PreSignature{
+		ID:       bytes.Repeat([]byte{b}, 32),
+		R:        sample.Scalar(rand.Reader, group).ActOnBase(),
+		RBar:     party.NewPointMap(points),
+		S:        party.NewPointMap(points),
+		KShare:   sample.Scalar(rand.Reader, group),
+		ChiShare: sample.Scalar(rand.Reader, group),
+	}
+}
+
+func TestResolveSigners(t *testing.T) {
+	a, b, c := "aa", "bb", "cc"
+	meta := &AccountMeta{PairMyID: a, PairOther: b, Parties: []string{a, b, c}, Threshold: 2}
+
+	signers, err := resolveSigners(meta, a, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := presigPool(meta, signers); got != subsetPresigPrefix+subsetID(signers) || !isPresigFile(got) {
+		t.Fatalf("presig file of a subset: %q", got)
+	}
+	all, err := resolveSigners(meta, a, "", []string{"0xBB", c})
+	if err != nil || len(all) != 3 {
+		t.Fatalf("all signers: %v %v", all, err)
+	}
+	if got := presigPool(meta, all); got != "presig-ecdsa" {
+		t.Fatalf("presig file of all parties: %q", got)
+	}
+
+	if _, err := resolveSigners(meta, a, "dd", nil); err == nil {
+		t.Fatal("a signer that holds no share was accepted")
+	}
+	meta.Threshold = 3
+	if _, err := resolveSigners(meta, a, b, nil); err == nil {
+		t.Fatal("fewer signers than the threshold were accepted")
+	}
+
+	// Accounts from before threshold keys are the pair.
+	old := &AccountMeta{PairMyID: a, PairOther: b}
+	signers, err = resolveSigners(old, a, b, nil)
+	if err != nil || presigPool(old, signers) != "presig-ecdsa" {
+		t.Fatalf("pair account: %v %v", signers, err)
+	}
+	if !signers.Contains(party.ID(b)) {
+		t.Fatal("pair signers miss the other party")
+	}
+}
+
+func TestKeygenParties(t *testing.T) {
+	me := "0x1100000000000000000000000000000000000000"
+	b := "0x2200000000000000000000000000000000000000"
+	c := "0x3300000000000000000000000000000000000000"
+	myid := normalizePartyID(me)
+
+	ids, threshold, err := keygenParties(myid, b, nil, 0)
+	if err != nil || len(ids) != 2 || threshold != 2 {
+		t.Fatalf("pair: %v %d %v", ids, threshold, err)
+	}
+	ids, threshold, err = keygenParties(myid, "", []string{me, b, c}, 2)
+	if err != nil || len(ids) != 3 || threshold != 2 {
+		t.Fatalf("2-of-3: %v %d %v", ids, threshold, err)
+	}
+	if _, _, err := keygenParties(myid, "", []string{b, c}, 4); err == nil {
+		t.Fatal("threshold above the parties was accepted")
+	}
+	if _, _, err := keygenParties(myid, b, []string{b}, 0); err == nil {
+		t.Fatal("a party listed twice was accepted")
+	}
+}
+
+func TestTakePresig(t *testing.T) {
+	c, _ := mkLocalClient(t)
+	ctx := context.Background()
+	base := "accounts/eth/1"
+	signers := party.NewIDSlice([]party.ID{"aa", "bb"})
+	for _, b := range []byte{1, 2} {
+		op, err := presigOp(base, "presig-ecdsa", fakePresig(signers, b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.stor.Put(ctx, op.Key, op.Value)
+	}
+	ids, err := c.poolIDs(ctx, base, "presig-ecdsa")
+	if err != nil || len(ids) != 2 || ids[0] != "0101010101010101" {
+		t.Fatalf("pool: %v %v", ids, err)
+	}
+
+	if _, id, err := c.takePresig(ctx, base, "presig-ecdsa", signers, ids[1]); err != nil || id != ids[1] {
+		t.Fatalf("take %s: %s %v", ids[1], id, err)
+	}
+	if _, _, err := c.takePresig(ctx, base, "presig-ecdsa", signers, ids[1]); !errors.Is(err, errNoPresig) {
+		t.Fatalf("a presignature was taken twice: %v", err)
+	}
+	if _, id, err := c.takePresig(ctx, base, "presig-ecdsa", signers, ""); err != nil || id != ids[0] {
+		t.Fatalf("take any: %s %v", id, err)
+	}
+	if _, _, err := c.takePresig(ctx, base, "presig-ecdsa", signers, ""); !errors.Is(err, errNoPresig) {
+		t.Fatalf("empty pool: %v", err)
+	}
+}
+
+func TestSyncPresigPool(t *testing.T) {
+	signers := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	theirs := func(ids ...string) []byte {
+		data, _ := cbor.Marshal(ids)
+		return data
+	}
+
+	hub := mpc.NewPartyHub(signers)
+	hub["a"] <- &protocol.Message{From: "x", Data: theirs()}
+	hub["a"] <- &protocol.Message{From: "b", Data: theirs("01", "02", "03")}
+	hub["a"] <- &protocol.Message{From: "c", Data: theirs("02", "03", "04")}
+	common, err := syncPresigPool(hub.Net("a"), "a", signers, []string{"01", "02", "03", "04"}, time.Second)
+	if err != nil || !slices.Equal(common, []string{"02", "03"}) {
+		t.Fatalf("common: %v %v", common, err)
+	}
+	if sent := <-hub["b"]; sent.From != "a" || !bytes.Equal(sent.Data, theirs("01", "02", "03", "04")) {
+		t.Fatalf("sent %+v", sent)
+	}
+
+	hub = mpc.NewPartyHub(signers)
+	hub["a"] <- &protocol.Message{From: "b", Data: theirs("01")}
+	if _, err := syncPresigPool(hub.Net("a"), "a", signers, []string{"01"}, 50*time.Millisecond); err == nil {
+		t.Fatal("a missing signer was not reported")
+	}
+}
+
+func TestSyncPoolHoldsLock(t *testing.T) {
+	c, _ := mkLocalClient(t)
+	ctx := context.Background()
+	base := "accounts/eth/1"
+	signers := party.NewIDSlice([]party.ID{"aa", "bb"})
+	for _, b := range []byte{1, 2} {
+		op, err := presigOp(base, "presig-ecdsa", fakePresig(signers, b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.stor.Put(ctx, op.Key, op.Value)
+	}
+
+	hub := mpc.NewPartyHub(signers)
+	type result struct {
+		common []string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		common, err := c.syncPool(ctx, base, "presig-ecdsa", "aa", signers,
+			func(string) (network.Network, error) { return hub.Net("aa"), nil })
+		done <- result{common, err}
+	}()
+	<-hub["bb"]
+
+	// The pool is listed: a signing cannot take a presignature the sync
+	// may drop until it is over.
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := c.takePresig(short, base, "presig-ecdsa", signers, "0101010101010101"); err == nil {
+		t.Fatal("a presignature was taken during the sync")
+	}
+
+	data, _ := cbor.Marshal([]string{"0202020202020202"})
+	hub["aa"] <- &protocol.Message{From: "bb", Data: data}
+	if r := <-done; r.err != nil || !slices.Equal(r.common, []string{"0202020202020202"}) {
+		t.Fatalf("sync: %v %v", r.common, r.err)
+	}
+	if _, _, err := c.takePresig(ctx, base, "presig-ecdsa", signers, "0101010101010101"); !errors.Is(err, errNoPresig) {
+		t.Fatalf("a dropped presignature was taken: %v", err)
+	}
+}
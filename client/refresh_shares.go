@@ -0,0 +1,418 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/ecdsa"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/pool"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/taurusgroup/multi-party-sig/protocols/cmp"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+	"github.com/valli0x/signature-escrow/network"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// ShareRefresh records one refresh of an account's shares.
+type ShareRefresh struct {
+	At        int64  `json:"at"`
+	SessionID string `json:"session_id"`
+}
+
+type ShareRefreshRequest struct {
+	SessionID string `json:"session_id"`
+	MyID      string `json:"my_id"`
+	Network   string `json:"network"`
+	Index     int    `json:"index"`
+}
+
+type ShareRefreshResponse struct {
+	Network     string `json:"network"`
+	Index       int    `json:"index"`
+	Address     string `json:"address"`
+	RefreshedAt int64  `json:"refreshed_at"`
+	// Presigned is whether a new ECDSA presignature of all parties was
+	// made; presignatures of the old shares are deleted.
+	Presigned bool `json:"presigned"`
+}
+
+// refreshConfirmTimeout bounds the wait for every party to confirm it holds
+// the same new public shares, and then to acknowledge it stored them.
+const refreshConfirmTimeout = 60 * time.Second
+
+// refreshShares replaces this party's share of an account with a new one
+// of the same public key.
+//
+// @Summary      Refresh key shares
+// @Description  Run the local part of a key share refresh with every other party of the account, who call it with the same session_id at the same time. The public key and address stay the same. Once every party confirmed the same new public shares, each stores its new share and records the refresh in the account metadata, keeping the old share and its presignatures aside, and acknowledges it to the others. Once every party acknowledged, the old share is deleted from storage and zeroed in memory; copies the storage backend keeps on its own (file system blocks, Raft log and snapshots, backups) are not erased. Without every acknowledgement the request fails and the old share is kept until /v1/accounts/commit, /v1/accounts/rollback or a signature under the new shares.
+// @Tags         accounts
+// @Accept       json
+// @Produce      json
+// @Param        body  body      ShareRefreshRequest  true  "Account to refresh"
+// @Success      200   {object}  ShareRefreshResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Failure      502   {object}  ErrorResponse
+// @Failure      504   {object}  ErrorResponse
+// @Router       /v1/accounts/refresh [post]
+func (c *Client) refreshShares() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ShareRefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.SessionID == "" || req.MyID == "" {
+			respondError(w, http.StatusBadRequest, errors.New("session_id and my_id are required"))
+			return
+		}
+		if err := validateSessionID(req.SessionID); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateNetwork(req.Network); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateIndex(req.Index); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		name := fmt.Sprintf("%s/%d", req.Network, req.Index)
+		base := "accounts/" + name
+		unlock, err := storage.Lock(r.Context(), c.stor, base)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		defer unlock()
+
+		meta, err := c.loadAccountMeta(r.Context(), name)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if meta == nil {
+			respondError(w, http.StatusNotFound, fmt.Errorf("account not found"))
+			return
+		}
+		if meta.Path != "" {
+			respondError(w, http.StatusBadRequest,
+				fmt.Errorf("%s derives from %s/%d: refresh that account", name, meta.Network, meta.Master))
+			return
+		}
+		if p, err := c.loadPending(r.Context(), base); err != nil || p != nil {
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			} else {
+				respondError(w, http.StatusConflict, errPending)
+			}
+			return
+		}
+		myid := normalizePartyID(req.MyID)
+		parties := meta.partyIDs()
+		if !parties.Contains(party.ID(myid)) {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("my_id does not hold a share of this account"))
+			return
+		}
+
+		channel := func(suffix string) func(party.ID) string {
+			return func(id party.ID) string { return req.SessionID + "/" + string(id) + "/" + suffix }
+		}
+		// The protocol run owns the network and releases it: it is set up
+		// once the key share is loaded, right before the run.
+		dialRefresh := func() (network.Network, bool) {
+			net, err := c.dial(party.ID(myid), parties, channel("refresh"))
+			if err != nil {
+				c.logger.Error("Failed to setup network", "error", err)
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
+				return nil, false
+			}
+			return net, true
+		}
+
+		pl := pool.NewPool(0)
+		defer pl.TearDown()
+
+		ctx, done := c.startRun(req.SessionID)
+		defer done()
+
+		c.logger.Info("Starting key share refresh", "session", req.SessionID, "account", name, "parties", len(parties))
+
+		var (
+			ops     []storage.Op
+			drop    []string
+			digest  []byte
+			wipe    func()
+			presign func() (*ecdsa.PreSignature, error)
+			fill    func()
+		)
+		switch req.Network {
+		case "eth":
+			data, err := c.stor.Get(r.Context(), base+"/conf-ecdsa")
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+			if data == nil {
+				respondError(w, http.StatusNotFound, fmt.Errorf("no ECDSA key share for %s", name))
+				return
+			}
+			config := mpccmp.EmptyConfig()
+			if err := config.UnmarshalBinary(data); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal config: %v", err))
+				return
+			}
+			net, ok := dialRefresh()
+			if !ok {
+				return
+			}
+			rec, save := c.recordRun(net, network.Transcript{
+				Protocol: "ecdsa-refresh", Session: req.SessionID, Party: party.ID(myid), Account: name, Parties: parties,
+				Config: configDigest(config),
+			})
+			refreshed, err := mpccmp.CMPRefreshContext(ctx, config, rec, pl)
+			save(err)
+			if err != nil {
+				f := c.protocolFailure(myid, parties, "ecdsa-refresh", req.SessionID, err)
+				respondFailure(w, f, fmt.Errorf("ECDSA refresh failed: %w", err))
+				return
+			}
+			kb, err := refreshed.MarshalBinary()
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal config: %w", err))
+				return
+			}
+			ops = append(ops, storage.Op{Key: base + "/conf-ecdsa", Value: kb})
+
+			// Presignatures come from the old shares: they go with them.
+			presigs, err := c.dropPresigOps(r.Context(), meta)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+			for _, op := range presigs {
+				drop = append(drop, op.Key)
+			}
+
+			digest = cmpPublicDigest(refreshed)
+			wipe = func() { mpccmp.Wipe(config) }
+			if meta.signersNeeded() == len(parties) {
+				presign = func() (*ecdsa.PreSignature, error) {
+					net, err := c.dial(party.ID(myid), parties, channel("refresh/presign"))
+					if err != nil {
+						return nil, err
+					}
+					return mpccmp.CMPPreSignContext(ctx, refreshed, parties, net, pl)
+				}
+				fill = func() {
+					c.fillPresigPool(name, myid, parties, refreshed,
+						func(id party.ID) string { return req.SessionID + "/" + string(id) + "/refresh" })
+				}
+			}
+
+		case "btc":
+			data, err := c.stor.Get(r.Context(), base+"/conf-frost")
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+			if data == nil {
+				respondError(w, http.StatusNotFound, fmt.Errorf("no FROST key share for %s", name))
+				return
+			}
+			config := &frost.TaprootConfig{}
+			if err := cbor.Unmarshal(data, config); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal frost config: %v", err))
+				return
+			}
+			net, ok := dialRefresh()
+			if !ok {
+				return
+			}
+			rec, save := c.recordRun(net, network.Transcript{
+				Protocol: "frost-refresh", Session: req.SessionID, Party: party.ID(myid), Account: name, Parties: parties,
+				Config: configDigest(config),
+			})
+			refreshed, err := mpcfrost.FrostRefreshTaprootContext(ctx, config, rec)
+			save(err)
+			if err != nil {
+				f := c.protocolFailure(myid, parties, "frost-refresh", req.SessionID, err)
+				respondFailure(w, f, fmt.Errorf("FROST refresh failed: %w", err))
+				return
+			}
+			configb, err := cbor.Marshal(refreshed)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal config: %w", err))
+				return
+			}
+			ops = append(ops, storage.Op{Key: base + "/conf-frost", Value: configb})
+			digest = frostPublicDigest(refreshed)
+			wipe = func() { mpcfrost.Wipe(config) }
+		}
+
+		// A party that fails the last round keeps its old share, which is
+		// useless with the new shares of the others. So nobody replaces its
+		// share before every party has the same new public shares.
+		confirm, err := c.dial(party.ID(myid), parties, channel("refresh/confirm"))
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
+			return
+		}
+		err = confirmRefresh(confirm, party.ID(myid), parties, digest, refreshConfirmTimeout)
+		confirm.Done()
+		if err != nil {
+			c.logger.Warn("Key share refresh not confirmed; keeping the old share", "account", name)
+			f := c.protocolFailure(myid, parties, "refresh-confirm", req.SessionID, err)
+			respondFailure(w, f, err)
+			return
+		}
+
+		now := time.Now().Unix()
+		meta.Refreshes = append(meta.Refreshes, ShareRefresh{At: now, SessionID: req.SessionID})
+		metaB, err := cbor.Marshal(meta)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal metadata: %w", err))
+			return
+		}
+		ops = append(ops, storage.Op{Key: base + "/meta", Value: metaB})
+
+		// The new share is stored with the old one kept aside, and only
+		// dropped once every party acknowledged storing theirs.
+		defer wipe()
+		staged, err := c.stageOps(r.Context(), base, "refresh", req.SessionID, ops, drop)
+		if err == nil {
+			err = storage.Batch(context.Background(), c.stor, staged)
+		}
+		if err != nil {
+			c.logger.Error("Failed to save refreshed share", "account", name, "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		ack, err := c.dial(party.ID(myid), parties, channel("refresh/ack"))
+		if err == nil {
+			err = confirmRefresh(ack, party.ID(myid), parties, digest, refreshConfirmTimeout)
+			ack.Done()
+		}
+		if err != nil {
+			c.logger.Warn("Key share refresh not acknowledged; keeping the old share", "account", name)
+			f := c.protocolFailure(myid, parties, "refresh-ack", req.SessionID, err)
+			respondFailure(w, f, fmt.Errorf("new share stored, but not every party acknowledged storing theirs; "+
+				"the old share is kept until /v1/accounts/commit or /v1/accounts/rollback: %w", err))
+			return
+		}
+		if err := c.commitStaged(context.Background(), base); err != nil {
+			c.logger.Error("Failed to delete the old share", "account", name, "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error: the old share is kept until /v1/accounts/commit"))
+			return
+		}
+
+		presigned := false
+		if presign != nil {
+			presig, err := presign()
+			if err == nil {
+				var op storage.Op
+				if op, err = presigOp(base, "presig-ecdsa", presig); err == nil {
+					err = c.stor.Put(context.Background(), op.Key, op.Value)
+					presigned = err == nil
+				}
+			}
+			if err != nil {
+				c.logger.Warn("Presign after refresh failed", "account", name, "error", err)
+			}
+		}
+		if presigned {
+			fill()
+		}
+
+		c.logger.Info("Key share refresh completed", "account", name, "presigned", presigned)
+		respondOk(w, ShareRefreshResponse{
+			Network:     req.Network,
+			Index:       req.Index,
+			Address:     meta.Address,
+			RefreshedAt: now,
+			Presigned:   presigned,
+		})
+	}
+}
+
+// confirmRefresh sends digest to every other party and waits for theirs,
+// which must all be the same. A party that is not one of parties only
+// listens; with a nil digest, it takes the first one it gets.
+func confirmRefresh(net network.Network, self party.ID, parties party.IDSlice, digest []byte, timeout time.Duration) error {
+	confirmed := map[party.ID]bool{}
+	if parties.Contains(self) {
+		net.Send(&protocol.Message{From: self, Broadcast: true, Data: digest})
+		confirmed[self] = true
+	}
+	others := len(parties) - len(confirmed)
+
+	deadline := time.After(timeout)
+	for len(confirmed) < len(parties) {
+		select {
+		case msg := <-net.Next():
+			if !parties.Contains(msg.From) || confirmed[msg.From] {
+				continue
+			}
+			if digest == nil {
+				digest = msg.Data
+			}
+			if !bytes.Equal(msg.Data, digest) {
+				return fmt.Errorf("party %s got different public shares: %w", msg.From, mpcblame.ErrMismatch)
+			}
+			confirmed[msg.From] = true
+		case <-deadline:
+			var waiting []party.ID
+			for _, id := range parties {
+				if !confirmed[id] {
+					waiting = append(waiting, id)
+				}
+			}
+			return fmt.Errorf("confirmed by %d of %d: %w",
+				others-len(waiting), others, &network.TimeoutError{Waiting: waiting})
+		}
+	}
+	return nil
+}
+
+// cmpPublicDigest hashes the public shares of every party of c.
+func cmpPublicDigest(c *cmp.Config) []byte {
+	h := sha256.New()
+	for _, id := range c.PartyIDs() {
+		b, _ := c.Public[id].ECDSA.MarshalBinary()
+		h.Write([]byte(id))
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// frostPublicDigest hashes the verification shares of every party of c.
+func frostPublicDigest(c *frost.TaprootConfig) []byte {
+	ids := make([]string, 0, len(c.VerificationShares))
+	for id := range c.VerificationShares {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	h := sha256.New()
+	for _, id := range ids {
+		b, _ := c.VerificationShares[party.ID(id)].MarshalBinary()
+		h.Write([]byte(id))
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
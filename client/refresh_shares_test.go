@@ -0,0 +1,204 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/valli0x/signature-escrow/mpc"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+	"github.com/valli0x/signature-escrow/network"
+	"github.com/valli0x/signature-escrow/storage"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+)
+
+func TestConfirmRefresh(t *testing.T) {
+	parties := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	digest := []byte("digest")
+
+	hub := mpc.NewPartyHub(parties)
+	hub["a"] <- &protocol.Message{From: "x", Data: []byte("other")}
+	hub["a"] <- &protocol.Message{From: "b", Data: digest}
+	hub["a"] <- &protocol.Message{From: "b", Data: digest}
+	hub["a"] <- &protocol.Message{From: "c", Data: digest}
+	if err := confirmRefresh(hub.Net("a"), "a", parties, digest, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if sent := <-hub["b"]; sent.From != "a" || string(sent.Data) != "digest" {
+		t.Fatalf("sent %+v", sent)
+	}
+
+	hub = mpc.NewPartyHub(parties)
+	hub["a"] <- &protocol.Message{From: "b", Data: []byte("other")}
+	if err := confirmRefresh(hub.Net("a"), "a", parties, digest, time.Second); err == nil {
+		t.Fatal("different public shares were confirmed")
+	}
+
+	hub = mpc.NewPartyHub(parties)
+	hub["a"] <- &protocol.Message{From: "b", Data: digest}
+	if err := confirmRefresh(hub.Net("a"), "a", parties, digest, 50*time.Millisecond); err == nil {
+		t.Fatal("a missing confirmation was not reported")
+	}
+
+	// A party that is not one of them only listens.
+	hub = mpc.NewPartyHub(party.NewIDSlice([]party.ID{"b", "c", "d"}))
+	hub["d"] <- &protocol.Message{From: "b", Data: digest}
+	hub["d"] <- &protocol.Message{From: "c", Data: []byte("other")}
+	if err := confirmRefresh(hub.Net("d"), "d", party.NewIDSlice([]party.ID{"b", "c"}), nil, time.Second); err == nil {
+		t.Fatal("different public shares were confirmed to a listener")
+	}
+	if len(hub["b"]) != 0 {
+		t.Fatal("a listener sent a confirmation")
+	}
+}
+
+func TestPendingChange(t *testing.T) {
+	c, ts := mkLocalClient(t)
+	storeFrostAccount(t, c, 1)
+	ctx := context.Background()
+	const base = "accounts/btc/1"
+	const presig = base + "/presig-ecdsa.0123456789abcdef"
+	_ = c.stor.Put(ctx, presig, []byte("presig"))
+	old, _ := c.stor.Get(ctx, base+"/conf-frost")
+
+	stage := func() {
+		t.Helper()
+		ops, err := c.stageOps(ctx, base, "refresh", "s1",
+			[]storage.Op{{Key: base + "/conf-frost", Value: []byte("new")}}, []string{presig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Batch(ctx, c.stor, ops); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(key string) []byte {
+		v, _ := c.stor.Get(ctx, key)
+		return v
+	}
+
+	stage()
+	if string(get(base+"/conf-frost")) != "new" || !bytes.Equal(get(base+"/conf-frost.prev"), old) ||
+		get(presig) != nil || string(get(presig+".prev")) != "presig" {
+		t.Fatal("staged change did not keep the old files aside")
+	}
+	refresh := ShareRefreshRequest{SessionID: "3f2504e0-4f89-11d3-9a0c-0305e82c3301", MyID: "a", Network: "btc", Index: 1}
+	if code := postBackup(t, ts, "/v1/accounts/refresh", refresh, nil); code != http.StatusConflict {
+		t.Fatalf("refresh over a pending change: %d", code)
+	}
+
+	var resp PendingChangeResponse
+	if code := postBackup(t, ts, "/v1/accounts/rollback", PendingChangeRequest{Network: "btc", Index: 1}, &resp); code != http.StatusOK || resp.Restored != 2 {
+		t.Fatalf("rollback: %d, %+v", code, resp)
+	}
+	if !bytes.Equal(get(base+"/conf-frost"), old) || string(get(presig)) != "presig" ||
+		get(base+"/conf-frost.prev") != nil || get(base+"/"+pendingFile) != nil {
+		t.Fatal("rollback did not restore the old files")
+	}
+	if code := postBackup(t, ts, "/v1/accounts/rollback", PendingChangeRequest{Network: "btc", Index: 1}, nil); code != http.StatusNotFound {
+		t.Fatalf("rollback without a pending change: %d", code)
+	}
+
+	stage()
+	if code := postBackup(t, ts, "/v1/accounts/commit", PendingChangeRequest{Network: "btc", Index: 1}, nil); code != http.StatusOK {
+		t.Fatalf("commit: %d", code)
+	}
+	if string(get(base+"/conf-frost")) != "new" || get(base+"/conf-frost.prev") != nil ||
+		get(presig+".prev") != nil || get(base+"/"+pendingFile) != nil {
+		t.Fatal("commit left the old files")
+	}
+
+	// A signature under the new shares commits as well.
+	stage()
+	var p pendingChange
+	_ = cbor.Unmarshal(get(base+"/"+pendingFile), &p)
+	if p.Kind != "refresh" || len(p.Retired) != 1 {
+		t.Fatalf("pending record: %+v", p)
+	}
+	c.commitAfterSign(ctx, "btc/1", nil)
+	if get(base+"/conf-frost.prev") != nil || get(base+"/"+pendingFile) != nil {
+		t.Fatal("a signature did not commit the change")
+	}
+}
+
+func TestSenderCommitsPending(t *testing.T) {
+	ids := party.NewIDSlice([]party.ID{"a", "b"})
+	hub := mpc.NewPartyHub(ids)
+	configs := make([]*frost.TaprootConfig, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			configs[i], _ = mpcfrost.FrostKeygenTaprootContext(context.Background(), id, ids, 1, hub.Net(id))
+		}()
+	}
+	wg.Wait()
+
+	// Both parties stored a new share, but the acknowledgements of the
+	// refresh never arrived.
+	ctx := context.Background()
+	const base = "accounts/btc/1"
+	signing := mpc.NewPartyHub(ids)
+	clients := make([]*httptest.Server, len(ids))
+	var sender *Client
+	for i, id := range ids {
+		c, ts := mkLocalClient(t)
+		c.dial = func(self party.ID, _ party.IDSlice, _ func(party.ID) string) (network.Network, error) {
+			return signing.Net(self), nil
+		}
+		data, err := cbor.Marshal(configs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, _ := cbor.Marshal(AccountMeta{Network: "btc", Index: 1, PairMyID: string(id), PairOther: string(ids[1-i])})
+		_ = c.stor.Put(ctx, base+"/meta", meta)
+		_ = c.stor.Put(ctx, base+"/conf-frost", []byte("old share"))
+		ops, err := c.stageOps(ctx, base, "refresh", "s1", []storage.Op{{Key: base + "/conf-frost", Value: data}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Batch(ctx, c.stor, ops); err != nil {
+			t.Fatal(err)
+		}
+		clients[i] = ts
+		if id == "a" {
+			sender = c
+		}
+	}
+
+	hash := strings.Repeat("ab", 32)
+	codes := make([]int, len(ids))
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		codes[0] = postBackup(t, clients[0], "/v1/incomplete-signature/send", SendWithdrawalTxRequest{
+			Algorithm: "frost", Name: "btc/1", EscrowAddress: "escrow", HashTx: hash, MyID: "a", Another: "b",
+		}, nil)
+	}()
+	go func() {
+		defer wg.Done()
+		codes[1] = postBackup(t, clients[1], "/v1/incomplete-signature/accept", AcceptWithdrawalTxRequest{
+			Algorithm: "frost", Name: "btc/1", EscrowAddress: "escrow", HashTx: hash, MyID: "b", Another: "a",
+		}, nil)
+	}()
+	wg.Wait()
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK {
+		t.Fatalf("signing: %v", codes)
+	}
+	if p, err := sender.loadPending(ctx, base); err != nil || p != nil {
+		t.Fatalf("the sender kept the change pending: %+v, %v", p, err)
+	}
+	if v, _ := sender.stor.Get(ctx, base+"/conf-frost.prev"); v != nil {
+		t.Fatal("the sender kept its old share")
+	}
+}
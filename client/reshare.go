@@ -0,0 +1,573 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/ecdsa"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/pool"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+	"github.com/valli0x/signature-escrow/mpc/mpcreshare"
+	"github.com/valli0x/signature-escrow/network"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// transportKeyKey holds the X25519 key new key shares are encrypted to when
+// an account is reshared to this client.
+const transportKeyKey = "client/transport-key"
+
+// reshareTimeout bounds the wait for the other parties during a resharing.
+const reshareTimeout = 2 * time.Minute
+
+// transportKey returns this client's transport key, made on first use.
+func (c *Client) transportKey(ctx context.Context) (*ecdh.PrivateKey, error) {
+	unlock, err := storage.Lock(ctx, c.stor, transportKeyKey)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	data, err := c.stor.Get(ctx, transportKeyKey)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		return ecdh.X25519().NewPrivateKey(data)
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.stor.Put(ctx, transportKeyKey, key.Bytes()); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+type ReshareParty struct {
+	ID string `json:"id"`
+	// TransportKey is the party's transport_key from its /v1/identity.
+	TransportKey string `json:"transport_key"`
+}
+
+type ReshareRequest struct {
+	SessionID string `json:"session_id"`
+	MyID      string `json:"my_id"`
+	Network   string `json:"network"`
+	Index     int    `json:"index"`
+	// Holders are every current key holder of the account, NewParties
+	// every key holder after the resharing, and Threshold how many of
+	// them sign together (all of them by default). A party may be in
+	// both lists.
+	Holders    []string       `json:"holders"`
+	NewParties []ReshareParty `json:"new_parties"`
+	Threshold  int            `json:"threshold"`
+	// PublicKey is the account's public key, as in its metadata. New
+	// parties take it on trust, so compare it out of band.
+	PublicKey string `json:"public_key"`
+}
+
+type ReshareResponse struct {
+	Network   string   `json:"network"`
+	Index     int      `json:"index"`
+	Address   string   `json:"address"`
+	Parties   []string `json:"parties"`
+	Threshold int      `json:"threshold"`
+	// Holder is whether this client holds a share of the account
+	// afterwards; a holder that is not a new party deleted it.
+	Holder bool `json:"holder"`
+	// Presigned is whether a new ECDSA presignature of all new parties
+	// was made.
+	Presigned bool `json:"presigned"`
+}
+
+// reshareAccount moves an account to a new set of key holders or a new
+// threshold without changing its key.
+//
+// @Summary      Reshare an account
+// @Description  Run the local part of a resharing, called with the same body and session_id by every current holder and every new party at the same time. Every current holder must take part. The public key and address stay the same, so no funds move. Once every new party confirmed the same public shares, new parties store their share, keeping any old one aside, and acknowledge it; holders that are not new parties set theirs aside. Once every new party acknowledged, the old shares are deleted; they no longer combine with the new ones. Without every acknowledgement the request fails and the old share is kept until /v1/accounts/commit or /v1/accounts/rollback.
+// @Tags         accounts
+// @Accept       json
+// @Produce      json
+// @Param        body  body      ReshareRequest  true  "Resharing parameters"
+// @Success      200   {object}  ReshareResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Failure      502   {object}  ErrorResponse
+// @Failure      504   {object}  ErrorResponse
+// @Router       /v1/accounts/reshare [post]
+func (c *Client) reshareAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ReshareRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.SessionID == "" || req.MyID == "" || req.PublicKey == "" {
+			respondError(w, http.StatusBadRequest, errors.New("session_id, my_id and public_key are required"))
+			return
+		}
+		if err := validateSessionID(req.SessionID); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateNetwork(req.Network); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateIndex(req.Index); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		dealers, err := parseIDList("holders", req.Holders)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		addrs := make([]string, 0, len(req.NewParties))
+		transport := map[party.ID]*ecdh.PublicKey{}
+		for _, p := range req.NewParties {
+			key, err := parseTransportKey(p.TransportKey)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("new_parties: transport key of %s: %w", p.ID, err))
+				return
+			}
+			addrs = append(addrs, p.ID)
+			transport[party.ID(normalizePartyID(p.ID))] = key
+		}
+		receivers, err := parseIDList("new_parties", addrs)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		threshold := req.Threshold
+		if threshold == 0 {
+			threshold = len(receivers)
+		}
+		if threshold < 2 || threshold > len(receivers) {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("threshold must be between 2 and %d", len(receivers)))
+			return
+		}
+
+		myid := normalizePartyID(req.MyID)
+		self := party.ID(myid)
+		dealer, receiver := dealers.Contains(self), receivers.Contains(self)
+		if !dealer && !receiver {
+			respondError(w, http.StatusBadRequest, errors.New("my_id is neither a holder nor a new party"))
+			return
+		}
+		pubHex := strings.TrimPrefix(strings.ToLower(req.PublicKey), "0x")
+		public, err := parseAccountPublicKey(req.Network, pubHex)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("public_key: %w", err))
+			return
+		}
+
+		name := fmt.Sprintf("%s/%d", req.Network, req.Index)
+		base := "accounts/" + name
+		unlock, err := storage.Lock(r.Context(), c.stor, base)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		defer unlock()
+
+		meta, err := c.loadAccountMeta(r.Context(), name)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		switch {
+		case dealer && meta == nil:
+			respondError(w, http.StatusNotFound, fmt.Errorf("account not found"))
+			return
+		case dealer && meta.Path != "":
+			respondError(w, http.StatusBadRequest,
+				fmt.Errorf("%s derives from %s/%d: reshare that account", name, meta.Network, meta.Master))
+			return
+		case dealer && !slices.Equal(meta.partyIDs(), dealers):
+			respondError(w, http.StatusBadRequest,
+				fmt.Errorf("holders must be every key holder of this account: %s", strings.Join(idStrings(meta.partyIDs()), ",")))
+			return
+		case dealer && meta.PublicKey != pubHex:
+			respondError(w, http.StatusBadRequest, errors.New("public_key is not the key of this account"))
+			return
+		case !dealer && meta != nil:
+			respondError(w, http.StatusConflict, fmt.Errorf("an account already exists at %s", name))
+			return
+		}
+		if p, err := c.loadPending(r.Context(), base); err != nil || p != nil {
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			} else {
+				respondError(w, http.StatusConflict, errPending)
+			}
+			return
+		}
+
+		var own *ecdh.PrivateKey
+		if receiver {
+			if own, err = c.transportKey(r.Context()); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+			if !own.PublicKey().Equal(transport[self]) {
+				respondError(w, http.StatusBadRequest, errors.New("new_parties lists another transport key for my_id"))
+				return
+			}
+		}
+
+		cfg := &mpcreshare.Config{
+			Session:       []byte(req.SessionID),
+			Self:          self,
+			Dealers:       dealers,
+			Receivers:     receivers,
+			Threshold:     threshold - 1,
+			PublicKey:     public,
+			TransportKeys: transport,
+			TransportKey:  own,
+			Timeout:       reshareTimeout,
+		}
+		everyone := party.NewIDSlice(append(append([]party.ID{}, dealers...), receivers...))
+
+		channel := func(suffix string) func(party.ID) string {
+			return func(id party.ID) string { return req.SessionID + "/" + string(id) + "/" + suffix }
+		}
+		newNet := func(ids party.IDSlice, suffix string) (network.Network, error) {
+			return c.dial(self, ids, channel(suffix))
+		}
+		// The resharing run owns its network and releases it, so the
+		// network is set up right before the run.
+		reshareNet := func() (network.Network, bool) {
+			net, err := newNet(everyone, "reshare")
+			if err != nil {
+				c.logger.Error("Failed to setup network", "error", err)
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
+				return nil, false
+			}
+			return net, true
+		}
+
+		pl := pool.NewPool(0)
+		defer pl.TearDown()
+
+		ctx, done := c.startRun(req.SessionID)
+		defer done()
+
+		c.logger.Info("Starting resharing", "session", req.SessionID, "account", name,
+			"holders", len(dealers), "new_parties", len(receivers), "threshold", threshold)
+
+		var (
+			ops     []storage.Op
+			digest  []byte
+			address string
+			wipe    = func() {}
+			presign func() (*ecdsa.PreSignature, error)
+			fill    func()
+		)
+		switch req.Network {
+		case "eth":
+			if dealer {
+				old, err := c.loadECDSAConfig(r.Context(), base)
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, err)
+					return
+				}
+				cfg.Share, cfg.ChainKey = old.ECDSA, old.ChainKey
+				cfg.DealerPublic = map[party.ID]curve.Point{}
+				for id, p := range old.Public {
+					cfg.DealerPublic[id] = p.ECDSA
+				}
+				wipe = func() { mpccmp.Wipe(old) }
+			}
+			var refreshNet network.Network
+			if receiver {
+				if refreshNet, err = newNet(receivers, "reshare/refresh"); err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
+					return
+				}
+			}
+			net, ok := reshareNet()
+			if !ok {
+				if refreshNet != nil {
+					refreshNet.Done()
+				}
+				return
+			}
+			config, err := mpccmp.CMPReshareContext(ctx, cfg, net, refreshNet, pl)
+			if refreshNet != nil {
+				refreshNet.Done()
+			}
+			if err != nil {
+				f := c.protocolFailure(myid, everyone, "ecdsa-reshare", req.SessionID, err)
+				respondFailure(w, f, fmt.Errorf("ECDSA resharing failed: %w", err))
+				return
+			}
+			if config != nil {
+				kb, err := config.MarshalBinary()
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal config: %w", err))
+					return
+				}
+				if address, err = mpccmp.GetAddress(config); err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get address: %w", err))
+					return
+				}
+				ops = append(ops, storage.Op{Key: base + "/conf-ecdsa", Value: kb})
+				digest = cmpPublicDigest(config)
+				if threshold == len(receivers) {
+					presign = func() (*ecdsa.PreSignature, error) {
+						net, err := newNet(receivers, "reshare/presign")
+						if err != nil {
+							return nil, err
+						}
+						return mpccmp.CMPPreSignContext(ctx, config, receivers, net, pl)
+					}
+				}
+				fill = func() {
+					c.fillPresigPool(name, myid, receivers, config,
+						channel("reshare/pool"))
+				}
+			}
+
+		case "btc":
+			if dealer {
+				data, err := c.stor.Get(r.Context(), base+"/conf-frost")
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+					return
+				}
+				if data == nil {
+					respondError(w, http.StatusNotFound, fmt.Errorf("no FROST key share for %s", name))
+					return
+				}
+				old := &frost.TaprootConfig{}
+				if err := cbor.Unmarshal(data, old); err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal frost config: %v", err))
+					return
+				}
+				cfg.Share, cfg.ChainKey = old.PrivateShare, old.ChainKey
+				cfg.DealerPublic = map[party.ID]curve.Point{}
+				for id, p := range old.VerificationShares {
+					cfg.DealerPublic[id] = p
+				}
+				wipe = func() { mpcfrost.Wipe(old) }
+			}
+			net, ok := reshareNet()
+			if !ok {
+				return
+			}
+			config, err := mpcfrost.FrostReshareTaprootContext(ctx, cfg, net)
+			if err != nil {
+				f := c.protocolFailure(myid, everyone, "frost-reshare", req.SessionID, err)
+				respondFailure(w, f, fmt.Errorf("FROST resharing failed: %w", err))
+				return
+			}
+			if config != nil {
+				configb, err := cbor.Marshal(config)
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal config: %w", err))
+					return
+				}
+				addr, err := mpcfrost.GetAddress(config)
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get address: %w", err))
+					return
+				}
+				address = addr.String()
+				ops = append(ops, storage.Op{Key: base + "/conf-frost", Value: configb})
+				digest = frostPublicDigest(config)
+			}
+		}
+
+		// Nobody stores or drops a share before every new party holds the
+		// same public shares: a holder that leaves listens in.
+		confirm, err := newNet(everyone, "reshare/confirm")
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
+			return
+		}
+		err = confirmRefresh(confirm, self, receivers, digest, refreshConfirmTimeout)
+		confirm.Done()
+		if err != nil {
+			c.logger.Warn("Resharing not confirmed; keeping the old share", "account", name)
+			f := c.protocolFailure(myid, everyone, "reshare-confirm", req.SessionID, err)
+			respondFailure(w, f, err)
+			return
+		}
+
+		// A holder's old files go: its share and the presignatures of it,
+		// or the whole account when it leaves.
+		written := map[string]bool{}
+		for _, op := range ops {
+			written[op.Key] = true
+		}
+		var drop []string
+		if dealer {
+			files, err := c.stor.List(r.Context(), base+"/")
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+			for _, f := range files {
+				if key := base + "/" + f; !written[key] && (!receiver || f != "meta") {
+					drop = append(drop, key)
+				}
+			}
+
+			// The accounts derived from it follow: they lose their
+			// presignatures, or go along with the account.
+			derived, err := c.derivedAccounts(r.Context(), req.Network, req.Index)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+			for _, d := range derived {
+				dbase := fmt.Sprintf("accounts/%s/%d", d.Network, d.Index)
+				files, err := c.stor.List(r.Context(), dbase+"/")
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+					return
+				}
+				for _, f := range files {
+					if !receiver || isPresigFile(f) {
+						drop = append(drop, dbase+"/"+f)
+					}
+				}
+			}
+		}
+
+		if receiver {
+			newMeta := AccountMeta{
+				Network:   req.Network,
+				Index:     req.Index,
+				Address:   address,
+				PublicKey: pubHex,
+				PairMyID:  myid,
+				PairOther: pairOther(myid, "", receivers),
+				SessionID: req.SessionID,
+				Parties:   idStrings(receivers),
+				Threshold: threshold,
+			}
+			if meta != nil {
+				newMeta.Refreshes = meta.Refreshes
+			}
+			metaB, err := cbor.Marshal(newMeta)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal metadata: %w", err))
+				return
+			}
+			ops = append(ops, storage.Op{Key: base + "/meta", Value: metaB})
+		} else {
+			address = meta.Address
+		}
+
+		// The change is staged with the old files kept aside. A holder that
+		// leaves deletes them only once every new party acknowledged storing
+		// its share.
+		defer wipe()
+		staged, err := c.stageOps(r.Context(), base, "reshare", req.SessionID, ops, drop)
+		if err == nil {
+			err = storage.Batch(context.Background(), c.stor, staged)
+		}
+		if err != nil {
+			c.logger.Error("Failed to save reshared account", "account", name, "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		ack, err := newNet(everyone, "reshare/ack")
+		if err == nil {
+			err = confirmRefresh(ack, self, receivers, digest, refreshConfirmTimeout)
+			ack.Done()
+		}
+		if err != nil {
+			c.logger.Warn("Resharing not acknowledged; keeping the old share", "account", name)
+			f := c.protocolFailure(myid, everyone, "reshare-ack", req.SessionID, err)
+			respondFailure(w, f, fmt.Errorf("resharing stored, but not every new party acknowledged storing its share; "+
+				"the old share is kept until /v1/accounts/commit or /v1/accounts/rollback: %w", err))
+			return
+		}
+		if err := c.commitStaged(context.Background(), base); err != nil {
+			c.logger.Error("Failed to delete the old share", "account", name, "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error: the old share is kept until /v1/accounts/commit"))
+			return
+		}
+
+		presigned := false
+		if presign != nil {
+			presig, err := presign()
+			if err == nil {
+				var op storage.Op
+				if op, err = presigOp(base, "presig-ecdsa", presig); err == nil {
+					err = c.stor.Put(context.Background(), op.Key, op.Value)
+					presigned = err == nil
+				}
+			}
+			if err != nil {
+				c.logger.Warn("Presign after resharing failed", "account", name, "error", err)
+			}
+		}
+		if presigned {
+			fill()
+		}
+
+		c.logger.Info("Resharing completed", "account", name, "holder", receiver, "presigned", presigned)
+		respondOk(w, ReshareResponse{
+			Network:   req.Network,
+			Index:     req.Index,
+			Address:   address,
+			Parties:   idStrings(receivers),
+			Threshold: threshold,
+			Holder:    receiver,
+			Presigned: presigned,
+		})
+	}
+}
+
+// parseTransportKey parses a hex X25519 public key.
+func parseTransportKey(s string) (*ecdh.PublicKey, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// parseAccountPublicKey parses the public key of an account as its
+// metadata records it: compressed for ECDSA, x-only for Taproot.
+func parseAccountPublicKey(net, pubHex string) (curve.Point, error) {
+	b, err := hex.DecodeString(pubHex)
+	if err != nil {
+		return nil, err
+	}
+	group := curve.Secp256k1{}
+	if net == "btc" {
+		point, err := group.LiftX(b)
+		if err != nil {
+			return nil, err
+		}
+		return point, nil
+	}
+	point := group.NewPoint()
+	if err := point.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return point, nil
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestReshareChecks(t *testing.T) {
+	c, ts := mkLocalClient(t)
+	cfg := storeFrostAccount(t, c, 1)
+	pub := hex.EncodeToString(cfg.PublicKey)
+	const (
+		a = "0x00000000000000000000000000000000000000aa"
+		b = "0x00000000000000000000000000000000000000bb"
+		d = "0x00000000000000000000000000000000000000dd"
+	)
+	meta, _ := cbor.Marshal(AccountMeta{Network: "btc", Index: 1, PublicKey: pub,
+		PairMyID: normalizePartyID(a), PairOther: normalizePartyID(b),
+		Parties: []string{normalizePartyID(a), normalizePartyID(b)}, Threshold: 2})
+	_ = c.stor.Put(context.Background(), "accounts/btc/1/meta", meta)
+
+	resp, err := http.Get(ts.URL + "/v1/identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id IdentityResponse
+	_ = json.NewDecoder(resp.Body).Decode(&id)
+	resp.Body.Close()
+	own, err := c.transportKey(context.Background())
+	if err != nil || id.TransportKey != hex.EncodeToString(own.PublicKey().Bytes()) {
+		t.Fatalf("identity transport key %q: %v", id.TransportKey, err)
+	}
+	other, _ := hex.DecodeString(id.TransportKey)
+	other[0] ^= 1
+
+	req := func(myid string, holders []string, key string) ReshareRequest {
+		return ReshareRequest{
+			SessionID:  "3f2504e0-4f89-11d3-9a0c-0305e82c3301",
+			MyID:       myid,
+			Network:    "btc",
+			Index:      1,
+			Holders:    holders,
+			NewParties: []ReshareParty{{ID: a, TransportKey: key}, {ID: d, TransportKey: id.TransportKey}},
+			PublicKey:  pub,
+		}
+	}
+	cases := []struct {
+		name string
+		req  ReshareRequest
+		code int
+	}{
+		{"holders are not every key holder", req(a, []string{a, d}, id.TransportKey), http.StatusBadRequest},
+		{"another transport key for my_id", req(a, []string{a, b}, hex.EncodeToString(other)), http.StatusBadRequest},
+		{"a new party with an account there", req(d, []string{a, b}, id.TransportKey), http.StatusConflict},
+		{"neither holder nor new party", req(b[:len(b)-1]+"c", []string{a, b}, id.TransportKey), http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		if code := postBackup(t, ts, "/v1/accounts/reshare", tc.req, nil); code != tc.code {
+			t.Errorf("%s: %d, want %d", tc.name, code, tc.code)
+		}
+	}
+
+	wrongKey := req(a, []string{a, b}, id.TransportKey)
+	wrongKey.PublicKey = pub[:len(pub)-2] + "00"
+	if code := postBackup(t, ts, "/v1/accounts/reshare", wrongKey, nil); code != http.StatusBadRequest {
+		t.Errorf("wrong public key: %d", code)
+	}
+
+	// An uncommitted refresh of the account comes first.
+	pending, _ := cbor.Marshal(pendingChange{Kind: "refresh", SessionID: "s"})
+	_ = c.stor.Put(context.Background(), "accounts/btc/1/"+pendingFile, pending)
+	if code := postBackup(t, ts, "/v1/accounts/reshare", req(a, []string{a, b}, id.TransportKey), nil); code != http.StatusConflict {
+		t.Errorf("pending change: %d", code)
+	}
+}
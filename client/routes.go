@@ -23,26 +23,44 @@ func (c *Client) routes() *chi.Mux {
 		httpSwagger.URL("/swagger/doc.json"),
 	))
 
+	r.Get("/.well-known/jwks.json", c.jwks())
+
 	r.Route("/v1", func(r chi.Router) {
 		r.Post("/auth/nonce", c.authNonce())
 		r.Post("/auth/login", c.authLogin())
+		r.Post("/auth/refresh", c.authRefresh())
 		r.Get("/identity", c.identity())
 
 		r.Group(func(r chi.Router) {
 			if c.authEnabled {
-				r.Use(auth.Middleware(c.jwtSecret))
+				r.Use(auth.Middleware(c.keys, c.tokens, nil))
 				r.Use(c.ownerGuard)
+
+				r.Post("/auth/logout", c.authLogout())
+				r.Post("/auth/revoke-all", c.authRevokeAll())
 			}
 
 			r.Route("/keygen", func(r chi.Router) {
 				r.Post("/ecdsa", c.keygenECDSA())
 				r.Post("/frost", c.keygenFROST())
 			})
+			r.Post("/presign/ecdsa", c.presignECDSA())
+			r.Post("/session/cancel", c.cancelSession())
 
 			r.Route("/accounts", func(r chi.Router) {
 				r.Get("/list", c.listAccounts())
 				r.Post("/get", c.getAccount())
 				r.Post("/delete", c.deleteAccount())
+				r.Post("/refresh", c.refreshShares())
+				r.Post("/reshare", c.reshareAccount())
+				r.Post("/commit", c.commitChange())
+				r.Post("/rollback", c.rollbackChange())
+				r.Post("/derive", c.deriveAccount())
+			})
+
+			r.Route("/backup", func(r chi.Router) {
+				r.Post("/export", c.exportBackup())
+				r.Post("/import", c.importBackup())
 			})
 
 			r.Route("/exchanges", func(r chi.Router) {
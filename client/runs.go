@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/valli0x/signature-escrow/network"
+)
+
+// errSessionCancelled is why a run stops when its session is cancelled.
+var errSessionCancelled = errors.New("session cancelled")
+
+// sessionPollInterval is how often the client asks the escrow server
+// whether the sessions it runs were cancelled.
+const sessionPollInterval = 2 * time.Second
+
+// run is an MPC run in progress.
+type run struct {
+	cancel context.CancelCauseFunc
+}
+
+// background is the context of MPC runs: it ends when the client shuts
+// down, not when the request that started a run goes away, as the other
+// parties would be left waiting.
+func (c *Client) background() context.Context {
+	ctx := context.Background()
+	if c.base != nil {
+		ctx = c.base
+	}
+	return network.WithRoundTimeout(ctx, c.roundTimeout())
+}
+
+// roundTimeout is how long a run waits for a round.
+func (c *Client) roundTimeout() time.Duration {
+	if c.env != nil && c.env.MPCRoundTimeout > 0 {
+		return c.env.MPCRoundTimeout
+	}
+	return network.RoundTimeout
+}
+
+// startRun returns the context of an MPC run of session, which also ends
+// when the session is cancelled, and the func to call once the run is over.
+func (c *Client) startRun(session string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(c.background())
+	r := &run{cancel: cancel}
+	c.runsMu.Lock()
+	if c.runs == nil {
+		c.runs = map[string][]*run{}
+	}
+	c.runs[session] = append(c.runs[session], r)
+	c.runsMu.Unlock()
+
+	return ctx, func() {
+		c.runsMu.Lock()
+		c.runs[session] = slices.DeleteFunc(c.runs[session], func(o *run) bool { return o == r })
+		if len(c.runs[session]) == 0 {
+			delete(c.runs, session)
+		}
+		c.runsMu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancelRuns cancels the runs of session and returns how many there were.
+func (c *Client) cancelRuns(session string) int {
+	c.runsMu.Lock()
+	defer c.runsMu.Unlock()
+	for _, r := range c.runs[session] {
+		r.cancel(errSessionCancelled)
+	}
+	return len(c.runs[session])
+}
+
+type sessionStatusResponse struct {
+	Status string `json:"status"`
+}
+
+// watchSessions stops the runs of the sessions the escrow server reports
+// cancelled, until ctx is done, so a party stops even if nobody calls its
+// /v1/session/cancel. It needs the escrow server, see escrowEnabled.
+func (c *Client) watchSessions(ctx context.Context) {
+	if !c.escrowEnabled() {
+		return
+	}
+	ticker := time.NewTicker(sessionPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.pollSessions(ctx)
+		}
+	}
+}
+
+// pollSessions cancels the runs of every session in progress that the
+// escrow server reports cancelled.
+func (c *Client) pollSessions(ctx context.Context) {
+	c.runsMu.Lock()
+	sessions := slices.Collect(maps.Keys(c.runs))
+	c.runsMu.Unlock()
+	for _, session := range sessions {
+		var resp sessionStatusResponse
+		err := c.escrowDo(ctx, http.MethodPost, "/v1/session/status", SessionCancelRequest{SessionID: session}, &resp)
+		if err != nil {
+			c.logger.Debug("session status unknown", "session", session, "error", err)
+			continue
+		}
+		if resp.Status == "cancelled" {
+			n := c.cancelRuns(session)
+			c.logger.Info("session cancelled on the escrow server", "session", session, "runs", n)
+		}
+	}
+}
+
+type SessionCancelRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+type SessionCancelResponse struct {
+	// Cancelled is how many runs of the session were stopped.
+	Cancelled int `json:"cancelled"`
+}
+
+// cancelSession stops the MPC runs of a session.
+//
+// @Summary      Cancel a session's MPC runs
+// @Description  Stop the keygen, presign, refresh, reshare or signing runs of session_id (the hash for a signing) on this client. Each run tells the other parties, whose runs fail as aborted, and answers its own request with a "cancelled" failure. A client with ESCROW_API_KEY also stops the runs of a session cancelled on the escrow server by itself, within a few seconds; the partner's client stops even if it never hears of the cancellation. The confirmation after a refresh or resharing is not cancelled, so the parties never end up with different shares.
+// @Tags         session
+// @Accept       json
+// @Produce      json
+// @Param        body  body      SessionCancelRequest  true  "Session to cancel"
+// @Success      200   {object}  SessionCancelResponse
+// @Failure      400   {object}  ErrorResponse
+// @Router       /v1/session/cancel [post]
+func (c *Client) cancelSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SessionCancelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.SessionID == "" {
+			respondError(w, http.StatusBadRequest, errors.New("session_id is required"))
+			return
+		}
+		n := c.cancelRuns(req.SessionID)
+		c.logger.Info("session cancelled", "session", req.SessionID, "runs", n)
+		respondOk(w, SessionCancelResponse{Cancelled: n})
+	}
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/valli0x/signature-escrow/network"
+	"github.com/valli0x/signature-escrow/server/servertest"
+)
+
+func TestCancelSession(t *testing.T) {
+	c, ts := mkLocalClient(t)
+	c.env.MPCRoundTimeout = time.Minute
+
+	ctx1, done1 := c.startRun("s1")
+	ctx2, done2 := c.startRun("s1")
+	defer done2()
+	other, doneOther := c.startRun("s2")
+	defer doneOther()
+	if d := network.RoundTimeoutOf(ctx1); d != time.Minute {
+		t.Fatalf("round timeout %v", d)
+	}
+
+	if code := postBackup(t, ts, "/v1/session/cancel", SessionCancelRequest{}, nil); code != http.StatusBadRequest {
+		t.Fatalf("no session: %d", code)
+	}
+	var resp SessionCancelResponse
+	if code := postBackup(t, ts, "/v1/session/cancel", SessionCancelRequest{SessionID: "s1"}, &resp); code != http.StatusOK || resp.Cancelled != 2 {
+		t.Fatalf("cancel: %d %+v", code, resp)
+	}
+	for _, ctx := range []context.Context{ctx1, ctx2} {
+		if !errors.Is(context.Cause(ctx), errSessionCancelled) {
+			t.Fatalf("run not cancelled: %v", context.Cause(ctx))
+		}
+	}
+	if other.Err() != nil {
+		t.Fatal("a run of another session was cancelled")
+	}
+
+	// A run that is over is no longer cancelled.
+	done1()
+	resp = SessionCancelResponse{}
+	if code := postBackup(t, ts, "/v1/session/cancel", SessionCancelRequest{SessionID: "s1"}, &resp); code != http.StatusOK || resp.Cancelled != 1 {
+		t.Fatalf("cancel again: %d %+v", code, resp)
+	}
+}
+
+func TestWatchSessions(t *testing.T) {
+	ts := newEscrowServer(t)
+	token, _ := servertest.Login(t, ts.URL)
+	c, _ := mkLocalClient(t)
+	c.env.EscrowServer, c.env.EscrowAPIKey = ts.URL, escrowAPIKey(t, ts.URL, token)
+
+	ctx, done := c.startRun("s1")
+	defer done()
+	other, doneOther := c.startRun("s2")
+	defer doneOther()
+
+	// The partner claimed s1 and runs it; the initiator cancels it on the
+	// server all the same, and the client stops.
+	partner, partnerAddr := servertest.Login(t, ts.URL)
+	pair := servertest.Pair(t, ts.URL, token, partner, partnerAddr)
+	session := map[string]string{"session_id": "s1", "pair_id": pair}
+	if _, result, err := servertest.PostJSON(ts.URL+"/v1/session/claim", session, partner); err != nil || result["ok"] != true {
+		t.Fatalf("claim: %v %v", result, err)
+	}
+	c.pollSessions(context.Background())
+	if ctx.Err() != nil {
+		t.Fatal("a claimed session was cancelled")
+	}
+	_, cancelled, err := servertest.PostJSON(ts.URL+"/v1/session/cancel", session, token)
+	if err != nil || cancelled["ok"] != true || cancelled["claimed"] != true {
+		t.Fatalf("cancel: %v %v", cancelled, err)
+	}
+	c.pollSessions(context.Background())
+	if !errors.Is(context.Cause(ctx), errSessionCancelled) {
+		t.Fatalf("run not cancelled: %v", context.Cause(ctx))
+	}
+	if other.Err() != nil {
+		t.Fatal("a run of another session was cancelled")
+	}
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// Schema lists the migrations of the client's storage, oldest first. Never
+// reorder or remove one; append a new migration for every change to the
+// layout or to a stored record.
+var Schema = storage.Schema{
+	Store: "client",
+	Migrations: []storage.Migration{
+		{Version: 1, Name: "split-exchanges", Apply: splitExchanges},
+		{Version: 2, Name: "presig-pools", Apply: presigPools},
+	},
+}
+
+// splitExchanges moves the exchanges from the single list at exchangesKey
+// to one key per exchange. An exchange with an id the handlers would not
+// accept gets a new one.
+func splitExchanges(ctx context.Context, stor storage.Storage) error {
+	data, err := stor.Get(ctx, exchangesKey)
+	if err != nil || data == nil {
+		return err
+	}
+	var list []Exchange
+	if err := cbor.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	ops := make([]storage.Op, 0, len(list)+1)
+	for _, ex := range list {
+		if validateExchangeID(ex.ID) != nil {
+			ex.ID = randID()
+		}
+		value, err := cbor.Marshal(ex)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, storage.Op{Key: exchangesPrefix + ex.ID, Value: value})
+	}
+	return storage.Batch(ctx, stor, append(ops, storage.Op{Key: exchangesKey, Delete: true}))
+}
+
+// presigPools moves every single presignature of an ECDSA account into its
+// signer set's pool, under the id both signers agree on.
+func presigPools(ctx context.Context, stor storage.Storage) error {
+	accounts, err := stor.List(ctx, "accounts/eth/")
+	if err != nil {
+		return err
+	}
+	var ops []storage.Op
+	for _, a := range accounts {
+		if !strings.HasSuffix(a, "/") {
+			continue
+		}
+		base := "accounts/eth/" + strings.TrimSuffix(a, "/")
+		files, err := stor.List(ctx, base+"/")
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if !isPresigFile(f) || strings.Contains(f, ".") {
+				continue
+			}
+			data, err := stor.Get(ctx, base+"/"+f)
+			if err != nil {
+				return err
+			}
+			if data == nil {
+				continue
+			}
+			entry, err := presigEntry(f, data)
+			if err != nil {
+				return err
+			}
+			ops = append(ops,
+				storage.Op{Key: base + "/" + entry, Value: data},
+				storage.Op{Key: base + "/" + f, Delete: true})
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return storage.Batch(ctx, stor, ops)
+}
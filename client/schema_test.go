@@ -0,0 +1,65 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+func TestSplitExchanges(t *testing.T) {
+	c, _ := mkLocalClient(t)
+	ctx := context.Background()
+	legacy, _ := cbor.Marshal([]Exchange{
+		{ID: "aaa", CreatedAt: 1},
+		{ID: "bbb", CreatedAt: 2},
+		{ID: "../x", CreatedAt: 3},
+	})
+	_ = c.stor.Put(ctx, "accounts/eth/1/meta", []byte{})
+	_ = c.stor.Put(ctx, exchangesKey, legacy)
+
+	res, err := storage.Migrate(ctx, c.stor, Schema, storage.MigrateOptions{})
+	if err != nil || res.From != 0 || res.To != Schema.Latest() {
+		t.Fatalf("Migrate: %+v, %v", res, err)
+	}
+	if v, _ := c.stor.Get(ctx, exchangesKey); v != nil {
+		t.Fatal("legacy list kept")
+	}
+	list, err := c.loadExchanges()
+	if err != nil || len(list) != 3 {
+		t.Fatalf("exchanges: %+v, %v", list, err)
+	}
+	if list[1].ID != "bbb" || list[2].ID != "aaa" || validateExchangeID(list[0].ID) != nil {
+		t.Fatalf("exchanges: %+v", list)
+	}
+}
+
+func TestPresigPools(t *testing.T) {
+	c, _ := mkLocalClient(t)
+	ctx := context.Background()
+	signers := party.NewIDSlice([]party.ID{"aa", "bb"})
+	subset := subsetPresigPrefix + subsetID(signers)
+	single, _ := cbor.Marshal(fakePresig(signers, 1))
+	ofSubset, _ := cbor.Marshal(fakePresig(signers, 2))
+	_ = c.stor.Put(ctx, "accounts/eth/1/presig-ecdsa", single)
+	_ = c.stor.Put(ctx, "accounts/eth/1/"+subset, ofSubset)
+	_ = c.stor.Put(ctx, "accounts/eth/2/presig-ecdsa.0303030303030303", single)
+	if _, err := storage.Migrate(ctx, c.stor, Schema, storage.MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string][]byte{
+		"accounts/eth/1/presig-ecdsa":                    nil,
+		"accounts/eth/1/" + subset:                       nil,
+		"accounts/eth/1/presig-ecdsa.0101010101010101":   single,
+		"accounts/eth/1/" + subset + ".0202020202020202": ofSubset,
+		"accounts/eth/2/presig-ecdsa.0303030303030303":   single,
+	} {
+		if got, _ := c.stor.Get(ctx, key); !bytes.Equal(got, want) {
+			t.Fatalf("%s after migration: %d bytes", key, len(got))
+		}
+	}
+}
@@ -13,8 +13,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
 	"github.com/valli0x/signature-escrow/auth"
 	"github.com/valli0x/signature-escrow/config"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
+	"github.com/valli0x/signature-escrow/network"
 	"github.com/valli0x/signature-escrow/storage"
 	"google.golang.org/grpc"
 )
@@ -34,12 +37,25 @@ type Client struct {
 	env         *config.Env
 	storagePass string
 	Conn        *grpc.ClientConn
-	jwtSecret   []byte
+	// dial connects self to parties over the relay, each party receiving
+	// on its channel; tests replace it with an in-process network.
+	dial        func(self party.ID, parties party.IDSlice, channel func(party.ID) string) (network.Network, error)
+	keys        *auth.KeySet
+	siwe        auth.SIWEConfig
 	nonceStore  *auth.NonceStore
+	tokens      *auth.TokenStore
 	authEnabled bool
 	cosignMu    sync.Mutex
 	cosignBusy  map[string]bool
 	histMu      sync.Mutex
+	// runs are the MPC runs in progress by session, see startRun; base is
+	// the context of the client, set by Run.
+	runsMu sync.Mutex
+	runs   map[string][]*run
+	base   context.Context
+	// transcriptKey seals the transcripts of MPC runs; nil when they are
+	// not recorded.
+	transcriptKey []byte
 }
 
 type ClientConfig struct {
@@ -50,7 +66,13 @@ type ClientConfig struct {
 	StoragePass string
 	Conn        *grpc.ClientConn
 	JWTSecret   string
-	ClientAuth  string
+	// JWTKeys signs access tokens. When nil, an HS256 key derived from
+	// JWTSecret or StoragePass is used.
+	JWTKeys    *auth.KeySet
+	ClientAuth string
+	SIWE       auth.SIWEConfig
+	// TranscriptKey turns on MPC transcripts, see config.Env.TranscriptKey.
+	TranscriptKey []byte
 }
 
 func authOn(v string) bool {
@@ -91,18 +113,47 @@ func NewClient(cfg *ClientConfig) *Client {
 		env:         cfg.Env,
 		storagePass: cfg.StoragePass,
 		Conn:        cfg.Conn,
-		jwtSecret:   clientSecret(cfg.JWTSecret, cfg.StoragePass),
+		keys:        cfg.JWTKeys,
+		siwe:        cfg.SIWE,
 		nonceStore:  auth.NewNonceStore(),
+		tokens:      auth.NewTokenStore(cfg.Stor),
 		authEnabled: authOn(cfg.ClientAuth),
 		cosignBusy:  make(map[string]bool),
+
+		transcriptKey: cfg.TranscriptKey,
+	}
+
+	if c.keys == nil {
+		c.keys = auth.NewHMACKeySet(clientSecret(cfg.JWTSecret, cfg.StoragePass))
+	}
+	// The app signs in to the client it talks to on this machine.
+	if c.siwe.Domain == "" {
+		c.siwe.Domain = auth.ListenDomain(cfg.Addr)
 	}
 
+	c.dial = c.dialRelay
 	c.srv.Handler = c.routes()
 
 	return c
 }
 
+// dialRelay connects self to parties through the communication server.
+func (c *Client) dialRelay(self party.ID, parties party.IDSlice, channel func(party.ID) string) (network.Network, error) {
+	net, err := network.NewPartyClient(c.env.Communication, self, parties, channel,
+		c.logger.With("component", "network"), c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	return net, nil
+}
+
 func (c *Client) Run(ctx context.Context) {
+	// A shutdown stops the MPC runs in progress, which tell the other
+	// parties.
+	c.base = ctx
+	c.srv.BaseContext = func(net.Listener) context.Context { return ctx }
+	go c.watchSessions(ctx)
+
 	listener, err := net.Listen(ipv4, c.addr)
 	if err != nil {
 		c.logger.Error("can't listen on address, client quitting", "addr", c.addr, "error", err)
@@ -121,6 +172,19 @@ func (c *Client) Run(ctx context.Context) {
 		}
 	}(wg)
 
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.nonceStore.Cleanup()
+			}
+		}
+	}()
+
 	c.logger.Info("client server listening", "addr", c.addr)
 	if err := c.srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
 		wg.Done()
@@ -144,6 +208,8 @@ func respondOk(w http.ResponseWriter, body interface{}) {
 
 type ErrorResponse struct {
 	Errors []string `json:"errors"`
+	// Failure classifies the failure of an MPC protocol run.
+	Failure *mpcblame.Failure `json:"failure,omitempty"`
 }
 
 func respondError(w http.ResponseWriter, status int, err error) {
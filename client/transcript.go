@@ -0,0 +1,227 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/pool"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+	"github.com/valli0x/signature-escrow/network"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+const (
+	transcriptsPrefix = "transcripts/"
+	// transcriptsMax is how many transcripts are kept; older ones go.
+	transcriptsMax = 100
+)
+
+// recordRun wraps n to record the run t when transcripts are on. Call the
+// returned save with the run's error once it ends; it closes n.
+func (c *Client) recordRun(n network.Network, t network.Transcript) (network.Network, func(error)) {
+	if c.transcriptKey == nil {
+		return n, func(error) {}
+	}
+	rec := network.NewRecorder(n, t)
+	return rec, func(err error) {
+		rec.Done()
+		t := rec.Transcript()
+		if err != nil {
+			t.Error = err.Error()
+		}
+		if err := c.saveTranscript(context.Background(), &t); err != nil {
+			c.logger.Warn("transcript not saved", "protocol", t.Protocol, "session", t.Session, "error", err)
+		}
+	}
+}
+
+// The sides of a FROST signing, see network.Transcript.Role.
+const (
+	roleInc    = "inc"
+	roleCoSign = "cosign"
+)
+
+var digestMode, _ = cbor.CoreDetEncOptions().EncMode()
+
+// configDigest hashes the key share config a run uses, so a replay can
+// tell it still has the same one.
+func configDigest(config any) []byte {
+	data, err := digestMode.Marshal(config)
+	if err != nil {
+		return nil
+	}
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+// errConfigChanged is a transcript whose run used another key share than
+// the one stored now.
+var errConfigChanged = errors.New("the key share is not the one the run used")
+
+// checkConfig returns errConfigChanged unless config is the key share the
+// run of t used.
+func checkConfig(t *network.Transcript, config any) error {
+	if t.Config == nil || !bytes.Equal(t.Config, configDigest(config)) {
+		return fmt.Errorf("%s: %w", t.Account, errConfigChanged)
+	}
+	return nil
+}
+
+// saveTranscript seals and stores t under a new id, which sorts by age, and
+// drops the oldest transcripts past transcriptsMax.
+func (c *Client) saveTranscript(ctx context.Context, t *network.Transcript) error {
+	t.ID = fmt.Sprintf("%013d-%s", t.Started, randID())
+	sealed, err := network.SealTranscript(c.transcriptKey, t)
+	if err != nil {
+		return err
+	}
+	if err := c.stor.Put(ctx, transcriptsPrefix+t.ID, sealed); err != nil {
+		return err
+	}
+	c.logger.Info("transcript saved", "id", t.ID, "protocol", t.Protocol, "messages", len(t.Entries))
+
+	ids, err := c.stor.List(ctx, transcriptsPrefix)
+	if err != nil || len(ids) <= transcriptsMax {
+		return err
+	}
+	slices.Sort(ids)
+	var ops []storage.Op
+	for _, id := range ids[:len(ids)-transcriptsMax] {
+		ops = append(ops, storage.Op{Key: transcriptsPrefix + id, Delete: true})
+	}
+	return storage.Batch(ctx, c.stor, ops)
+}
+
+// TranscriptSummary describes a stored transcript.
+type TranscriptSummary struct {
+	ID       string
+	Protocol string
+	Session  string
+	Account  string
+	Messages int
+	Error    string
+}
+
+// ListTranscripts lists the transcripts in stor, oldest first.
+func ListTranscripts(ctx context.Context, stor storage.Storage, key []byte) ([]TranscriptSummary, error) {
+	ids, err := stor.List(ctx, transcriptsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(ids)
+	var list []TranscriptSummary
+	for _, id := range ids {
+		t, err := loadTranscript(ctx, stor, key, id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		list = append(list, TranscriptSummary{
+			ID: id, Protocol: t.Protocol, Session: t.Session, Account: t.Account,
+			Messages: len(t.Entries), Error: t.Error,
+		})
+	}
+	return list, nil
+}
+
+func loadTranscript(ctx context.Context, stor storage.Storage, key []byte, id string) (*network.Transcript, error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return nil, fmt.Errorf("invalid transcript id %q", id)
+	}
+	sealed, err := stor.Get(ctx, transcriptsPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if sealed == nil {
+		return nil, fmt.Errorf("no transcript %s", id)
+	}
+	return network.OpenTranscript(key, sealed)
+}
+
+// ReplayReport compares a rerun of a transcript with the recorded run.
+type ReplayReport struct {
+	Protocol string
+	// Recorded and Replayed are the errors of the two runs, empty for none.
+	Recorded string
+	Replayed string
+	// Failure classifies the error of the rerun.
+	Failure *mpcblame.Failure
+	// Diverged is the first message the rerun sent that the recorded run
+	// did not, or -1.
+	Diverged int
+}
+
+// ReplayTranscript reruns the side of the party that recorded transcript
+// id, against the messages it received then and the key share in stor.
+// Every run draws fresh randomness, so a rerun reproduces what the other
+// parties sent wrong, not the exact messages of the recorded party; past
+// that, it fails the check of the broadcasts the others echoed.
+func ReplayTranscript(ctx context.Context, stor storage.Storage, key []byte, id string, logger *slog.Logger) (*ReplayReport, error) {
+	t, err := loadTranscript(ctx, stor, key, id)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := network.NewReplay(t)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{stor: stor, logger: logger}
+	base := "accounts/" + t.Account
+	pl := pool.NewPool(0)
+	defer pl.TearDown()
+
+	switch t.Protocol {
+	case "ecdsa-keygen":
+		_, err = mpccmp.CMPKeygenContext(ctx, t.Party, t.Parties, t.Threshold, rep, pl)
+	case "frost-keygen":
+		_, err = mpcfrost.FrostKeygenTaprootContext(ctx, t.Party, t.Parties, t.Threshold, rep)
+	case "ecdsa-presign", "ecdsa-refresh":
+		config, lerr := c.loadECDSAConfig(ctx, base)
+		if lerr != nil {
+			return nil, lerr
+		}
+		if lerr := checkConfig(t, config); lerr != nil {
+			return nil, lerr
+		}
+		if t.Protocol == "ecdsa-presign" {
+			_, err = mpccmp.CMPPreSignContext(ctx, config, t.Parties, rep, pl)
+		} else {
+			_, err = mpccmp.CMPRefreshContext(ctx, config, rep, pl)
+		}
+	case "frost-refresh", "frost-sign":
+		config, lerr := c.loadFROSTConfig(ctx, base)
+		if lerr != nil {
+			return nil, lerr
+		}
+		if lerr := checkConfig(t, config); lerr != nil {
+			return nil, lerr
+		}
+		switch {
+		case t.Protocol == "frost-refresh":
+			_, err = mpcfrost.FrostRefreshTaprootContext(ctx, config, rep)
+		case t.Role == roleInc:
+			err = mpcfrost.FrostSignTaprootIncContext(ctx, config, t.Hash, t.Parties, rep)
+		case t.Role == roleCoSign:
+			_, err = mpcfrost.FrostSignTaprootCoSignContext(ctx, config, t.Hash, t.Parties, rep)
+		default:
+			return nil, fmt.Errorf("the transcript does not say which side of the signing %s ran", t.Party)
+		}
+	default:
+		return nil, fmt.Errorf("%s runs cannot be replayed", t.Protocol)
+	}
+
+	report := &ReplayReport{Protocol: t.Protocol, Recorded: t.Error, Diverged: rep.Diverged()}
+	if err != nil {
+		report.Replayed = err.Error()
+		report.Failure = mpcblame.Classify(t.Party, t.Protocol, t.Session, err)
+	}
+	return report, nil
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/valli0x/signature-escrow/mpc"
+	"github.com/valli0x/signature-escrow/network"
+)
+
+func TestRecordRun(t *testing.T) {
+	c, _ := mkLocalClient(t)
+	ctx := context.Background()
+
+	// Off without a key.
+	hub := mpc.NewPartyHub(party.NewIDSlice([]party.ID{"a", "b"}))
+	n := hub.Net("a")
+	if rec, _ := c.recordRun(n, network.Transcript{}); rec != n {
+		t.Fatal("recorded without a transcript key")
+	}
+
+	c.transcriptKey = make([]byte, 32)
+	rec, save := c.recordRun(hub.Net("a"), network.Transcript{Protocol: "test", Party: "a"})
+	hub["a"] <- &protocol.Message{From: "b", RoundNumber: 1, Data: []byte("in")}
+	if msg := <-rec.Next(); string(msg.Data) != "in" {
+		t.Fatalf("received %+v", msg)
+	}
+	rec.Send(&protocol.Message{From: "a", RoundNumber: 1, Data: []byte("out")})
+	<-hub["b"]
+	save(errors.New("round 2 timed out"))
+
+	list, err := ListTranscripts(ctx, c.stor, c.transcriptKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Protocol != "test" || list[0].Messages != 2 || list[0].Error != "round 2 timed out" {
+		t.Fatalf("transcripts: %+v", list)
+	}
+	if _, err := ListTranscripts(ctx, c.stor, bytes.Repeat([]byte{1}, 32)); err == nil {
+		t.Fatal("listed with a bad key")
+	}
+	if _, err := ReplayTranscript(ctx, c.stor, c.transcriptKey, list[0].ID, c.logger); err == nil {
+		t.Fatal("replayed an unknown protocol")
+	}
+	if _, err := ReplayTranscript(ctx, c.stor, c.transcriptKey, "../accounts", c.logger); err == nil {
+		t.Fatal("replayed outside the transcripts")
+	}
+}
+
+func TestReplayChecksTranscript(t *testing.T) {
+	c, _ := mkLocalClient(t)
+	c.transcriptKey = make([]byte, 32)
+	ctx := network.WithRoundTimeout(context.Background(), 50*time.Millisecond)
+	storeFrostAccount(t, c, 1)
+	config, err := c.loadFROSTConfig(ctx, "accounts/btc/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	save := func(tr network.Transcript) string {
+		tr.Party, tr.Account, tr.Parties = "a", "btc/1", party.IDSlice{"a"}
+		tr.Hash = make([]byte, 32)
+		if err := c.saveTranscript(ctx, &tr); err != nil {
+			t.Fatal(err)
+		}
+		return tr.ID
+	}
+
+	id := save(network.Transcript{Protocol: "frost-sign", Role: roleCoSign, Config: []byte("other share")})
+	if _, err := ReplayTranscript(ctx, c.stor, c.transcriptKey, id, c.logger); !errors.Is(err, errConfigChanged) {
+		t.Fatalf("replayed against another key share: %v", err)
+	}
+	id = save(network.Transcript{Protocol: "frost-refresh"})
+	if _, err := ReplayTranscript(ctx, c.stor, c.transcriptKey, id, c.logger); !errors.Is(err, errConfigChanged) {
+		t.Fatalf("replayed without a recorded key share: %v", err)
+	}
+	id = save(network.Transcript{Protocol: "frost-sign", Config: configDigest(config)})
+	if _, err := ReplayTranscript(ctx, c.stor, c.transcriptKey, id, c.logger); err == nil {
+		t.Fatal("replayed a signing without its side")
+	}
+	for _, role := range []string{roleInc, roleCoSign} {
+		id = save(network.Transcript{Protocol: "frost-sign", Role: role, Config: configDigest(config)})
+		if _, err := ReplayTranscript(ctx, c.stor, c.transcriptKey, id, c.logger); err != nil {
+			t.Fatalf("%s: %v", role, err)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package client
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"regexp"
 	"strings"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
 )
 
 func normalizePartyID(id string) string {
@@ -35,9 +39,13 @@ func validateNetwork(network string) error {
 	return nil
 }
 
+// maxAccountIndex bounds account indexes. Accounts are listed in numeric
+// order (see accountMetas), so the storage layout does not limit them.
+const maxAccountIndex = 1<<31 - 1
+
 func validateIndex(index int) error {
-	if index < 1 || index > 100 {
-		return fmt.Errorf("index must be between 1 and 100")
+	if index < 1 || index > maxAccountIndex {
+		return fmt.Errorf("index must be between 1 and %d", maxAccountIndex)
 	}
 	return nil
 }
@@ -48,3 +56,108 @@ func validateETHAddress(addr string) error {
 	}
 	return nil
 }
+
+// maxParties bounds the key holders of one account.
+const maxParties = 16
+
+// parseParties validates the key holders of an account and returns every
+// party ID, myid included, sorted. others may list myid too, so that every
+// party can send the same list.
+func parseParties(myid string, others []string) (party.IDSlice, error) {
+	ids := []party.ID{party.ID(myid)}
+	seen := map[string]bool{myid: true}
+	for _, other := range others {
+		if err := validateETHAddress(other); err != nil {
+			return nil, fmt.Errorf("parties: %w", err)
+		}
+		id := normalizePartyID(other)
+		if id == myid {
+			continue
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("parties: %s listed twice", other)
+		}
+		seen[id] = true
+		ids = append(ids, party.ID(id))
+	}
+	if len(ids) < 2 {
+		return nil, fmt.Errorf("at least one other party is required")
+	}
+	if len(ids) > maxParties {
+		return nil, fmt.Errorf("at most %d parties", maxParties)
+	}
+	return party.NewIDSlice(ids), nil
+}
+
+// keygenParties returns the key holders of a new account and how many of
+// them sign together: another and the listed parties, and by default all of
+// them.
+func keygenParties(myid, another string, parties []string, threshold int) (party.IDSlice, int, error) {
+	if another != "" {
+		parties = append([]string{another}, parties...)
+	}
+	ids, err := parseParties(myid, parties)
+	if err != nil {
+		return nil, 0, err
+	}
+	if threshold == 0 {
+		threshold = len(ids)
+	}
+	if threshold < 2 || threshold > len(ids) {
+		return nil, 0, fmt.Errorf("threshold must be between 2 and %d", len(ids))
+	}
+	return ids, threshold, nil
+}
+
+// pairOther returns the party recorded as PairOther of a new account:
+// another, or else the first other party.
+func pairOther(myid, another string, parties party.IDSlice) string {
+	if another != "" {
+		return normalizePartyID(another)
+	}
+	for _, id := range parties {
+		if string(id) != myid {
+			return string(id)
+		}
+	}
+	return ""
+}
+
+func idStrings(ids party.IDSlice) []string {
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = string(id)
+	}
+	return out
+}
+
+// subsetID names a sorted set of signers in storage keys.
+func subsetID(signers party.IDSlice) string {
+	sum := sha256.Sum256([]byte(strings.Join(idStrings(signers), ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// parseIDList validates a list of ETH addresses given as field and returns
+// their party IDs, sorted.
+func parseIDList(field string, addrs []string) (party.IDSlice, error) {
+	ids := make([]party.ID, 0, len(addrs))
+	seen := map[string]bool{}
+	for _, addr := range addrs {
+		if err := validateETHAddress(addr); err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		id := normalizePartyID(addr)
+		if seen[id] {
+			return nil, fmt.Errorf("%s: %s listed twice", field, addr)
+		}
+		seen[id] = true
+		ids = append(ids, party.ID(id))
+	}
+	if len(ids) < 2 {
+		return nil, fmt.Errorf("%s: at least two parties are required", field)
+	}
+	if len(ids) > maxParties {
+		return nil, fmt.Errorf("%s: at most %d parties", field, maxParties)
+	}
+	return party.NewIDSlice(ids), nil
+}
@@ -12,12 +12,10 @@ import (
 	"time"
 
 	ethtypes "github.com/ethereum/go-ethereum/core/types"
-	"github.com/fxamacker/cbor/v2"
 	"github.com/taurusgroup/multi-party-sig/pkg/party"
 	"github.com/taurusgroup/multi-party-sig/pkg/pool"
 	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
-	"github.com/taurusgroup/multi-party-sig/protocols/cmp"
-	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
 	"github.com/valli0x/signature-escrow/mpc/mpccmp"
 	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
 	"github.com/valli0x/signature-escrow/network"
@@ -30,17 +28,28 @@ type SendWithdrawalTxRequest struct {
 	HashTx        string `json:"hash_tx"`
 	MyID          string `json:"my_id"`
 	Another       string `json:"another_id"`
-	To            string `json:"to,omitempty"`
-	Amount        string `json:"amount,omitempty"`
-	TxData        string `json:"tx_data,omitempty"`
-	EscrowID      string `json:"escrow_id,omitempty"`
-	Pub           string `json:"pub,omitempty"`
+	// Signers are the parties signing this withdrawal, my_id and
+	// another_id included; by default just those two. With ECDSA every
+	// signer but another_id sends, and another_id accepts.
+	Signers []string `json:"signers,omitempty"`
+	// PresigID picks the ECDSA presignature to sign with, by default the
+	// first in the pool of the signers. Every sender must use the same.
+	PresigID string `json:"presig_id,omitempty"`
+	To       string `json:"to,omitempty"`
+	Amount   string `json:"amount,omitempty"`
+	TxData   string `json:"tx_data,omitempty"`
+	EscrowID string `json:"escrow_id,omitempty"`
+	Pub      string `json:"pub,omitempty"`
 }
 
 type SendWithdrawalTxResponse struct {
-	Status         string `json:"status"`
-	Message        string `json:"message"`
-	PresignRotated bool   `json:"presign_rotated"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// PresignRotated reports that the presignature pool of the signers ran
+	// low and is being replenished in the background.
+	PresignRotated bool `json:"presign_rotated"`
+	// PresigID is the ECDSA presignature used, for the acceptor.
+	PresigID string `json:"presig_id,omitempty"`
 }
 
 type AcceptWithdrawalTxRequest struct {
@@ -48,12 +57,18 @@ type AcceptWithdrawalTxRequest struct {
 	Name          string `json:"name"`
 	EscrowAddress string `json:"escrow_address"`
 	MyID          string `json:"my_id"`
-	Another       string `json:"another_id"`
-	HashTx        string `json:"hash_tx,omitempty"`
-	To            string `json:"to,omitempty"`
-	Amount        string `json:"amount,omitempty"`
-	TxData        string `json:"tx_data,omitempty"`
-	EscrowID      string `json:"escrow_id,omitempty"`
+	Another       string `json:"another_id,omitempty"`
+	// Signers are as in SendWithdrawalTxRequest; another_id may be left out
+	// when they are listed.
+	Signers []string `json:"signers,omitempty"`
+	// PresigID, when set, is the ECDSA presignature the senders must have
+	// used; they name it in their incomplete signatures either way.
+	PresigID string `json:"presig_id,omitempty"`
+	HashTx   string `json:"hash_tx,omitempty"`
+	To       string `json:"to,omitempty"`
+	Amount   string `json:"amount,omitempty"`
+	TxData   string `json:"tx_data,omitempty"`
+	EscrowID string `json:"escrow_id,omitempty"`
 }
 
 type AcceptWithdrawalTxResponse struct {
@@ -66,13 +81,15 @@ type AcceptWithdrawalTxResponse struct {
 	// check in multi-party-sig's Verify.
 	EscrowSignature string `json:"escrow_signature,omitempty"`
 	Message         string `json:"message"`
-	PresignRotated  bool   `json:"presign_rotated"`
+	// PresignRotated is as in SendWithdrawalTxResponse.
+	PresignRotated bool   `json:"presign_rotated"`
+	PresigID       string `json:"presig_id,omitempty"`
 }
 
 // sendWithdrawalTx initiates the sender half of an MPC withdrawal signature.
 //
 // @Summary      Send incomplete signature
-// @Description  Run the initiating half of an MPC withdrawal signature (ECDSA incomplete signature send, or FROST round2/round3 exchange).
+// @Description  Run the initiating half of an MPC withdrawal signature (ECDSA incomplete signature send, or FROST round2/round3 exchange). For a threshold account every chosen signer but the accepting one calls it with the same signers.
 // @Tags         incomplete-signature
 // @Accept       json
 // @Produce      json
@@ -80,7 +97,10 @@ type AcceptWithdrawalTxResponse struct {
 // @Success      200   {object}  SendWithdrawalTxResponse
 // @Failure      400   {object}  ErrorResponse
 // @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
 // @Failure      500   {object}  ErrorResponse
+// @Failure      502   {object}  ErrorResponse
+// @Failure      504   {object}  ErrorResponse
 // @Router       /v1/incomplete-signature/send [post]
 func (c *Client) sendWithdrawalTx() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -95,6 +115,13 @@ func (c *Client) sendWithdrawalTx() http.HandlerFunc {
 			return
 		}
 
+		if req.PresigID != "" {
+			if err := validatePresigID(req.PresigID); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
 		alg := req.Algorithm
 		name := req.Name
 		escrowAddress := req.EscrowAddress
@@ -102,12 +129,29 @@ func (c *Client) sendWithdrawalTx() http.HandlerFunc {
 		myid := normalizePartyID(req.MyID)
 		another := normalizePartyID(req.Another)
 
-		stor := c.stor
+		meta, err := c.loadAccountMeta(r.Context(), name)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		signers, err := resolveSigners(meta, myid, another, req.Signers)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !signers.Contains(party.ID(another)) {
+			respondError(w, http.StatusBadRequest, errors.New("another_id must be one of the signers"))
+			return
+		}
 
-		net, err := network.NewClient(
-			c.env.Communication,
-			myid+"/cosign/"+hashTxWithdrawal, another+"/cosign/"+hashTxWithdrawal,
-			c.logger.With("component", "network"), c.Conn)
+		// ECDSA sends the incomplete signature to another alone; FROST
+		// exchanges rounds with every signer.
+		netParties := signers
+		if alg == "ecdsa" {
+			netParties = party.NewIDSlice([]party.ID{party.ID(myid), party.ID(another)})
+		}
+		net, err := c.dial(party.ID(myid), netParties,
+			func(id party.ID) string { return string(id) + "/cosign/" + hashTxWithdrawal })
 		if err != nil {
 			c.logger.Error("Failed to setup network", "error", err)
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
@@ -117,37 +161,27 @@ func (c *Client) sendWithdrawalTx() http.HandlerFunc {
 
 		switch alg {
 		case "ecdsa":
-			config := mpccmp.EmptyConfig()
-			data, err := stor.Get(context.Background(), "accounts/"+name+"/conf-ecdsa")
+			config, err := c.loadECDSAConfig(context.Background(), "accounts/"+name)
 			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get config: %v", err))
-				return
-			}
-			if err := config.UnmarshalBinary(data); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal config: %v", err))
+				respondError(w, http.StatusNotFound, err)
 				return
 			}
 
-			presign := mpccmp.EmptyPreSign()
-			data, err = stor.Get(context.Background(), "accounts/"+name+"/presig-ecdsa")
+			hashB, err := hex.DecodeString(hashTxWithdrawal)
 			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get presign: %v", err))
+				respondError(w, http.StatusBadRequest, fmt.Errorf("invalid hash format: %v", err))
 				return
 			}
-			if err := cbor.Unmarshal(data, presign); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal presign: %v", err))
+
+			presign, presigID, err := c.takePresig(context.Background(), "accounts/"+name, presigPool(meta, signers), signers, req.PresigID)
+			if err != nil {
+				respondError(w, presigErrorStatus(err), err)
 				return
 			}
 
 			pl := pool.NewPool(0)
 			defer pl.TearDown()
 
-			hashB, err := hex.DecodeString(hashTxWithdrawal)
-			if err != nil {
-				respondError(w, http.StatusBadRequest, fmt.Errorf("invalid hash format: %v", err))
-				return
-			}
-
 			incSig, err := mpccmp.CMPPreSignOnlineInc(config, presign, hashB, pl)
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to create incomplete signature: %v", err))
@@ -160,12 +194,10 @@ func (c *Client) sendWithdrawalTx() http.HandlerFunc {
 				return
 			}
 
-			tx := struct {
-				IncSig string `json:"inc_sig"`
-				HashTx string `json:"hash_tx"`
-			}{
-				IncSig: incSigHex,
-				HashTx: hashTxWithdrawal,
+			tx := incSigMsg{
+				IncSig:   incSigHex,
+				HashTx:   hashTxWithdrawal,
+				PresigID: presigID,
 			}
 
 			msg := &protocol.Message{}
@@ -175,8 +207,15 @@ func (c *Client) sendWithdrawalTx() http.HandlerFunc {
 				return
 			}
 			net.Send(msg)
+			// The presignature was made with the other signers under these
+			// shares, so they hold them as well.
+			c.commitAfterSign(context.Background(), name, meta)
 
-			go c.rotateECDSAPresign(name, myid, another, hashTxWithdrawal, config)
+			replenish := c.presigPoolLow(context.Background(), name, meta, signers)
+			if replenish {
+				c.fillPresigPool(name, myid, signers, config,
+					func(id party.ID) string { return string(id) + "/rotate/" + hashTxWithdrawal })
+			}
 
 			net0, idx0 := parseAccountName(name)
 			status0 := "sent"
@@ -190,26 +229,22 @@ func (c *Client) sendWithdrawalTx() http.HandlerFunc {
 				TxData: req.TxData, EscrowID: req.EscrowID, Pub: req.Pub,
 			})
 
+			message := "Incomplete signature sent"
+			if replenish {
+				message += "; presignature pool replenishing in background"
+			}
 			response := SendWithdrawalTxResponse{
 				Status:         "sent",
-				Message:        "Incomplete signature sent; presignature refreshing in background",
-				PresignRotated: false,
+				Message:        message,
+				PresignRotated: replenish,
+				PresigID:       presigID,
 			}
 			respondOk(w, response)
 
 		case "frost":
-			config := &frost.TaprootConfig{}
-			data, err := stor.Get(context.Background(), "accounts/"+name+"/conf-frost")
+			config, err := c.loadFROSTConfig(context.Background(), "accounts/"+name)
 			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get frost config: %v", err))
-				return
-			}
-			if data == nil {
-				respondError(w, http.StatusNotFound, fmt.Errorf("frost config not found for %s/%s", name, escrowAddress))
-				return
-			}
-			if err := cbor.Unmarshal(data, config); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal frost config: %v", err))
+				respondError(w, http.StatusNotFound, err)
 				return
 			}
 
@@ -219,13 +254,25 @@ func (c *Client) sendWithdrawalTx() http.HandlerFunc {
 				return
 			}
 
-			signers := party.NewIDSlice([]party.ID{party.ID(myid), party.ID(another)})
-
-			if err := mpcfrost.FrostSignTaprootInc(config, hashB, signers, net); err != nil {
-				c.logger.Error("FROST inc signing failed", "error", err)
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("frost inc signing failed: %v", err))
+			ctx, done := c.startRun(hashTxWithdrawal)
+			defer done()
+			rec, save := c.recordRun(net, network.Transcript{
+				Protocol: "frost-sign", Session: hashTxWithdrawal, Party: party.ID(myid),
+				Account: name, Parties: signers, Hash: hashB, Role: roleInc, Config: configDigest(config),
+			})
+			err = mpcfrost.FrostSignTaprootIncContext(ctx, config, hashB, signers, rec)
+			save(err)
+			if err != nil {
+				net0, idx0 := parseAccountName(name)
+				f := c.protocolFailure(myid, signers, "frost-sign", hashTxWithdrawal, err)
+				c.cosignFailed(w, CosignEvent{
+					Role: "initiator", Network: net0, Index: idx0, Escrow: escrowAddress,
+					To: req.To, Amount: req.Amount, Hash: hashTxWithdrawal,
+					TxData: req.TxData, EscrowID: req.EscrowID, Pub: req.Pub,
+				}, f, fmt.Errorf("frost inc signing failed: %w", err))
 				return
 			}
+			c.commitAfterSign(context.Background(), name, meta)
 
 			respondOk(w, SendWithdrawalTxResponse{
 				Status:  "sent",
@@ -242,7 +289,7 @@ func (c *Client) sendWithdrawalTx() http.HandlerFunc {
 // acceptWithdrawalTx completes the receiver half of an MPC withdrawal signature.
 //
 // @Summary      Accept incomplete signature
-// @Description  Run the accepting half of an MPC withdrawal signature and return the complete signature (ECDSA co-sign, or FROST co-sign).
+// @Description  Run the accepting half of an MPC withdrawal signature and return the complete signature (ECDSA co-sign of every other signer's incomplete signature, or FROST co-sign).
 // @Tags         incomplete-signature
 // @Accept       json
 // @Produce      json
@@ -250,7 +297,10 @@ func (c *Client) sendWithdrawalTx() http.HandlerFunc {
 // @Success      200   {object}  AcceptWithdrawalTxResponse
 // @Failure      400   {object}  ErrorResponse
 // @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
 // @Failure      500   {object}  ErrorResponse
+// @Failure      502   {object}  ErrorResponse
+// @Failure      504   {object}  ErrorResponse
 // @Router       /v1/incomplete-signature/accept [post]
 func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -260,7 +310,7 @@ func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 			return
 		}
 
-		if req.Algorithm == "" || req.Name == "" || req.EscrowAddress == "" || req.MyID == "" || req.Another == "" {
+		if req.Algorithm == "" || req.Name == "" || req.EscrowAddress == "" || req.MyID == "" || (req.Another == "" && len(req.Signers) == 0) {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("alg, name and escrow_address are required"))
 			return
 		}
@@ -275,6 +325,12 @@ func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("tx_data is required: the co-signer must verify what it signs"))
 			return
 		}
+		if req.PresigID != "" {
+			if err := validatePresigID(req.PresigID); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
 
 		alg := req.Algorithm
 		name := req.Name
@@ -316,12 +372,19 @@ func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 			}()
 		}
 
-		stor := c.stor
+		meta, err := c.loadAccountMeta(r.Context(), name)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		signers, err := resolveSigners(meta, myid, another, req.Signers)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
 
-		net, err := network.NewClient(
-			c.env.Communication,
-			myid+"/cosign/"+req.HashTx, another+"/cosign/"+req.HashTx,
-			c.logger.With("component", "network"), c.Conn)
+		net, err := c.dial(party.ID(myid), signers,
+			func(id party.ID) string { return string(id) + "/cosign/" + req.HashTx })
 		if err != nil {
 			c.logger.Error("Failed to setup network", "error", err)
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("network setup failed: %w", err))
@@ -329,24 +392,31 @@ func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 		}
 		defer net.Done()
 
+		// A signing is cancelled by its hash.
+		ctx, done := c.startRun(req.HashTx)
+		defer done()
+
 		switch alg {
 		case "ecdsa":
-			var msg *protocol.Message
-			select {
-			case msg = <-net.Next():
-			case <-time.After(90 * time.Second):
-				respondError(w, http.StatusGatewayTimeout,
-					errors.New("timed out waiting for the other party's incomplete signature"))
+			net0, idx0 := parseAccountName(name)
+			failed := CosignEvent{
+				Role: "acceptor", Network: net0, Index: idx0, Escrow: address,
+				To: req.To, Amount: req.Amount, Hash: req.HashTx,
+				TxData: req.TxData, EscrowID: req.EscrowID,
+			}
+			tx, incSigs, err := collectIncSigs(ctx, net, party.ID(myid), signers, 90*time.Second)
+			if err != nil {
+				f := c.protocolFailure(myid, signers, "ecdsa-sign", req.HashTx, err)
+				c.cosignFailed(w, failed, f, err)
 				return
 			}
-
-			tx := struct {
-				IncSig string `json:"inc_sig"`
-				HashTx string `json:"hash_tx"`
-			}{}
-
-			if err := json.Unmarshal(msg.Data, &tx); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal message: %v", err))
+			failed.Hash = tx.HashTx
+			if err := validatePresigID(tx.PresigID); err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("the incomplete signatures name no presignature: %w", err))
+				return
+			}
+			if req.PresigID != "" && req.PresigID != tx.PresigID {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("the senders used presignature %s, not %s", tx.PresigID, req.PresigID))
 				return
 			}
 
@@ -369,25 +439,9 @@ func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 				}
 			}
 
-			config := mpccmp.EmptyConfig()
-			data, err := stor.Get(context.Background(), "accounts/"+name+"/conf-ecdsa")
+			config, err := c.loadECDSAConfig(context.Background(), "accounts/"+name)
 			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get config: %v", err))
-				return
-			}
-			if err := config.UnmarshalBinary(data); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal config: %v", err))
-				return
-			}
-
-			presign := mpccmp.EmptyPreSign()
-			data, err = stor.Get(context.Background(), "accounts/"+name+"/presig-ecdsa")
-			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get presign: %v", err))
-				return
-			}
-			if err := cbor.Unmarshal(data, presign); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal presign: %v", err))
+				respondError(w, http.StatusNotFound, err)
 				return
 			}
 
@@ -397,20 +451,23 @@ func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 				return
 			}
 
-			incSig, err := mpccmp.HexToMsg(tx.IncSig)
+			presign, _, err := c.takePresig(context.Background(), "accounts/"+name, presigPool(meta, signers), signers, tx.PresigID)
 			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to convert hex to message: %v", err))
+				respondError(w, presigErrorStatus(err), err)
 				return
 			}
 
 			pl := pool.NewPool(0)
 			defer pl.TearDown()
 
-			sig, err := mpccmp.CMPPreSignOnlineCoSign(config, presign, hashB, incSig, pl)
+			sig, err := mpccmp.CMPPreSignOnlineCoSign(config, presign, hashB, incSigs, pl)
 			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to complete signature: %v", err))
+				f := c.protocolFailure(myid, signers, "ecdsa-sign", tx.HashTx, err)
+				c.cosignFailed(w, failed, f, fmt.Errorf("failed to complete signature: %w", err))
 				return
 			}
+			// The signature verified, so the signers hold the same shares.
+			c.commitAfterSign(context.Background(), name, meta)
 
 			escrowSig, err := mpccmp.GetSigByte(sig)
 			if err != nil {
@@ -427,9 +484,12 @@ func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 			completeSignature := hex.EncodeToString(sigEthereum)
 			escrowSignature := hex.EncodeToString(escrowSig)
 
-			go c.rotateECDSAPresign(name, myid, another, tx.HashTx, config)
+			replenish := c.presigPoolLow(context.Background(), name, meta, signers)
+			if replenish {
+				c.fillPresigPool(name, myid, signers, config,
+					func(id party.ID) string { return string(id) + "/rotate/" + tx.HashTx })
+			}
 
-			net0, idx0 := parseAccountName(name)
 			c.recordCosign(CosignEvent{
 				Role: "acceptor", Status: "completed",
 				Network: net0, Index: idx0, Escrow: address,
@@ -443,7 +503,8 @@ func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 				CompleteSignature: completeSignature,
 				EscrowSignature:   escrowSignature,
 				Message:           "Another complete signature of the withdrawal transaction",
-				PresignRotated:    false,
+				PresignRotated:    replenish,
+				PresigID:          tx.PresigID,
 			}
 			respondOk(w, response)
 
@@ -459,29 +520,29 @@ func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 				return
 			}
 
-			config := &frost.TaprootConfig{}
-			data, err := stor.Get(context.Background(), "accounts/"+name+"/conf-frost")
+			config, err := c.loadFROSTConfig(context.Background(), "accounts/"+name)
 			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to get frost config: %v", err))
+				respondError(w, http.StatusNotFound, err)
 				return
 			}
-			if data == nil {
-				respondError(w, http.StatusNotFound, fmt.Errorf("frost config not found for %s/%s", name, address))
-				return
-			}
-			if err := cbor.Unmarshal(data, config); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal frost config: %v", err))
-				return
-			}
-
-			signers := party.NewIDSlice([]party.ID{party.ID(myid), party.ID(another)})
 
-			sig, err := mpcfrost.FrostSignTaprootCoSign(config, hashB, signers, net)
+			rec, save := c.recordRun(net, network.Transcript{
+				Protocol: "frost-sign", Session: req.HashTx, Party: party.ID(myid),
+				Account: name, Parties: signers, Hash: hashB, Role: roleCoSign, Config: configDigest(config),
+			})
+			sig, err := mpcfrost.FrostSignTaprootCoSignContext(ctx, config, hashB, signers, rec)
+			save(err)
 			if err != nil {
-				c.logger.Error("FROST co-sign failed", "error", err)
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("frost co-sign failed: %v", err))
+				net0, idx0 := parseAccountName(name)
+				f := c.protocolFailure(myid, signers, "frost-sign", req.HashTx, err)
+				c.cosignFailed(w, CosignEvent{
+					Role: "acceptor", Network: net0, Index: idx0, Escrow: address,
+					To: req.To, Amount: req.Amount, Hash: req.HashTx,
+					TxData: req.TxData, EscrowID: req.EscrowID,
+				}, f, fmt.Errorf("frost co-sign failed: %w", err))
 				return
 			}
+			c.commitAfterSign(context.Background(), name, meta)
 
 			respondOk(w, AcceptWithdrawalTxResponse{
 				Status:            "completed",
@@ -497,45 +558,65 @@ func (c *Client) acceptWithdrawalTx() http.HandlerFunc {
 	}
 }
 
-func (c *Client) rotateECDSAPresign(name, myid, another, roundID string, config *cmp.Config) bool {
-	presigKey := "accounts/" + name + "/presig-ecdsa"
-
-	signers := party.NewIDSlice([]party.ID{party.ID(myid), party.ID(another)})
-
-	net, err := network.NewClient(
-		c.env.Communication,
-		myid+"/rotate/"+roundID, another+"/rotate/"+roundID,
-		c.logger.With("component", "network"), c.Conn,
-	)
-	if err != nil {
-		c.logger.Error("presign rotation: network setup failed", "error", err)
-		_ = c.stor.Delete(context.Background(), presigKey)
-		return false
+// presigErrorStatus is the status of an error from takePresig.
+func presigErrorStatus(err error) int {
+	if errors.Is(err, errNoPresig) {
+		return http.StatusConflict
 	}
-	defer net.Done()
-
-	pl := pool.NewPool(0)
-	defer pl.TearDown()
+	return http.StatusInternalServerError
+}
 
-	newPresig, err := mpccmp.CMPPreSign(config, signers, net, pl)
-	if err != nil {
-		c.logger.Error("presign rotation failed", "error", err)
-		_ = c.stor.Delete(context.Background(), presigKey)
-		return false
-	}
+type incSigMsg struct {
+	IncSig   string `json:"inc_sig"`
+	HashTx   string `json:"hash_tx"`
+	PresigID string `json:"presig_id"`
+}
 
-	b, err := cbor.Marshal(newPresig)
-	if err != nil {
-		c.logger.Error("presign rotation: marshal failed", "error", err)
-		_ = c.stor.Delete(context.Background(), presigKey)
-		return false
+// collectIncSigs waits for the incomplete signature of every signer but
+// self, or for ctx. They must all be for the same hash, from the same
+// presignature.
+func collectIncSigs(ctx context.Context, net network.Network, self party.ID, signers party.IDSlice, timeout time.Duration) (incSigMsg, []*protocol.Message, error) {
+	var tx incSigMsg
+	incSigs := make(map[party.ID]*protocol.Message)
+	deadline := time.After(timeout)
+	for len(incSigs) < len(signers)-1 {
+		var msg *protocol.Message
+		select {
+		case msg = <-net.Next():
+		case <-deadline:
+			var waiting []party.ID
+			for _, id := range signers {
+				if _, ok := incSigs[id]; !ok && id != self {
+					waiting = append(waiting, id)
+				}
+			}
+			return tx, nil, fmt.Errorf("incomplete signatures: got %d of %d: %w",
+				len(incSigs), len(signers)-1, &network.TimeoutError{Waiting: waiting})
+		case <-ctx.Done():
+			return tx, nil, fmt.Errorf("incomplete signatures: %w", &network.CancelError{Cause: context.Cause(ctx)})
+		}
+		var m incSigMsg
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			continue
+		}
+		incSig, err := mpccmp.HexToMsg(m.IncSig)
+		if err != nil || incSig.From == self || !signers.Contains(incSig.From) {
+			continue
+		}
+		if len(incSigs) == 0 {
+			tx = m
+		} else if !strings.EqualFold(m.HashTx, tx.HashTx) {
+			return tx, nil, fmt.Errorf("signer %s sent a different hash_tx: %w", incSig.From, mpcblame.ErrMismatch)
+		} else if m.PresigID != tx.PresigID {
+			return tx, nil, fmt.Errorf("signer %s used a different presignature: %w", incSig.From, mpcblame.ErrMismatch)
+		}
+		incSigs[incSig.From] = incSig
 	}
-
-	if err := c.stor.Put(context.Background(), presigKey, b); err != nil {
-		c.logger.Error("presign rotation: save failed", "error", err)
-		return false
+	out := make([]*protocol.Message, 0, len(incSigs))
+	for _, id := range signers {
+		if m, ok := incSigs[id]; ok {
+			out = append(out, m)
+		}
 	}
-
-	c.logger.Info("presignature rotated", "account", name)
-	return true
+	return tx, out, nil
 }
@@ -1,23 +1,100 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 type Env struct {
 	Mode string
 
 	ServerAddr string
 	JWTSecret  string
+	// ServerState is "storage" (nonces and session claims in shared
+	// storage, replica-safe) or "memory".
+	ServerState string
+	// JWTAlg is HS256, ES256 or EdDSA. Empty selects HS256 when JWTSecret
+	// is set and ES256 otherwise.
+	JWTAlg         string
+	JWTKeyRotation time.Duration
+
+	// RateLimits is "group=N/unit[:burst],..." for the ip, auth, mailbox
+	// and default groups, or "off".
+	RateLimits     string
+	RateLimitProxy bool
+	// LoginMaxFailures failed logins within LoginLockout lock the client
+	// out for LoginLockout; zero disables the lockout.
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+
+	// ServerSeal "shamir" starts MODE=server sealed: the storage opens with
+	// the unseal keys MODE=init-seal made (SealShares keys, SealThreshold
+	// needed) instead of StoragePass.
+	ServerSeal    string
+	SealShares    int
+	SealThreshold int
+
+	SIWEDomain    string
+	SIWEURI       string
+	SIWEChainID   int64
+	SIWEStatement string
+	LegacyLogin   bool
 
 	ClientAddr string
 	ClientAuth string
+	// PresigPoolSize is how many ECDSA presignatures the client keeps for
+	// each set of signers of an account.
+	PresigPoolSize int
+	// TranscriptKey, 32 bytes in hex, turns on recording the messages of
+	// every MPC run into encrypted transcripts (see MODE=replay-transcript).
+	TranscriptKey string
+	// TranscriptID is the transcript MODE=replay-transcript replays; without
+	// it the mode lists them.
+	TranscriptID string
+	// MPCRoundTimeout is how long an MPC run waits for a round.
+	MPCRoundTimeout time.Duration
 
 	Communication string
 	NatsURL       string
 
-	StoragePath string
-	StoragePass string
+	// StorageBackend is "file" (one file per key), "bolt" (a single
+	// transactional file, see MODE=migrate-storage), "raft" (replicated
+	// over several server nodes) or "memory" (nothing persisted, for
+	// throwaway dev servers).
+	StorageBackend string
+	StoragePath    string
+	StoragePass    string
+	// StorageVersioned lists comma-separated key prefixes whose encrypted
+	// values carry version counters, so a rolled-back copy is refused.
+	StorageVersioned string
+	// StorageNewPass is the password MODE=rekey-storage switches to.
+	StorageNewPass string
+	// StorageMigrateTo is the bolt data directory MODE=migrate-storage
+	// copies the file backend at StoragePath into.
+	StorageMigrateTo string
+	// StorageSchemaDryRun makes MODE=server and MODE=client log the pending
+	// schema migrations and exit without changing anything.
+	StorageSchemaDryRun bool
+
+	// Raft settings for STORAGE_BACKEND=raft; the node keeps its log and
+	// snapshots in StoragePath. RaftNodeID defaults to the host name.
+	// RaftBootstrap forms a new cluster; RaftJoin is a member address to
+	// join through, and the member MODE=raft-remove talks to. RaftSecret is
+	// shared by every node and authenticates them to each other.
+	RaftNodeID    string
+	RaftAddr      string
+	RaftAdvertise string
+	RaftBootstrap bool
+	RaftJoin      string
+	RaftSecret    string
 
+	// EscrowServer is the escrow server the client reaches with
+	// EscrowAPIKey, an API key of the party's address with the mailbox
+	// scope, to tell the other parties why an MPC run failed. Without the
+	// key the client does not reach it.
 	EscrowServer     string
+	EscrowAPIKey     string
 	EthereumRPC      string
 	BlockCypherToken string
 }
@@ -29,16 +106,55 @@ func LoadFromEnv() *Env {
 		ServerAddr: getenv("SERVER_ADDR", ":8282"),
 		JWTSecret:  getenv("JWT_SECRET", ""),
 
+		ServerState: getenv("SERVER_STATE", "storage"),
+
+		JWTAlg:         getenv("JWT_ALG", ""),
+		JWTKeyRotation: getenvDuration("JWT_KEY_ROTATION", 30*24*time.Hour),
+
+		RateLimits:       getenv("RATE_LIMITS", "ip=20/s:50,auth=10/m:10,mailbox=120/m:30,default=300/m:60"),
+		RateLimitProxy:   getenvBool("RATE_LIMIT_TRUST_PROXY", false),
+		LoginMaxFailures: int(getenvInt("LOGIN_MAX_FAILURES", 5)),
+		LoginLockout:     getenvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+
+		ServerSeal:    getenv("SERVER_SEAL", ""),
+		SealShares:    int(getenvInt("SEAL_SHARES", 5)),
+		SealThreshold: int(getenvInt("SEAL_THRESHOLD", 3)),
+
+		SIWEDomain:    getenv("SIWE_DOMAIN", ""),
+		SIWEURI:       getenv("SIWE_URI", ""),
+		SIWEChainID:   getenvInt("SIWE_CHAIN_ID", 1),
+		SIWEStatement: getenv("SIWE_STATEMENT", "Sign in to MPC Oven"),
+		LegacyLogin:   getenvBool("AUTH_LEGACY_MESSAGE", false),
+
 		ClientAddr: getenv("CLIENT_ADDR", ":8080"),
 		ClientAuth: getenv("CLIENT_AUTH", "on"),
 
+		PresigPoolSize:  int(getenvInt("PRESIG_POOL_SIZE", 4)),
+		TranscriptKey:   getenv("MPC_TRANSCRIPT_KEY", ""),
+		TranscriptID:    getenv("TRANSCRIPT_ID", ""),
+		MPCRoundTimeout: getenvDuration("MPC_ROUND_TIMEOUT", 2*time.Minute),
+
 		Communication: getenv("COMMUNICATION_ADDR", "localhost:6379"),
 		NatsURL:       getenv("NATS_URL", "nats://localhost:4222"),
 
-		StoragePath: getenv("STORAGE_PATH", "./data"),
-		StoragePass: getenv("STORAGE_PASS", ""),
+		StorageBackend:   getenv("STORAGE_BACKEND", "file"),
+		StoragePath:      getenv("STORAGE_PATH", "./data"),
+		StoragePass:      getenv("STORAGE_PASS", ""),
+		StorageVersioned: getenv("STORAGE_VERSIONED", "accounts/"),
+		StorageNewPass:   getenv("STORAGE_NEW_PASS", ""),
+		StorageMigrateTo: getenv("STORAGE_MIGRATE_TO", ""),
+
+		StorageSchemaDryRun: getenvBool("STORAGE_SCHEMA_DRY_RUN", false),
+
+		RaftNodeID:    getenv("RAFT_NODE_ID", hostname()),
+		RaftAddr:      getenv("RAFT_ADDR", ":7000"),
+		RaftAdvertise: getenv("RAFT_ADVERTISE", ""),
+		RaftBootstrap: getenvBool("RAFT_BOOTSTRAP", false),
+		RaftJoin:      getenv("RAFT_JOIN", ""),
+		RaftSecret:    getenv("RAFT_SECRET", ""),
 
 		EscrowServer:     getenv("ESCROW_SERVER", "localhost:8282"),
+		EscrowAPIKey:     getenv("ESCROW_API_KEY", ""),
 		EthereumRPC:      getenv("ETHEREUM_RPC", ""),
 		BlockCypherToken: getenv("BLOCKCYPHER_TOKEN", ""),
 	}
@@ -50,3 +166,35 @@ func getenv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getenvInt(key string, fallback int64) int64 {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+func getenvBool(key string, fallback bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
+
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
@@ -3,13 +3,19 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/joho/godotenv"
+	"github.com/valli0x/signature-escrow/auth"
 	"github.com/valli0x/signature-escrow/client"
 	"github.com/valli0x/signature-escrow/config"
 	"github.com/valli0x/signature-escrow/network"
@@ -47,8 +53,18 @@ func main() {
 		err = runClient(ctx, env, logger)
 	case "communication":
 		err = runCommunication(env, logger)
+	case "migrate-storage":
+		err = runMigrateStorage(ctx, env, logger)
+	case "rekey-storage":
+		err = runRekeyStorage(ctx, env, logger)
+	case "raft-remove":
+		err = runRaftRemove(ctx, env, logger)
+	case "init-seal":
+		err = runInitSeal(ctx, env, logger)
+	case "replay-transcript":
+		err = runReplayTranscript(ctx, env, logger)
 	default:
-		err = fmt.Errorf("unknown MODE: %s (expected: server, client, communication)", env.Mode)
+		err = fmt.Errorf("unknown MODE: %s (expected: server, client, communication, migrate-storage, rekey-storage, raft-remove, init-seal, replay-transcript)", env.Mode)
 	}
 
 	if err != nil {
@@ -58,28 +74,142 @@ func main() {
 }
 
 func runServer(ctx context.Context, env *config.Env, logger *slog.Logger) error {
-	stor, err := makeStorage(env, logger)
+	// Sign-in messages are bound to the server's public domain, which only
+	// the operator knows.
+	if env.SIWEDomain == "" {
+		return errors.New("SIWE_DOMAIN is required in server mode")
+	}
+
+	var contracts auth.ContractCaller
+	if env.EthereumRPC != "" {
+		ec, err := ethclient.DialContext(ctx, env.EthereumRPC)
+		if err != nil {
+			return fmt.Errorf("ethereum rpc: %w", err)
+		}
+		defer ec.Close()
+		contracts = ec
+	}
+
+	var limits server.RateLimits
+	if env.RateLimits != "off" {
+		var err error
+		if limits, err = server.ParseRateLimits(env.RateLimits); err != nil {
+			return fmt.Errorf("RATE_LIMITS: %w", err)
+		}
+	}
+
+	newServer := func(ctx context.Context, stor storage.Storage) (*server.Server, error) {
+		keys, err := jwtKeys(ctx, env, stor)
+		if err != nil {
+			return nil, err
+		}
+		return server.NewServer(&server.ServerConfig{
+			Addr:        env.ServerAddr,
+			Stor:        stor,
+			Logger:      logger,
+			JWTSecret:   []byte(env.JWTSecret),
+			JWTKeys:     keys,
+			KeyRotation: env.JWTKeyRotation,
+			Contracts:   contracts,
+			State:       env.ServerState,
+			SIWE:        siweConfig(env),
+			RateLimits:  limits,
+			TrustProxy:  env.RateLimitProxy,
+			Lockout: server.LoginLockout{
+				MaxFailures: env.LoginMaxFailures,
+				Window:      env.LoginLockout,
+				Duration:    env.LoginLockout,
+			},
+		}), nil
+	}
+
+	switch env.ServerSeal {
+	case "":
+	case "shamir":
+		return runSealedServer(ctx, env, logger, limits, newServer)
+	default:
+		return fmt.Errorf("unknown SERVER_SEAL: %s (expected: shamir, or empty)", env.ServerSeal)
+	}
+
+	stor, closeStor, err := makeStorage(env, logger)
 	if err != nil {
 		return err
 	}
+	defer closeStor()
 
-	srv := server.NewServer(&server.ServerConfig{
-		Addr:      env.ServerAddr,
-		Stor:      stor,
-		Logger:    logger,
-		JWTSecret: []byte(env.JWTSecret),
-	})
+	if done, err := migrateSchema(ctx, env, logger, stor, server.Schema); err != nil || done {
+		return err
+	}
+
+	srv, err := newServer(ctx, stor)
+	if err != nil {
+		return err
+	}
 
 	logger.Info("starting host server", "addr", env.ServerAddr)
 	srv.Run(ctx)
 	return nil
 }
 
+// runSealedServer starts the server sealed; the storage is migrated and the
+// server built each time it is unsealed.
+func runSealedServer(ctx context.Context, env *config.Env, logger *slog.Logger, limits server.RateLimits,
+	newServer func(context.Context, storage.Storage) (*server.Server, error)) error {
+	if env.StoragePass != "" {
+		return fmt.Errorf("SERVER_SEAL=shamir opens the storage with unseal keys, unset STORAGE_PASS")
+	}
+	if env.StorageSchemaDryRun {
+		return fmt.Errorf("STORAGE_SCHEMA_DRY_RUN needs an unsealed storage, run it without SERVER_SEAL")
+	}
+	backend, closeStor, err := makeBackend(env, logger)
+	if err != nil {
+		return err
+	}
+	defer closeStor()
+
+	sealer := server.NewSealer(&server.SealerConfig{
+		Addr:    env.ServerAddr,
+		Backend: backend,
+		Logger:  logger,
+		Open: func(ctx context.Context, stor storage.Storage) (*server.Server, error) {
+			trackVersions(env, stor.(*storage.EncryptedStorage))
+			if _, err := migrateSchema(ctx, env, logger, stor, server.Schema); err != nil {
+				return nil, err
+			}
+			return newServer(ctx, stor)
+		},
+		RateLimits: limits,
+		TrustProxy: env.RateLimitProxy,
+	})
+
+	logger.Info("starting sealed host server", "addr", env.ServerAddr)
+	sealer.Run(ctx)
+	return nil
+}
+
 func runClient(ctx context.Context, env *config.Env, logger *slog.Logger) error {
-	stor, err := makeStorage(env, logger)
+	stor, closeStor, err := makeStorage(env, logger)
 	if err != nil {
 		return err
 	}
+	defer closeStor()
+
+	if done, err := migrateSchema(ctx, env, logger, stor, client.Schema); err != nil || done {
+		return err
+	}
+
+	keys, err := jwtKeys(ctx, env, stor)
+	if err != nil {
+		return err
+	}
+
+	var transcriptKey []byte
+	if env.TranscriptKey != "" {
+		if transcriptKey, err = network.ParseTranscriptKey(env.TranscriptKey); err != nil {
+			return fmt.Errorf("MPC_TRANSCRIPT_KEY: %w", err)
+		}
+		logger.Info("recording MPC transcripts")
+	}
 
 	var commCreds credentials.TransportCredentials = insecure.NewCredentials()
 	if os.Getenv("COMMUNICATION_TLS") == "true" || os.Getenv("COMMUNICATION_TLS") == "1" {
@@ -98,7 +228,11 @@ func runClient(ctx context.Context, env *config.Env, logger *slog.Logger) error
 		StoragePass: env.StoragePass,
 		Conn:        conn,
 		JWTSecret:   env.JWTSecret,
+		JWTKeys:     keys,
 		ClientAuth:  env.ClientAuth,
+		SIWE:        siweConfig(env),
+
+		TranscriptKey: transcriptKey,
 	})
 
 	logger.Info("starting client server", "addr", env.ClientAddr)
@@ -116,21 +250,294 @@ func runCommunication(env *config.Env, logger *slog.Logger) error {
 	return srv.Run()
 }
 
-func makeStorage(env *config.Env, logger *slog.Logger) (storage.Storage, error) {
+func siweConfig(env *config.Env) auth.SIWEConfig {
+	return auth.SIWEConfig{
+		Domain:    env.SIWEDomain,
+		URI:       env.SIWEURI,
+		ChainID:   env.SIWEChainID,
+		Statement: env.SIWEStatement,
+		Legacy:    env.LegacyLogin,
+	}
+}
+
+// jwtKeys returns the asymmetric signing key set, or nil when tokens are
+// signed with the shared HS256 secret.
+func jwtKeys(ctx context.Context, env *config.Env, stor storage.Storage) (*auth.KeySet, error) {
+	alg := env.JWTAlg
+	if alg == "" {
+		alg = auth.AlgES256
+		if env.JWTSecret != "" {
+			alg = auth.AlgHS256
+		}
+	}
+	if alg == auth.AlgHS256 {
+		return nil, nil
+	}
+	keys, err := auth.LoadKeySet(ctx, stor, alg)
+	if err != nil {
+		return nil, fmt.Errorf("jwt keys: %w", err)
+	}
+	if _, err := keys.RotateIfOlder(ctx, env.JWTKeyRotation); err != nil {
+		return nil, fmt.Errorf("jwt key rotation: %w", err)
+	}
+	return keys, nil
+}
+
+func makeStorage(env *config.Env, logger *slog.Logger) (storage.Storage, func(), error) {
+	backend, closeStor, err := makeBackend(env, logger)
+	if err != nil || env.StoragePass == "" {
+		return backend, closeStor, err
+	}
+
+	encStor, err := storage.NewEncryptedStorage(backend, env.StoragePass)
+	if err != nil {
+		closeStor()
+		return nil, nil, fmt.Errorf("encrypted storage: %w", err)
+	}
+	trackVersions(env, encStor)
+	return encStor, closeStor, nil
+}
+
+func trackVersions(env *config.Env, enc *storage.EncryptedStorage) {
+	for _, prefix := range strings.Split(env.StorageVersioned, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			enc.TrackVersions(prefix)
+		}
+	}
+}
+
+// makeBackend opens STORAGE_BACKEND without encryption.
+func makeBackend(env *config.Env, logger *slog.Logger) (storage.Storage, func(), error) {
 	storConf := map[string]string{"path": env.StoragePath}
+	storLogger := logger.With("component", "storage")
 
-	fileStor, err := storage.NewFileStorage(storConf, logger.With("component", "storage"))
+	var backend storage.Storage
+	closeStor := func() {}
+	switch env.StorageBackend {
+	case "", "file":
+		fileStor, err := storage.NewFileStorage(storConf, storLogger)
+		if err != nil {
+			return nil, nil, fmt.Errorf("file storage: %w", err)
+		}
+		backend = fileStor
+	case "bolt":
+		boltStor, err := storage.NewBoltStorage(storConf, storLogger)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bolt storage: %w", err)
+		}
+		backend = boltStor
+		closeStor = func() {
+			if err := boltStor.Close(); err != nil {
+				logger.Error("close storage", "error", err)
+			}
+		}
+	case "raft":
+		if env.RaftSecret == "" {
+			return nil, nil, errors.New("RAFT_SECRET is required for STORAGE_BACKEND=raft")
+		}
+		advertise := env.RaftAdvertise
+		if advertise == "" && strings.HasPrefix(env.RaftAddr, ":") {
+			host, _ := os.Hostname()
+			advertise = host + env.RaftAddr
+		}
+		raftStor, err := storage.NewRaftStorage(storage.RaftConfig{
+			NodeID:    env.RaftNodeID,
+			Addr:      env.RaftAddr,
+			Advertise: advertise,
+			Dir:       env.StoragePath,
+			Secret:    []byte(env.RaftSecret),
+			Bootstrap: env.RaftBootstrap,
+			Join:      env.RaftJoin,
+			Logger:    storLogger,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("raft storage: %w", err)
+		}
+		backend = raftStor
+		closeStor = func() {
+			if err := raftStor.Close(); err != nil {
+				logger.Error("close storage", "error", err)
+			}
+		}
+	case "memory":
+		logger.Warn("STORAGE_BACKEND=memory: nothing is persisted, all data is lost on exit")
+		backend = storage.NewMemoryStorage()
+	default:
+		return nil, nil, fmt.Errorf("unknown STORAGE_BACKEND: %s (expected: file, bolt, raft, memory)", env.StorageBackend)
+	}
+	return backend, closeStor, nil
+}
+
+// migrateSchema brings stor to the latest version of schema, copying it to
+// a directory next to STORAGE_PATH first. With STORAGE_SCHEMA_DRY_RUN it only
+// logs what would run and reports done, so the caller exits.
+func migrateSchema(ctx context.Context, env *config.Env, logger *slog.Logger, stor storage.Storage, schema storage.Schema) (bool, error) {
+	res, err := storage.Migrate(ctx, stor, schema, storage.MigrateOptions{
+		DryRun: env.StorageSchemaDryRun,
+		Backup: func(ctx context.Context, from int) error {
+			path := fmt.Sprintf("%s.schema-v%d-%s", strings.TrimRight(env.StoragePath, "/"), from, time.Now().UTC().Format("20060102T150405Z"))
+			n, err := storage.Snapshot(ctx, stor, path, logger.With("component", "storage"))
+			if err != nil {
+				return err
+			}
+			logger.Info("storage backed up before migrating", "keys", n, "path", path)
+			return nil
+		},
+		Logger: logger,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("file storage: %w", err)
+		return false, fmt.Errorf("storage schema: %w", err)
 	}
+	if env.StorageSchemaDryRun {
+		for _, m := range res.Pending {
+			logger.Info("pending storage migration", "store", schema.Store, "version", m.Version, "name", m.Name)
+		}
+		logger.Info("storage schema dry run", "store", schema.Store, "version", res.From, "latest", schema.Latest())
+		return true, nil
+	}
+	if res.To != res.From {
+		logger.Info("storage schema migrated", "store", schema.Store, "from", res.From, "to", res.To)
+	}
+	return false, nil
+}
 
+// runMigrateStorage copies the file backend at STORAGE_PATH into a bolt
+// database at STORAGE_MIGRATE_TO. Values are copied as stored, so encrypted
+// data stays encrypted under the same STORAGE_PASS. Stop the server first.
+func runMigrateStorage(ctx context.Context, env *config.Env, logger *slog.Logger) error {
+	if env.StorageMigrateTo == "" {
+		return fmt.Errorf("STORAGE_MIGRATE_TO must be set")
+	}
+	storLogger := logger.With("component", "storage")
+
+	src, err := storage.NewFileStorage(map[string]string{"path": env.StoragePath}, storLogger)
+	if err != nil {
+		return fmt.Errorf("file storage: %w", err)
+	}
+	dst, err := storage.NewBoltStorage(map[string]string{"path": env.StorageMigrateTo}, storLogger)
+	if err != nil {
+		return fmt.Errorf("bolt storage: %w", err)
+	}
+	defer dst.Close()
+
+	if keys, err := dst.List(ctx, ""); err != nil {
+		return err
+	} else if len(keys) != 0 {
+		return fmt.Errorf("%s is not empty", env.StorageMigrateTo)
+	}
+
+	n, err := storage.Copy(ctx, dst, src)
+	if err != nil {
+		return fmt.Errorf("migrate storage: %w", err)
+	}
+	logger.Info("storage migrated", "keys", n, "from", env.StoragePath, "to", env.StorageMigrateTo)
+	return nil
+}
+
+// runRekeyStorage re-encrypts the storage at STORAGE_PATH under
+// STORAGE_NEW_PASS. With STORAGE_NEW_PASS empty it only finishes an
+// interrupted rekey or moves values left from before the keyring onto the
+// current data key. Processes running on the file backend keep working while
+// it runs; restart them with the new password afterwards.
+func runRekeyStorage(ctx context.Context, env *config.Env, logger *slog.Logger) error {
 	if env.StoragePass == "" {
-		return fileStor, nil
+		return fmt.Errorf("STORAGE_PASS must be set")
+	}
+	stor, closeStor, err := makeStorage(env, logger)
+	if err != nil {
+		return err
+	}
+	defer closeStor()
+	enc := stor.(*storage.EncryptedStorage)
+
+	var n int
+	if env.StorageNewPass != "" {
+		n, err = enc.Rekey(ctx, env.StorageNewPass)
+	} else {
+		n, err = enc.Reencrypt(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("rekey storage: %w", err)
 	}
+	logger.Info("storage re-encrypted", "values", n, "new_pass", env.StorageNewPass != "")
+	return nil
+}
+
+// runInitSeal splits a new storage master key into SEAL_SHARES unseal keys
+// and prints them. A storage encrypted with STORAGE_PASS is moved onto the
+// master key; afterwards only SERVER_SEAL=shamir opens it.
+func runInitSeal(ctx context.Context, env *config.Env, logger *slog.Logger) error {
+	backend, closeStor, err := makeBackend(env, logger)
+	if err != nil {
+		return err
+	}
+	defer closeStor()
 
-	encStor, err := storage.NewEncryptedStorage(fileStor, env.StoragePass)
+	keys, err := storage.InitSeal(ctx, backend, env.StoragePass, env.SealShares, env.SealThreshold)
 	if err != nil {
-		return nil, fmt.Errorf("encrypted storage: %w", err)
+		return fmt.Errorf("init seal: %w", err)
 	}
-	return encStor, nil
+	logger.Warn("unseal keys created: give one to each operator, they are not stored anywhere",
+		"shares", env.SealShares, "threshold", env.SealThreshold)
+	for i, key := range keys {
+		fmt.Printf("Unseal key %d: %s\n", i+1, base64.StdEncoding.EncodeToString(key))
+	}
+	return nil
+}
+
+// runRaftRemove removes node RAFT_NODE_ID from the Raft cluster, asking the
+// member at RAFT_JOIN. Use it for a node that is gone for good; a node that
+// is only restarting rejoins on its own.
+func runRaftRemove(ctx context.Context, env *config.Env, logger *slog.Logger) error {
+	if env.RaftJoin == "" || env.RaftNodeID == "" || env.RaftSecret == "" {
+		return fmt.Errorf("RAFT_JOIN, RAFT_NODE_ID and RAFT_SECRET must be set")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := storage.RaftRemove(ctx, env.RaftJoin, []byte(env.RaftSecret), env.RaftNodeID); err != nil {
+		return fmt.Errorf("raft remove: %w", err)
+	}
+	logger.Info("raft node removed", "node", env.RaftNodeID, "via", env.RaftJoin)
+	return nil
+}
+
+// runReplayTranscript reruns the recorded side of the MPC transcript
+// TRANSCRIPT_ID from the client storage, or lists the transcripts without
+// one. Stop a client on a bolt storage first.
+func runReplayTranscript(ctx context.Context, env *config.Env, logger *slog.Logger) error {
+	key, err := network.ParseTranscriptKey(env.TranscriptKey)
+	if err != nil {
+		return fmt.Errorf("MPC_TRANSCRIPT_KEY: %w", err)
+	}
+	stor, closeStor, err := makeStorage(env, logger)
+	if err != nil {
+		return err
+	}
+	defer closeStor()
+
+	if env.TranscriptID == "" {
+		list, err := client.ListTranscripts(ctx, stor, key)
+		if err != nil {
+			return err
+		}
+		for _, t := range list {
+			fmt.Printf("%s\t%s\t%s\t%s\t%d messages\t%s\n", t.ID, t.Protocol, t.Account, t.Session, t.Messages, t.Error)
+		}
+		return nil
+	}
+
+	// The replay gets every message up front: a round that still stalls
+	// will not get more.
+	replayCtx := network.WithRoundTimeout(ctx, 10*time.Second)
+	report, err := client.ReplayTranscript(replayCtx, stor, key, env.TranscriptID, logger)
+	if err != nil {
+		return err
+	}
+	logger.Info("transcript replayed", "protocol", report.Protocol, "recorded_error", report.Recorded,
+		"replayed_error", report.Replayed, "diverged_at", report.Diverged)
+	if report.Failure != nil {
+		logger.Info("replay failure", "kind", report.Failure.Kind, "round", report.Failure.Round,
+			"culprits", report.Failure.Culprits, "reporter", report.Failure.Reporter)
+	}
+	return nil
 }
@@ -0,0 +1,176 @@
+package mpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+	"github.com/valli0x/signature-escrow/network"
+)
+
+// garbleNet sends garbage in place of every message.
+type garbleNet struct{ *PartyNet }
+
+func (n garbleNet) Send(msg *protocol.Message) {
+	bad := *msg
+	bad.Data = []byte{0xff}
+	n.PartyNet.Send(&bad)
+}
+
+func TestBlameTimeout(t *testing.T) {
+	defer func(d time.Duration) { network.RoundTimeout = d }(network.RoundTimeout)
+	network.RoundTimeout = 300 * time.Millisecond
+
+	// c never shows up.
+	ids := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	hub := NewPartyHub(ids)
+	var mu sync.Mutex
+	failures := map[party.ID]*mpcblame.Failure{}
+	var wg sync.WaitGroup
+	for _, id := range []party.ID{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mpcfrost.FrostKeygenTaproot(id, ids, 1, hub.Net(id))
+			mu.Lock()
+			failures[id] = mpcblame.Classify(id, "frost-keygen", "s", err)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range []party.ID{"a", "b"} {
+		f := failures[id]
+		if f == nil {
+			t.Fatalf("%s: keygen without c succeeded", id)
+		}
+		switch f.Kind {
+		case mpcblame.KindTimeout:
+			if !slices.Equal(f.Culprits, []string{"c"}) || f.Round == 0 {
+				t.Errorf("%s: %+v", id, f)
+			}
+		case mpcblame.KindAborted:
+			// The other one timed out first and said so.
+		default:
+			t.Errorf("%s: %+v", id, f)
+		}
+	}
+}
+
+func TestBlameInvalidMessage(t *testing.T) {
+	defer func(d time.Duration) { network.RoundTimeout = d }(network.RoundTimeout)
+	network.RoundTimeout = 5 * time.Second
+
+	ids := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	hub := NewPartyHub(ids)
+	var mu sync.Mutex
+	failures := map[party.ID]*mpcblame.Failure{}
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		var n network.Network = hub.Net(id)
+		if id == "b" {
+			n = garbleNet{hub.Net(id)}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mpcfrost.FrostKeygenTaproot(id, ids, 1, n)
+			mu.Lock()
+			failures[id] = mpcblame.Classify(id, "frost-keygen", "s", err)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range []party.ID{"a", "c"} {
+		f := failures[id]
+		if f == nil || f.Kind != mpcblame.KindInvalidMessage || !slices.Equal(f.Culprits, []string{"b"}) {
+			t.Errorf("%s: %+v", id, f)
+		}
+	}
+	if f := failures["b"]; f == nil || f.Kind != mpcblame.KindAborted {
+		t.Errorf("b: %+v", f)
+	}
+}
+
+func TestBlameCancel(t *testing.T) {
+	defer func(d time.Duration) { network.RoundTimeout = d }(network.RoundTimeout)
+	network.RoundTimeout = 10 * time.Second
+
+	// c never shows up, and a cancels the run before b gives up on it.
+	ids := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	hub := NewPartyHub(ids)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	var mu sync.Mutex
+	failures := map[party.ID]*mpcblame.Failure{}
+	var wg sync.WaitGroup
+	for _, id := range []party.ID{"a", "b"} {
+		runCtx := context.Background()
+		if id == "a" {
+			runCtx = ctx
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mpcfrost.FrostKeygenTaprootContext(runCtx, id, ids, 1, hub.Net(id))
+			mu.Lock()
+			failures[id] = mpcblame.Classify(id, "frost-keygen", "s", err)
+			mu.Unlock()
+		}()
+	}
+	start := time.Now()
+	wg.Wait()
+
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("the parties took %v to stop", time.Since(start))
+	}
+	if f := failures["a"]; f == nil || f.Kind != mpcblame.KindCancelled || f.Round == 0 {
+		t.Errorf("a: %+v", f)
+	}
+	if f := failures["b"]; f == nil || f.Kind != mpcblame.KindAborted || f.Reporter != "a" {
+		t.Errorf("b: %+v", f)
+	}
+
+	// A per-round timeout from the context is a timeout.
+	ctx = network.WithRoundTimeout(context.Background(), 200*time.Millisecond)
+	_, err := mpcfrost.FrostKeygenTaprootContext(ctx, "a", ids, 1, NewPartyHub(ids).Net("a"))
+	if f := mpcblame.Classify("a", "frost-keygen", "s", err); f == nil || f.Kind != mpcblame.KindTimeout {
+		t.Errorf("round timeout: %+v", f)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	if mpcblame.Classify("a", "p", "", nil) != nil {
+		t.Fatal("no error was classified")
+	}
+	for _, tc := range []struct {
+		err  error
+		kind mpcblame.Kind
+	}{
+		{fmt.Errorf("cmp signature: %w", mpcblame.ErrSignature), mpcblame.KindVerification},
+		{protocol.Error{Err: errors.New("broadcast verification failed")}, mpcblame.KindVerification},
+		{protocol.Error{Culprits: []party.ID{"a"}, Err: errors.New("sampling failed")}, mpcblame.KindLocal},
+		{protocol.Error{Culprits: []party.ID{"b"}, Err: errors.New("round 3: bad proof")}, mpcblame.KindInvalidMessage},
+		{protocol.Error{Culprits: []party.ID{"b"}, Err: errors.New(`aborted by other party with error: "x"`)}, mpcblame.KindAborted},
+		{errors.New("storage error"), mpcblame.KindLocal},
+		{fmt.Errorf("keygen: %w", &network.CancelError{Round: 2, Cause: context.Canceled}), mpcblame.KindCancelled},
+		{&network.CancelError{Round: 2, Cause: context.DeadlineExceeded}, mpcblame.KindTimeout},
+	} {
+		f := mpcblame.Classify("a", "p", "", tc.err)
+		if f.Kind != tc.kind || f.Validate() != nil {
+			t.Errorf("%v: %+v", tc.err, f)
+		}
+		if tc.kind == mpcblame.KindInvalidMessage && (f.Round != 3 || f.Culprits[0] != "b") {
+			t.Errorf("%v: %+v", tc.err, f)
+		}
+	}
+}
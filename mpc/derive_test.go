@@ -0,0 +1,101 @@
+package mpc
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/pool"
+	"github.com/taurusgroup/multi-party-sig/protocols/cmp"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+)
+
+func TestDeriveCMP(t *testing.T) {
+	ids := party.NewIDSlice([]party.ID{"a", "b"})
+	pools := map[party.ID]*pool.Pool{}
+	for _, id := range ids {
+		pools[id] = pool.NewPool(0)
+		defer pools[id].TearDown()
+	}
+
+	var mu sync.Mutex
+	configs := map[party.ID]*cmp.Config{}
+	hub := NewPartyHub(ids)
+	run(t, ids, func(id party.ID) error {
+		c, err := mpccmp.CMPKeygen(id, ids, 1, hub.Net(id), pools[id])
+		mu.Lock()
+		configs[id] = c
+		mu.Unlock()
+		return err
+	})
+
+	path := []uint32{0, 7}
+	children := map[party.ID]*cmp.Config{}
+	for _, id := range ids {
+		c, err := mpccmp.Derive(configs[id], path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		children[id] = c
+	}
+	if !children["a"].PublicPoint().Equal(children["b"].PublicPoint()) {
+		t.Fatal("parties derived different keys")
+	}
+	if children["a"].PublicPoint().Equal(configs["a"].PublicPoint()) {
+		t.Fatal("child key is the master key")
+	}
+	if _, err := mpccmp.Derive(configs["a"], []uint32{1 << 31}); err == nil {
+		t.Fatal("a hardened index was derived")
+	}
+
+	hash := make([]byte, 32)
+	hash[0] = 5
+	hub = NewPartyHub(ids)
+	run(t, ids, func(id party.ID) error {
+		_, err := mpccmp.CMPSign(children[id], hash, ids, hub.Net(id), pools[id])
+		return err
+	})
+}
+
+func TestDeriveFROST(t *testing.T) {
+	ids := party.NewIDSlice([]party.ID{"a", "b", "c"})
+
+	var mu sync.Mutex
+	configs := map[party.ID]*frost.TaprootConfig{}
+	hub := NewPartyHub(ids)
+	run(t, ids, func(id party.ID) error {
+		c, err := mpcfrost.FrostKeygenTaproot(id, ids, 1, hub.Net(id))
+		mu.Lock()
+		configs[id] = c
+		mu.Unlock()
+		return err
+	})
+
+	path := []uint32{3, 1}
+	children := map[party.ID]*frost.TaprootConfig{}
+	for _, id := range ids {
+		c, err := mpcfrost.DeriveTaproot(configs[id], path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		children[id] = c
+	}
+	if !bytes.Equal(children["a"].PublicKey, children["c"].PublicKey) {
+		t.Fatal("parties derived different keys")
+	}
+	if bytes.Equal(children["a"].PublicKey, configs["a"].PublicKey) {
+		t.Fatal("child key is the master key")
+	}
+
+	hash := make([]byte, 32)
+	hash[0] = 6
+	signers := party.NewIDSlice([]party.ID{"b", "c"})
+	hub = NewPartyHub(signers)
+	run(t, signers, func(id party.ID) error {
+		_, err := mpcfrost.FrostSignTaproot(children[id], hash, signers, hub.Net(id))
+		return err
+	})
+}
@@ -0,0 +1,132 @@
+// Package mpcblame classifies the failures of MPC protocol runs: who, if
+// anyone, is to blame and in which round.
+package mpcblame
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/valli0x/signature-escrow/network"
+)
+
+// Kind is what went wrong in a run.
+type Kind string
+
+const (
+	// KindTimeout: a round stalled; Culprits had not sent it.
+	KindTimeout Kind = "timeout"
+	// KindInvalidMessage: Culprits sent a message that failed its checks.
+	KindInvalidMessage Kind = "invalid_message"
+	// KindAborted: Reporter gave up on the run and said why in Message.
+	KindAborted Kind = "aborted"
+	// KindVerification: the run ended with a result that does not verify,
+	// or a party broadcast different messages, and nobody can be singled
+	// out.
+	KindVerification Kind = "verification"
+	// KindLocal: this party failed on its own, e.g. on corrupt state.
+	KindLocal Kind = "local"
+	// KindCancelled: this party's run was cancelled in Round, e.g. with its
+	// session.
+	KindCancelled Kind = "cancelled"
+)
+
+// Kinds lists every Kind.
+var Kinds = []Kind{KindTimeout, KindInvalidMessage, KindAborted, KindVerification, KindLocal, KindCancelled}
+
+var (
+	// ErrSignature is a signature, or presignature, that came out of a run
+	// but does not verify.
+	ErrSignature = errors.New("signature does not verify")
+	// ErrMismatch is parties that disagree on what they run, where nobody
+	// can tell which of them is wrong.
+	ErrMismatch = errors.New("parties disagree")
+)
+
+// Failure is a classified failure of a run, as reported by Party.
+type Failure struct {
+	// Protocol is the run that failed, e.g. "ecdsa-keygen"; Session is its
+	// session id or the hash being signed.
+	Protocol string   `json:"protocol"`
+	Session  string   `json:"session,omitempty"`
+	Party    string   `json:"party"`
+	Kind     Kind     `json:"kind"`
+	Round    int      `json:"round,omitempty"`
+	Culprits []string `json:"culprits,omitempty"`
+	Reporter string   `json:"reporter,omitempty"`
+	Message  string   `json:"message"`
+}
+
+// roundRe is how the protocol handler names the round of a bad message.
+var roundRe = regexp.MustCompile(`^round (\d+):`)
+
+// Classify returns what err, from the run protocol of self, was. It is nil
+// for a nil err.
+func Classify(self party.ID, protocolName, session string, err error) *Failure {
+	if err == nil {
+		return nil
+	}
+	f := &Failure{Protocol: protocolName, Session: session, Party: string(self), Kind: KindLocal, Message: err.Error()}
+
+	var timeout *network.TimeoutError
+	var cancel *network.CancelError
+	var perr protocol.Error
+	switch {
+	case errors.As(err, &timeout):
+		f.Kind, f.Round, f.Culprits = KindTimeout, timeout.Round, idStrings(timeout.Waiting)
+	case errors.As(err, &cancel):
+		f.Kind, f.Round = KindCancelled, cancel.Round
+		if errors.Is(err, context.DeadlineExceeded) {
+			f.Kind = KindTimeout
+		}
+	case errors.Is(err, ErrSignature), errors.Is(err, ErrMismatch):
+		f.Kind = KindVerification
+	case errors.As(err, &perr):
+		inner := ""
+		if perr.Err != nil {
+			inner = perr.Err.Error()
+		}
+		if m := roundRe.FindStringSubmatch(inner); m != nil {
+			f.Round, _ = strconv.Atoi(m[1])
+		}
+		switch {
+		case strings.HasPrefix(inner, "aborted by other party") && len(perr.Culprits) == 1:
+			f.Kind, f.Reporter = KindAborted, string(perr.Culprits[0])
+		case len(perr.Culprits) == 0:
+			f.Kind = KindVerification
+		case len(perr.Culprits) == 1 && perr.Culprits[0] == self:
+			f.Kind = KindLocal
+		default:
+			f.Kind, f.Culprits = KindInvalidMessage, idStrings(perr.Culprits)
+		}
+	}
+	return f
+}
+
+// Validate reports whether f, e.g. from another party, is well formed.
+func (f *Failure) Validate() error {
+	switch {
+	case f.Protocol == "" || f.Party == "":
+		return errors.New("failure needs protocol and party")
+	case !slices.Contains(Kinds, f.Kind):
+		return errors.New("unknown failure kind")
+	case f.Round < 0:
+		return errors.New("negative round")
+	case len(f.Message) > 1024:
+		return errors.New("failure message too long")
+	}
+	return nil
+}
+
+func idStrings(ids []party.ID) []string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = string(id)
+	}
+	return s
+}
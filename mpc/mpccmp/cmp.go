@@ -1,7 +1,9 @@
 package mpccmp
 
 import (
+	"context"
 	"errors"
+	"fmt"
 
 	"github.com/taurusgroup/multi-party-sig/pkg/ecdsa"
 	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
@@ -10,16 +12,24 @@ import (
 	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
 	"github.com/taurusgroup/multi-party-sig/protocols/cmp"
 
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
 	"github.com/valli0x/signature-escrow/network"
 )
 
+// CMPKeygen is CMPKeygenContext without a context.
 func CMPKeygen(id party.ID, ids party.IDSlice, threshold int, n network.Network, pl *pool.Pool) (*cmp.Config, error) {
+	return CMPKeygenContext(context.Background(), id, ids, threshold, n, pl)
+}
+
+func CMPKeygenContext(ctx context.Context, id party.ID, ids party.IDSlice, threshold int, n network.Network, pl *pool.Pool) (*cmp.Config, error) {
 	h, err := protocol.NewMultiHandler(cmp.Keygen(curve.Secp256k1{}, id, ids, threshold, pl), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	network.HandlerLoop(id, h, n)
+	if err := network.HandlerLoopContext(ctx, id, h, n); err != nil {
+		return nil, err
+	}
 
 	r, err := h.Result()
 	if err != nil {
@@ -29,13 +39,20 @@ func CMPKeygen(id party.ID, ids party.IDSlice, threshold int, n network.Network,
 	return r.(*cmp.Config), nil
 }
 
+// CMPSign is CMPSignContext without a context.
 func CMPSign(c *cmp.Config, m []byte, ids party.IDSlice, n network.Network, pl *pool.Pool) (*ecdsa.Signature, error) {
+	return CMPSignContext(context.Background(), c, m, ids, n, pl)
+}
+
+func CMPSignContext(ctx context.Context, c *cmp.Config, m []byte, ids party.IDSlice, n network.Network, pl *pool.Pool) (*ecdsa.Signature, error) {
 	h, err := protocol.NewMultiHandler(cmp.Sign(c, ids, m, pl), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	network.HandlerLoop(c.ID, h, n)
+	if err := network.HandlerLoopContext(ctx, c.ID, h, n); err != nil {
+		return nil, err
+	}
 
 	signResult, err := h.Result()
 	if err != nil {
@@ -44,35 +61,55 @@ func CMPSign(c *cmp.Config, m []byte, ids party.IDSlice, n network.Network, pl *
 	signature := signResult.(*ecdsa.Signature)
 
 	if !signature.Verify(c.PublicPoint(), m) {
-		return nil, errors.New("failed to verify cmp signature")
+		return nil, fmt.Errorf("cmp signature: %w", mpcblame.ErrSignature)
 	}
 
 	return signature, nil
 }
 
+// CMPRefresh is CMPRefreshContext without a context.
 func CMPRefresh(c *cmp.Config, n network.Network, pl *pool.Pool) (*cmp.Config, error) {
+	return CMPRefreshContext(context.Background(), c, n, pl)
+}
+
+// CMPRefreshContext replaces the shares of every party of c with new ones
+// of the same public key.
+func CMPRefreshContext(ctx context.Context, c *cmp.Config, n network.Network, pl *pool.Pool) (*cmp.Config, error) {
 	hRefresh, err := protocol.NewMultiHandler(cmp.Refresh(c, pl), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	network.HandlerLoop(c.ID, hRefresh, n)
+	if err := network.HandlerLoopContext(ctx, c.ID, hRefresh, n); err != nil {
+		return nil, err
+	}
 
 	r, err := hRefresh.Result()
 	if err != nil {
 		return nil, err
 	}
 
-	return r.(*cmp.Config), nil
+	refreshed := r.(*cmp.Config)
+	if !refreshed.PublicPoint().Equal(c.PublicPoint()) {
+		return nil, errors.New("refresh changed the public key")
+	}
+	return refreshed, nil
 }
 
+// CMPPreSignOnline is CMPPreSignOnlineContext without a context.
 func CMPPreSignOnline(c *cmp.Config, preSignature *ecdsa.PreSignature, m []byte, n network.Network, pl *pool.Pool) (*ecdsa.Signature, error) {
+	return CMPPreSignOnlineContext(context.Background(), c, preSignature, m, n, pl)
+}
+
+func CMPPreSignOnlineContext(ctx context.Context, c *cmp.Config, preSignature *ecdsa.PreSignature, m []byte, n network.Network, pl *pool.Pool) (*ecdsa.Signature, error) {
 	h, err := protocol.NewMultiHandler(cmp.PresignOnline(c, preSignature, m, pl), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	network.HandlerLoop(c.ID, h, n)
+	if err := network.HandlerLoopContext(ctx, c.ID, h, n); err != nil {
+		return nil, err
+	}
 
 	signResult, err := h.Result()
 	if err != nil {
@@ -80,18 +117,25 @@ func CMPPreSignOnline(c *cmp.Config, preSignature *ecdsa.PreSignature, m []byte,
 	}
 	signature := signResult.(*ecdsa.Signature)
 	if !signature.Verify(c.PublicPoint(), m) {
-		return nil, errors.New("failed to verify cmp signature")
+		return nil, fmt.Errorf("cmp signature: %w", mpcblame.ErrSignature)
 	}
 	return signature, nil
 }
 
+// CMPPreSign is CMPPreSignContext without a context.
 func CMPPreSign(c *cmp.Config, signers party.IDSlice, n network.Network, pl *pool.Pool) (*ecdsa.PreSignature, error) {
+	return CMPPreSignContext(context.Background(), c, signers, n, pl)
+}
+
+func CMPPreSignContext(ctx context.Context, c *cmp.Config, signers party.IDSlice, n network.Network, pl *pool.Pool) (*ecdsa.PreSignature, error) {
 	h, err := protocol.NewMultiHandler(cmp.Presign(c, signers, pl), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	network.HandlerLoop(c.ID, h, n)
+	if err := network.HandlerLoopContext(ctx, c.ID, h, n); err != nil {
+		return nil, err
+	}
 
 	signResult, err := h.Result()
 	if err != nil {
@@ -100,7 +144,7 @@ func CMPPreSign(c *cmp.Config, signers party.IDSlice, n network.Network, pl *poo
 
 	preSignature := signResult.(*ecdsa.PreSignature)
 	if err = preSignature.Validate(); err != nil {
-		return nil, errors.New("failed to verify cmp presignature")
+		return nil, fmt.Errorf("cmp presignature: %w", mpcblame.ErrSignature)
 	}
 	return preSignature, nil
 }
@@ -117,13 +161,17 @@ func CMPPreSignOnlineInc(c *cmp.Config, preSignature *ecdsa.PreSignature, m []by
 	return round8, nil
 }
 
-func CMPPreSignOnlineCoSign(c *cmp.Config, preSignature *ecdsa.PreSignature, m []byte, incSig *protocol.Message, pl *pool.Pool) (*ecdsa.Signature, error) {
+// CMPPreSignOnlineCoSign completes the signature from the incomplete
+// signatures of every other signer of preSignature.
+func CMPPreSignOnlineCoSign(c *cmp.Config, preSignature *ecdsa.PreSignature, m []byte, incSigs []*protocol.Message, pl *pool.Pool) (*ecdsa.Signature, error) {
 	h, err := protocol.NewMultiHandler(cmp.PresignOnline(c, preSignature, m, pl), nil)
 	if err != nil {
 		return nil, err
 	}
 	<-h.Listen()
-	h.Accept(incSig)
+	for _, incSig := range incSigs {
+		h.Accept(incSig)
+	}
 
 	signResult, err := h.Result()
 	if err != nil {
@@ -131,7 +179,7 @@ func CMPPreSignOnlineCoSign(c *cmp.Config, preSignature *ecdsa.PreSignature, m [
 	}
 	signature := signResult.(*ecdsa.Signature)
 	if !signature.Verify(c.PublicPoint(), m) {
-		return nil, errors.New("failed to verify cmp signature")
+		return nil, fmt.Errorf("cmp signature: %w", mpcblame.ErrSignature)
 	}
 	return signature, nil
 }
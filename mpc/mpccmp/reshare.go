@@ -0,0 +1,76 @@
+package mpccmp
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/cronokirby/safenum"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/arith"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
+	"github.com/taurusgroup/multi-party-sig/pkg/paillier"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/pedersen"
+	"github.com/taurusgroup/multi-party-sig/pkg/pool"
+	"github.com/taurusgroup/multi-party-sig/protocols/cmp"
+	"github.com/taurusgroup/multi-party-sig/protocols/cmp/config"
+
+	"github.com/valli0x/signature-escrow/mpc/mpcreshare"
+	"github.com/valli0x/signature-escrow/network"
+)
+
+// CMPReshare moves the key to cfg.Receivers and returns the new config of a
+// receiver, or nil for a party that only dealt.
+//
+// Resharing gives the receivers plain ECDSA shares. They then run a CMP
+// refresh on nRefresh, which makes the Paillier, Pedersen and ElGamal keys a
+// CMP config signs with; until then those hold fixed placeholders, which the
+// refresh only hashes.
+func CMPReshare(cfg *mpcreshare.Config, nReshare, nRefresh network.Network, pl *pool.Pool) (*cmp.Config, error) {
+	return CMPReshareContext(context.Background(), cfg, nReshare, nRefresh, pl)
+}
+
+// CMPReshareContext is CMPReshare under ctx.
+func CMPReshareContext(ctx context.Context, cfg *mpcreshare.Config, nReshare, nRefresh network.Network, pl *pool.Pool) (*cmp.Config, error) {
+	res, err := mpcreshare.ReshareContext(ctx, cfg, nReshare)
+	if err != nil {
+		return nil, err
+	}
+	if res.Share == nil {
+		return nil, nil
+	}
+
+	group := curve.Secp256k1{}
+	rid := sha256.Sum256(cfg.Session)
+	modulus := safenum.ModulusFromUint64(placeholderModulus)
+	one := new(safenum.Nat).SetUint64(1)
+	placeholder := func(point curve.Point) *config.Public {
+		return &config.Public{
+			ECDSA:    point,
+			ElGamal:  group.NewBasePoint(),
+			Paillier: paillier.NewPublicKey(modulus),
+			Pedersen: pedersen.New(arith.ModulusFromN(modulus), one, one),
+		}
+	}
+
+	bootstrap := EmptyConfig()
+	bootstrap.ID = cfg.Self
+	bootstrap.Threshold = cfg.Threshold
+	bootstrap.ECDSA = res.Share
+	bootstrap.ElGamal = group.NewScalar()
+	bootstrap.RID = rid[:]
+	bootstrap.ChainKey = res.ChainKey
+	bootstrap.Public = make(map[party.ID]*config.Public, len(res.Public))
+	for id, point := range res.Public {
+		bootstrap.Public[id] = placeholder(point)
+	}
+	if !bootstrap.PublicPoint().Equal(cfg.PublicKey) {
+		return nil, errors.New("reshare changed the public key")
+	}
+
+	return CMPRefreshContext(ctx, bootstrap, nRefresh, pl)
+}
+
+// placeholderModulus stands in for the Paillier and Pedersen moduli of a
+// config that is refreshed before it is used.
+const placeholderModulus = 0xffffffffffffffc5
@@ -123,3 +123,47 @@ func GetAddress(c *cmp.Config) (string, error) {
 
 	return address, nil
 }
+
+// CheckShare reports whether the secret share in c is the one behind the
+// party's public share, e.g. after restoring c from a backup.
+func CheckShare(c *cmp.Config) error {
+	own, ok := c.Public[c.ID]
+	if !ok || own.ECDSA == nil || c.ECDSA == nil {
+		return fmt.Errorf("config has no share for party %s", c.ID)
+	}
+	if !c.ECDSA.ActOnBase().Equal(own.ECDSA) {
+		return fmt.Errorf("secret share of party %s does not match its public share", c.ID)
+	}
+	return nil
+}
+
+// Wipe zeroes the secret scalars of c, once c has been replaced. The
+// Paillier secret key cannot be cleared from outside its package, so it is
+// dropped.
+func Wipe(c *cmp.Config) {
+	if c.ECDSA != nil {
+		c.ECDSA.Set(c.Group.NewScalar())
+	}
+	if c.ElGamal != nil {
+		c.ElGamal.Set(c.Group.NewScalar())
+	}
+	c.Paillier = nil
+}
+
+// Derive returns the shares of the child key at path below the key of c,
+// by non-hardened BIP-32 derivation. It needs no other party: each derives
+// its own share from the public key and chain key they all hold.
+func Derive(c *cmp.Config, path []uint32) (*cmp.Config, error) {
+	for _, i := range path {
+		if i >= 1<<31 {
+			// A hardened child derives from the secret key itself.
+			return nil, fmt.Errorf("index %d is hardened", i)
+		}
+		child, err := c.DeriveBIP32(i)
+		if err != nil {
+			return nil, err
+		}
+		c = child
+	}
+	return c, nil
+}
@@ -1,8 +1,13 @@
 package mpcfrost
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"time"
 
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
 	"github.com/valli0x/signature-escrow/network"
 
 	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
@@ -12,13 +17,20 @@ import (
 	"github.com/taurusgroup/multi-party-sig/protocols/frost"
 )
 
+// FrostKeygen is FrostKeygenContext without a context.
 func FrostKeygen(id party.ID, ids party.IDSlice, threshold int, n network.Network) (*frost.Config, error) {
+	return FrostKeygenContext(context.Background(), id, ids, threshold, n)
+}
+
+func FrostKeygenContext(ctx context.Context, id party.ID, ids party.IDSlice, threshold int, n network.Network) (*frost.Config, error) {
 	h, err := protocol.NewMultiHandler(frost.Keygen(curve.Secp256k1{}, id, ids, threshold), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	network.HandlerLoop(id, h, n)
+	if err := network.HandlerLoopContext(ctx, id, h, n); err != nil {
+		return nil, err
+	}
 
 	r, err := h.Result()
 	if err != nil {
@@ -27,13 +39,20 @@ func FrostKeygen(id party.ID, ids party.IDSlice, threshold int, n network.Networ
 	return r.(*frost.Config), nil
 }
 
+// FrostSign is FrostSignContext without a context.
 func FrostSign(c *frost.Config, id party.ID, m []byte, signers party.IDSlice, n network.Network) error {
+	return FrostSignContext(context.Background(), c, id, m, signers, n)
+}
+
+func FrostSignContext(ctx context.Context, c *frost.Config, id party.ID, m []byte, signers party.IDSlice, n network.Network) error {
 	h, err := protocol.NewMultiHandler(frost.Sign(c, signers, m), nil)
 	if err != nil {
 		return err
 	}
 
-	network.HandlerLoop(id, h, n)
+	if err := network.HandlerLoopContext(ctx, id, h, n); err != nil {
+		return err
+	}
 
 	r, err := h.Result()
 	if err != nil {
@@ -42,18 +61,25 @@ func FrostSign(c *frost.Config, id party.ID, m []byte, signers party.IDSlice, n
 
 	signature := r.(frost.Signature)
 	if !signature.Verify(c.PublicKey, m) {
-		return errors.New("failed to verify frost signature")
+		return fmt.Errorf("frost signature: %w", mpcblame.ErrSignature)
 	}
 	return nil
 }
 
+// FrostKeygenTaproot is FrostKeygenTaprootContext without a context.
 func FrostKeygenTaproot(id party.ID, ids party.IDSlice, threshold int, n network.Network) (*frost.TaprootConfig, error) {
+	return FrostKeygenTaprootContext(context.Background(), id, ids, threshold, n)
+}
+
+func FrostKeygenTaprootContext(ctx context.Context, id party.ID, ids party.IDSlice, threshold int, n network.Network) (*frost.TaprootConfig, error) {
 	h, err := protocol.NewMultiHandler(frost.KeygenTaproot(id, ids, threshold), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	network.HandlerLoop(id, h, n)
+	if err := network.HandlerLoopContext(ctx, id, h, n); err != nil {
+		return nil, err
+	}
 
 	r, err := h.Result()
 	if err != nil {
@@ -62,78 +88,161 @@ func FrostKeygenTaproot(id party.ID, ids party.IDSlice, threshold int, n network
 	return r.(*frost.TaprootConfig), nil
 }
 
-func FrostSignTaproot(c *frost.TaprootConfig, m []byte, signers party.IDSlice, n network.Network) (taproot.Signature, error) {
-	h, err := protocol.NewMultiHandler(frost.SignTaproot(c, signers, m), nil)
+// FrostRefreshTaproot is FrostRefreshTaprootContext without a context.
+func FrostRefreshTaproot(c *frost.TaprootConfig, n network.Network) (*frost.TaprootConfig, error) {
+	return FrostRefreshTaprootContext(context.Background(), c, n)
+}
+
+// FrostRefreshTaprootContext replaces the shares of every party of c with
+// new ones of the same public key.
+func FrostRefreshTaprootContext(ctx context.Context, c *frost.TaprootConfig, n network.Network) (*frost.TaprootConfig, error) {
+	ids := make([]party.ID, 0, len(c.VerificationShares))
+	for id := range c.VerificationShares {
+		ids = append(ids, id)
+	}
+	h, err := protocol.NewMultiHandler(frost.RefreshTaproot(c, party.NewIDSlice(ids)), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	network.HandlerLoop(c.ID, h, n)
+	if err := network.HandlerLoopContext(ctx, c.ID, h, n); err != nil {
+		return nil, err
+	}
 
 	r, err := h.Result()
 	if err != nil {
 		return nil, err
 	}
 
-	signature := r.(taproot.Signature)
-	if !c.PublicKey.Verify(signature, m) {
-		return nil, errors.New("failed to verify frost signature")
+	refreshed := r.(*frost.TaprootConfig)
+	if !bytes.Equal(refreshed.PublicKey, c.PublicKey) {
+		return nil, errors.New("refresh changed the public key")
 	}
-	return signature, nil
+	return refreshed, nil
 }
 
-func FrostSignTaprootInc(c *frost.TaprootConfig, m []byte, signers party.IDSlice, n network.Network) error {
+// FrostSignTaproot is FrostSignTaprootContext without a context.
+func FrostSignTaproot(c *frost.TaprootConfig, m []byte, signers party.IDSlice, n network.Network) (taproot.Signature, error) {
+	return FrostSignTaprootContext(context.Background(), c, m, signers, n)
+}
+
+func FrostSignTaprootContext(ctx context.Context, c *frost.TaprootConfig, m []byte, signers party.IDSlice, n network.Network) (taproot.Signature, error) {
 	h, err := protocol.NewMultiHandler(frost.SignTaproot(c, signers, m), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	round2, ok := <-h.Listen()
-	if !ok {
-		return errors.New("failed to getting incomplete signature, send round2")
+	if err := network.HandlerLoopContext(ctx, c.ID, h, n); err != nil {
+		return nil, err
 	}
-	n.Send(round2)
 
-	round2, ok = <-n.Next()
-	if !ok {
-		return errors.New("failed to getting incomplete signature, accept round2")
+	r, err := h.Result()
+	if err != nil {
+		return nil, err
 	}
-	h.Accept(round2)
 
-	round3, ok := <-h.Listen()
-	if !ok {
-		return errors.New("failed to getting incomplete signature, send round3")
+	signature := r.(taproot.Signature)
+	if !c.PublicKey.Verify(signature, m) {
+		return nil, fmt.Errorf("frost signature: %w", mpcblame.ErrSignature)
 	}
-	n.Send(round3)
+	return signature, nil
+}
 
-	return nil
+// frostFinalRound is the round of the signature shares, the last message
+// of a FROST signing.
+const frostFinalRound = 3
+
+// FrostSignTaprootInc is FrostSignTaprootIncContext without a context.
+func FrostSignTaprootInc(c *frost.TaprootConfig, m []byte, signers party.IDSlice, n network.Network) error {
+	return FrostSignTaprootIncContext(context.Background(), c, m, signers, n)
 }
 
-func FrostSignTaprootCoSign(c *frost.TaprootConfig, m []byte, signers party.IDSlice, n network.Network) (taproot.Signature, error) {
+// FrostSignTaprootIncContext takes part in a signing without completing
+// it: it exchanges nonce commitments with the other signers and sends them
+// its signature share.
+func FrostSignTaprootIncContext(ctx context.Context, c *frost.TaprootConfig, m []byte, signers party.IDSlice, n network.Network) error {
 	h, err := protocol.NewMultiHandler(frost.SignTaproot(c, signers, m), nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	round2, ok := <-h.Listen()
-	if !ok {
-		return nil, errors.New("failed to getting incomplete signature, send round2")
+	rounds := network.NewRoundTracker(c.ID, n)
+	timeout := network.RoundTimeoutOf(ctx)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg, ok := <-h.Listen():
+			if !ok {
+				_, err := h.Result()
+				if err == nil {
+					err = errors.New("signing ended before the signature share was sent")
+				}
+				return err
+			}
+			rounds.Sent(msg)
+			n.Send(msg)
+			if msg.RoundNumber == frostFinalRound {
+				return nil
+			}
+		case msg, ok := <-n.Next():
+			if !ok {
+				return errors.New("failed to getting incomplete signature, network closed")
+			}
+			rounds.Received(msg)
+			h.Accept(msg)
+		case <-timer.C:
+			return stall(rounds.Timeout(), rounds, h, n)
+		case <-ctx.Done():
+			return stall(rounds.Cancel(ctx), rounds, h, n)
+		}
+		timer.Reset(timeout)
 	}
-	n.Send(round2)
+}
 
-	round2, ok = <-n.Next()
-	if !ok {
-		return nil, errors.New("failed to getting incomplete signature, accept round2")
-	}
-	h.Accept(round2)
+// FrostSignTaprootCoSign is FrostSignTaprootCoSignContext without a context.
+func FrostSignTaprootCoSign(c *frost.TaprootConfig, m []byte, signers party.IDSlice, n network.Network) (taproot.Signature, error) {
+	return FrostSignTaprootCoSignContext(context.Background(), c, m, signers, n)
+}
 
-	<-h.Listen()
+// FrostSignTaprootCoSignContext completes a signing: it exchanges nonce
+// commitments with the other signers and collects their signature shares.
+func FrostSignTaprootCoSignContext(ctx context.Context, c *frost.TaprootConfig, m []byte, signers party.IDSlice, n network.Network) (taproot.Signature, error) {
+	h, err := protocol.NewMultiHandler(frost.SignTaproot(c, signers, m), nil)
+	if err != nil {
+		return nil, err
+	}
 
-	round3, ok := <-n.Next()
-	if !ok {
-		return nil, errors.New("failed to getting incomplete signature, accept round3")
+	rounds := network.NewRoundTracker(c.ID, n)
+	timeout := network.RoundTimeoutOf(ctx)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+loop:
+	for {
+		select {
+		case msg, ok := <-h.Listen():
+			if !ok {
+				break loop
+			}
+			// Nobody else completes the signature, so our own share
+			// stays here.
+			rounds.Sent(msg)
+			if msg.RoundNumber != frostFinalRound {
+				n.Send(msg)
+			}
+		case msg, ok := <-n.Next():
+			if !ok {
+				return nil, errors.New("failed to getting incomplete signature, network closed")
+			}
+			rounds.Received(msg)
+			h.Accept(msg)
+		case <-timer.C:
+			return nil, stall(rounds.Timeout(), rounds, h, n)
+		case <-ctx.Done():
+			return nil, stall(rounds.Cancel(ctx), rounds, h, n)
+		}
+		timer.Reset(timeout)
 	}
-	h.Accept(round3)
 
 	r, err := h.Result()
 	if err != nil {
@@ -141,7 +250,15 @@ func FrostSignTaprootCoSign(c *frost.TaprootConfig, m []byte, signers party.IDSl
 	}
 	signature := r.(taproot.Signature)
 	if !c.PublicKey.Verify(signature, m) {
-		return nil, errors.New("failed to verify frost signature")
+		return nil, fmt.Errorf("frost signature: %w", mpcblame.ErrSignature)
 	}
 	return signature, nil
 }
+
+// stall gives up on a run that timed out or was cancelled with err, as
+// network.HandlerLoopContext does.
+func stall(err error, rounds *network.RoundTracker, h protocol.Handler, n network.Network) error {
+	rounds.Abort(n, err)
+	h.Stop()
+	return err
+}
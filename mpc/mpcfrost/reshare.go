@@ -0,0 +1,50 @@
+package mpcfrost
+
+import (
+	"context"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/taproot"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+
+	"github.com/valli0x/signature-escrow/mpc/mpcreshare"
+	"github.com/valli0x/signature-escrow/network"
+)
+
+// TaprootPublicPoint returns the point of the x-only public key of c, the
+// one its shares add up to.
+func TaprootPublicPoint(c *frost.TaprootConfig) (curve.Point, error) {
+	return curve.Secp256k1{}.LiftX(c.PublicKey)
+}
+
+// FrostReshareTaproot moves the key to cfg.Receivers and returns the new
+// config of a receiver, or nil for a party that only dealt. cfg.PublicKey is
+// the point of the x-only key, see TaprootPublicPoint.
+func FrostReshareTaproot(cfg *mpcreshare.Config, n network.Network) (*frost.TaprootConfig, error) {
+	return FrostReshareTaprootContext(context.Background(), cfg, n)
+}
+
+// FrostReshareTaprootContext is FrostReshareTaproot under ctx.
+func FrostReshareTaprootContext(ctx context.Context, cfg *mpcreshare.Config, n network.Network) (*frost.TaprootConfig, error) {
+	res, err := mpcreshare.ReshareContext(ctx, cfg, n)
+	if err != nil {
+		return nil, err
+	}
+	if res.Share == nil {
+		return nil, nil
+	}
+
+	shares := make(map[party.ID]*curve.Secp256k1Point, len(res.Public))
+	for id, point := range res.Public {
+		shares[id] = point.(*curve.Secp256k1Point)
+	}
+	return &frost.TaprootConfig{
+		ID:                 cfg.Self,
+		Threshold:          cfg.Threshold,
+		PrivateShare:       res.Share.(*curve.Secp256k1Scalar),
+		PublicKey:          taproot.PublicKey(cfg.PublicKey.(*curve.Secp256k1Point).XBytes()),
+		ChainKey:           res.ChainKey,
+		VerificationShares: shares,
+	}, nil
+}
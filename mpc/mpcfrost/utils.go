@@ -45,3 +45,39 @@ func GetAddress(c *frost.TaprootConfig) (*btcutil.AddressWitnessPubKeyHash, erro
 
 	return address, nil
 }
+
+// CheckShare reports whether the private share in c is the one behind the
+// party's verification share, e.g. after restoring c from a backup.
+func CheckShare(c *frost.TaprootConfig) error {
+	own, ok := c.VerificationShares[c.ID]
+	if !ok || own == nil || c.PrivateShare == nil {
+		return fmt.Errorf("config has no share for party %s", c.ID)
+	}
+	if !c.PrivateShare.ActOnBase().Equal(own) {
+		return fmt.Errorf("private share of party %s does not match its verification share", c.ID)
+	}
+	return nil
+}
+
+// Wipe zeroes the private share of c, once c has been replaced.
+func Wipe(c *frost.TaprootConfig) {
+	if c.PrivateShare != nil {
+		c.PrivateShare.Set(c.PrivateShare.Curve().NewScalar())
+	}
+}
+
+// DeriveTaproot returns the shares of the child key at path below the key
+// of c, by non-hardened BIP-32 derivation, like mpccmp.Derive.
+func DeriveTaproot(c *frost.TaprootConfig, path []uint32) (*frost.TaprootConfig, error) {
+	for _, i := range path {
+		if i >= 1<<31 {
+			return nil, fmt.Errorf("index %d is hardened", i)
+		}
+		child, err := c.DeriveChild(i)
+		if err != nil {
+			return nil, err
+		}
+		c = child
+	}
+	return c, nil
+}
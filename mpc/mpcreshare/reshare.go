@@ -0,0 +1,422 @@
+// Package mpcreshare moves a threshold key to a new set of parties or a new
+// threshold without changing the public key.
+//
+// Every current holder (dealer) shares its Lagrange-weighted share of the
+// key, λᵢ•xᵢ, with a fresh polynomial of the new degree and sends each new
+// holder (receiver) its evaluation, encrypted to the receiver's transport
+// key. The dealers broadcast Feldman commitments to their polynomials, so
+// that receivers can check their shares and every party can compute the new
+// public shares. Last, all parties confirm they saw the same commitments.
+package mpcreshare
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/polynomial"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+
+	"github.com/valli0x/signature-escrow/network"
+)
+
+const protocolID = "signature-escrow/reshare"
+
+const (
+	roundDeal    = 1
+	roundConfirm = 2
+)
+
+// scalarSize is the encoded size of a secp256k1 scalar.
+const scalarSize = 32
+
+// Config is one party's part in a resharing.
+type Config struct {
+	// Session binds the messages to one resharing.
+	Session []byte
+	Self    party.ID
+	// Dealers are every current holder of the key, Receivers every new
+	// one. A party may be both.
+	Dealers   party.IDSlice
+	Receivers party.IDSlice
+	// Threshold is the degree of the new sharing: Threshold+1 receivers
+	// sign together, as in the threshold of a keygen.
+	Threshold int
+	// PublicKey is the key being reshared; receivers pin it.
+	PublicKey curve.Point
+
+	// Share and ChainKey are a dealer's current share and the chain key
+	// of the key.
+	Share    curve.Scalar
+	ChainKey []byte
+	// DealerPublic are the dealers' current public shares, which a dealer
+	// has from its config. With them, a dealer whose commitment is not of
+	// its part of the key is named; without them, as for a new party, only
+	// the sum of the commitments is checked against PublicKey.
+	DealerPublic map[party.ID]curve.Point
+
+	// TransportKeys are the receivers' public keys their shares are
+	// encrypted to, and TransportKey a receiver's own private key.
+	TransportKeys map[party.ID]*ecdh.PublicKey
+	TransportKey  *ecdh.PrivateKey
+
+	// Timeout bounds the wait for the other parties; zero waits forever.
+	Timeout time.Duration
+}
+
+// Result is a party's part of the reshared key.
+type Result struct {
+	// Share is the new share of a receiver, nil for a dealer that is not
+	// one.
+	Share curve.Scalar
+	// Public are the public shares of every receiver.
+	Public   map[party.ID]curve.Point
+	ChainKey []byte
+}
+
+type dealMsg struct {
+	Commitment []byte `cbor:"1,keyasint"`
+}
+
+type confirmMsg struct {
+	Digest []byte `cbor:"1,keyasint"`
+}
+
+// Reshare is ReshareContext without a context.
+func Reshare(cfg *Config, n network.Network) (*Result, error) {
+	return ReshareContext(context.Background(), cfg, n)
+}
+
+// ReshareContext runs cfg.Self's part of a resharing over n. A party that
+// gives up, on cfg.Timeout or because ctx ended, tells the others, who stop
+// too.
+func ReshareContext(ctx context.Context, cfg *Config, n network.Network) (*Result, error) {
+	defer n.Done()
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	group := curve.Secp256k1{}
+	receiver := cfg.Receivers.Contains(cfg.Self)
+	everyone := cfg.everyone()
+
+	commitments := map[party.ID]*polynomial.Exponent{}
+	shares := map[party.ID]curve.Scalar{}
+	chainKeys := map[party.ID][]byte{}
+	digests := map[party.ID][]byte{}
+
+	if cfg.Dealers.Contains(cfg.Self) {
+		commitment, own, err := cfg.deal(n)
+		if err != nil {
+			return nil, err
+		}
+		commitments[cfg.Self] = commitment
+		chainKeys[cfg.Self] = cfg.ChainKey
+		if own != nil {
+			shares[cfg.Self] = own
+		}
+	}
+
+	var deadline <-chan time.Time
+	if cfg.Timeout > 0 {
+		deadline = time.After(cfg.Timeout)
+	}
+	var digest []byte
+	for {
+		if digest == nil && len(commitments) == len(cfg.Dealers) && (!receiver || len(shares) == len(cfg.Dealers)) {
+			var err error
+			if digest, err = cfg.digest(commitments); err != nil {
+				return nil, err
+			}
+			if err := broadcast(n, &protocol.Message{RoundNumber: roundConfirm, From: cfg.Self}, confirmMsg{Digest: digest}); err != nil {
+				return nil, err
+			}
+		}
+		if digest != nil && len(digests) == len(everyone)-1 {
+			for id, d := range digests {
+				if !bytes.Equal(d, digest) {
+					return nil, fmt.Errorf("reshare: party %s saw different commitments", id)
+				}
+			}
+			return cfg.result(commitments, shares, chainKeys)
+		}
+
+		var msg *protocol.Message
+		select {
+		case msg = <-n.Next():
+		case <-deadline:
+			return nil, cfg.abort(n, fmt.Errorf("reshare: timed out with %d of %d commitments and %d of %d confirmations",
+				len(commitments), len(cfg.Dealers), len(digests), len(everyone)-1))
+		case <-ctx.Done():
+			round := roundDeal
+			if digest != nil {
+				round = roundConfirm
+			}
+			return nil, cfg.abort(n, &network.CancelError{Round: round, Cause: context.Cause(ctx)})
+		}
+		if msg == nil || msg.Protocol != protocolID || msg.From == cfg.Self || !everyone.Contains(msg.From) {
+			continue
+		}
+
+		switch {
+		case msg.RoundNumber == 0:
+			// Reported the way protocol handlers report an abort.
+			return nil, protocol.Error{
+				Culprits: []party.ID{msg.From},
+				Err:      fmt.Errorf("aborted by other party with error: %q", msg.Data),
+			}
+
+		case msg.RoundNumber == roundDeal && msg.Broadcast:
+			if !cfg.Dealers.Contains(msg.From) || commitments[msg.From] != nil {
+				continue
+			}
+			var m dealMsg
+			if err := cbor.Unmarshal(msg.Data, &m); err != nil {
+				return nil, fmt.Errorf("reshare: commitment of %s: %w", msg.From, err)
+			}
+			commitment := polynomial.EmptyExponent(group)
+			if err := commitment.UnmarshalBinary(m.Commitment); err != nil {
+				return nil, fmt.Errorf("reshare: commitment of %s: %w", msg.From, err)
+			}
+			if commitment.Degree() != cfg.Threshold {
+				return nil, fmt.Errorf("reshare: commitment of %s has degree %d, not %d",
+					msg.From, commitment.Degree(), cfg.Threshold)
+			}
+			commitments[msg.From] = commitment
+
+		case msg.RoundNumber == roundDeal:
+			if !receiver || msg.To != cfg.Self || !cfg.Dealers.Contains(msg.From) || shares[msg.From] != nil {
+				continue
+			}
+			plain, err := open(cfg.TransportKey, cfg.ad(msg.From, cfg.Self), msg.Data)
+			if err != nil || len(plain) < scalarSize {
+				return nil, fmt.Errorf("reshare: share from %s cannot be decrypted", msg.From)
+			}
+			share := group.NewScalar()
+			if err := share.UnmarshalBinary(plain[:scalarSize]); err != nil {
+				return nil, fmt.Errorf("reshare: share from %s: %w", msg.From, err)
+			}
+			shares[msg.From] = share
+			chainKeys[msg.From] = plain[scalarSize:]
+
+		case msg.RoundNumber == roundConfirm:
+			if digests[msg.From] != nil {
+				continue
+			}
+			var m confirmMsg
+			if err := cbor.Unmarshal(msg.Data, &m); err != nil {
+				return nil, fmt.Errorf("reshare: confirmation of %s: %w", msg.From, err)
+			}
+			digests[msg.From] = m.Digest
+		}
+	}
+}
+
+// deal sends the commitment to a new polynomial sharing the dealer's part
+// of the key and every receiver's share of it. It returns the commitment and
+// the dealer's own share when it is a receiver too.
+func (cfg *Config) deal(n network.Network) (*polynomial.Exponent, curve.Scalar, error) {
+	group := curve.Secp256k1{}
+	w := polynomial.Lagrange(group, cfg.Dealers)[cfg.Self].Mul(cfg.Share)
+	f := polynomial.NewPolynomial(group, cfg.Threshold, w)
+	commitment := polynomial.NewPolynomialExponent(f)
+
+	data, err := commitment.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := broadcast(n, &protocol.Message{RoundNumber: roundDeal, From: cfg.Self}, dealMsg{Commitment: data}); err != nil {
+		return nil, nil, err
+	}
+
+	var own curve.Scalar
+	for _, j := range cfg.Receivers {
+		share := f.Evaluate(j.Scalar(group))
+		if j == cfg.Self {
+			own = share
+			continue
+		}
+		plain, err := share.MarshalBinary()
+		if err != nil {
+			return nil, nil, err
+		}
+		sealed, err := seal(cfg.TransportKeys[j], cfg.ad(cfg.Self, j), append(plain, cfg.ChainKey...))
+		if err != nil {
+			return nil, nil, err
+		}
+		n.Send(&protocol.Message{
+			Protocol:    protocolID,
+			RoundNumber: roundDeal,
+			From:        cfg.Self,
+			To:          j,
+			Data:        sealed,
+		})
+	}
+	return commitment, own, nil
+}
+
+// result checks the shares against the commitments and sums them up. A
+// dealer whose commitment or share is wrong is reported as the culprit.
+func (cfg *Config) result(commitments map[party.ID]*polynomial.Exponent, shares map[party.ID]curve.Scalar, chainKeys map[party.ID][]byte) (*Result, error) {
+	group := curve.Secp256k1{}
+
+	if cfg.DealerPublic != nil {
+		var culprits []party.ID
+		lagrange := polynomial.Lagrange(group, cfg.Dealers)
+		for _, i := range cfg.Dealers {
+			want := lagrange[i].Act(cfg.DealerPublic[i])
+			if !commitments[i].Constant().Equal(want) {
+				culprits = append(culprits, i)
+			}
+		}
+		if len(culprits) > 0 {
+			return nil, protocol.Error{
+				Culprits: culprits,
+				Err:      errors.New("reshare: commitment is not of the dealer's part of the key"),
+			}
+		}
+	}
+	constant := group.NewPoint()
+	for _, i := range cfg.Dealers {
+		constant = constant.Add(commitments[i].Evaluate(group.NewScalar()))
+	}
+	if !constant.Equal(cfg.PublicKey) {
+		return nil, errors.New("reshare: the dealers' commitments are not of the public key")
+	}
+
+	res := &Result{Public: map[party.ID]curve.Point{}}
+	for _, j := range cfg.Receivers {
+		x := j.Scalar(group)
+		public := group.NewPoint()
+		for _, i := range cfg.Dealers {
+			public = public.Add(commitments[i].Evaluate(x))
+		}
+		res.Public[j] = public
+	}
+
+	if !cfg.Receivers.Contains(cfg.Self) {
+		return res, nil
+	}
+	x := cfg.Self.Scalar(group)
+	sum := group.NewScalar()
+	for _, i := range cfg.Dealers {
+		if !shares[i].ActOnBase().Equal(commitments[i].Evaluate(x)) {
+			return nil, protocol.Error{
+				Culprits: []party.ID{i},
+				Err:      errors.New("reshare: share does not match its commitment"),
+			}
+		}
+		sum.Add(shares[i])
+		if res.ChainKey == nil {
+			res.ChainKey = chainKeys[i]
+		} else if !bytes.Equal(res.ChainKey, chainKeys[i]) {
+			return nil, fmt.Errorf("reshare: dealer %s sent a different chain key", i)
+		}
+	}
+	res.Share = sum
+	return res, nil
+}
+
+// digest hashes what every party must agree on: the resharing and the
+// dealers' commitments.
+func (cfg *Config) digest(commitments map[party.ID]*polynomial.Exponent) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte(protocolID))
+	h.Write(cfg.Session)
+	pub, err := cfg.PublicKey.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	h.Write(pub)
+	fmt.Fprintf(h, "%d", cfg.Threshold)
+	if _, err := cfg.Dealers.WriteTo(h); err != nil {
+		return nil, err
+	}
+	if _, err := cfg.Receivers.WriteTo(h); err != nil {
+		return nil, err
+	}
+	for _, i := range cfg.Dealers {
+		data, err := commitments[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		h.Write(data)
+	}
+	return h.Sum(nil), nil
+}
+
+// ad is the associated data of the share from dealer to receiver.
+func (cfg *Config) ad(dealer, receiver party.ID) []byte {
+	return []byte(protocolID + "/" + string(cfg.Session) + "/" + string(dealer) + "/" + string(receiver))
+}
+
+func (cfg *Config) everyone() party.IDSlice {
+	ids := append([]party.ID{}, cfg.Dealers...)
+	for _, j := range cfg.Receivers {
+		if !cfg.Dealers.Contains(j) {
+			ids = append(ids, j)
+		}
+	}
+	return party.NewIDSlice(ids)
+}
+
+func (cfg *Config) validate() error {
+	if !cfg.Dealers.Valid() || !cfg.Receivers.Valid() {
+		return errors.New("reshare: dealers and receivers must be sorted and without duplicates")
+	}
+	if !cfg.Dealers.Contains(cfg.Self) && !cfg.Receivers.Contains(cfg.Self) {
+		return fmt.Errorf("reshare: %s is neither a dealer nor a receiver", cfg.Self)
+	}
+	if cfg.Threshold < 1 || cfg.Threshold >= len(cfg.Receivers) {
+		return fmt.Errorf("reshare: threshold must be between 1 and %d", len(cfg.Receivers)-1)
+	}
+	if cfg.PublicKey == nil || cfg.PublicKey.IsIdentity() {
+		return errors.New("reshare: no public key")
+	}
+	if cfg.Dealers.Contains(cfg.Self) && cfg.Share == nil {
+		return errors.New("reshare: a dealer needs its share")
+	}
+	if cfg.DealerPublic != nil {
+		for _, i := range cfg.Dealers {
+			if cfg.DealerPublic[i] == nil {
+				return fmt.Errorf("reshare: no public share for dealer %s", i)
+			}
+		}
+	}
+	for _, j := range cfg.Receivers {
+		if j != cfg.Self && cfg.TransportKeys[j] == nil {
+			return fmt.Errorf("reshare: no transport key for %s", j)
+		}
+	}
+	if cfg.Receivers.Contains(cfg.Self) && !cfg.Dealers.Contains(cfg.Self) && cfg.TransportKey == nil {
+		return errors.New("reshare: a receiver needs its transport key")
+	}
+	return nil
+}
+
+// abort tells the other parties that cfg.Self gave up with err, and
+// returns err.
+func (cfg *Config) abort(n network.Network, err error) error {
+	n.Send(&protocol.Message{Protocol: protocolID, From: cfg.Self, Broadcast: true, Data: []byte(err.Error())})
+	return err
+}
+
+// broadcast sends v to every party with the header of msg.
+func broadcast(n network.Network, msg *protocol.Message, v any) error {
+	data, err := cbor.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg.Protocol = protocolID
+	msg.Broadcast = true
+	msg.Data = data
+	n.Send(msg)
+	return nil
+}
@@ -0,0 +1,257 @@
+package mpcreshare
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/polynomial"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/sample"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/valli0x/signature-escrow/mpc"
+	"github.com/valli0x/signature-escrow/network"
+)
+
+// The key is held by a, b and c, 2 of whom sign; it moves to a, c and d.
+var (
+	dealers   = party.NewIDSlice([]party.ID{"a", "b", "c"})
+	receivers = party.NewIDSlice([]party.ID{"a", "c", "d"})
+	everyone  = party.NewIDSlice([]party.ID{"a", "b", "c", "d"})
+)
+
+// testConfigs returns the config of every party of a resharing of a new
+// key, and the key's secret.
+func testConfigs(t *testing.T, session string) (map[party.ID]*Config, curve.Scalar) {
+	t.Helper()
+	group := curve.Secp256k1{}
+	secret := sample.Scalar(rand.Reader, group)
+	f := polynomial.NewPolynomial(group, 1, secret)
+	chainKey := bytes.Repeat([]byte{7}, 32)
+
+	shares := map[party.ID]curve.Scalar{}
+	public := map[party.ID]curve.Point{}
+	for _, i := range dealers {
+		shares[i] = f.Evaluate(i.Scalar(group))
+		public[i] = shares[i].ActOnBase()
+	}
+	private := map[party.ID]*ecdh.PrivateKey{}
+	transport := map[party.ID]*ecdh.PublicKey{}
+	for _, j := range receivers {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		private[j], transport[j] = key, key.PublicKey()
+	}
+
+	cfgs := map[party.ID]*Config{}
+	for _, id := range everyone {
+		cfg := &Config{
+			Session:       []byte(session),
+			Self:          id,
+			Dealers:       dealers,
+			Receivers:     receivers,
+			Threshold:     1,
+			PublicKey:     secret.ActOnBase(),
+			TransportKeys: transport,
+			TransportKey:  private[id],
+			Timeout:       5 * time.Second,
+		}
+		if share := shares[id]; share != nil {
+			cfg.Share, cfg.ChainKey, cfg.DealerPublic = share, chainKey, public
+		}
+		cfgs[id] = cfg
+	}
+	return cfgs, secret
+}
+
+// tamperNet changes the messages its party sends with tamper.
+type tamperNet struct {
+	*mpc.PartyNet
+	tamper func(*protocol.Message)
+}
+
+func (n tamperNet) Send(msg *protocol.Message) {
+	bad := *msg
+	n.tamper(&bad)
+	n.PartyNet.Send(&bad)
+}
+
+// runReshare runs the parties of cfgs over hub, or over nets for those
+// listed there.
+func runReshare(cfgs map[party.ID]*Config, hub mpc.PartyHub, nets map[party.ID]network.Network) (map[party.ID]*Result, map[party.ID]error) {
+	var mu sync.Mutex
+	results := map[party.ID]*Result{}
+	errs := map[party.ID]error{}
+	var wg sync.WaitGroup
+	for id, cfg := range cfgs {
+		var n network.Network = hub.Net(id)
+		if nets[id] != nil {
+			n = nets[id]
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := Reshare(cfg, n)
+			mu.Lock()
+			results[id], errs[id] = res, err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// culprits returns the parties err blames.
+func culprits(err error) []party.ID {
+	var perr protocol.Error
+	if !errors.As(err, &perr) {
+		return nil
+	}
+	return perr.Culprits
+}
+
+func TestReshare(t *testing.T) {
+	cfgs, secret := testConfigs(t, "reshare")
+	results, errs := runReshare(cfgs, mpc.NewPartyHub(everyone), nil)
+	for _, id := range everyone {
+		if errs[id] != nil {
+			t.Fatalf("%s: %v", id, errs[id])
+		}
+	}
+	if results["b"].Share != nil {
+		t.Fatal("b left but got a share")
+	}
+
+	// Any two receivers make the key again.
+	group := curve.Secp256k1{}
+	pair := party.NewIDSlice([]party.ID{"a", "d"})
+	lagrange := polynomial.Lagrange(group, pair)
+	sum := group.NewScalar()
+	for _, j := range pair {
+		sum.Add(group.NewScalar().Set(lagrange[j]).Mul(results[j].Share))
+	}
+	if !sum.Equal(secret) {
+		t.Fatal("the new shares are not of the key")
+	}
+	for _, j := range receivers {
+		if !results[j].Share.ActOnBase().Equal(results["a"].Public[j]) {
+			t.Fatalf("public share of %s", j)
+		}
+		if !bytes.Equal(results[j].ChainKey, cfgs["a"].ChainKey) {
+			t.Fatalf("chain key of %s", j)
+		}
+	}
+}
+
+func TestReshareWrongDegree(t *testing.T) {
+	// b deals a polynomial of degree 2.
+	cfgs, _ := testConfigs(t, "reshare-degree")
+	cfgs["b"].Threshold = 2
+	_, errs := runReshare(cfgs, mpc.NewPartyHub(everyone), nil)
+	for _, id := range everyone {
+		if id == "b" {
+			continue
+		}
+		if errs[id] == nil || !strings.Contains(errs[id].Error(), "commitment of b has degree 2") {
+			t.Errorf("%s: %v", id, errs[id])
+		}
+	}
+}
+
+func TestReshareShareMismatch(t *testing.T) {
+	// b commits to its polynomial but sends d a share off it.
+	cfgs, _ := testConfigs(t, "reshare-share")
+	hub := mpc.NewPartyHub(everyone)
+	b := cfgs["b"]
+	bad := tamperNet{hub.Net("b"), func(msg *protocol.Message) {
+		if msg.RoundNumber != roundDeal || msg.To != "d" {
+			return
+		}
+		share, _ := sample.Scalar(rand.Reader, curve.Secp256k1{}).MarshalBinary()
+		msg.Data, _ = seal(b.TransportKeys["d"], b.ad("b", "d"), append(share, b.ChainKey...))
+	}}
+	_, errs := runReshare(cfgs, hub, map[party.ID]network.Network{"b": bad})
+
+	if got := culprits(errs["d"]); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("d: %v", errs["d"])
+	}
+	for _, id := range []party.ID{"a", "b", "c"} {
+		if errs[id] != nil {
+			t.Errorf("%s: %v", id, errs[id])
+		}
+	}
+}
+
+func TestReshareBadDealerPublic(t *testing.T) {
+	// b deals a share of some other key.
+	cfgs, _ := testConfigs(t, "reshare-constant")
+	cfgs["b"].Share = sample.Scalar(rand.Reader, curve.Secp256k1{})
+	_, errs := runReshare(cfgs, mpc.NewPartyHub(everyone), nil)
+
+	for _, id := range []party.ID{"a", "c"} {
+		if got := culprits(errs[id]); len(got) != 1 || got[0] != "b" {
+			t.Errorf("%s: %v", id, errs[id])
+		}
+	}
+	// d does not know the dealers' public shares: it only sees that the
+	// key does not add up.
+	if errs["d"] == nil || culprits(errs["d"]) != nil {
+		t.Errorf("d: %v", errs["d"])
+	}
+}
+
+func TestReshareChainKeys(t *testing.T) {
+	cfgs, _ := testConfigs(t, "reshare-chain")
+	cfgs["b"].ChainKey = bytes.Repeat([]byte{8}, 32)
+	_, errs := runReshare(cfgs, mpc.NewPartyHub(everyone), nil)
+	for _, id := range receivers {
+		if errs[id] == nil || !strings.Contains(errs[id].Error(), "dealer b sent a different chain key") {
+			t.Errorf("%s: %v", id, errs[id])
+		}
+	}
+}
+
+func TestReshareConfirmMismatch(t *testing.T) {
+	// c confirms commitments nobody else saw.
+	cfgs, _ := testConfigs(t, "reshare-confirm")
+	hub := mpc.NewPartyHub(everyone)
+	bad := tamperNet{hub.Net("c"), func(msg *protocol.Message) {
+		if msg.RoundNumber == roundConfirm {
+			msg.Data, _ = cbor.Marshal(confirmMsg{Digest: bytes.Repeat([]byte{1}, 32)})
+		}
+	}}
+	_, errs := runReshare(cfgs, hub, map[party.ID]network.Network{"c": bad})
+	for _, id := range everyone {
+		if id == "c" {
+			continue
+		}
+		if errs[id] == nil || !strings.Contains(errs[id].Error(), "party c saw different commitments") {
+			t.Errorf("%s: %v", id, errs[id])
+		}
+	}
+}
+
+func TestReshareAbort(t *testing.T) {
+	// d gives up before the others start.
+	cfgs, _ := testConfigs(t, "reshare-abort")
+	hub := mpc.NewPartyHub(everyone)
+	d := cfgs["d"]
+	delete(cfgs, "d")
+	_ = d.abort(hub.Net("d"), errors.New("no space left"))
+
+	_, errs := runReshare(cfgs, hub, nil)
+	for id := range cfgs {
+		if got := culprits(errs[id]); len(got) != 1 || got[0] != "d" || !strings.Contains(errs[id].Error(), "no space left") {
+			t.Errorf("%s: %v", id, errs[id])
+		}
+	}
+}
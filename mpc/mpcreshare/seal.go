@@ -0,0 +1,74 @@
+package mpcreshare
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+const sealLabel = "mpcoven/reshare/seal"
+
+// seal encrypts plain to the X25519 key to with an ephemeral key. The
+// result is the ephemeral public key, the nonce and the ciphertext.
+func seal(to *ecdh.PublicKey, ad, plain []byte) ([]byte, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(to)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealAEAD(shared, eph.PublicKey().Bytes(), to.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, eph.PublicKey().Bytes()...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plain, ad), nil
+}
+
+// open decrypts what seal encrypted to key.
+func open(key *ecdh.PrivateKey, ad, sealed []byte) ([]byte, error) {
+	const ephSize = 32
+	if len(sealed) < ephSize {
+		return nil, errors.New("sealed message too short")
+	}
+	eph, err := ecdh.X25519().NewPublicKey(sealed[:ephSize])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := key.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealAEAD(shared, sealed[:ephSize], key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	rest := sealed[ephSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("sealed message too short")
+	}
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], ad)
+}
+
+func sealAEAD(shared, eph, recipient []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte(sealLabel))
+	h.Write(shared)
+	h.Write(eph)
+	h.Write(recipient)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
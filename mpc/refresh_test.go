@@ -0,0 +1,102 @@
+package mpc
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/pool"
+	"github.com/taurusgroup/multi-party-sig/protocols/cmp"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+)
+
+func TestRefreshCMP(t *testing.T) {
+	ids := party.NewIDSlice([]party.ID{"a", "b"})
+	pools := map[party.ID]*pool.Pool{}
+	for _, id := range ids {
+		pools[id] = pool.NewPool(0)
+		defer pools[id].TearDown()
+	}
+
+	var mu sync.Mutex
+	configs := map[party.ID]*cmp.Config{}
+	hub := NewPartyHub(ids)
+	run(t, ids, func(id party.ID) error {
+		c, err := mpccmp.CMPKeygen(id, ids, 1, hub.Net(id), pools[id])
+		mu.Lock()
+		configs[id] = c
+		mu.Unlock()
+		return err
+	})
+
+	refreshed := map[party.ID]*cmp.Config{}
+	hub = NewPartyHub(ids)
+	run(t, ids, func(id party.ID) error {
+		c, err := mpccmp.CMPRefresh(configs[id], hub.Net(id), pools[id])
+		mu.Lock()
+		refreshed[id] = c
+		mu.Unlock()
+		return err
+	})
+	if refreshed["a"].ECDSA.Equal(configs["a"].ECDSA) {
+		t.Fatal("share was not replaced")
+	}
+
+	hash := make([]byte, 32)
+	hash[0] = 3
+	hub = NewPartyHub(ids)
+	run(t, ids, func(id party.ID) error {
+		_, err := mpccmp.CMPSign(refreshed[id], hash, ids, hub.Net(id), pools[id])
+		return err
+	})
+
+	mpccmp.Wipe(configs["a"])
+	if !configs["a"].ECDSA.IsZero() {
+		t.Fatal("old share was not wiped")
+	}
+}
+
+func TestRefreshFROST(t *testing.T) {
+	ids := party.NewIDSlice([]party.ID{"a", "b", "c"})
+
+	var mu sync.Mutex
+	configs := map[party.ID]*frost.TaprootConfig{}
+	hub := NewPartyHub(ids)
+	run(t, ids, func(id party.ID) error {
+		c, err := mpcfrost.FrostKeygenTaproot(id, ids, 1, hub.Net(id))
+		mu.Lock()
+		configs[id] = c
+		mu.Unlock()
+		return err
+	})
+
+	refreshed := map[party.ID]*frost.TaprootConfig{}
+	hub = NewPartyHub(ids)
+	run(t, ids, func(id party.ID) error {
+		c, err := mpcfrost.FrostRefreshTaproot(configs[id], hub.Net(id))
+		mu.Lock()
+		refreshed[id] = c
+		mu.Unlock()
+		return err
+	})
+	if !bytes.Equal(refreshed["a"].PublicKey, configs["a"].PublicKey) {
+		t.Fatal("public key changed")
+	}
+
+	hash := make([]byte, 32)
+	hash[0] = 4
+	signers := party.NewIDSlice([]party.ID{"a", "c"})
+	hub = NewPartyHub(signers)
+	run(t, signers, func(id party.ID) error {
+		_, err := mpcfrost.FrostSignTaproot(refreshed[id], hash, signers, hub.Net(id))
+		return err
+	})
+
+	mpcfrost.Wipe(configs["a"])
+	if !configs["a"].PrivateShare.IsZero() {
+		t.Fatal("old share was not wiped")
+	}
+}
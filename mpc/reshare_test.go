@@ -0,0 +1,279 @@
+package mpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
+	"github.com/taurusgroup/multi-party-sig/pkg/math/sample"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/pool"
+	"github.com/taurusgroup/multi-party-sig/protocols/cmp"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+	"github.com/valli0x/signature-escrow/mpc/mpcreshare"
+	"github.com/valli0x/signature-escrow/network"
+)
+
+func transportKeys(t *testing.T, ids party.IDSlice) (map[party.ID]*ecdh.PrivateKey, map[party.ID]*ecdh.PublicKey) {
+	private := map[party.ID]*ecdh.PrivateKey{}
+	public := map[party.ID]*ecdh.PublicKey{}
+	for _, id := range ids {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		private[id], public[id] = key, key.PublicKey()
+	}
+	return private, public
+}
+
+func TestReshareCMP(t *testing.T) {
+	dealers := party.NewIDSlice([]party.ID{"a", "b"})
+	receivers := party.NewIDSlice([]party.ID{"a", "c"})
+	everyone := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	pools := map[party.ID]*pool.Pool{}
+	for _, id := range everyone {
+		pools[id] = pool.NewPool(0)
+		defer pools[id].TearDown()
+	}
+
+	var mu sync.Mutex
+	configs := map[party.ID]*cmp.Config{}
+	hub := NewPartyHub(dealers)
+	run(t, dealers, func(id party.ID) error {
+		c, err := mpccmp.CMPKeygen(id, dealers, 1, hub.Net(id), pools[id])
+		mu.Lock()
+		configs[id] = c
+		mu.Unlock()
+		return err
+	})
+	public := configs["a"].PublicPoint()
+
+	private, transport := transportKeys(t, receivers)
+	reshared := map[party.ID]*cmp.Config{}
+	hub = NewPartyHub(everyone)
+	refreshHub := NewPartyHub(receivers)
+	run(t, everyone, func(id party.ID) error {
+		cfg := &mpcreshare.Config{
+			Session:       []byte("reshare-cmp"),
+			Self:          id,
+			Dealers:       dealers,
+			Receivers:     receivers,
+			Threshold:     1,
+			PublicKey:     public,
+			TransportKeys: transport,
+			TransportKey:  private[id],
+		}
+		if c := configs[id]; c != nil {
+			cfg.Share, cfg.ChainKey = c.ECDSA, c.ChainKey
+		}
+		c, err := mpccmp.CMPReshare(cfg, hub.Net(id), refreshHub.Net(id), pools[id])
+		mu.Lock()
+		reshared[id] = c
+		mu.Unlock()
+		return err
+	})
+	if reshared["b"] != nil {
+		t.Fatal("a dealer that is not a receiver got a config")
+	}
+	if !reshared["c"].PublicPoint().Equal(public) {
+		t.Fatal("public key changed")
+	}
+
+	hash := make([]byte, 32)
+	hash[0] = 5
+	hub = NewPartyHub(receivers)
+	run(t, receivers, func(id party.ID) error {
+		_, err := mpccmp.CMPSign(reshared[id], hash, receivers, hub.Net(id), pools[id])
+		return err
+	})
+}
+
+func TestReshareFROST(t *testing.T) {
+	dealers := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	receivers := party.NewIDSlice([]party.ID{"b", "c", "d"})
+	everyone := party.NewIDSlice([]party.ID{"a", "b", "c", "d"})
+
+	var mu sync.Mutex
+	configs := map[party.ID]*frost.TaprootConfig{}
+	hub := NewPartyHub(dealers)
+	run(t, dealers, func(id party.ID) error {
+		c, err := mpcfrost.FrostKeygenTaproot(id, dealers, 1, hub.Net(id))
+		mu.Lock()
+		configs[id] = c
+		mu.Unlock()
+		return err
+	})
+	public, err := mpcfrost.TaprootPublicPoint(configs["a"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2-of-3 becomes 3-of-3 with a new party.
+	private, transport := transportKeys(t, receivers)
+	reshared := map[party.ID]*frost.TaprootConfig{}
+	hub = NewPartyHub(everyone)
+	run(t, everyone, func(id party.ID) error {
+		cfg := &mpcreshare.Config{
+			Session:       []byte("reshare-frost"),
+			Self:          id,
+			Dealers:       dealers,
+			Receivers:     receivers,
+			Threshold:     2,
+			PublicKey:     public,
+			TransportKeys: transport,
+			TransportKey:  private[id],
+		}
+		if c := configs[id]; c != nil {
+			cfg.Share, cfg.ChainKey = c.PrivateShare, c.ChainKey
+		}
+		c, err := mpcfrost.FrostReshareTaproot(cfg, hub.Net(id))
+		mu.Lock()
+		reshared[id] = c
+		mu.Unlock()
+		return err
+	})
+	if !bytes.Equal(reshared["d"].PublicKey, configs["a"].PublicKey) {
+		t.Fatal("public key changed")
+	}
+
+	hash := make([]byte, 32)
+	hash[0] = 6
+	hub = NewPartyHub(receivers)
+	run(t, receivers, func(id party.ID) error {
+		_, err := mpcfrost.FrostSignTaproot(reshared[id], hash, receivers, hub.Net(id))
+		return err
+	})
+
+	// d never shows up to a second resharing, which a cancels: b and c
+	// stop too, and keep their shares.
+	defer func(d time.Duration) { network.RoundTimeout = d }(network.RoundTimeout)
+	network.RoundTimeout = 10 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	hub = NewPartyHub(everyone)
+	failures := map[party.ID]*mpcblame.Failure{}
+	var wg sync.WaitGroup
+	for _, id := range dealers {
+		runCtx := context.Background()
+		if id == "a" {
+			runCtx = ctx
+		}
+		cfg := &mpcreshare.Config{
+			Session:       []byte("reshare-frost-cancel"),
+			Self:          id,
+			Dealers:       dealers,
+			Receivers:     receivers,
+			Threshold:     2,
+			PublicKey:     public,
+			TransportKeys: transport,
+			TransportKey:  private[id],
+			Share:         configs[id].PrivateShare,
+			ChainKey:      configs[id].ChainKey,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mpcfrost.FrostReshareTaprootContext(runCtx, cfg, hub.Net(id))
+			mu.Lock()
+			failures[id] = mpcblame.Classify(id, "frost-reshare", "s", err)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if f := failures["a"]; f == nil || f.Kind != mpcblame.KindCancelled {
+		t.Errorf("a: %+v", f)
+	}
+	for _, id := range []party.ID{"b", "c"} {
+		if f := failures[id]; f == nil || f.Kind != mpcblame.KindAborted || f.Reporter != "a" {
+			t.Errorf("%s: %+v", id, f)
+		}
+	}
+}
+
+func TestReshareBadDealer(t *testing.T) {
+	dealers := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	receivers := party.NewIDSlice([]party.ID{"a", "c", "d"})
+	everyone := party.NewIDSlice([]party.ID{"a", "b", "c", "d"})
+
+	var mu sync.Mutex
+	configs := map[party.ID]*frost.TaprootConfig{}
+	hub := NewPartyHub(dealers)
+	run(t, dealers, func(id party.ID) error {
+		c, err := mpcfrost.FrostKeygenTaproot(id, dealers, 1, hub.Net(id))
+		mu.Lock()
+		configs[id] = c
+		mu.Unlock()
+		return err
+	})
+	public, err := mpcfrost.TaprootPublicPoint(configs["a"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b deals a share of some other key. The dealers know every dealer's
+	// public share and name b; d only sees that the key does not add up.
+	private, transport := transportKeys(t, receivers)
+	hub = NewPartyHub(everyone)
+	errs := map[party.ID]error{}
+	var wg sync.WaitGroup
+	for _, id := range everyone {
+		cfg := &mpcreshare.Config{
+			Session:       []byte("reshare-bad-dealer"),
+			Self:          id,
+			Dealers:       dealers,
+			Receivers:     receivers,
+			Threshold:     1,
+			PublicKey:     public,
+			TransportKeys: transport,
+			TransportKey:  private[id],
+		}
+		if c := configs[id]; c != nil {
+			cfg.Share, cfg.ChainKey = c.PrivateShare, c.ChainKey
+			cfg.DealerPublic = map[party.ID]curve.Point{}
+			for j, p := range c.VerificationShares {
+				cfg.DealerPublic[j] = p
+			}
+			if id == "b" {
+				cfg.Share = sample.Scalar(rand.Reader, curve.Secp256k1{})
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mpcfrost.FrostReshareTaproot(cfg, hub.Net(id))
+			mu.Lock()
+			errs[id] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range everyone {
+		f := mpcblame.Classify(id, "frost-reshare", "s", errs[id])
+		switch {
+		case f == nil:
+			t.Errorf("%s: resharing with a bad dealer succeeded", id)
+		case id == "b":
+			if f.Kind != mpcblame.KindLocal {
+				t.Errorf("b: %+v", f)
+			}
+		case id == "d":
+			if f.Kind == mpcblame.KindInvalidMessage {
+				t.Errorf("d named a culprit without the dealers' public shares: %+v", f)
+			}
+		default:
+			if f.Kind != mpcblame.KindInvalidMessage || len(f.Culprits) != 1 || f.Culprits[0] != "b" {
+				t.Errorf("%s: %+v", id, f)
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package mpc
 import (
 	"sync"
 
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
 	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
 )
 
@@ -47,3 +48,55 @@ func (n *Network) Done() chan struct{} {
 func (n *Network) SetSendCh(send chan<- *protocol.Message) {
 	n.send = send
 }
+
+// PartyHub routes messages between any number of parties, by recipient or
+// to everyone else for a broadcast. A test can also put a message on the
+// channel of a party, or take one off, to play a peer itself.
+type PartyHub map[party.ID]chan *protocol.Message
+
+// PartyNet is the network.Network of one party of a PartyHub.
+type PartyNet struct {
+	id   party.ID
+	hub  PartyHub
+	once sync.Once
+	done chan struct{}
+}
+
+func NewPartyHub(ids party.IDSlice) PartyHub {
+	hub := PartyHub{}
+	for _, id := range ids {
+		hub[id] = make(chan *protocol.Message, 1000)
+	}
+	return hub
+}
+
+// Net returns the network of party id. A party that is not in the hub can
+// send but receives nothing.
+func (h PartyHub) Net(id party.ID) *PartyNet {
+	return &PartyNet{id: id, hub: h, done: make(chan struct{})}
+}
+
+func (n *PartyNet) Next() <-chan *protocol.Message { return n.hub[n.id] }
+
+func (n *PartyNet) Send(msg *protocol.Message) {
+	for id, ch := range n.hub {
+		if id != n.id && (msg.To == "" || msg.To == id) {
+			ch <- msg
+		}
+	}
+}
+
+func (n *PartyNet) Parties() party.IDSlice {
+	var ids []party.ID
+	for id := range n.hub {
+		if id != n.id {
+			ids = append(ids, id)
+		}
+	}
+	return party.NewIDSlice(ids)
+}
+
+func (n *PartyNet) Done() chan struct{} {
+	n.once.Do(func() { close(n.done) })
+	return n.done
+}
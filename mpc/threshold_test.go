@@ -0,0 +1,107 @@
+package mpc
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/ecdsa"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/pool"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+	"github.com/taurusgroup/multi-party-sig/protocols/cmp"
+	"github.com/taurusgroup/multi-party-sig/protocols/frost"
+	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+)
+
+// run calls fn for every id concurrently.
+func run(t *testing.T, ids party.IDSlice, fn func(id party.ID) error) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(id)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("%s: %v", ids[i], err)
+		}
+	}
+}
+
+func TestThresholdCMP(t *testing.T) {
+	ids := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	// One pool per party: the parties wait on each other inside the pool.
+	pools := map[party.ID]*pool.Pool{}
+	for _, id := range ids {
+		pools[id] = pool.NewPool(0)
+		defer pools[id].TearDown()
+	}
+
+	hub := NewPartyHub(ids)
+	configs := map[party.ID]*cmp.Config{}
+	var mu sync.Mutex
+	run(t, ids, func(id party.ID) error {
+		c, err := mpccmp.CMPKeygen(id, ids, 1, hub.Net(id), pools[id])
+		mu.Lock()
+		configs[id] = c
+		mu.Unlock()
+		return err
+	})
+
+	signers := party.NewIDSlice([]party.ID{"a", "c"})
+	hub = NewPartyHub(signers)
+	presigs := map[party.ID]*ecdsa.PreSignature{}
+	run(t, signers, func(id party.ID) error {
+		p, err := mpccmp.CMPPreSign(configs[id], signers, hub.Net(id), pools[id])
+		mu.Lock()
+		presigs[id] = p
+		mu.Unlock()
+		return err
+	})
+
+	hash := make([]byte, 32)
+	hash[0] = 1
+	incSig, err := mpccmp.CMPPreSignOnlineInc(configs["a"], presigs["a"], hash, pools["a"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpccmp.CMPPreSignOnlineCoSign(configs["c"], presigs["c"], hash, []*protocol.Message{incSig}, pools["c"]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestThresholdFROST(t *testing.T) {
+	ids := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	hub := NewPartyHub(ids)
+	configs := map[party.ID]*frost.TaprootConfig{}
+	var mu sync.Mutex
+	run(t, ids, func(id party.ID) error {
+		c, err := mpcfrost.FrostKeygenTaproot(id, ids, 1, hub.Net(id))
+		mu.Lock()
+		configs[id] = c
+		mu.Unlock()
+		return err
+	})
+
+	hash := make([]byte, 32)
+	hash[0] = 2
+	for _, signers := range []party.IDSlice{
+		party.NewIDSlice([]party.ID{"b", "c"}),
+		ids,
+	} {
+		hub = NewPartyHub(signers)
+		run(t, signers, func(id party.ID) error {
+			if id == signers[len(signers)-1] {
+				_, err := mpcfrost.FrostSignTaprootCoSign(configs[id], hash, signers, hub.Net(id))
+				return err
+			}
+			return mpcfrost.FrostSignTaprootInc(configs[id], hash, signers, hub.Net(id))
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package mpc
+
+import (
+	"crypto/rand"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
+	"github.com/valli0x/signature-escrow/mpc/mpcfrost"
+	"github.com/valli0x/signature-escrow/network"
+)
+
+// recordKeygen runs a FROST keygen of ids, with b garbling its messages if
+// garble is set, and returns the sealed transcript of a.
+func recordKeygen(t *testing.T, ids party.IDSlice, key []byte, garble bool) []byte {
+	t.Helper()
+	hub := NewPartyHub(ids)
+	var rec *network.Recorder
+	var recErr error
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		var n network.Network = hub.Net(id)
+		if garble && id == "b" {
+			n = garbleNet{hub.Net(id)}
+		}
+		if id == "a" {
+			rec = network.NewRecorder(n, network.Transcript{Protocol: "frost-keygen", Party: id, Parties: ids, Threshold: 1})
+			n = rec
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mpcfrost.FrostKeygenTaproot(id, ids, 1, n)
+			if id == "a" {
+				recErr = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	tr := rec.Transcript()
+	if recErr != nil {
+		tr.Error = recErr.Error()
+	}
+	var in, out int
+	for i, e := range tr.Entries {
+		if e.Out {
+			out++
+		} else {
+			in++
+		}
+		if i > 0 && e.At < tr.Entries[i-1].At {
+			t.Fatal("entries out of order")
+		}
+	}
+	if in == 0 || out == 0 {
+		t.Fatalf("recorded %d in, %d out", in, out)
+	}
+	sealed, err := network.SealTranscript(key, &tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func TestTranscriptReplay(t *testing.T) {
+	defer func(d time.Duration) { network.RoundTimeout = d }(network.RoundTimeout)
+	network.RoundTimeout = 5 * time.Second
+
+	ids := party.NewIDSlice([]party.ID{"a", "b", "c"})
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+
+	sealed := recordKeygen(t, ids, key, true)
+	if _, err := network.OpenTranscript(make([]byte, 32), sealed); err == nil {
+		t.Fatal("transcript opened with another key")
+	}
+	tr, err := network.OpenTranscript(key, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Error == "" {
+		t.Fatal("failed run recorded no error")
+	}
+
+	// The rerun of a reproduces the failure and its culprit.
+	rep, err := network.NewReplay(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mpcfrost.FrostKeygenTaproot(tr.Party, tr.Parties, tr.Threshold, rep)
+	f := mpcblame.Classify(tr.Party, tr.Protocol, "", err)
+	if f == nil || f.Kind != mpcblame.KindInvalidMessage || !slices.Equal(f.Culprits, []string{"b"}) {
+		t.Fatalf("replayed failure: %+v", f)
+	}
+
+	// A run that went well replays up to the check of the broadcasts the
+	// others echo, which were of the recorded run's randomness.
+	tr, err = network.OpenTranscript(key, recordKeygen(t, ids, key, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Error != "" {
+		t.Fatal(tr.Error)
+	}
+	rep, err = network.NewReplay(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mpcfrost.FrostKeygenTaproot(tr.Party, tr.Parties, tr.Threshold, rep)
+	if f := mpcblame.Classify(tr.Party, tr.Protocol, "", err); f == nil || f.Kind != mpcblame.KindVerification {
+		t.Fatalf("replay of a good run: %+v", f)
+	}
+}
@@ -3,10 +3,12 @@ package network
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"io"
 	"log/slog"
 	"sync"
 
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
 	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
 	pb "github.com/valli0x/signature-escrow/network/proto"
 	"google.golang.org/grpc"
@@ -24,6 +26,14 @@ type client struct {
 	ready        chan struct{}
 	closed       bool
 	cancel       context.CancelFunc
+	// peers, when set, routes each message to its recipient's channel
+	// instead of send.
+	peers []peer
+}
+
+type peer struct {
+	id      party.ID
+	channel string
 }
 
 func NewClient(address, accept, send string, logger *slog.Logger, conn *grpc.ClientConn) (*client, error) {
@@ -45,6 +55,28 @@ func NewClient(address, accept, send string, logger *slog.Logger, conn *grpc.Cli
 	return client, nil
 }
 
+// NewPartyClient connects self to a group of parties over the relay. It
+// receives on channel(self) and sends a message to channel(msg.To), or to
+// the channel of every other party when it has no recipient. With two
+// parties it is the same as NewClient(channel(self), channel(other)).
+func NewPartyClient(address string, self party.ID, parties party.IDSlice, channel func(party.ID) string, logger *slog.Logger, conn *grpc.ClientConn) (*client, error) {
+	var peers []peer
+	for _, id := range parties {
+		if id != self {
+			peers = append(peers, peer{id: id, channel: channel(id)})
+		}
+	}
+	if len(peers) == 0 {
+		return nil, errors.New("network: no other parties")
+	}
+	c, err := NewClient(address, channel(self), peers[0].channel, logger, conn)
+	if err != nil {
+		return nil, err
+	}
+	c.peers = peers
+	return c, nil
+}
+
 func (c *client) receiving(ctx context.Context) {
 	stream, err := c.grpc.Next(ctx, &pb.NextReq{Name: c.accept})
 	if err != nil {
@@ -89,10 +121,38 @@ func (c *client) Send(msg *protocol.Message) {
 	}
 	dataStr := base64.StdEncoding.EncodeToString(data)
 
-	_, err = c.grpc.Send(context.Background(), &pb.SendReq{Name: c.send, Msgbody: dataStr})
-	if err != nil {
-		c.logger.Error("could not send", "error", err)
+	for _, name := range c.targets(msg) {
+		_, err = c.grpc.Send(context.Background(), &pb.SendReq{Name: name, Msgbody: dataStr})
+		if err != nil {
+			c.logger.Error("could not send", "to", name, "error", err)
+		}
+	}
+}
+
+// targets returns the channels msg goes to.
+func (c *client) targets(msg *protocol.Message) []string {
+	if c.peers == nil {
+		return []string{c.send}
+	}
+	var names []string
+	for _, p := range c.peers {
+		if msg.To == "" || msg.To == p.id {
+			names = append(names, p.channel)
+		}
+	}
+	if len(names) == 0 {
+		c.logger.Error("message for an unknown party dropped", "to", msg.To)
+	}
+	return names
+}
+
+// Parties returns the other parties of a client made by NewPartyClient.
+func (c *client) Parties() party.IDSlice {
+	ids := make([]party.ID, 0, len(c.peers))
+	for _, p := range c.peers {
+		ids = append(ids, p.id)
 	}
+	return party.NewIDSlice(ids)
 }
 
 func (c *client) Next() <-chan *protocol.Message {
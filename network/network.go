@@ -1,6 +1,9 @@
 package network
 
 import (
+	"context"
+	"time"
+
 	"github.com/taurusgroup/multi-party-sig/pkg/party"
 	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
 )
@@ -11,17 +14,44 @@ type Network interface {
 	Done() chan struct{}
 }
 
-func HandlerLoop(id party.ID, h protocol.Handler, channel Network) {
+// HandlerLoop is HandlerLoopContext without a context.
+func HandlerLoop(id party.ID, h protocol.Handler, channel Network) error {
+	return HandlerLoopContext(context.Background(), id, h, channel)
+}
+
+// HandlerLoopContext runs h over channel until it ends. A run that stalls
+// for the round timeout of ctx is stopped: the other parties are told, and
+// the returned *TimeoutError names who it waited for. A run whose ctx ends
+// is stopped the same way and returns a *CancelError.
+func HandlerLoopContext(ctx context.Context, id party.ID, h protocol.Handler, channel Network) error {
+	rounds := NewRoundTracker(id, channel)
+	timeout := RoundTimeoutOf(ctx)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	for {
+		var err error
 		select {
 		case msg, ok := <-h.Listen():
 			if !ok {
 				channel.Done()
-				return
+				return nil
 			}
+			rounds.Sent(msg)
 			channel.Send(msg)
 		case msg := <-channel.Next():
+			rounds.Received(msg)
 			h.Accept(msg)
+		case <-timer.C:
+			err = rounds.Timeout()
+		case <-ctx.Done():
+			err = rounds.Cancel(ctx)
+		}
+		if err != nil {
+			rounds.Abort(channel, err)
+			h.Stop()
+			channel.Done()
+			return err
 		}
+		timer.Reset(timeout)
 	}
 }
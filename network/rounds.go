@@ -0,0 +1,147 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+)
+
+// RoundTimeout is how long a protocol run waits without a message in
+// either direction before it gives up on the round, unless its context says
+// otherwise (see WithRoundTimeout).
+var RoundTimeout = 2 * time.Minute
+
+type roundTimeoutKey struct{}
+
+// WithRoundTimeout returns a context whose runs give up on a round after d.
+func WithRoundTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, roundTimeoutKey{}, d)
+}
+
+// RoundTimeoutOf returns the round timeout of runs under ctx.
+func RoundTimeoutOf(ctx context.Context) time.Duration {
+	if d, ok := ctx.Value(roundTimeoutKey{}).(time.Duration); ok && d > 0 {
+		return d
+	}
+	return RoundTimeout
+}
+
+// Roster is implemented by networks that know the other parties of the
+// run, so that a timeout can name the silent ones.
+type Roster interface {
+	Parties() party.IDSlice
+}
+
+// TimeoutError is a run that stalled in Round, or before a result when it
+// is 0: Waiting are the parties that had not sent that round.
+type TimeoutError struct {
+	Round   int
+	Waiting []party.ID
+}
+
+func (e *TimeoutError) Error() string {
+	s := "timed out"
+	if e.Round > 0 {
+		s = fmt.Sprintf("round %d timed out", e.Round)
+	}
+	if len(e.Waiting) > 0 {
+		ids := make([]string, len(e.Waiting))
+		for i, id := range e.Waiting {
+			ids[i] = string(id)
+		}
+		s += " waiting for " + strings.Join(ids, ",")
+	}
+	return s
+}
+
+// CancelError is a run stopped in Round, 0 outside of rounds, because its
+// context ended; Cause is why, e.g. context.Canceled.
+type CancelError struct {
+	Round int
+	Cause error
+}
+
+func (e *CancelError) Error() string {
+	if e.Round == 0 {
+		return fmt.Sprintf("cancelled: %v", e.Cause)
+	}
+	return fmt.Sprintf("round %d cancelled: %v", e.Round, e.Cause)
+}
+
+func (e *CancelError) Unwrap() error { return e.Cause }
+
+// RoundTracker follows the rounds of one protocol run, to tell who a
+// stalled run waits for and to abort it for the other parties.
+type RoundTracker struct {
+	self    party.ID
+	parties party.IDSlice
+	round   int
+	last    map[party.ID]int
+	header  *protocol.Message
+}
+
+// NewRoundTracker tracks the run of self over n.
+func NewRoundTracker(self party.ID, n Network) *RoundTracker {
+	t := &RoundTracker{self: self, last: map[party.ID]int{}}
+	if r, ok := n.(Roster); ok {
+		t.parties = r.Parties()
+	}
+	return t
+}
+
+// Sent records a message of self.
+func (t *RoundTracker) Sent(msg *protocol.Message) {
+	if t.header == nil {
+		t.header = msg
+	}
+	t.round = max(t.round, int(msg.RoundNumber))
+}
+
+// Received records a message of another party.
+func (t *RoundTracker) Received(msg *protocol.Message) {
+	t.last[msg.From] = max(t.last[msg.From], int(msg.RoundNumber))
+}
+
+// Timeout returns the error of a run that stalled now: the parties that
+// have not reached the round self is in.
+func (t *RoundTracker) Timeout() *TimeoutError {
+	round := max(t.round, 1)
+	others := slices.Clone(t.parties)
+	for id := range t.last {
+		if !slices.Contains(others, id) {
+			others = append(others, id)
+		}
+	}
+	var waiting []party.ID
+	for _, id := range others {
+		if id != t.self && t.last[id] < round {
+			waiting = append(waiting, id)
+		}
+	}
+	slices.Sort(waiting)
+	return &TimeoutError{Round: round, Waiting: waiting}
+}
+
+// Cancel returns the error of a run stopped now because ctx ended.
+func (t *RoundTracker) Cancel(ctx context.Context) *CancelError {
+	return &CancelError{Round: max(t.round, 1), Cause: context.Cause(ctx)}
+}
+
+// Abort tells the other parties that self gave up on the run with err, so
+// they stop waiting for it. Their handlers report it as an abort by self.
+func (t *RoundTracker) Abort(n Network, err error) {
+	if t.header == nil {
+		return
+	}
+	n.Send(&protocol.Message{
+		SSID:     t.header.SSID,
+		From:     t.self,
+		Protocol: t.header.Protocol,
+		Data:     []byte(err.Error()),
+	})
+}
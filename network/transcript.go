@@ -0,0 +1,274 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/taurusgroup/multi-party-sig/pkg/party"
+	"github.com/taurusgroup/multi-party-sig/pkg/protocol"
+)
+
+// Transcript is every message one party sent and received in a protocol
+// run, with what else a replay of its side needs but its key share.
+type Transcript struct {
+	ID       string
+	Protocol string
+	Session  string
+	Party    party.ID
+	// Account is the "network/index" whose key share the run used, if any.
+	Account string
+	Parties party.IDSlice
+	// Threshold is the one the protocol was given: one less than the
+	// parties it takes to sign.
+	Threshold int
+	Hash      []byte
+	// Role is the side of a run whose parties play different parts: "inc"
+	// or "cosign" for a FROST signing.
+	Role string
+	// Config is a digest of the key share the run used, if any.
+	Config []byte
+	// Started is when the run started, in Unix milliseconds.
+	Started int64
+	Entries []Entry
+	// Error is how the run failed, empty when it did not.
+	Error string
+}
+
+// Entry is one message of a transcript.
+type Entry struct {
+	// At is the time since the run started.
+	At  time.Duration
+	Out bool
+	// Message is the protocol.Message in binary form.
+	Message []byte
+}
+
+// Recorder is a Network that records a transcript of the run over it.
+type Recorder struct {
+	n     Network
+	next  chan *protocol.Message
+	stop  chan struct{}
+	once  sync.Once
+	start time.Time
+	mu    sync.Mutex
+	t     Transcript
+}
+
+// NewRecorder records the run t over n.
+func NewRecorder(n Network, t Transcript) *Recorder {
+	r := &Recorder{
+		n:     n,
+		next:  make(chan *protocol.Message),
+		stop:  make(chan struct{}),
+		start: time.Now(),
+		t:     t,
+	}
+	r.t.Started = r.start.UnixMilli()
+	go r.forward()
+	return r
+}
+
+func (r *Recorder) forward() {
+	for {
+		select {
+		case msg := <-r.n.Next():
+			r.record(msg, false)
+			select {
+			case r.next <- msg:
+			case <-r.stop:
+				return
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *Recorder) record(msg *protocol.Message, out bool) {
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.t.Entries = append(r.t.Entries, Entry{At: time.Since(r.start), Out: out, Message: data})
+}
+
+func (r *Recorder) Next() <-chan *protocol.Message { return r.next }
+
+func (r *Recorder) Send(msg *protocol.Message) {
+	r.record(msg, true)
+	r.n.Send(msg)
+}
+
+func (r *Recorder) Done() chan struct{} {
+	r.once.Do(func() { close(r.stop) })
+	return r.n.Done()
+}
+
+// Parties returns the other parties of the underlying network, if it
+// knows them.
+func (r *Recorder) Parties() party.IDSlice {
+	if roster, ok := r.n.(Roster); ok {
+		return roster.Parties()
+	}
+	return nil
+}
+
+// Transcript returns what was recorded so far.
+func (r *Recorder) Transcript() Transcript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.t
+	t.Entries = append([]Entry(nil), r.t.Entries...)
+	return t
+}
+
+// Replay is a Network that plays the received messages of a transcript
+// back to a rerun of its party's side, and keeps what the rerun sends.
+type Replay struct {
+	t    *Transcript
+	next chan *protocol.Message
+	done chan struct{}
+	once sync.Once
+	mu   sync.Mutex
+	sent []*protocol.Message
+}
+
+// NewReplay replays t.
+func NewReplay(t *Transcript) (*Replay, error) {
+	var in []*protocol.Message
+	for i, e := range t.Entries {
+		if e.Out {
+			continue
+		}
+		msg := &protocol.Message{}
+		if err := msg.UnmarshalBinary(e.Message); err != nil {
+			return nil, fmt.Errorf("transcript entry %d: %w", i, err)
+		}
+		in = append(in, msg)
+	}
+	r := &Replay{t: t, next: make(chan *protocol.Message, len(in)), done: make(chan struct{})}
+	for _, msg := range in {
+		r.next <- msg
+	}
+	return r, nil
+}
+
+func (r *Replay) Next() <-chan *protocol.Message { return r.next }
+
+func (r *Replay) Send(msg *protocol.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, msg)
+}
+
+func (r *Replay) Done() chan struct{} {
+	r.once.Do(func() { close(r.done) })
+	return r.done
+}
+
+func (r *Replay) Parties() party.IDSlice {
+	var ids []party.ID
+	for _, id := range r.t.Parties {
+		if id != r.t.Party {
+			ids = append(ids, id)
+		}
+	}
+	return party.NewIDSlice(ids)
+}
+
+// Diverged returns the index of the first message the rerun sent that the
+// recorded run did not: another round, recipient or broadcast flag. Their
+// contents differ anyway, as every run draws fresh randomness. It is -1
+// when the rerun sent the same messages.
+func (r *Replay) Diverged() int {
+	var recorded []*protocol.Message
+	for _, e := range r.t.Entries {
+		if !e.Out {
+			continue
+		}
+		msg := &protocol.Message{}
+		if msg.UnmarshalBinary(e.Message) != nil {
+			break
+		}
+		recorded = append(recorded, msg)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range max(len(recorded), len(r.sent)) {
+		if i >= len(recorded) || i >= len(r.sent) {
+			return i
+		}
+		a, b := recorded[i], r.sent[i]
+		if a.RoundNumber != b.RoundNumber || a.To != b.To || a.Broadcast != b.Broadcast {
+			return i
+		}
+	}
+	return -1
+}
+
+// transcriptAD binds a sealed transcript to its purpose.
+var transcriptAD = []byte("signature-escrow transcript v1")
+
+// ParseTranscriptKey parses the hex encoded 32-byte key transcripts are
+// sealed with.
+func ParseTranscriptKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("transcript key must be 64 hex characters")
+	}
+	return key, nil
+}
+
+// SealTranscript encrypts t with key.
+func SealTranscript(key []byte, t *Transcript) ([]byte, error) {
+	aead, err := transcriptAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := cbor.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, transcriptAD), nil
+}
+
+// OpenTranscript decrypts a transcript sealed with key.
+func OpenTranscript(key, sealed []byte) (*Transcript, error) {
+	aead, err := transcriptAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("transcript too short")
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], transcriptAD)
+	if err != nil {
+		return nil, errors.New("transcript does not open with this key")
+	}
+	t := &Transcript{}
+	if err := cbor.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func transcriptAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/valli0x/signature-escrow/auth"
+)
+
+type APIKeyCreateRequest struct {
+	Name string `json:"name"`
+	// Scopes: escrow:read, escrow:deposit, mailbox, timebox.
+	Scopes []string `json:"scopes"`
+	// Pairs optionally restricts the key to these pair IDs.
+	Pairs []string `json:"pairs,omitempty"`
+	// ExpiresIn is the key lifetime in seconds (default 90 days, max 1 year).
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+type APIKeyCreateResponse struct {
+	// Key is the credential to send as "Authorization: Bearer <key>". It is
+	// shown only once.
+	Key string `json:"key"`
+	*auth.APIKey
+}
+
+type APIKeyListResponse struct {
+	Keys []*auth.APIKey `json:"keys"`
+}
+
+type APIKeyRevokeRequest struct {
+	ID string `json:"id"`
+}
+
+// apiKeyCreate issues a scoped API key for the caller's address.
+//
+// @Summary      Create an API key
+// @Description  Issues a long-lived credential for bots and service accounts. The key acts as the caller's address on the route groups in "scopes" (escrow:read, escrow:deposit, mailbox, timebox), optionally only for the listed pairs. The secret is returned once.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        body  body      APIKeyCreateRequest  true  "Key scopes and expiry"
+// @Success      200   {object}  APIKeyCreateResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Security     BearerAuth
+// @Router       /v1/apikeys/create [post]
+func (s *Server) apiKeyCreate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req APIKeyCreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+
+		owner := auth.AddressFromContext(r.Context())
+		for _, id := range req.Pairs {
+			pair, err := loadPair(s.stor, id)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+			if pair == nil || !pairContains(pair, owner) {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("pair %s not found", id))
+				return
+			}
+		}
+
+		token, key, err := s.apiKeys.Create(r.Context(), owner, req.Name, req.Scopes, req.Pairs,
+			time.Duration(req.ExpiresIn)*time.Second)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		s.logger.Info("api key created", "address", owner, "api_key", key.ID, "scopes", key.Scopes)
+		respondOk(w, APIKeyCreateResponse{Key: token, APIKey: key})
+	}
+}
+
+// apiKeyList lists the caller's API keys.
+//
+// @Summary      List API keys
+// @Description  Returns the caller's API keys without their secrets.
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  APIKeyListResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Security     BearerAuth
+// @Router       /v1/apikeys/list [get]
+func (s *Server) apiKeyList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := s.apiKeys.List(r.Context(), auth.AddressFromContext(r.Context()))
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		respondOk(w, APIKeyListResponse{Keys: keys})
+	}
+}
+
+// apiKeyRevoke revokes one of the caller's API keys.
+//
+// @Summary      Revoke an API key
+// @Description  Revokes an API key by ID. Returns 204 No Content on success. /v1/auth/revoke-all also revokes all API keys.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        body  body  APIKeyRevokeRequest  true  "Key ID"
+// @Success      204   "No Content"
+// @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Security     BearerAuth
+// @Router       /v1/apikeys/revoke [post]
+func (s *Server) apiKeyRevoke() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req APIKeyRevokeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.ID == "" {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("key id is required"))
+			return
+		}
+
+		owner := auth.AddressFromContext(r.Context())
+		if err := s.apiKeys.Revoke(r.Context(), owner, req.ID); err != nil {
+			if errors.Is(err, auth.ErrInvalidAPIKey) {
+				respondError(w, http.StatusForbidden, fmt.Errorf("not your api key"))
+				return
+			}
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+
+		s.logger.Info("api key revoked", "address", owner, "api_key", req.ID)
+		respondOk(w, nil)
+	}
+}
+
+// logRequests logs authenticated requests under the caller's address, with
+// the API key ID when one was used.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", ww.Status(),
+			"duration", time.Since(start),
+			"address", auth.AddressFromContext(r.Context()),
+		}
+		if key := auth.APIKeyFromContext(r.Context()); key != nil {
+			attrs = append(attrs, "api_key", key.ID)
+		}
+		s.logger.Debug("request", attrs...)
+	})
+}
@@ -1,17 +1,19 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/valli0x/signature-escrow/auth"
 )
 
-const tokenTTL = 24 * time.Hour
-
 type NonceRequest struct {
+	// Address is an ETH address or a btc:-prefixed P2WPKH / P2TR address.
 	Address string `json:"address"`
 }
 
@@ -24,21 +26,34 @@ type LoginRequest struct {
 	Address   string `json:"address"`
 	Signature string `json:"signature"`
 	Nonce     string `json:"nonce"`
+	// Message is the exact text the wallet signed. Optional: when omitted the
+	// message issued with the nonce is assumed.
+	Message string `json:"message,omitempty"`
 }
 
 type LoginResponse struct {
-	Token   string `json:"token"`
-	Address string `json:"address"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Address      string `json:"address"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
-// authNonce issues a one-time nonce for an ETH address to sign.
+// authNonce issues a one-time nonce for an ETH or BTC address to sign.
 //
 // @Summary      Request a login nonce
-// @Description  Returns a nonce and an EIP-191 message for the given ETH address. The client signs the message and submits it to /v1/auth/login.
+// @Description  Returns a nonce and an EIP-4361 (Sign-In with Ethereum) message for the given address, bound to this server's domain and chain ID. ETH addresses sign it with EIP-191; Bitcoin identities ("btc:<P2WPKH or P2TR address>") get a "Bitcoin account" message and sign it with BIP-322 or legacy signmessage. Submit the signature to /v1/auth/login.
 // @Tags         auth
 // @Accept       json
 // @Produce      json
-// @Param        body  body      NonceRequest  true  "ETH address"
+// @Param        body  body      NonceRequest  true  "ETH or btc: address"
 // @Success      200   {object}  NonceResponse
 // @Failure      400   {object}  ErrorResponse
 // @Failure      500   {object}  ErrorResponse
@@ -56,13 +71,19 @@ func (s *Server) authNonce() http.HandlerFunc {
 			return
 		}
 
-		nonce, err := s.nonceStore.Generate(req.Address)
+		id, err := auth.ParseIdentity(req.Address)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		nonce, issuedAt, err := s.nonceStore.Issue(r.Context(), id)
 		if err != nil {
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate nonce: %w", err))
 			return
 		}
 
-		message := auth.GenerateNonce(req.Address, nonce)
+		message := s.siwe.Message(req.Address, nonce, issuedAt)
 
 		respondOk(w, NonceResponse{
 			Nonce:   nonce,
@@ -74,7 +95,7 @@ func (s *Server) authNonce() http.HandlerFunc {
 // authLogin verifies a signed nonce and issues a JWT.
 //
 // @Summary      Login with a signed nonce
-// @Description  Verifies the EIP-191 signature over the nonce message and returns a JWT (valid 24h) on success.
+// @Description  Verifies the EIP-191 signature over the sign-in message and returns a short-lived access JWT (15 min) plus a rotating refresh token on success. The EIP-4361 message's domain, nonce, chain ID and time bounds are checked; pass the signed text in "message" if it differs from the one issued with the nonce. Besides EOA signatures, contract wallets are verified via EIP-1271 isValidSignature (when an Ethereum RPC is configured) and registered MPC shared accounts via their CMP signature. For btc: identities the signature is base64 (BIP-322 simple, or a 65-byte signmessage signature for P2WPKH).
 // @Tags         auth
 // @Accept       json
 // @Produce      json
@@ -82,6 +103,7 @@ func (s *Server) authNonce() http.HandlerFunc {
 // @Success      200   {object}  LoginResponse
 // @Failure      400   {object}  ErrorResponse
 // @Failure      401   {object}  ErrorResponse
+// @Failure      429   {object}  ErrorResponse
 // @Failure      500   {object}  ErrorResponse
 // @Router       /v1/auth/login [post]
 func (s *Server) authLogin() http.HandlerFunc {
@@ -97,32 +119,210 @@ func (s *Server) authLogin() http.HandlerFunc {
 			return
 		}
 
-		if !s.nonceStore.Verify(req.Address, req.Nonce) {
+		id, err := auth.ParseIdentity(req.Address)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		guard := loginKeys(s.limiter.clientIP(r), id)
+		if wait := s.logins.lockedFor(guard, time.Now()); wait > 0 {
+			setRetryAfter(w, wait)
+			respondError(w, http.StatusTooManyRequests, fmt.Errorf("too many failed logins"))
+			return
+		}
+
+		issuedAt, ok, err := s.nonceStore.Consume(r.Context(), id, req.Nonce)
+		if err != nil {
+			s.logger.Error("nonce lookup failed", "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if !ok {
+			s.logins.fail(guard, time.Now())
 			respondError(w, http.StatusUnauthorized, fmt.Errorf("invalid or expired nonce"))
 			return
 		}
 
-		message := auth.GenerateNonce(req.Address, req.Nonce)
+		message, err := s.siwe.ResolveMessage(req.Address, req.Nonce, req.Message, issuedAt, time.Now())
+		if err != nil {
+			s.logger.Warn("sign-in message rejected", "address", req.Address, "error", err)
+			s.logins.fail(guard, time.Now())
+			respondError(w, http.StatusUnauthorized, err)
+			return
+		}
 
-		address, err := auth.VerifySignature(req.Address, message, req.Signature)
+		identity, err := s.verifier.Verify(r.Context(), id, message, req.Signature)
 		if err != nil {
 			s.logger.Error("signature verification failed", "error", err)
+			s.logins.fail(guard, time.Now())
 			respondError(w, http.StatusUnauthorized, fmt.Errorf("signature verification failed"))
 			return
 		}
 
-		token, err := auth.GenerateToken(address, s.jwtSecret, tokenTTL)
+		resp, err := s.issueSession(r.Context(), identity, "")
 		if err != nil {
 			s.logger.Error("failed to generate token", "error", err)
 			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate token"))
 			return
 		}
+		if auth.IdentityNamespace(identity) == auth.NamespaceETH {
+			resp.Address = common.HexToAddress(identity).Hex()
+		}
+		s.logins.succeed(guard)
 
-		s.logger.Info("user authenticated", "address", address.Hex())
+		s.logger.Info("user authenticated", "address", resp.Address)
 
-		respondOk(w, LoginResponse{
-			Token:   token,
-			Address: address.Hex(),
-		})
+		respondOk(w, resp)
+	}
+}
+
+// issueSession mints an access token for address. With refresh == "" a new
+// refresh-token family is started; otherwise refresh is the already rotated
+// successor to hand back.
+func (s *Server) issueSession(ctx context.Context, address, refresh string) (*LoginResponse, error) {
+	gen, err := s.tokens.Generation(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	token, err := auth.SignClaims(auth.NewClaims(address, gen, auth.AccessTokenTTL), s.keys)
+	if err != nil {
+		return nil, err
+	}
+	if refresh == "" {
+		if refresh, err = s.tokens.IssueRefresh(ctx, address, gen); err != nil {
+			return nil, err
+		}
+	}
+	return &LoginResponse{
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(auth.AccessTokenTTL.Seconds()),
+		Address:      address,
+	}, nil
+}
+
+// authRefresh rotates a refresh token and issues a new access token.
+//
+// @Summary      Refresh a session
+// @Description  Exchanges a refresh token for a new access JWT and a new refresh token. Each refresh token works once; re-presenting a rotated token revokes its whole family.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        body  body      RefreshRequest  true  "Refresh token"
+// @Success      200   {object}  LoginResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /v1/auth/refresh [post]
+func (s *Server) authRefresh() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.RefreshToken == "" {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("refresh_token is required"))
+			return
+		}
+
+		address, _, next, err := s.tokens.Rotate(r.Context(), req.RefreshToken)
+		if errors.Is(err, auth.ErrInvalidRefreshToken) {
+			respondError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			s.logger.Error("refresh token rotation failed", "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+
+		resp, err := s.issueSession(r.Context(), address, next)
+		if err != nil {
+			s.logger.Error("failed to generate token", "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate token"))
+			return
+		}
+
+		respondOk(w, resp)
+	}
+}
+
+// authLogout ends the current session.
+//
+// @Summary      Logout
+// @Description  Puts the presented access token on the denylist and, if given, revokes the refresh token of this session. Returns 204 No Content.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        body  body      LogoutRequest  false  "Refresh token to revoke"
+// @Success      204   "No Content"
+// @Failure      401   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Security     BearerAuth
+// @Router       /v1/auth/logout [post]
+func (s *Server) authLogout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LogoutRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		addr := auth.AddressFromContext(r.Context())
+		if claims := auth.ClaimsFromContext(r.Context()); claims != nil {
+			if err := s.tokens.Deny(r.Context(), claims); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+		}
+		if req.RefreshToken != "" {
+			if err := s.tokens.RevokeRefresh(r.Context(), addr, req.RefreshToken); err != nil &&
+				!errors.Is(err, auth.ErrInvalidRefreshToken) {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+				return
+			}
+		}
+
+		s.logger.Info("user logged out", "address", addr)
+		respondOk(w, nil)
+	}
+}
+
+// authRevokeAll revokes every session of the caller's address.
+//
+// @Summary      Revoke all sessions
+// @Description  Invalidates every access token, refresh token and API key ever issued to the caller's address, including the one used for this request. Use it when a device is lost.
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  map[string]interface{}
+// @Failure      401  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Security     BearerAuth
+// @Router       /v1/auth/revoke-all [post]
+func (s *Server) authRevokeAll() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := auth.AddressFromContext(r.Context())
+		if _, err := s.tokens.RevokeAll(r.Context(), addr); err != nil {
+			s.logger.Error("revoke all sessions failed", "address", addr, "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+
+		s.logger.Info("all sessions revoked", "address", addr)
+		respondOk(w, map[string]any{"revoked": true})
+	}
+}
+
+// jwks publishes the public keys access tokens are signed with.
+//
+// @Summary      JSON Web Key Set
+// @Description  Public keys (RFC 7517) for verifying access tokens issued by this server, selected by the token's kid header. Empty when the server signs with a shared HS256 secret.
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  auth.JWKSet
+// @Router       /.well-known/jwks.json [get]
+func (s *Server) jwks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		respondOk(w, s.keys.JWKS())
 	}
 }
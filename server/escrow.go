@@ -235,9 +235,16 @@ func (s *Server) escrow() http.HandlerFunc {
 
 		// The whole read-modify-write must be atomic: two concurrent deposits
 		// would otherwise each load the old pollination and clobber the other's
-		// flower (last-writer-wins on the stored blob).
-		s.escrowMu.Lock()
-		defer s.escrowMu.Unlock()
+		// flower (last-writer-wins on the stored blob). The storage lock also
+		// covers deposits arriving at other replicas, and it is taken on the
+		// key the pollination is stored under so that a replicated store
+		// fences the write once the lease is lost.
+		unlock, err := storage.Lock(r.Context(), s.stor, f.ID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		defer unlock()
 
 		p, err := getPollination(f.ID, s.stor)
 		if err != nil {
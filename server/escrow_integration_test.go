@@ -1,51 +1,27 @@
 package server
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
 
-	ethaccounts "github.com/ethereum/go-ethereum/accounts"
-	"github.com/ethereum/go-ethereum/crypto"
 	mpsecdsa "github.com/taurusgroup/multi-party-sig/pkg/ecdsa"
 	"github.com/taurusgroup/multi-party-sig/pkg/math/curve"
 	"github.com/taurusgroup/multi-party-sig/pkg/math/sample"
 	"github.com/valli0x/signature-escrow/mpc/mpccmp"
+	"github.com/valli0x/signature-escrow/server/servertest"
+	"github.com/valli0x/signature-escrow/storage"
 )
 
-func authToken(t *testing.T, tsURL string) (string, string) {
-	t.Helper()
-	priv, err := crypto.GenerateKey()
-	if err != nil {
-		t.Fatal(err)
-	}
-	addr := crypto.PubkeyToAddress(priv.PublicKey).Hex()
-	_, res, err := postJSON(tsURL+"/v1/auth/nonce", map[string]string{"address": addr}, "")
-	if err != nil {
-		t.Fatal(err)
-	}
-	msg := res["message"].(string)
-	nonce := res["nonce"].(string)
-	h := ethaccounts.TextHash([]byte(msg))
-	sig, _ := crypto.Sign(h, priv)
-	sig[64] += 27
-	_, res, err = postJSON(tsURL+"/v1/auth/login", map[string]string{
-		"address": addr, "signature": "0x" + hex.EncodeToString(sig), "nonce": nonce,
-	}, "")
-	if err != nil {
-		t.Fatal(err)
-	}
-	tok, _ := res["token"].(string)
-	if tok == "" {
-		t.Fatal("no token")
-	}
-	return tok, addr
-}
-
 // cmpAccount builds a shared-account pubkey (compressed hex) + a CMP-format
 // signature (hex) over the given hash — the exact bytes the app deposits.
 func cmpAccount(t *testing.T, hash []byte) (pubHex, sigHex string) {
@@ -81,14 +57,14 @@ func cmpAccount(t *testing.T, hash []byte) (pubHex, sigHex string) {
 }
 
 func deposit(tsURL, token, id, alg, pub, hash, sig string) (*http.Response, map[string]interface{}) {
-	resp, res, _ := postJSON(tsURL+"/v1/escrow", map[string]string{
+	resp, res, _ := servertest.PostJSON(tsURL+"/v1/escrow", map[string]string{
 		"alg": alg, "id": id, "pub": pub, "hash": hash, "sig": sig,
 	}, token)
 	return resp, res
 }
 
 func check(tsURL, token, id, pub string) (*http.Response, map[string]interface{}) {
-	resp, res, _ := postJSON(tsURL+"/v1/escrow/check", map[string]string{"id": id, "pub": pub}, token)
+	resp, res, _ := servertest.PostJSON(tsURL+"/v1/escrow/check", map[string]string{"id": id, "pub": pub}, token)
 	return resp, res
 }
 
@@ -116,8 +92,8 @@ func TestEscrowHappyPathRelease(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
 	sw := newSwap(t)
-	tokA, _ := authToken(t, ts.URL)
-	tokB, _ := authToken(t, ts.URL)
+	tokA, _ := servertest.Login(t, ts.URL)
+	tokB, _ := servertest.Login(t, ts.URL)
 	id := "swap-happy"
 
 	// Alice deposits her pub/hash carrying Bob's sig; still pending (one flower).
@@ -167,8 +143,8 @@ func TestEscrowMismatchedSigsNeverRelease(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
 	sw := newSwap(t)
-	tokA, _ := authToken(t, ts.URL)
-	tokB, _ := authToken(t, ts.URL)
+	tokA, _ := servertest.Login(t, ts.URL)
+	tokB, _ := servertest.Login(t, ts.URL)
 	id := "swap-bad"
 	// Deposit each party's OWN sig under OWN pub (the naive/wrong pairing) —
 	// pollination cross-check fails, so nothing is ever released.
@@ -203,8 +179,8 @@ func TestEscrowForeignOverwriteRejected(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
 	sw := newSwap(t)
-	tokA, _ := authToken(t, ts.URL)
-	tokM, _ := authToken(t, ts.URL) // mallory
+	tokA, _ := servertest.Login(t, ts.URL)
+	tokM, _ := servertest.Login(t, ts.URL) // mallory
 	id := "swap-grief"
 	deposit(ts.URL, tokA, id, "ecdsa", sw.pubA, sw.hashA, sw.sigB)
 	// Mallory tries to overwrite Alice's slot (same pub) with garbage.
@@ -213,7 +189,7 @@ func TestEscrowForeignOverwriteRejected(t *testing.T) {
 		t.Fatalf("foreign overwrite expected 409, got %d %v", resp.StatusCode, res)
 	}
 	// Alice's flower must be intact: complete the swap normally and release.
-	tokB, _ := authToken(t, ts.URL)
+	tokB, _ := servertest.Login(t, ts.URL)
 	deposit(ts.URL, tokB, id, "ecdsa", sw.pubB, sw.hashB, sw.sigA)
 	_, res = check(ts.URL, tokA, id, sw.pubA)
 	if res["status"] != "complete" {
@@ -227,7 +203,7 @@ func TestEscrowSigImmutable(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
 	sw := newSwap(t)
-	tokA, _ := authToken(t, ts.URL)
+	tokA, _ := servertest.Login(t, ts.URL)
 	id := "swap-immut"
 	deposit(ts.URL, tokA, id, "ecdsa", sw.pubA, sw.hashA, sw.sigB)
 	resp, _ := deposit(ts.URL, tokA, id, "ecdsa", sw.pubA, sw.hashA, "0011")
@@ -245,7 +221,7 @@ func TestEscrowOneDepositorBothSlotsRejected(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
 	sw := newSwap(t)
-	tokA, _ := authToken(t, ts.URL)
+	tokA, _ := servertest.Login(t, ts.URL)
 	id := "swap-selfboth"
 	deposit(ts.URL, tokA, id, "ecdsa", sw.pubA, sw.hashA, sw.sigB)
 	resp, res := deposit(ts.URL, tokA, id, "ecdsa", sw.pubB, sw.hashB, sw.sigA)
@@ -259,9 +235,9 @@ func TestEscrowThirdParticipantRejected(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
 	sw := newSwap(t)
-	tokA, _ := authToken(t, ts.URL)
-	tokB, _ := authToken(t, ts.URL)
-	tokC, _ := authToken(t, ts.URL)
+	tokA, _ := servertest.Login(t, ts.URL)
+	tokB, _ := servertest.Login(t, ts.URL)
+	tokC, _ := servertest.Login(t, ts.URL)
 	id := "swap-third"
 	deposit(ts.URL, tokA, id, "ecdsa", sw.pubA, sw.hashA, sw.sigB)
 	deposit(ts.URL, tokB, id, "ecdsa", sw.pubB, sw.hashB, sw.sigA)
@@ -278,9 +254,9 @@ func TestEscrowReleaseOnlyToDepositor(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
 	sw := newSwap(t)
-	tokA, _ := authToken(t, ts.URL)
-	tokB, _ := authToken(t, ts.URL)
-	tokM, _ := authToken(t, ts.URL)
+	tokA, _ := servertest.Login(t, ts.URL)
+	tokB, _ := servertest.Login(t, ts.URL)
+	tokM, _ := servertest.Login(t, ts.URL)
 	id := "swap-authz"
 	deposit(ts.URL, tokA, id, "ecdsa", sw.pubA, sw.hashA, sw.sigB)
 	deposit(ts.URL, tokB, id, "ecdsa", sw.pubB, sw.hashB, sw.sigA)
@@ -307,8 +283,8 @@ func TestEscrowConcurrentDepositsNoClobber(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
 	sw := newSwap(t)
-	tokA, _ := authToken(t, ts.URL)
-	tokB, _ := authToken(t, ts.URL)
+	tokA, _ := servertest.Login(t, ts.URL)
+	tokB, _ := servertest.Login(t, ts.URL)
 	id := "swap-race"
 
 	// The two legit parties deposit concurrently many times (idempotent) —
@@ -340,9 +316,9 @@ func TestEscrowSquatGriefsButCannotSteal(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
 	sw := newSwap(t)
-	tokM, _ := authToken(t, ts.URL) // attacker who leaked the id
-	tokA, _ := authToken(t, ts.URL) // real Alice
-	tokB, _ := authToken(t, ts.URL) // real Bob
+	tokM, _ := servertest.Login(t, ts.URL) // attacker who leaked the id
+	tokA, _ := servertest.Login(t, ts.URL) // real Alice
+	tokB, _ := servertest.Login(t, ts.URL) // real Bob
 	id := "swap-squat"
 
 	hM := sha256.Sum256([]byte("attacker"))
@@ -370,3 +346,132 @@ func TestEscrowSquatGriefsButCannotSteal(t *testing.T) {
 		t.Fatal("released Bob's counterparty sig despite an invalid (squatted) flower")
 	}
 }
+
+// newRaftNodes starts n nodes of one Raft storage cluster whose lock
+// leases last lockTTL, or the default when zero.
+func newRaftNodes(t *testing.T, n int, lockTTL time.Duration) []*storage.RaftStorage {
+	t.Helper()
+	nodes := make([]*storage.RaftStorage, n)
+	for i := range nodes {
+		cfg := storage.RaftConfig{NodeID: fmt.Sprintf("node%d", i), Addr: "127.0.0.1:0", Dir: t.TempDir(), Secret: []byte("cluster secret"), LockTTL: lockTTL}
+		if i == 0 {
+			cfg.Bootstrap = true
+		} else {
+			cfg.Join = nodes[0].Addr()
+		}
+		node, err := storage.NewRaftStorage(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+		nodes[i] = node
+	}
+	return nodes
+}
+
+// newRaftReplicas starts n server replicas, each on its own node of one
+// Raft storage cluster.
+func newRaftReplicas(t *testing.T, n int) ([]*storage.RaftStorage, []*httptest.Server) {
+	t.Helper()
+	nodes := newRaftNodes(t, n, 0)
+	servers := make([]*httptest.Server, n)
+	for i, node := range nodes {
+		servers[i] = setupTestServerWith(t, node)
+		t.Cleanup(servers[i].Close)
+	}
+	return nodes, servers
+}
+
+// raftLeader returns the index of the node that leads, waiting for an
+// election if need be.
+func raftLeader(t *testing.T, nodes []*storage.RaftStorage) int {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, n := range nodes {
+			if n != nil && n.Leader() == fmt.Sprintf("node%d", i) {
+				return i
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no leader")
+	return -1
+}
+
+// 11. Replicated storage: deposits on different replicas serialize, and the
+// swap completes with the same signatures after the leader dies mid-swap.
+func TestEscrowReleaseAcrossFailover(t *testing.T) {
+	nodes, servers := newRaftReplicas(t, 3)
+	sw := newSwap(t)
+	tokA, _ := servertest.Login(t, servers[1].URL)
+	tokB, _ := servertest.Login(t, servers[2].URL)
+	id := "swap-failover"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			deposit(servers[i%3].URL, tokA, id, "ecdsa", sw.pubA, sw.hashA, sw.sigB)
+		}(i)
+	}
+	wg.Wait()
+
+	lead := raftLeader(t, nodes)
+	nodes[lead].Close()
+	survivors := []*httptest.Server{servers[(lead+1)%3], servers[(lead+2)%3]}
+
+	resp, res := deposit(survivors[0].URL, tokB, id, "ecdsa", sw.pubB, sw.hashB, sw.sigA)
+	if resp.StatusCode != 200 || res["status"] != "complete" {
+		t.Fatalf("bob deposit after failover: %d %v", resp.StatusCode, res)
+	}
+	assertReleasedSig(t, res, sw.pubB, sw.hashB)
+	resp, res = check(survivors[1].URL, tokA, id, sw.pubA)
+	if resp.StatusCode != 200 || res["status"] != "complete" {
+		t.Fatalf("alice check after failover: %d %v", resp.StatusCode, res)
+	}
+	assertReleasedSig(t, res, sw.pubA, sw.hashA)
+
+	// The released deposits stay fixed on every replica.
+	_, other := cmpAccount(t, []byte("other withdrawal hash, 32 bytes!"))
+	if resp, _ := deposit(survivors[1].URL, tokA, id, "ecdsa", sw.pubA, sw.hashA, other); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("rewrite of a released deposit: %d", resp.StatusCode)
+	}
+}
+
+// 12. A replica whose lease on a deposit ran out while the cluster failed
+// over cannot write the pollination it loaded under that lease.
+func TestEscrowStaleLeaseWriteFenced(t *testing.T) {
+	nodes := newRaftNodes(t, 3, 200*time.Millisecond)
+	lead := raftLeader(t, nodes)
+	holder := nodes[(lead+1)%3]
+	id := "swap-stale-lease"
+
+	unlock, err := storage.Lock(context.Background(), holder, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if err := putPollination(id, newPollination(), holder); err != nil {
+		t.Fatal(err)
+	}
+
+	// The election outlasts the lease, so the holder's renewals fail and
+	// the new leader sees the lease expired.
+	nodes[lead].Close()
+	nodes[lead] = nil
+	raftLeader(t, nodes)
+	time.Sleep(400 * time.Millisecond)
+
+	p := newPollination()
+	if err := p.addFlower(&flower{ID: id, Pub: []byte("pub"), Depositor: "0xa"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putPollination(id, p, holder); !errors.Is(err, storage.ErrLeaseLost) {
+		t.Fatalf("write under a lost lease: %v", err)
+	}
+	if got, err := getPollination(id, holder); err != nil || got == nil || got.flower1 != nil {
+		t.Fatalf("fenced write applied: %+v, %v", got, err)
+	}
+}
@@ -5,16 +5,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
 	"github.com/valli0x/signature-escrow/auth"
+	"github.com/valli0x/signature-escrow/mpc/mpcblame"
 	"github.com/valli0x/signature-escrow/storage"
 )
 
 const mailboxPrefix = "mailbox/"
 
+// mpcFailureType is the mailbox message that tells the other party why an
+// MPC run failed; its body is an mpcblame.Failure.
+const mpcFailureType = "mpc-failure"
+
 type Message struct {
 	ID        string          `json:"id"`
 	From      string          `json:"from"`
@@ -52,17 +58,20 @@ func messageID(from, to string, ts int64) string {
 	)
 }
 
+func inboxKey(address string) string {
+	return mailboxPrefix + "inbox/" + strings.ToLower(address)
+}
+
 func storeMessage(stor storage.Storage, msg *Message) error {
 	data, err := cbor.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
-	if err := stor.Put(context.Background(), mailboxPrefix+msg.ID, data); err != nil {
-		return err
-	}
-
-	return addToIndex(stor, mailboxPrefix+"inbox/"+strings.ToLower(msg.To), msg.ID)
+	return storage.Batch(context.Background(), stor, []storage.Op{
+		{Key: mailboxPrefix + msg.ID, Value: data},
+		storage.IndexAddOp(inboxKey(msg.To), msg.ID),
+	})
 }
 
 func loadMessage(stor storage.Storage, id string) (*Message, error) {
@@ -81,58 +90,18 @@ func loadMessage(stor storage.Storage, id string) (*Message, error) {
 }
 
 func deleteMessage(stor storage.Storage, id, recipient string) error {
-	if err := stor.Delete(context.Background(), mailboxPrefix+id); err != nil {
-		return err
-	}
-
-	return removeFromIndex(stor, mailboxPrefix+"inbox/"+strings.ToLower(recipient), id)
-}
-
-func removeFromIndex(stor storage.Storage, key, msgID string) error {
-	data, err := stor.Get(context.Background(), key)
-	if err != nil {
-		return err
-	}
-	if data == nil {
-		return nil
-	}
-
-	var ids []string
-	if err := cbor.Unmarshal(data, &ids); err != nil {
-		return err
-	}
-
-	filtered := make([]string, 0, len(ids))
-	for _, id := range ids {
-		if id != msgID {
-			filtered = append(filtered, id)
-		}
-	}
-
-	if len(filtered) == 0 {
-		return stor.Delete(context.Background(), key)
-	}
-
-	newData, err := cbor.Marshal(filtered)
-	if err != nil {
+	ctx := context.Background()
+	if err := storage.MigrateIndex(ctx, stor, inboxKey(recipient)); err != nil {
 		return err
 	}
-	return stor.Put(context.Background(), key, newData)
+	return storage.Batch(ctx, stor, []storage.Op{
+		storage.IndexRemoveOp(inboxKey(recipient), id),
+		{Key: mailboxPrefix + id, Delete: true},
+	})
 }
 
 func loadInbox(stor storage.Storage, address string) ([]string, error) {
-	data, err := stor.Get(context.Background(), mailboxPrefix+"inbox/"+strings.ToLower(address))
-	if err != nil {
-		return nil, err
-	}
-	if data == nil {
-		return nil, nil
-	}
-	var ids []string
-	if err := cbor.Unmarshal(data, &ids); err != nil {
-		return nil, err
-	}
-	return ids, nil
+	return storage.IndexList(context.Background(), stor, inboxKey(address))
 }
 
 // mailboxSend sends a message to the other member of a pair.
@@ -163,9 +132,24 @@ func (s *Server) mailboxSend() http.HandlerFunc {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("to, pair_id and type are required"))
 			return
 		}
+		if req.Type == mpcFailureType {
+			var f mpcblame.Failure
+			if err := json.Unmarshal(req.Body, &f); err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("invalid %s body: %w", mpcFailureType, err))
+				return
+			}
+			if err := f.Validate(); err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("invalid %s body: %w", mpcFailureType, err))
+				return
+			}
+		}
 
 		from := auth.AddressFromContext(r.Context())
-		to := strings.ToLower(req.To)
+		to, err := auth.ParseIdentity(req.To)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
 
 		pair, err := loadPair(s.stor, req.PairID)
 		if err != nil {
@@ -183,6 +167,10 @@ func (s *Server) mailboxSend() http.HandlerFunc {
 			respondError(w, http.StatusForbidden, fmt.Errorf("you are not part of this pair"))
 			return
 		}
+		if !auth.PairAllowed(r.Context(), pair.ID) {
+			respondError(w, http.StatusForbidden, fmt.Errorf("api key is not valid for this pair"))
+			return
+		}
 
 		recipientInPair := strings.EqualFold(pair.Initiator, to) || strings.EqualFold(pair.Partner, to)
 		if !recipientInPair {
@@ -237,11 +225,12 @@ func (s *Server) mailboxPending() http.HandlerFunc {
 		messages := make([]Message, 0)
 		for _, id := range ids {
 			msg, err := loadMessage(s.stor, id)
-			if err != nil || msg == nil {
+			if err != nil || msg == nil || !auth.PairAllowed(r.Context(), msg.PairID) {
 				continue
 			}
 			messages = append(messages, *msg)
 		}
+		sort.SliceStable(messages, func(i, j int) bool { return messages[i].CreatedAt < messages[j].CreatedAt })
 
 		respondOk(w, MailboxPendingResponse{Messages: messages})
 	}
@@ -287,7 +276,7 @@ func (s *Server) mailboxAck() http.HandlerFunc {
 			respondError(w, http.StatusNotFound, fmt.Errorf("message not found"))
 			return
 		}
-		if !strings.EqualFold(msg.To, myAddr) {
+		if !strings.EqualFold(msg.To, myAddr) || !auth.PairAllowed(r.Context(), msg.PairID) {
 			respondError(w, http.StatusForbidden, fmt.Errorf("not your message"))
 			return
 		}
@@ -31,6 +31,7 @@ type Pair struct {
 }
 
 type PairCreateRequest struct {
+	// Partner is an ETH address or a btc:-prefixed Bitcoin address.
 	Partner string `json:"partner"`
 }
 
@@ -57,6 +58,8 @@ type PairPendingResponse struct {
 	Outgoing []Pair `json:"outgoing"`
 }
 
+// pairID derives the pair ID from both identities. ETH identities contribute
+// their bare hex, so IDs of ETH-only pairs are unchanged.
 func pairID(a, b string) string {
 	a = strings.ToLower(strings.TrimPrefix(a, "0x"))
 	b = strings.ToLower(strings.TrimPrefix(b, "0x"))
@@ -66,25 +69,22 @@ func pairID(a, b string) string {
 	return b + "_" + a
 }
 
+func pairIndexKey(address string) string {
+	return pairPrefix + "by-addr/" + strings.ToLower(address)
+}
+
+// storePair writes the pair and both address index entries in one batch.
 func storePair(stor storage.Storage, p *Pair) error {
 	data, err := cbor.Marshal(p)
 	if err != nil {
 		return err
 	}
 
-	if err := stor.Put(context.Background(), pairPrefix+p.ID, data); err != nil {
-		return err
-	}
-
-	if err := addToIndex(stor, pairPrefix+"by-addr/"+strings.ToLower(p.Initiator), p.ID); err != nil {
-		return err
-	}
-
-	if err := addToIndex(stor, pairPrefix+"by-addr/"+strings.ToLower(p.Partner), p.ID); err != nil {
-		return err
-	}
-
-	return nil
+	return storage.Batch(context.Background(), stor, []storage.Op{
+		{Key: pairPrefix + p.ID, Value: data},
+		storage.IndexAddOp(pairIndexKey(p.Initiator), p.ID),
+		storage.IndexAddOp(pairIndexKey(p.Partner), p.ID),
+	})
 }
 
 func loadPair(stor storage.Storage, id string) (*Pair, error) {
@@ -103,61 +103,27 @@ func loadPair(stor storage.Storage, id string) (*Pair, error) {
 }
 
 func deletePair(stor storage.Storage, p *Pair) error {
-	if err := removeFromIndex(stor, pairPrefix+"by-addr/"+strings.ToLower(p.Initiator), p.ID); err != nil {
-		return err
-	}
-	if err := removeFromIndex(stor, pairPrefix+"by-addr/"+strings.ToLower(p.Partner), p.ID); err != nil {
-		return err
-	}
-	return stor.Delete(context.Background(), pairPrefix+p.ID)
-}
-
-func addToIndex(stor storage.Storage, key, pairID string) error {
-	var ids []string
-
-	data, err := stor.Get(context.Background(), key)
-	if err != nil {
-		return err
-	}
-	if data != nil {
-		if err := cbor.Unmarshal(data, &ids); err != nil {
+	ctx := context.Background()
+	for _, addr := range []string{p.Initiator, p.Partner} {
+		if err := storage.MigrateIndex(ctx, stor, pairIndexKey(addr)); err != nil {
 			return err
 		}
 	}
-
-	for _, id := range ids {
-		if id == pairID {
-			return nil
-		}
-	}
-
-	ids = append(ids, pairID)
-	newData, err := cbor.Marshal(ids)
-	if err != nil {
-		return err
-	}
-	return stor.Put(context.Background(), key, newData)
+	return storage.Batch(ctx, stor, []storage.Op{
+		storage.IndexRemoveOp(pairIndexKey(p.Initiator), p.ID),
+		storage.IndexRemoveOp(pairIndexKey(p.Partner), p.ID),
+		{Key: pairPrefix + p.ID, Delete: true},
+	})
 }
 
 func loadIndex(stor storage.Storage, address string) ([]string, error) {
-	data, err := stor.Get(context.Background(), pairPrefix+"by-addr/"+strings.ToLower(address))
-	if err != nil {
-		return nil, err
-	}
-	if data == nil {
-		return nil, nil
-	}
-	var ids []string
-	if err := cbor.Unmarshal(data, &ids); err != nil {
-		return nil, err
-	}
-	return ids, nil
+	return storage.IndexList(context.Background(), stor, pairIndexKey(address))
 }
 
-// pairCreate creates a pending pair with another ETH address.
+// pairCreate creates a pending pair with another identity.
 //
 // @Summary      Create a pair
-// @Description  Create a pending pair request to another ETH address. Idempotent: returns the existing pair if present.
+// @Description  Create a pending pair request to another identity: an ETH address or "btc:<address>". Identities of both kinds can pair with each other. Idempotent: returns the existing pair if present.
 // @Tags         pair
 // @Accept       json
 // @Produce      json
@@ -182,7 +148,11 @@ func (s *Server) pairCreate() http.HandlerFunc {
 		}
 
 		initiator := auth.AddressFromContext(r.Context())
-		partner := strings.ToLower(req.Partner)
+		partner, err := auth.ParseIdentity(req.Partner)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
 
 		if strings.EqualFold(initiator, partner) {
 			respondError(w, http.StatusBadRequest, fmt.Errorf("cannot pair with yourself"))
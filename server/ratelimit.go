@@ -0,0 +1,286 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valli0x/signature-escrow/auth"
+)
+
+// Rate limit budgets, by route group.
+const (
+	// LimitIP applies to every /v1 request, keyed by client IP.
+	LimitIP = "ip"
+	// LimitAuth applies to nonce, login and refresh, keyed by client IP.
+	LimitAuth = "auth"
+	// LimitMailbox applies to the mailbox routes, keyed by address.
+	LimitMailbox = "mailbox"
+	// LimitDefault applies to other authenticated routes, keyed by address.
+	LimitDefault = "default"
+)
+
+// RateLimit is a token bucket: Burst requests at once, refilled at Rate per
+// second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits maps a route group to its budget. A group without an entry is
+// not limited.
+type RateLimits map[string]RateLimit
+
+// ParseRateLimits parses "group=N/unit[:burst],..." such as
+// "auth=10/m:10,mailbox=60/m:20". unit is s, m or h; burst defaults to N.
+func ParseRateLimits(spec string) (RateLimits, error) {
+	limits := make(RateLimits)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		group, budget, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q: expected group=N/unit[:burst]", part)
+		}
+		budget, burstStr, hasBurst := strings.Cut(budget, ":")
+		count, unit, ok := strings.Cut(budget, "/")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q: expected N/unit", part)
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("rate limit %q: bad count", part)
+		}
+		var per time.Duration
+		switch unit {
+		case "s":
+			per = time.Second
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		default:
+			return nil, fmt.Errorf("rate limit %q: unit must be s, m or h", part)
+		}
+		burst := n
+		if hasBurst {
+			if burst, err = strconv.Atoi(burstStr); err != nil || burst <= 0 {
+				return nil, fmt.Errorf("rate limit %q: bad burst", part)
+			}
+		}
+		limits[strings.TrimSpace(group)] = RateLimit{Rate: float64(n) / per.Seconds(), Burst: burst}
+	}
+	return limits, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps token buckets in process memory, so with several
+// replicas each one enforces the budget on its own.
+type rateLimiter struct {
+	mu         sync.Mutex
+	limits     RateLimits
+	buckets    map[string]*bucket
+	trustProxy bool
+}
+
+func newRateLimiter(limits RateLimits, trustProxy bool) *rateLimiter {
+	return &rateLimiter{limits: limits, buckets: make(map[string]*bucket), trustProxy: trustProxy}
+}
+
+// take spends one token of key's bucket. It returns the tokens left and, when
+// the request is rejected, how long until a token is available.
+func (l *rateLimiter) take(lim RateLimit, key string, now time.Time) (remaining float64, wait time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(lim.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(lim.Burst), b.tokens+now.Sub(b.last).Seconds()*lim.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return b.tokens, time.Duration((1 - b.tokens) / lim.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return b.tokens, 0, true
+}
+
+// prune drops buckets that have refilled completely.
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		group, _, _ := strings.Cut(key, "|")
+		lim, ok := l.limits[group]
+		if !ok || b.tokens+now.Sub(b.last).Seconds()*lim.Rate >= float64(lim.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the caller's IP. Behind a reverse proxy (trustProxy) the
+// X-Real-IP or first X-Forwarded-For hop set by the proxy is used.
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	if l.trustProxy {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// limit enforces group's budget, keyed by the authenticated address when
+// byAddress is set (falling back to the client IP) and by client IP
+// otherwise.
+func (l *rateLimiter) limit(group string, byAddress bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		lim, ok := l.limits[group]
+		if !ok {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := ""
+			if byAddress {
+				key = auth.AddressFromContext(r.Context())
+			}
+			if key == "" {
+				key = l.clientIP(r)
+			}
+
+			now := time.Now()
+			remaining, wait, ok := l.take(lim, group+"|"+key, now)
+			full := time.Duration((float64(lim.Burst) - remaining) / lim.Rate * float64(time.Second))
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(lim.Burst))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(math.Max(remaining, 0))))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(now.Add(full).Unix(), 10))
+			if !ok {
+				setRetryAfter(w, wait)
+				respondError(w, http.StatusTooManyRequests, errRateLimited)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// LoginLockout locks out a client after MaxFailures failed logins within
+// Window, for Duration. A zero MaxFailures disables it.
+type LoginLockout struct {
+	MaxFailures int
+	Window      time.Duration
+	Duration    time.Duration
+}
+
+type loginFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// loginGuard tracks failed logins per address+IP, so an address cannot be
+// locked out by failures from elsewhere, and per client IP with a higher
+// threshold (ipFailureFactor) to catch address spraying without locking out
+// everyone behind a NAT after a few typos.
+type loginGuard struct {
+	mu       sync.Mutex
+	cfg      LoginLockout
+	failures map[string]*loginFailures
+}
+
+func newLoginGuard(cfg LoginLockout) *loginGuard {
+	return &loginGuard{cfg: cfg, failures: make(map[string]*loginFailures)}
+}
+
+const ipFailureFactor = 4
+
+func loginKeys(ip, address string) []string {
+	return []string{"ip|" + ip, "addr|" + strings.ToLower(address) + "|" + ip}
+}
+
+// lockedFor returns how long any of keys is still locked out.
+func (g *loginGuard) lockedFor(keys []string, now time.Time) time.Duration {
+	if g.cfg.MaxFailures <= 0 {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var wait time.Duration
+	for _, k := range keys {
+		if f, ok := g.failures[k]; ok && now.Before(f.lockedUntil) {
+			wait = max(wait, f.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+func (g *loginGuard) fail(keys []string, now time.Time) {
+	if g.cfg.MaxFailures <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, k := range keys {
+		f, ok := g.failures[k]
+		if !ok || now.Sub(f.first) > g.cfg.Window {
+			f = &loginFailures{first: now}
+			g.failures[k] = f
+		}
+		limit := g.cfg.MaxFailures
+		if strings.HasPrefix(k, "ip|") {
+			limit *= ipFailureFactor
+		}
+		f.count++
+		if f.count >= limit {
+			f.lockedUntil = now.Add(g.cfg.Duration)
+			f.count = 0
+			f.first = now
+		}
+	}
+}
+
+func (g *loginGuard) succeed(keys []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Only the address+IP record is cleared: a success must not reset the
+	// per-IP count an attacker spraying addresses builds up.
+	delete(g.failures, keys[1])
+}
+
+func (g *loginGuard) prune(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for k, f := range g.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.first) > g.cfg.Window {
+			delete(g.failures, k)
+		}
+	}
+}
@@ -23,39 +23,70 @@ func (s *Server) routes() *chi.Mux {
 		httpSwagger.URL("/swagger/doc.json"),
 	))
 
+	r.Get("/.well-known/jwks.json", s.jwks())
+
 	r.Route("/v1", func(r chi.Router) {
+		r.Use(s.limiter.limit(LimitIP, false))
+
 		r.Route("/auth", func(r chi.Router) {
+			r.Use(s.limiter.limit(LimitAuth, false))
 			r.Post("/nonce", s.authNonce())
 			r.Post("/login", s.authLogin())
+			r.Post("/refresh", s.authRefresh())
 		})
 
 		r.Group(func(r chi.Router) {
-			r.Use(auth.Middleware(s.jwtSecret))
+			r.Use(auth.Middleware(s.keys, s.tokens, s.apiKeys))
+			r.Use(s.logRequests)
+
+			r.Group(func(r chi.Router) {
+				r.Use(s.limiter.limit(LimitDefault, true))
+				r.Use(auth.SessionOnly)
+
+				r.Post("/auth/logout", s.authLogout())
+				r.Post("/auth/revoke-all", s.authRevokeAll())
+
+				r.Route("/apikeys", func(r chi.Router) {
+					r.Post("/create", s.apiKeyCreate())
+					r.Get("/list", s.apiKeyList())
+					r.Post("/revoke", s.apiKeyRevoke())
+				})
 
-			r.Route("/pair", func(r chi.Router) {
-				r.Post("/create", s.pairCreate())
-				r.Post("/accept", s.pairAccept())
-				r.Get("/pending", s.pairPending())
-				r.Post("/delete", s.pairDelete())
+				r.Route("/pair", func(r chi.Router) {
+					r.Post("/create", s.pairCreate())
+					r.Post("/accept", s.pairAccept())
+					r.Get("/pending", s.pairPending())
+					r.Post("/delete", s.pairDelete())
+					r.Post("/shared", s.sharedRegister())
+				})
+			})
+
+			r.Route("/session", func(r chi.Router) {
+				r.Use(s.limiter.limit(LimitDefault, true))
+				r.With(auth.SessionOnly).Post("/claim", s.sessionClaim())
+				r.With(auth.SessionOnly).Post("/cancel", s.sessionCancel())
+				r.With(auth.RequireScope(auth.ScopeMailbox)).Post("/status", s.sessionStatus())
 			})
 
 			r.Route("/mailbox", func(r chi.Router) {
+				r.Use(s.limiter.limit(LimitMailbox, true))
+				r.Use(auth.RequireScope(auth.ScopeMailbox))
 				r.Post("/send", s.mailboxSend())
 				r.Get("/pending", s.mailboxPending())
 				r.Post("/ack", s.mailboxAck())
 			})
 
-			r.Route("/session", func(r chi.Router) {
-				r.Post("/claim", s.sessionClaim())
-				r.Post("/cancel", s.sessionCancel())
-			})
+			r.Group(func(r chi.Router) {
+				r.Use(s.limiter.limit(LimitDefault, true))
 
-			r.Post("/escrow", s.escrow())
-			r.Post("/escrow/check", s.escrowCheck())
+				r.With(auth.RequireScope(auth.ScopeEscrowDeposit)).Post("/escrow", s.escrow())
+				r.With(auth.RequireScope(auth.ScopeEscrowRead)).Post("/escrow/check", s.escrowCheck())
 
-			r.Route("/timebox", func(r chi.Router) {
-				r.Post("/", s.timeboxPost())
-				r.Get("/", s.timeboxGet())
+				r.Route("/timebox", func(r chi.Router) {
+					r.Use(auth.RequireScope(auth.ScopeTimebox))
+					r.Post("/", s.timeboxPost())
+					r.Get("/", s.timeboxGet())
+				})
 			})
 		})
 	})
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"context"
+
+	"github.com/valli0x/signature-escrow/auth"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// Schema lists the migrations of the server's storage, oldest first. Never
+// reorder or remove one; append a new migration for every change to the
+// layout or to a stored record.
+var Schema = storage.Schema{
+	Store: "server",
+	Migrations: []storage.Migration{
+		{Version: 1, Name: "index-markers", Apply: migrateIndexes},
+	},
+}
+
+// migrateIndexes converts every index still stored as one CBOR list to
+// marker keys, instead of leaving it to the first access.
+func migrateIndexes(ctx context.Context, stor storage.Storage) error {
+	for _, prefix := range []string{pairPrefix + "by-addr/", mailboxPrefix + "inbox/"} {
+		if err := storage.MigrateIndexes(ctx, stor, prefix); err != nil {
+			return err
+		}
+	}
+	return auth.MigrateAPIKeyIndexes(ctx, stor)
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+// Sealer runs the server in sealed mode. The storage master key is split
+// into unseal keys (see storage.InitSeal) and the process starts without it:
+// only /v1/sys/status, /v1/sys/unseal and /v1/sys/seal are served until
+// enough operators have submitted their keys. Then the storage is opened,
+// the Server is built over it and every other request is passed on to it.
+// Sealing again drops the server and the keys.
+type Sealer struct {
+	addr    string
+	srv     *http.Server
+	backend storage.Storage
+	logger  *slog.Logger
+	open    func(ctx context.Context, stor storage.Storage) (*Server, error)
+	limiter *rateLimiter
+
+	mu sync.Mutex
+	// ctx is the parent of the unsealed server's background work.
+	ctx   context.Context
+	info  *storage.SealInfo
+	keys  [][]byte
+	inner *Server
+	stop  context.CancelFunc
+}
+
+type SealerConfig struct {
+	Addr string
+	// Backend is the raw storage holding the sealed keyring.
+	Backend storage.Storage
+	Logger  *slog.Logger
+	// Open builds the server over the unsealed storage, once per unseal.
+	Open func(ctx context.Context, stor storage.Storage) (*Server, error)
+	// RateLimits and TrustProxy are as in ServerConfig; the sys routes use
+	// the auth budget.
+	RateLimits RateLimits
+	TrustProxy bool
+}
+
+type SealStatusResponse struct {
+	// Initialized is false until MODE=init-seal created the unseal keys.
+	Initialized bool `json:"initialized"`
+	Sealed      bool `json:"sealed"`
+	Threshold   int  `json:"threshold"`
+	Shares      int  `json:"shares"`
+	// Progress is how many unseal keys were submitted so far.
+	Progress int `json:"progress"`
+}
+
+type UnsealRequest struct {
+	// Key is one unseal key, base64.
+	Key string `json:"key"`
+	// Reset discards the keys submitted so far instead.
+	Reset bool `json:"reset,omitempty"`
+}
+
+type SealRequest struct {
+	// Key is any one of the unseal keys, base64.
+	Key string `json:"key"`
+}
+
+func NewSealer(cfg *SealerConfig) *Sealer {
+	s := &Sealer{
+		addr:    cfg.Addr,
+		srv:     newHTTPServer(),
+		backend: cfg.Backend,
+		logger:  cfg.Logger,
+		open:    cfg.Open,
+		limiter: newRateLimiter(cfg.RateLimits, cfg.TrustProxy),
+		ctx:     context.Background(),
+	}
+	s.srv.Handler = s.routes()
+	return s
+}
+
+func (s *Sealer) routes() *chi.Mux {
+	r := chi.NewRouter()
+	r.Route("/v1/sys", func(r chi.Router) {
+		r.Use(s.limiter.limit(LimitAuth, false))
+		r.Get("/status", s.status())
+		r.Post("/unseal", s.unseal())
+		r.Post("/seal", s.seal())
+	})
+	r.Handle("/*", http.HandlerFunc(s.forward))
+	return r
+}
+
+func (s *Sealer) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.ctx = ctx
+	s.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.limiter.prune(now)
+			}
+		}
+	}()
+
+	s.logger.Warn("server is sealed, submit unseal keys to /v1/sys/unseal")
+	serve(ctx, s.srv, s.addr, s.logger)
+
+	s.mu.Lock()
+	s.sealLocked()
+	s.mu.Unlock()
+}
+
+// forward passes a request to the unsealed server.
+func (s *Sealer) forward(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	inner := s.inner
+	s.mu.Unlock()
+	if inner == nil {
+		respondError(w, http.StatusServiceUnavailable, fmt.Errorf("server is sealed"))
+		return
+	}
+	inner.srv.Handler.ServeHTTP(w, r)
+}
+
+// loadInfo reads the unseal key settings, which MODE=init-seal may have
+// written after this process started; s.mu must be held.
+func (s *Sealer) loadInfo(ctx context.Context) error {
+	if s.info != nil {
+		return nil
+	}
+	info, err := storage.LoadSealInfo(ctx, s.backend)
+	if err != nil {
+		return err
+	}
+	s.info = info
+	return nil
+}
+
+// statusLocked describes the seal; s.mu must be held.
+func (s *Sealer) statusLocked() SealStatusResponse {
+	st := SealStatusResponse{Sealed: s.inner == nil, Progress: len(s.keys)}
+	if s.info != nil {
+		st.Initialized = true
+		st.Threshold = s.info.Threshold
+		st.Shares = s.info.Shares
+	}
+	return st
+}
+
+// sealLocked stops the unsealed server and forgets the submitted keys; s.mu
+// must be held.
+func (s *Sealer) sealLocked() {
+	if s.stop != nil {
+		s.stop()
+	}
+	s.inner, s.stop = nil, nil
+	s.resetLocked()
+}
+
+func (s *Sealer) resetLocked() {
+	for _, k := range s.keys {
+		clear(k)
+	}
+	s.keys = nil
+}
+
+func decodeUnsealKey(key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("unseal key must be base64")
+	}
+	return b, nil
+}
+
+// status reports whether the server is sealed.
+//
+// @Summary      Seal status
+// @Description  Reports whether the server is sealed and how many of the threshold unseal keys were submitted. Served while sealed.
+// @Tags         sys
+// @Produce      json
+// @Success      200  {object}  SealStatusResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /v1/sys/status [get]
+func (s *Sealer) status() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.loadInfo(r.Context()); err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		respondOk(w, s.statusLocked())
+	}
+}
+
+// unseal takes one unseal key.
+//
+// @Summary      Submit an unseal key
+// @Description  Adds one unseal key. Once the threshold is reached the storage is opened and the server starts handling every other route. Each key is checked on submission; submitting the same key twice counts once. "reset" discards the keys submitted so far.
+// @Tags         sys
+// @Accept       json
+// @Produce      json
+// @Param        body  body      UnsealRequest  true  "Unseal key"
+// @Success      200   {object}  SealStatusResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /v1/sys/unseal [post]
+func (s *Sealer) unseal() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req UnsealRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.loadInfo(r.Context()); err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if s.info == nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("storage has no unseal keys, run MODE=init-seal"))
+			return
+		}
+		if req.Reset {
+			s.resetLocked()
+			respondOk(w, s.statusLocked())
+			return
+		}
+		if s.inner != nil {
+			respondOk(w, s.statusLocked())
+			return
+		}
+
+		key, err := decodeUnsealKey(req.Key)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !s.info.Check(key) {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid unseal key"))
+			return
+		}
+		for _, k := range s.keys {
+			if bytes.Equal(k, key) {
+				respondOk(w, s.statusLocked())
+				return
+			}
+		}
+		s.keys = append(s.keys, key)
+		if len(s.keys) < s.info.Threshold {
+			respondOk(w, s.statusLocked())
+			return
+		}
+
+		stor, err := storage.Unseal(r.Context(), s.backend, s.keys)
+		s.resetLocked()
+		if err != nil {
+			s.logger.Error("unseal failed", "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("unseal failed"))
+			return
+		}
+		inner, err := s.open(s.ctx, stor)
+		if err != nil {
+			s.logger.Error("unsealed server failed to start", "error", err)
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("unseal failed"))
+			return
+		}
+		ctx, stop := context.WithCancel(s.ctx)
+		inner.background(ctx)
+		s.inner, s.stop = inner, stop
+
+		s.logger.Info("server unsealed")
+		respondOk(w, s.statusLocked())
+	}
+}
+
+// seal drops the storage keys and stops serving escrow traffic.
+//
+// @Summary      Seal the server
+// @Description  Seals an unsealed server: the storage keys are dropped and every route but /v1/sys answers 503 until the threshold of unseal keys is submitted again. Any one unseal key authorizes it.
+// @Tags         sys
+// @Accept       json
+// @Produce      json
+// @Param        body  body      SealRequest  true  "One unseal key"
+// @Success      200   {object}  SealStatusResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /v1/sys/seal [post]
+func (s *Sealer) seal() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SealRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		key, err := decodeUnsealKey(req.Key)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.loadInfo(r.Context()); err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if s.info == nil || !s.info.Check(key) {
+			respondError(w, http.StatusForbidden, fmt.Errorf("invalid unseal key"))
+			return
+		}
+		if s.inner != nil {
+			s.sealLocked()
+			s.logger.Warn("server sealed")
+		}
+		respondOk(w, s.statusLocked())
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/valli0x/signature-escrow/server/servertest"
+	"github.com/valli0x/signature-escrow/storage"
+)
+
+func TestSealer(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewMemoryStorage()
+	logger := slog.New(slog.DiscardHandler)
+
+	sealer := NewSealer(&SealerConfig{
+		Addr:    ":0",
+		Backend: backend,
+		Logger:  logger,
+		Open: func(ctx context.Context, stor storage.Storage) (*Server, error) {
+			return NewServer(&ServerConfig{Addr: ":0", Stor: stor, Logger: logger, JWTSecret: []byte("test-secret")}), nil
+		},
+	})
+	ts := httptest.NewServer(sealer.routes())
+	defer ts.Close()
+
+	status := func(want SealStatusResponse) {
+		t.Helper()
+		resp, body, err := servertest.GetJSON(ts.URL+"/v1/sys/status", "")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("status: %v %v", resp, err)
+		}
+		got := SealStatusResponse{
+			Initialized: body["initialized"] == true,
+			Sealed:      body["sealed"] == true,
+			Threshold:   int(body["threshold"].(float64)),
+			Shares:      int(body["shares"].(float64)),
+			Progress:    int(body["progress"].(float64)),
+		}
+		if got != want {
+			t.Fatalf("status %+v, want %+v", got, want)
+		}
+	}
+	jwks := func(want int) {
+		t.Helper()
+		resp, _, err := servertest.GetJSON(ts.URL+"/.well-known/jwks.json", "")
+		if err != nil || resp.StatusCode != want {
+			t.Fatalf("jwks: %v %v, want %d", resp, err, want)
+		}
+	}
+	post := func(path string, body any, want int) {
+		t.Helper()
+		resp, _, err := servertest.PostJSON(ts.URL+path, body, "")
+		if err != nil || resp.StatusCode != want {
+			t.Fatalf("%s: %v %v, want %d", path, resp, err, want)
+		}
+	}
+
+	status(SealStatusResponse{Sealed: true})
+	post("/v1/sys/unseal", UnsealRequest{Key: "AAAA"}, http.StatusBadRequest)
+
+	keys, err := storage.InitSeal(ctx, backend, "", 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := make([]string, len(keys))
+	for i, k := range keys {
+		enc[i] = base64.StdEncoding.EncodeToString(k)
+	}
+
+	status(SealStatusResponse{Initialized: true, Sealed: true, Threshold: 2, Shares: 3})
+	jwks(http.StatusServiceUnavailable)
+
+	post("/v1/sys/unseal", UnsealRequest{Key: "not base64"}, http.StatusBadRequest)
+	post("/v1/sys/unseal", UnsealRequest{Key: base64.StdEncoding.EncodeToString(make([]byte, 33))}, http.StatusBadRequest)
+	post("/v1/sys/unseal", UnsealRequest{Key: enc[2]}, http.StatusOK)
+	post("/v1/sys/unseal", UnsealRequest{Key: enc[2]}, http.StatusOK)
+	status(SealStatusResponse{Initialized: true, Sealed: true, Threshold: 2, Shares: 3, Progress: 1})
+	post("/v1/sys/unseal", UnsealRequest{Reset: true}, http.StatusOK)
+	status(SealStatusResponse{Initialized: true, Sealed: true, Threshold: 2, Shares: 3})
+
+	post("/v1/sys/unseal", UnsealRequest{Key: enc[2]}, http.StatusOK)
+	post("/v1/sys/unseal", UnsealRequest{Key: enc[0]}, http.StatusOK)
+	status(SealStatusResponse{Initialized: true, Threshold: 2, Shares: 3})
+	jwks(http.StatusOK)
+
+	post("/v1/sys/seal", SealRequest{Key: base64.StdEncoding.EncodeToString(make([]byte, 33))}, http.StatusForbidden)
+	jwks(http.StatusOK)
+	post("/v1/sys/seal", SealRequest{Key: enc[1]}, http.StatusOK)
+	status(SealStatusResponse{Initialized: true, Sealed: true, Threshold: 2, Shares: 3})
+	jwks(http.StatusServiceUnavailable)
+
+	post("/v1/sys/unseal", UnsealRequest{Key: enc[1]}, http.StatusOK)
+	post("/v1/sys/unseal", UnsealRequest{Key: enc[0]}, http.StatusOK)
+	jwks(http.StatusOK)
+}
@@ -18,6 +18,17 @@ const (
 	timeoutSeconds = 300
 	idleTimeout    = 300
 	maxHeaderBytes = 1024 * 1024
+
+	janitorInterval = time.Minute
+)
+
+// Where login nonces and keygen session claims live.
+const (
+	// StateStorage keeps them in the server storage, so any number of
+	// replicas can share it. The default.
+	StateStorage = "storage"
+	// StateMemory keeps them in process memory (single replica only).
+	StateMemory = "memory"
 )
 
 type Server struct {
@@ -25,10 +36,16 @@ type Server struct {
 	srv        *http.Server
 	stor       storage.Storage
 	logger     *slog.Logger
-	jwtSecret  []byte
-	nonceStore *auth.NonceStore
-	sessions   *sessionRegistry
-	escrowMu   sync.Mutex
+	keys       *auth.KeySet
+	keyMaxAge  time.Duration
+	siwe       auth.SIWEConfig
+	nonceStore auth.Nonces
+	tokens     *auth.TokenStore
+	apiKeys    *auth.APIKeyStore
+	verifier   *auth.Verifier
+	sessions   SessionRegistry
+	limiter    *rateLimiter
+	logins     *loginGuard
 }
 
 type ServerConfig struct {
@@ -36,24 +53,55 @@ type ServerConfig struct {
 	Stor      storage.Storage
 	Logger    *slog.Logger
 	JWTSecret []byte
+	// JWTKeys signs access tokens. When nil, JWTSecret is used as an HS256
+	// key.
+	JWTKeys *auth.KeySet
+	// KeyRotation is the maximum age of the current signing key; zero
+	// disables automatic rotation.
+	KeyRotation time.Duration
+	// Contracts, when set, enables EIP-1271 logins for contract wallets.
+	Contracts auth.ContractCaller
+	SIWE      auth.SIWEConfig
+	// State is StateStorage (default) or StateMemory.
+	State string
+	// RateLimits holds the per-group request budgets; nil disables rate
+	// limiting.
+	RateLimits RateLimits
+	// TrustProxy takes the client IP from X-Real-IP / X-Forwarded-For.
+	// Only set it behind a reverse proxy that overwrites those headers.
+	TrustProxy bool
+	Lockout    LoginLockout
 }
 
 func NewServer(cfg *ServerConfig) *Server {
-	httpServer := &http.Server{
-		MaxHeaderBytes: maxHeaderBytes,
-		IdleTimeout:    idleTimeout * time.Second,
-		ReadTimeout:    timeoutSeconds * time.Second,
-		WriteTimeout:   timeoutSeconds * time.Second,
+	s := &Server{
+		srv:       newHTTPServer(),
+		addr:      cfg.Addr,
+		stor:      cfg.Stor,
+		logger:    cfg.Logger,
+		keys:      cfg.JWTKeys,
+		keyMaxAge: cfg.KeyRotation,
+		siwe:      cfg.SIWE,
+		tokens:    auth.NewTokenStore(cfg.Stor),
+		limiter:   newRateLimiter(cfg.RateLimits, cfg.TrustProxy),
+		logins:    newLoginGuard(cfg.Lockout),
+	}
+	if s.siwe.Domain == "" {
+		s.siwe.Domain = auth.ListenDomain(cfg.Addr)
 	}
+	if cfg.State == StateMemory {
+		s.nonceStore = auth.NewNonceStore()
+		s.sessions = newSessionRegistry()
+	} else {
+		s.nonceStore = auth.NewStorageNonceStore(cfg.Stor)
+		s.sessions = newStorageSessions(cfg.Stor)
+	}
+	s.apiKeys = auth.NewAPIKeyStore(cfg.Stor, s.tokens)
 
-	s := &Server{
-		srv:        httpServer,
-		addr:       cfg.Addr,
-		stor:       cfg.Stor,
-		logger:     cfg.Logger,
-		jwtSecret:  cfg.JWTSecret,
-		nonceStore: auth.NewNonceStore(),
-		sessions:   newSessionRegistry(),
+	s.verifier = &auth.Verifier{Contracts: cfg.Contracts, Shared: s}
+
+	if s.keys == nil {
+		s.keys = auth.NewHMACKeySet(cfg.JWTSecret)
 	}
 
 	s.srv.Handler = s.routes()
@@ -61,10 +109,33 @@ func NewServer(cfg *ServerConfig) *Server {
 	return s
 }
 
+func newHTTPServer() *http.Server {
+	return &http.Server{
+		MaxHeaderBytes: maxHeaderBytes,
+		IdleTimeout:    idleTimeout * time.Second,
+		ReadTimeout:    timeoutSeconds * time.Second,
+		WriteTimeout:   timeoutSeconds * time.Second,
+	}
+}
+
 func (s *Server) Run(ctx context.Context) {
-	listener, err := net.Listen("tcp", s.addr)
+	s.background(ctx)
+	serve(ctx, s.srv, s.addr, s.logger)
+}
+
+// background starts key rotation and the janitor until ctx is done.
+func (s *Server) background(ctx context.Context) {
+	if s.keyMaxAge > 0 {
+		go s.rotateKeys(ctx)
+	}
+	go s.janitor(ctx)
+}
+
+// serve runs srv on addr until ctx is done.
+func serve(ctx context.Context, srv *http.Server, addr string, logger *slog.Logger) {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		s.logger.Error("can't listen on address, server quitting", "addr", s.addr, "error", err)
+		logger.Error("can't listen on address, server quitting", "addr", addr, "error", err)
 		return
 	}
 
@@ -75,19 +146,70 @@ func (s *Server) Run(ctx context.Context) {
 		defer wg.Done()
 		<-ctx.Done()
 
-		if err := s.srv.Shutdown(context.Background()); err != nil {
-			s.logger.Error("HTTP server shutdown error", "error", err)
+		if err := srv.Shutdown(context.Background()); err != nil {
+			logger.Error("HTTP server shutdown error", "error", err)
 		}
 	}(wg)
 
-	s.logger.Info("host server listening", "addr", s.addr)
-	if err := s.srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+	logger.Info("host server listening", "addr", addr)
+	if err := srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
 		wg.Done()
-		s.logger.Error("unexpected HTTP server serve error", "error", err)
+		logger.Error("unexpected HTTP server serve error", "error", err)
 	}
 
 	wg.Wait()
-	s.logger.Info("host server off")
+	logger.Info("host server off")
+}
+
+// rotateKeys replaces the JWT signing key once it is older than keyMaxAge.
+func (s *Server) rotateKeys(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if rotated, err := s.keys.RotateIfOlder(ctx, s.keyMaxAge); err != nil {
+			s.logger.Error("jwt key rotation failed", "error", err)
+		} else if rotated {
+			s.logger.Info("jwt signing key rotated", "kid", s.keys.Current())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// janitor removes expired nonces, session claims and tokens, and forgets
+// idle rate limit buckets and login failures. With shared state every
+// replica runs it; the sweeps are idempotent.
+func (s *Server) janitor(ctx context.Context) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		s.limiter.prune(now)
+		s.logins.prune(now)
+		if n, err := s.nonceStore.Sweep(ctx); err != nil {
+			s.logger.Error("nonce sweep failed", "error", err)
+		} else if n > 0 {
+			s.logger.Debug("expired nonces removed", "count", n)
+		}
+		if n, err := s.sessions.Sweep(ctx); err != nil {
+			s.logger.Error("session sweep failed", "error", err)
+		} else if n > 0 {
+			s.logger.Debug("expired sessions removed", "count", n)
+		}
+		if n, err := s.tokens.Sweep(ctx); err != nil {
+			s.logger.Error("token sweep failed", "error", err)
+		} else if n > 0 {
+			s.logger.Debug("dead tokens removed", "count", n)
+		}
+	}
 }
 
 func respondOk(w http.ResponseWriter, body interface{}) {
@@ -116,3 +238,9 @@ func respondError(w http.ResponseWriter, status int, err error) {
 
 	json.NewEncoder(w).Encode(resp)
 }
+
+// Handler returns the routes of the server, to serve them elsewhere, as
+// tests do.
+func (s *Server) Handler() http.Handler {
+	return s.srv.Handler
+}
@@ -1,90 +1,58 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"crypto/ecdsa"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/valli0x/signature-escrow/auth"
+	"github.com/valli0x/signature-escrow/server/servertest"
 	"github.com/valli0x/signature-escrow/storage"
 )
 
 func setupTestServer(t *testing.T) *httptest.Server {
 	t.Helper()
-
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
-
-	storConf := map[string]string{"path": t.TempDir()}
-	fileStor, err := storage.NewFileStorage(storConf, logger)
+	fileStor, err := storage.NewFileStorage(map[string]string{"path": t.TempDir()}, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
+	return setupTestServerWith(t, fileStor)
+}
+
+func setupTestServerWith(t *testing.T, stor storage.Storage) *httptest.Server {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 
 	srv := NewServer(&ServerConfig{
 		Addr:      ":0",
-		Stor:      fileStor,
+		Stor:      stor,
 		Logger:    logger,
 		JWTSecret: []byte("test-secret"),
+		SIWE:      auth.SIWEConfig{Domain: "escrow.example"},
 	})
 
 	return httptest.NewServer(srv.routes())
 }
 
-func getJSON(url string, token string) (*http.Response, map[string]interface{}, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, nil, err
-	}
-	if token != "" {
-		req.Header.Set("Authorization", "Bearer "+token)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer resp.Body.Close()
-
-	data, _ := io.ReadAll(resp.Body)
-	var result map[string]interface{}
-	json.Unmarshal(data, &result)
-
-	return resp, result, nil
-}
-
-func postJSON(url string, body interface{}, token string) (*http.Response, map[string]interface{}, error) {
-	b, _ := json.Marshal(body)
-	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
-	if err != nil {
-		return nil, nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	if token != "" {
-		req.Header.Set("Authorization", "Bearer "+token)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer resp.Body.Close()
-
-	data, _ := io.ReadAll(resp.Body)
-	var result map[string]interface{}
-	json.Unmarshal(data, &result)
-
-	return resp, result, nil
-}
-
 func TestAuthFlow(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
@@ -95,7 +63,7 @@ func TestAuthFlow(t *testing.T) {
 	}
 	address := crypto.PubkeyToAddress(privateKey.PublicKey).Hex()
 
-	resp, result, err := postJSON(ts.URL+"/v1/auth/nonce", map[string]string{
+	resp, result, err := servertest.PostJSON(ts.URL+"/v1/auth/nonce", map[string]string{
 		"address": address,
 	}, "")
 	if err != nil {
@@ -118,7 +86,7 @@ func TestAuthFlow(t *testing.T) {
 	sig[64] += 27
 	signature := "0x" + hex.EncodeToString(sig)
 
-	resp, result, err = postJSON(ts.URL+"/v1/auth/login", map[string]string{
+	resp, result, err = servertest.PostJSON(ts.URL+"/v1/auth/login", map[string]string{
 		"address":   address,
 		"signature": signature,
 		"nonce":     nonce,
@@ -139,7 +107,7 @@ func TestAuthFlow(t *testing.T) {
 		t.Fatal("empty address in login response")
 	}
 
-	resp, result, err = postJSON(ts.URL+"/v1/escrow", map[string]string{
+	resp, result, err = servertest.PostJSON(ts.URL+"/v1/escrow", map[string]string{
 		"test": "data",
 	}, "")
 	if err != nil {
@@ -150,7 +118,7 @@ func TestAuthFlow(t *testing.T) {
 	}
 	t.Log("escrow without auth correctly rejected")
 
-	resp, result, err = postJSON(ts.URL+"/v1/escrow", map[string]string{
+	resp, result, err = servertest.PostJSON(ts.URL+"/v1/escrow", map[string]string{
 		"alg":  "ecdsa",
 		"id":   "test-escrow-id",
 		"pub":  hex.EncodeToString(crypto.CompressPubkey(&privateKey.PublicKey)),
@@ -177,8 +145,8 @@ func TestEscrowExchange(t *testing.T) {
 	addrA := crypto.PubkeyToAddress(keyA.PublicKey).Hex()
 	addrB := crypto.PubkeyToAddress(keyB.PublicKey).Hex()
 
-	tokenA := authenticate(t, ts.URL, keyA, addrA)
-	tokenB := authenticate(t, ts.URL, keyB, addrB)
+	tokenA := servertest.Authenticate(t, ts.URL, keyA, addrA)
+	tokenB := servertest.Authenticate(t, ts.URL, keyB, addrB)
 
 	escrowID := "test-escrow-exchange"
 	hashA := crypto.Keccak256([]byte("tx-data-A"))
@@ -189,7 +157,7 @@ func TestEscrowExchange(t *testing.T) {
 	sigAforB, _ := crypto.Sign(hashB, keyA)
 	sigBforA, _ := crypto.Sign(hashA, keyB)
 
-	resp, result, err := postJSON(ts.URL+"/v1/escrow", map[string]string{
+	resp, result, err := servertest.PostJSON(ts.URL+"/v1/escrow", map[string]string{
 		"alg":  "ecdsa",
 		"id":   escrowID,
 		"pub":  hex.EncodeToString(pubA),
@@ -207,7 +175,7 @@ func TestEscrowExchange(t *testing.T) {
 	}
 	t.Log("A submitted flower (pending)")
 
-	resp, result, err = postJSON(ts.URL+"/v1/escrow", map[string]string{
+	resp, result, err = servertest.PostJSON(ts.URL+"/v1/escrow", map[string]string{
 		"alg":  "ecdsa",
 		"id":   escrowID,
 		"pub":  hex.EncodeToString(pubB),
@@ -239,10 +207,10 @@ func TestPairingFlow(t *testing.T) {
 	addrA := crypto.PubkeyToAddress(keyA.PublicKey).Hex()
 	addrB := crypto.PubkeyToAddress(keyB.PublicKey).Hex()
 
-	tokenA := authenticate(t, ts.URL, keyA, addrA)
-	tokenB := authenticate(t, ts.URL, keyB, addrB)
+	tokenA := servertest.Authenticate(t, ts.URL, keyA, addrA)
+	tokenB := servertest.Authenticate(t, ts.URL, keyB, addrB)
 
-	resp, result, err := postJSON(ts.URL+"/v1/pair/create", map[string]string{
+	resp, result, err := servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{
 		"partner": addrB,
 	}, tokenA)
 	if err != nil {
@@ -259,7 +227,7 @@ func TestPairingFlow(t *testing.T) {
 		t.Fatalf("expected status pending, got %s", result["status"])
 	}
 
-	resp, result, err = getJSON(ts.URL+"/v1/pair/pending", tokenB)
+	resp, result, err = servertest.GetJSON(ts.URL+"/v1/pair/pending", tokenB)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -272,7 +240,7 @@ func TestPairingFlow(t *testing.T) {
 	}
 	t.Logf("B sees incoming pair: %v", incoming[0])
 
-	resp, result, err = getJSON(ts.URL+"/v1/pair/pending", tokenA)
+	resp, result, err = servertest.GetJSON(ts.URL+"/v1/pair/pending", tokenA)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -282,7 +250,7 @@ func TestPairingFlow(t *testing.T) {
 	}
 	t.Logf("A sees outgoing pair: %v", outgoing[0])
 
-	resp, _, err = postJSON(ts.URL+"/v1/pair/accept", map[string]string{
+	resp, _, err = servertest.PostJSON(ts.URL+"/v1/pair/accept", map[string]string{
 		"id": pairID,
 	}, tokenA)
 	if err != nil {
@@ -293,7 +261,7 @@ func TestPairingFlow(t *testing.T) {
 	}
 	t.Log("A correctly cannot accept own pair")
 
-	resp, result, err = postJSON(ts.URL+"/v1/pair/accept", map[string]string{
+	resp, result, err = servertest.PostJSON(ts.URL+"/v1/pair/accept", map[string]string{
 		"id": pairID,
 	}, tokenB)
 	if err != nil {
@@ -307,7 +275,7 @@ func TestPairingFlow(t *testing.T) {
 	}
 	t.Logf("pair accepted: id=%s status=%s", result["id"], result["status"])
 
-	resp, _, err = postJSON(ts.URL+"/v1/pair/create", map[string]string{
+	resp, _, err = servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{
 		"partner": addrA,
 	}, tokenA)
 	if err != nil {
@@ -318,7 +286,7 @@ func TestPairingFlow(t *testing.T) {
 	}
 	t.Log("self-pairing correctly rejected")
 
-	resp, result, err = postJSON(ts.URL+"/v1/pair/create", map[string]string{
+	resp, result, err = servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{
 		"partner": addrB,
 	}, tokenA)
 	if err != nil {
@@ -332,7 +300,7 @@ func TestPairingFlow(t *testing.T) {
 	}
 	t.Log("duplicate pair correctly returns existing")
 
-	resp, _, err = postJSON(ts.URL+"/v1/pair/create", map[string]string{
+	resp, _, err = servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{
 		"partner": addrB,
 	}, "")
 	if err != nil {
@@ -344,6 +312,44 @@ func TestPairingFlow(t *testing.T) {
 	t.Log("unauthenticated pair create correctly rejected")
 }
 
+func TestPairingStorageFailures(t *testing.T) {
+	stor := storage.NewFaultyStorage(storage.NewMemoryStorage())
+	ts := setupTestServerWith(t, stor)
+	defer ts.Close()
+
+	keyA, _ := crypto.GenerateKey()
+	keyB, _ := crypto.GenerateKey()
+	addrA := crypto.PubkeyToAddress(keyA.PublicKey).Hex()
+	addrB := crypto.PubkeyToAddress(keyB.PublicKey).Hex()
+	tokenA := servertest.Authenticate(t, ts.URL, keyA, addrA)
+
+	// A failed index write leaves no pair behind.
+	stor.Inject(storage.Fault{Prefix: pairIndexKey(addrB), Ops: storage.FaultPut, Fail: true, Count: 1})
+	resp, result, _ := servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{"partner": addrB}, tokenA)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("pair create with failing storage: %d %v", resp.StatusCode, result)
+	}
+	resp, result, _ = servertest.GetJSON(ts.URL+"/v1/pair/pending", tokenA)
+	if resp.StatusCode != 200 || len(result["outgoing"].([]interface{})) != 0 {
+		t.Fatalf("pair list after failed create: %d %v", resp.StatusCode, result)
+	}
+
+	// The fault fired once; the retry goes through.
+	resp, result, _ = servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{"partner": addrB}, tokenA)
+	if resp.StatusCode != 200 {
+		t.Fatalf("pair create retry: %d %v", resp.StatusCode, result)
+	}
+
+	remove := stor.Inject(storage.Fault{Prefix: "pairs/", Ops: storage.FaultGet | storage.FaultList, Fail: true})
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", tokenA); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("pair list with failing storage: %d", resp.StatusCode)
+	}
+	remove()
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", tokenA); resp.StatusCode != 200 {
+		t.Fatalf("pair list after the fault is removed: %d", resp.StatusCode)
+	}
+}
+
 func TestMailboxFlow(t *testing.T) {
 	ts := setupTestServer(t)
 	defer ts.Close()
@@ -353,10 +359,10 @@ func TestMailboxFlow(t *testing.T) {
 	addrA := crypto.PubkeyToAddress(keyA.PublicKey).Hex()
 	addrB := crypto.PubkeyToAddress(keyB.PublicKey).Hex()
 
-	tokenA := authenticate(t, ts.URL, keyA, addrA)
-	tokenB := authenticate(t, ts.URL, keyB, addrB)
+	tokenA := servertest.Authenticate(t, ts.URL, keyA, addrA)
+	tokenB := servertest.Authenticate(t, ts.URL, keyB, addrB)
 
-	resp, result, _ := postJSON(ts.URL+"/v1/pair/create", map[string]string{
+	resp, result, _ := servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{
 		"partner": addrB,
 	}, tokenA)
 	if resp.StatusCode != 200 {
@@ -364,9 +370,9 @@ func TestMailboxFlow(t *testing.T) {
 	}
 	pairID := result["id"].(string)
 
-	postJSON(ts.URL+"/v1/pair/accept", map[string]string{"id": pairID}, tokenB)
+	servertest.PostJSON(ts.URL+"/v1/pair/accept", map[string]string{"id": pairID}, tokenB)
 
-	resp, result, err := postJSON(ts.URL+"/v1/mailbox/send", map[string]interface{}{
+	resp, result, err := servertest.PostJSON(ts.URL+"/v1/mailbox/send", map[string]interface{}{
 		"to":      addrB,
 		"pair_id": pairID,
 		"type":    "keygen_request",
@@ -381,7 +387,7 @@ func TestMailboxFlow(t *testing.T) {
 	msgID := result["id"].(string)
 	t.Logf("message sent: id=%s", msgID)
 
-	resp, result, err = getJSON(ts.URL+"/v1/mailbox/pending", tokenB)
+	resp, result, err = servertest.GetJSON(ts.URL+"/v1/mailbox/pending", tokenB)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -399,7 +405,7 @@ func TestMailboxFlow(t *testing.T) {
 		t.Fatalf("expected keygen_request, got %s", msg["type"])
 	}
 
-	resp, result, _ = getJSON(ts.URL+"/v1/mailbox/pending", tokenA)
+	resp, result, _ = servertest.GetJSON(ts.URL+"/v1/mailbox/pending", tokenA)
 	aMessages := result["messages"].([]interface{})
 	if len(aMessages) != 0 {
 		t.Fatalf("A should have 0 messages, got %d", len(aMessages))
@@ -408,9 +414,9 @@ func TestMailboxFlow(t *testing.T) {
 
 	keyC, _ := crypto.GenerateKey()
 	addrC := crypto.PubkeyToAddress(keyC.PublicKey).Hex()
-	tokenC := authenticate(t, ts.URL, keyC, addrC)
+	tokenC := servertest.Authenticate(t, ts.URL, keyC, addrC)
 
-	resp, _, _ = postJSON(ts.URL+"/v1/mailbox/send", map[string]interface{}{
+	resp, _, _ = servertest.PostJSON(ts.URL+"/v1/mailbox/send", map[string]interface{}{
 		"to":      addrB,
 		"pair_id": pairID,
 		"type":    "keygen_request",
@@ -421,7 +427,7 @@ func TestMailboxFlow(t *testing.T) {
 	}
 	t.Log("outsider correctly rejected")
 
-	resp, _, err = postJSON(ts.URL+"/v1/mailbox/ack", map[string]string{
+	resp, _, err = servertest.PostJSON(ts.URL+"/v1/mailbox/ack", map[string]string{
 		"id": msgID,
 	}, tokenB)
 	if err != nil {
@@ -431,47 +437,675 @@ func TestMailboxFlow(t *testing.T) {
 		t.Fatalf("mailbox ack: expected 204, got %d", resp.StatusCode)
 	}
 
-	resp, result, _ = getJSON(ts.URL+"/v1/mailbox/pending", tokenB)
+	resp, result, _ = servertest.GetJSON(ts.URL+"/v1/mailbox/pending", tokenB)
 	messages = result["messages"].([]interface{})
 	if len(messages) != 0 {
 		t.Fatalf("B should have 0 messages after ack, got %d", len(messages))
 	}
 	t.Log("message acknowledged and removed")
+
+	// An mpc-failure body must be a well-formed failure.
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"protocol":"ecdsa-sign","party":"a","kind":"timeout","round":2,"culprits":["b"],"message":"round 2 timed out"}`, 200},
+		{`{"protocol":"ecdsa-sign","party":"a","kind":"gremlins","message":"?"}`, 400},
+		{`{"kind":"timeout"}`, 400},
+		{`"timeout"`, 400},
+	} {
+		resp, _, _ = servertest.PostJSON(ts.URL+"/v1/mailbox/send", map[string]interface{}{
+			"to":      addrB,
+			"pair_id": pairID,
+			"type":    "mpc-failure",
+			"body":    json.RawMessage(tc.body),
+		}, tokenA)
+		if resp.StatusCode != tc.want {
+			t.Fatalf("mpc-failure %s: expected %d, got %d", tc.body, tc.want, resp.StatusCode)
+		}
+	}
 }
 
-func authenticate(t *testing.T, baseURL string, key *ecdsa.PrivateKey, address string) string {
-	t.Helper()
+func TestSIWELoginValidation(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.Close()
 
-	_, result, err := postJSON(baseURL+"/v1/auth/nonce", map[string]string{
-		"address": address,
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+
+	login := func(message string) (*http.Response, map[string]interface{}) {
+		_, result, err := servertest.PostJSON(ts.URL+"/v1/auth/nonce", map[string]string{"address": address}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := result["nonce"].(string)
+		issued := result["message"].(string)
+		if !strings.Contains(issued, " wants you to sign in with your Ethereum account:\n"+address) {
+			t.Fatalf("nonce message is not EIP-4361: %q", issued)
+		}
+		if message == "" {
+			message = issued
+		} else {
+			message = strings.ReplaceAll(message, "{nonce}", nonce)
+		}
+		sig, _ := crypto.Sign(accounts.TextHash([]byte(message)), key)
+		resp, result, err := servertest.PostJSON(ts.URL+"/v1/auth/login", map[string]string{
+			"address":   address,
+			"signature": "0x" + hex.EncodeToString(sig),
+			"nonce":     nonce,
+			"message":   message,
+		}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, result
+	}
+
+	if resp, result := login(""); resp.StatusCode != 200 {
+		t.Fatalf("issued message: expected 200, got %d: %v", resp.StatusCode, result)
+	}
+
+	host := "escrow.example"
+	now := time.Now().UTC()
+	exp := now.Add(time.Minute)
+	msg := func(domain string, chain int64, expires time.Time) string {
+		m := &auth.SIWEMessage{
+			Domain: domain, Address: address, URI: "https://" + domain, Version: "1",
+			ChainID: chain, Nonce: "{nonce}", IssuedAt: now, ExpirationTime: &expires,
+		}
+		return m.String()
+	}
+
+	if resp, result := login(msg(host, 1, exp)); resp.StatusCode != 200 {
+		t.Fatalf("wallet-built message: expected 200, got %d: %v", resp.StatusCode, result)
+	}
+	if resp, _ := login(msg("evil.example", 1, exp)); resp.StatusCode != 401 {
+		t.Fatalf("foreign domain: expected 401, got %d", resp.StatusCode)
+	}
+	// The Host the request came in on binds nothing.
+	if resp, _ := login(msg(strings.TrimPrefix(ts.URL, "http://"), 1, exp)); resp.StatusCode != 401 {
+		t.Fatalf("request host as domain: expected 401, got %d", resp.StatusCode)
+	}
+	if resp, _ := login(msg(host, 5, exp)); resp.StatusCode != 401 {
+		t.Fatalf("wrong chain: expected 401, got %d", resp.StatusCode)
+	}
+	if resp, _ := login(msg(host, 1, now.Add(-time.Minute))); resp.StatusCode != 401 {
+		t.Fatalf("expired message: expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func loginSession(t *testing.T, baseURL string, key *ecdsa.PrivateKey) (token, refresh string) {
+	t.Helper()
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	_, result, err := servertest.PostJSON(baseURL+"/v1/auth/nonce", map[string]string{"address": address}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := crypto.Sign(accounts.TextHash([]byte(result["message"].(string))), key)
+	_, result, err = servertest.PostJSON(baseURL+"/v1/auth/login", map[string]string{
+		"address":   address,
+		"signature": "0x" + hex.EncodeToString(sig),
+		"nonce":     result["nonce"].(string),
 	}, "")
 	if err != nil {
 		t.Fatal(err)
 	}
+	token, _ = result["token"].(string)
+	refresh, _ = result["refresh_token"].(string)
+	if token == "" || refresh == "" {
+		t.Fatalf("login did not return a session: %v", result)
+	}
+	return token, refresh
+}
 
-	nonce := result["nonce"].(string)
-	message := result["message"].(string)
+func TestSessionRefreshLogoutRevoke(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.Close()
 
-	msgHash := accounts.TextHash([]byte(message))
-	sig, err := crypto.Sign(msgHash, key)
+	key, _ := crypto.GenerateKey()
+	token, refresh := loginSession(t, ts.URL, key)
+
+	resp, result, _ := servertest.PostJSON(ts.URL+"/v1/auth/refresh", map[string]string{"refresh_token": refresh}, "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("refresh: expected 200, got %d: %v", resp.StatusCode, result)
+	}
+	token2 := result["token"].(string)
+	refresh2 := result["refresh_token"].(string)
+	if refresh2 == refresh {
+		t.Fatal("refresh token was not rotated")
+	}
+
+	// Replaying the rotated token kills the whole family, successor included.
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/auth/refresh", map[string]string{"refresh_token": refresh}, ""); resp.StatusCode != 401 {
+		t.Fatalf("refresh replay: expected 401, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/auth/refresh", map[string]string{"refresh_token": refresh2}, ""); resp.StatusCode != 401 {
+		t.Fatalf("successor after replay: expected 401, got %d", resp.StatusCode)
+	}
+
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", token2); resp.StatusCode != 200 {
+		t.Fatalf("refreshed access token: expected 200, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/auth/logout", map[string]string{}, token2); resp.StatusCode != 204 {
+		t.Fatalf("logout: expected 204, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", token2); resp.StatusCode != 401 {
+		t.Fatalf("logged-out token: expected 401, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", token); resp.StatusCode != 200 {
+		t.Fatalf("other session should survive logout, got %d", resp.StatusCode)
+	}
+
+	// A second device; revoke-all from the first kills both.
+	token3, refresh3 := loginSession(t, ts.URL, key)
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/auth/revoke-all", map[string]string{}, token); resp.StatusCode != 200 {
+		t.Fatalf("revoke-all: expected 200, got %d", resp.StatusCode)
+	}
+	for _, tok := range []string{token, token3} {
+		if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", tok); resp.StatusCode != 401 {
+			t.Fatalf("token after revoke-all: expected 401, got %d", resp.StatusCode)
+		}
+	}
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/auth/refresh", map[string]string{"refresh_token": refresh3}, ""); resp.StatusCode != 401 {
+		t.Fatalf("refresh after revoke-all: expected 401, got %d", resp.StatusCode)
+	}
+
+	token4, _ := loginSession(t, ts.URL, key)
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", token4); resp.StatusCode != 200 {
+		t.Fatalf("fresh login after revoke-all: expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestJWKSVerification(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	fileStor, err := storage.NewFileStorage(map[string]string{"path": t.TempDir()}, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
-	sig[64] += 27
+	keys, err := auth.LoadKeySet(context.Background(), fileStor, auth.AlgES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&ServerConfig{Addr: ":0", Stor: fileStor, Logger: logger, JWTKeys: keys})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	key, _ := crypto.GenerateKey()
+	token, _ := loginSession(t, ts.URL, key)
+
+	resp, err := http.Get(ts.URL + "/.well-known/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	doc, _ := io.ReadAll(resp.Body)
+	remote, err := auth.ParseJWKS(doc)
+	if err != nil {
+		t.Fatalf("parse jwks: %v\n%s", err, doc)
+	}
+	claims, err := auth.ValidateToken(token, remote)
+	if err != nil {
+		t.Fatalf("token not verifiable with published jwks: %v", err)
+	}
+	if claims.Address != strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex()) {
+		t.Fatalf("unexpected subject %s", claims.Address)
+	}
+
+	if _, err := keys.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("token signed before rotation rejected: %d", resp.StatusCode)
+	}
+}
+
+// cmpSign produces the CMP-native encoding ([33B R][32B S]) of an ECDSA
+// signature over the EIP-191 hash of message, as an MPC signing round would.
+func cmpSign(t *testing.T, key *ecdsa.PrivateKey, message string) string {
+	t.Helper()
+	sig, err := crypto.Sign(accounts.TextHash([]byte(message)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "0x" + hex.EncodeToString(append([]byte{0x02 + sig[64]}, sig[:64]...))
+}
+
+func TestSharedAccountLogin(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.Close()
+
+	keyA, _ := crypto.GenerateKey()
+	keyB, _ := crypto.GenerateKey()
+	addrB := crypto.PubkeyToAddress(keyB.PublicKey).Hex()
+	tokenA := servertest.Authenticate(t, ts.URL, keyA, crypto.PubkeyToAddress(keyA.PublicKey).Hex())
+	tokenB := servertest.Authenticate(t, ts.URL, keyB, addrB)
+
+	_, result, _ := servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{"partner": addrB}, tokenA)
+	pairID := result["id"].(string)
 
-	_, result, err = postJSON(baseURL+"/v1/auth/login", map[string]string{
+	// Stand-in for the pair's 2-of-2 key.
+	shared, _ := crypto.GenerateKey()
+	sharedAddr := crypto.PubkeyToAddress(shared.PublicKey).Hex()
+	register := map[string]string{
+		"pair_id":    pairID,
+		"public_key": hex.EncodeToString(crypto.CompressPubkey(&shared.PublicKey)),
+		"signature":  cmpSign(t, shared, SharedAccountMessage(sharedAddr, pairID)),
+	}
+
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/pair/shared", register, tokenA); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("register on pending pair: expected 400, got %d", resp.StatusCode)
+	}
+	servertest.PostJSON(ts.URL+"/v1/pair/accept", map[string]string{"id": pairID}, tokenB)
+
+	forged := map[string]string{
+		"pair_id":    pairID,
+		"public_key": register["public_key"],
+		"signature":  cmpSign(t, keyA, SharedAccountMessage(sharedAddr, pairID)),
+	}
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/pair/shared", forged, tokenA); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("register without shared-key proof: expected 401, got %d", resp.StatusCode)
+	}
+
+	// An MPC signature cannot log in before the account is registered.
+	loginShared := func() (*http.Response, map[string]interface{}) {
+		_, nonce, _ := servertest.PostJSON(ts.URL+"/v1/auth/nonce", map[string]string{"address": sharedAddr}, "")
+		resp, result, err := servertest.PostJSON(ts.URL+"/v1/auth/login", map[string]string{
+			"address":   sharedAddr,
+			"signature": cmpSign(t, shared, nonce["message"].(string)),
+			"nonce":     nonce["nonce"].(string),
+		}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, result
+	}
+	if resp, _ := loginShared(); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unregistered shared login: expected 401, got %d", resp.StatusCode)
+	}
+
+	resp, result, _ := servertest.PostJSON(ts.URL+"/v1/pair/shared", register, tokenA)
+	if resp.StatusCode != http.StatusOK || result["address"] != sharedAddr {
+		t.Fatalf("register: %d %v", resp.StatusCode, result)
+	}
+
+	resp, result = loginShared()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("shared login: %d %v", resp.StatusCode, result)
+	}
+	if !strings.EqualFold(result["address"].(string), sharedAddr) {
+		t.Fatalf("logged in as %v, want %s", result["address"], sharedAddr)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.Close()
+
+	keyA, _ := crypto.GenerateKey()
+	keyB, _ := crypto.GenerateKey()
+	addrA := crypto.PubkeyToAddress(keyA.PublicKey).Hex()
+	addrB := crypto.PubkeyToAddress(keyB.PublicKey).Hex()
+	tokenA := servertest.Authenticate(t, ts.URL, keyA, addrA)
+	tokenB := servertest.Authenticate(t, ts.URL, keyB, addrB)
+
+	_, result, _ := servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{"partner": addrB}, tokenA)
+	pairID := result["id"].(string)
+	servertest.PostJSON(ts.URL+"/v1/pair/accept", map[string]string{"id": pairID}, tokenB)
+
+	resp, result, _ := servertest.PostJSON(ts.URL+"/v1/apikeys/create", map[string]interface{}{
+		"name": "bot", "scopes": []string{"nope"},
+	}, tokenA)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown scope: expected 400, got %d", resp.StatusCode)
+	}
+
+	resp, result, _ = servertest.PostJSON(ts.URL+"/v1/apikeys/create", map[string]interface{}{
+		"name":   "market-maker",
+		"scopes": []string{"mailbox", "escrow:read"},
+		"pairs":  []string{pairID},
+	}, tokenA)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create key: %d %v", resp.StatusCode, result)
+	}
+	apiKey := result["key"].(string)
+	keyID := result["id"].(string)
+	if !strings.HasPrefix(apiKey, "sek_"+keyID+"_") {
+		t.Fatalf("unexpected key format %q", apiKey)
+	}
+
+	send := map[string]interface{}{"to": addrB, "pair_id": pairID, "type": "quote", "body": map[string]int{"px": 1}}
+	if resp, result, _ := servertest.PostJSON(ts.URL+"/v1/mailbox/send", send, apiKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("mailbox send with key: %d %v", resp.StatusCode, result)
+	}
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/escrow/check", map[string]string{"id": "x", "pub": "00"}, apiKey); resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		t.Fatalf("escrow check with escrow:read key: %d", resp.StatusCode)
+	}
+
+	// Out of scope or session-only routes are refused.
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/escrow", map[string]string{}, apiKey); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("escrow deposit without scope: expected 403, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", apiKey); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("pair route with key: expected 403, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/apikeys/create", map[string]interface{}{"scopes": []string{"mailbox"}}, apiKey); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("key minting a key: expected 403, got %d", resp.StatusCode)
+	}
+
+	// A key restricted to one pair cannot use another.
+	keyC, _ := crypto.GenerateKey()
+	addrC := crypto.PubkeyToAddress(keyC.PublicKey).Hex()
+	tokenC := servertest.Authenticate(t, ts.URL, keyC, addrC)
+	_, result, _ = servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{"partner": addrC}, tokenA)
+	otherPair := result["id"].(string)
+	servertest.PostJSON(ts.URL+"/v1/pair/accept", map[string]string{"id": otherPair}, tokenC)
+	send["to"], send["pair_id"] = addrC, otherPair
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/mailbox/send", send, apiKey); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("send on other pair: expected 403, got %d", resp.StatusCode)
+	}
+
+	_, result, _ = servertest.GetJSON(ts.URL+"/v1/apikeys/list", tokenA)
+	if keys := result["keys"].([]interface{}); len(keys) != 1 {
+		t.Fatalf("expected 1 key, got %v", keys)
+	}
+
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/apikeys/revoke", map[string]string{"id": keyID}, tokenB); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("revoke by non-owner: expected 403, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/apikeys/revoke", map[string]string{"id": keyID}, tokenA); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke: expected 204, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/mailbox/pending", apiKey); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked key: expected 401, got %d", resp.StatusCode)
+	}
+
+	// revoke-all also kills API keys.
+	_, result, _ = servertest.PostJSON(ts.URL+"/v1/apikeys/create", map[string]interface{}{"scopes": []string{"timebox"}}, tokenA)
+	second := result["key"].(string)
+	servertest.PostJSON(ts.URL+"/v1/auth/revoke-all", nil, tokenA)
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/timebox?pub=00&hash=00", second); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("key after revoke-all: expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestReplicasShareState(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	dir := t.TempDir()
+	replica := func() *httptest.Server {
+		stor, err := storage.NewFileStorage(map[string]string{"path": dir}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Behind a load balancer every replica sees the same Host.
+		srv := NewServer(&ServerConfig{Addr: ":0", Stor: stor, Logger: logger, JWTSecret: []byte("test-secret"),
+			SIWE: auth.SIWEConfig{Domain: "escrow.example"}})
+		return httptest.NewServer(srv.routes())
+	}
+	a, b := replica(), replica()
+	defer a.Close()
+	defer b.Close()
+
+	// Nonce from replica A, login at replica B.
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	_, nonce, _ := servertest.PostJSON(a.URL+"/v1/auth/nonce", map[string]string{"address": address}, "")
+	sig, _ := crypto.Sign(accounts.TextHash([]byte(nonce["message"].(string))), key)
+	login := map[string]string{
 		"address":   address,
-		"signature": fmt.Sprintf("0x%s", hex.EncodeToString(sig)),
-		"nonce":     nonce,
+		"signature": "0x" + hex.EncodeToString(sig),
+		"nonce":     nonce["nonce"].(string),
+	}
+	resp, result, _ := servertest.PostJSON(b.URL+"/v1/auth/login", login, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("cross-replica login: %d %v", resp.StatusCode, result)
+	}
+	token := result["token"].(string)
+
+	// The nonce is spent everywhere.
+	if resp, _, _ := servertest.PostJSON(a.URL+"/v1/auth/login", login, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("nonce replay on other replica: expected 401, got %d", resp.StatusCode)
+	}
+
+	// The partner claims a session on one replica; the initiator's cancel
+	// on the other reaches the claim, and the status every replica reports.
+	partner, partnerAddr := servertest.Login(t, a.URL)
+	pair := servertest.Pair(t, a.URL, token, partner, partnerAddr)
+	session := map[string]string{"session_id": "keygen-1", "pair_id": pair}
+	_, result, _ = servertest.PostJSON(a.URL+"/v1/session/claim", session, partner)
+	if result["ok"] != true {
+		t.Fatalf("claim: %v", result)
+	}
+	_, result, _ = servertest.PostJSON(a.URL+"/v1/session/status", session, token)
+	if result["status"] != "claimed" {
+		t.Fatalf("status after claim: %v", result)
+	}
+	_, result, _ = servertest.PostJSON(b.URL+"/v1/session/cancel", session, token)
+	if result["ok"] != true || result["claimed"] != true {
+		t.Fatalf("cancel after claim on other replica: %v", result)
+	}
+	_, result, _ = servertest.PostJSON(a.URL+"/v1/session/status", session, partner)
+	if result["status"] != "cancelled" {
+		t.Fatalf("status after cancel: %v", result)
+	}
+	_, result, _ = servertest.PostJSON(a.URL+"/v1/session/claim", session, partner)
+	if result["ok"] != false {
+		t.Fatalf("claim after cancel: %v", result)
+	}
+}
+
+func TestSessionBoundToPair(t *testing.T) {
+	ts := setupTestServer(t)
+	tokenA, _ := servertest.Login(t, ts.URL)
+	tokenB, addrB := servertest.Login(t, ts.URL)
+	tokenC, addrC := servertest.Login(t, ts.URL)
+	pair := servertest.Pair(t, ts.URL, tokenA, tokenB, addrB)
+	other := servertest.Pair(t, ts.URL, tokenA, tokenC, addrC)
+
+	// C is in no pair with B, and the claim needs a pair of the caller.
+	session := map[string]string{"session_id": "keygen-1", "pair_id": pair}
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/session/claim", session, tokenC); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("claim in a foreign pair: expected 403, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/session/claim", map[string]string{"session_id": "keygen-1"}, tokenB); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("claim without a pair: expected 400, got %d", resp.StatusCode)
+	}
+	_, result, _ := servertest.PostJSON(ts.URL+"/v1/session/claim", session, tokenB)
+	if result["ok"] != true {
+		t.Fatalf("claim: %v", result)
+	}
+
+	// Another pair can neither claim the session again nor read its status.
+	_, result, _ = servertest.PostJSON(ts.URL+"/v1/session/claim", map[string]string{"session_id": "keygen-1", "pair_id": other}, tokenC)
+	if result["ok"] != false {
+		t.Fatalf("claim by another pair: %v", result)
+	}
+	resp, result, _ := servertest.PostJSON(ts.URL+"/v1/session/status", map[string]string{"session_id": "keygen-1"}, tokenC)
+	if resp.StatusCode != http.StatusForbidden || result["status"] != nil {
+		t.Fatalf("status for a foreign address: %d %v", resp.StatusCode, result)
+	}
+
+	// Its cancel is too late and changes nothing.
+	_, result, _ = servertest.PostJSON(ts.URL+"/v1/session/cancel", map[string]string{"session_id": "keygen-1"}, tokenC)
+	if result["ok"] != false || result["claimed"] != false {
+		t.Fatalf("cancel by a foreign address: %v", result)
+	}
+	_, result, _ = servertest.PostJSON(ts.URL+"/v1/session/status", session, tokenA)
+	if result["status"] != "claimed" {
+		t.Fatalf("status after a foreign cancel: %v", result)
+	}
+
+	// A member of the pair still cancels it.
+	_, result, _ = servertest.PostJSON(ts.URL+"/v1/session/cancel", session, tokenA)
+	if result["ok"] != true || result["claimed"] != true {
+		t.Fatalf("cancel by the initiator: %v", result)
+	}
+	_, result, _ = servertest.PostJSON(ts.URL+"/v1/session/status", session, tokenB)
+	if result["status"] != "cancelled" {
+		t.Fatalf("status after cancel: %v", result)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("auth=3/m,default=2/h:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[LimitAuth].Burst != 3 || limits[LimitDefault].Burst != 2 {
+		t.Fatalf("parsed %v", limits)
+	}
+	for _, bad := range []string{"auth", "auth=3", "auth=3/d", "auth=0/m", "auth=3/m:x"} {
+		if _, err := ParseRateLimits(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	stor, err := storage.NewFileStorage(map[string]string{"path": t.TempDir()}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&ServerConfig{Addr: ":0", Stor: stor, Logger: logger, JWTSecret: []byte("test-secret"),
+		RateLimits: limits})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	// Three auth calls per IP: two nonces and a login, then 429.
+	key, _ := crypto.GenerateKey()
+	token, _ := loginSession(t, ts.URL, key)
+	resp, result, _ := servertest.PostJSON(ts.URL+"/v1/auth/nonce", map[string]string{"address": crypto.PubkeyToAddress(key.PublicKey).Hex()}, "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("last auth call: %d remaining=%q", resp.StatusCode, resp.Header.Get("X-RateLimit-Remaining"))
+	}
+	resp, result, _ = servertest.PostJSON(ts.URL+"/v1/auth/nonce", map[string]string{"address": crypto.PubkeyToAddress(key.PublicKey).Hex()}, "")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("over budget: %d retry-after=%q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if errs, _ := result["errors"].([]interface{}); len(errs) != 1 || errs[0] != "rate limit exceeded" {
+		t.Fatalf("error body: %v", result)
+	}
+
+	// Authenticated routes are budgeted per address, not per IP.
+	other, _ := crypto.GenerateKey()
+	// Start from a fresh auth budget for the second login.
+	srv.limiter.buckets = make(map[string]*bucket)
+	otherToken, _ := loginSession(t, ts.URL, other)
+	for i := 0; i < 2; i++ {
+		if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", token); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: %d", i, resp.StatusCode)
+		}
+	}
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", token); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third request: expected 429, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := servertest.GetJSON(ts.URL+"/v1/pair/pending", otherToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf("other address: expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	stor, err := storage.NewFileStorage(map[string]string{"path": t.TempDir()}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&ServerConfig{Addr: ":0", Stor: stor, Logger: logger, JWTSecret: []byte("test-secret"),
+		Lockout: LoginLockout{MaxFailures: 2, Window: time.Minute, Duration: time.Minute}})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	bad := map[string]string{"address": address, "signature": "0x00", "nonce": "wrong"}
+	for i := 0; i < 2; i++ {
+		if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/auth/login", bad, ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("failure %d: expected 401, got %d", i, resp.StatusCode)
+		}
+	}
+
+	// Even a correct login is refused while locked out.
+	_, nonce, _ := servertest.PostJSON(ts.URL+"/v1/auth/nonce", map[string]string{"address": address}, "")
+	sig, _ := crypto.Sign(accounts.TextHash([]byte(nonce["message"].(string))), key)
+	resp, _, _ := servertest.PostJSON(ts.URL+"/v1/auth/login", map[string]string{
+		"address":   address,
+		"signature": "0x" + hex.EncodeToString(sig),
+		"nonce":     nonce["nonce"].(string),
 	}, "")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("locked out: expected 429 with Retry-After, got %d", resp.StatusCode)
+	}
+
+	// Other addresses from the same IP are not affected below the IP threshold.
+	other, _ := crypto.GenerateKey()
+	loginSession(t, ts.URL, other)
+}
+
+func TestBitcoinLogin(t *testing.T) {
+	ts := setupTestServer(t)
+	defer ts.Close()
+
+	priv, _ := btcec.NewPrivateKey()
+	taproot := txscript.ComputeTaprootKeyNoScript(priv.PubKey())
+	addr, _ := btcutil.NewAddressTaproot(schnorr.SerializePubKey(taproot), &chaincfg.MainNetParams)
+	identity := "btc:" + addr.EncodeAddress()
+
+	_, nonce, _ := servertest.PostJSON(ts.URL+"/v1/auth/nonce", map[string]string{"address": identity}, "")
+	message := nonce["message"].(string)
+	if !strings.Contains(message, "sign in with your Bitcoin account:\n"+addr.EncodeAddress()) {
+		t.Fatalf("nonce message: %q", message)
+	}
+
+	pkScript, _ := txscript.PayToAddrScript(addr)
+	_, toSign, _ := auth.BIP322Transactions(pkScript, message)
+	prevOuts := txscript.NewCannedPrevOutputFetcher(pkScript, 0)
+	witness, err := txscript.TaprootWitnessSignature(toSign, txscript.NewTxSigHashes(toSign, prevOuts), 0, 0,
+		pkScript, txscript.SigHashDefault, priv)
 	if err != nil {
 		t.Fatal(err)
 	}
+	resp, result, _ := servertest.PostJSON(ts.URL+"/v1/auth/login", map[string]string{
+		"address":   identity,
+		"signature": base64.StdEncoding.EncodeToString(auth.EncodeWitness(witness)),
+		"nonce":     nonce["nonce"].(string),
+	}, "")
+	if resp.StatusCode != http.StatusOK || result["address"] != identity {
+		t.Fatalf("bitcoin login: %d %v", resp.StatusCode, result)
+	}
+	btcToken := result["token"].(string)
 
-	token, ok := result["token"].(string)
-	if !ok || token == "" {
-		t.Fatalf("auth failed for %s: %v", address, result)
+	// A BTC identity pairs and exchanges mail with an ETH identity.
+	ethKey, _ := crypto.GenerateKey()
+	ethAddr := crypto.PubkeyToAddress(ethKey.PublicKey).Hex()
+	ethToken := servertest.Authenticate(t, ts.URL, ethKey, ethAddr)
+
+	resp, result, _ = servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{"partner": ethAddr}, btcToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pair create: %v", result)
+	}
+	pairID := result["id"].(string)
+	if resp, result, _ := servertest.PostJSON(ts.URL+"/v1/pair/accept", map[string]string{"id": pairID}, ethToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf("pair accept: %v", result)
+	}
+
+	resp, result, _ = servertest.PostJSON(ts.URL+"/v1/mailbox/send", map[string]interface{}{
+		"to": "eth:" + ethAddr, "pair_id": pairID, "type": "keygen_request", "body": map[string]interface{}{},
+	}, btcToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("mailbox send: %v", result)
+	}
+	_, result, _ = servertest.GetJSON(ts.URL+"/v1/mailbox/pending", ethToken)
+	messages := result["messages"].([]interface{})
+	if len(messages) != 1 || messages[0].(map[string]interface{})["from"] != identity {
+		t.Fatalf("eth inbox: %v", result)
+	}
+
+	resp, result, _ = servertest.PostJSON(ts.URL+"/v1/mailbox/send", map[string]interface{}{
+		"to": addr.EncodeAddress(), "pair_id": pairID, "type": "keygen_response", "body": map[string]interface{}{},
+	}, ethToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("reply to bare btc address: %v", result)
 	}
 
-	return token
+	if resp, _, _ := servertest.PostJSON(ts.URL+"/v1/pair/create", map[string]string{"partner": "btc:not-an-address"}, ethToken); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid partner: expected 400, got %d", resp.StatusCode)
+	}
 }
@@ -0,0 +1,125 @@
+// Package servertest holds the HTTP helpers the tests of the escrow server
+// and of its clients use to sign in and call it.
+package servertest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// GetJSON sends a GET to url as token and decodes the answer.
+func GetJSON(url string, token string) (*http.Response, map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return do(req, token)
+}
+
+// PostJSON posts body to url as token and decodes the answer.
+func PostJSON(url string, body interface{}, token string) (*http.Response, map[string]interface{}, error) {
+	b, _ := json.Marshal(body)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(req, token)
+}
+
+func do(req *http.Request, token string) (*http.Response, map[string]interface{}, error) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	var result map[string]interface{}
+	json.Unmarshal(data, &result)
+
+	return resp, result, nil
+}
+
+// Authenticate signs in to the server at baseURL as address, whose key is
+// key, and returns the access token.
+func Authenticate(t testing.TB, baseURL string, key *ecdsa.PrivateKey, address string) string {
+	t.Helper()
+
+	_, result, err := PostJSON(baseURL+"/v1/auth/nonce", map[string]string{
+		"address": address,
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := result["nonce"].(string)
+	message := result["message"].(string)
+
+	msgHash := accounts.TextHash([]byte(message))
+	sig, err := crypto.Sign(msgHash, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[64] += 27
+
+	_, result, err = PostJSON(baseURL+"/v1/auth/login", map[string]string{
+		"address":   address,
+		"signature": fmt.Sprintf("0x%s", hex.EncodeToString(sig)),
+		"nonce":     nonce,
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, ok := result["token"].(string)
+	if !ok || token == "" {
+		t.Fatalf("auth failed for %s: %v", address, result)
+	}
+
+	return token
+}
+
+// Login signs in to the server at baseURL with a new key and returns the
+// access token and the address.
+func Login(t testing.TB, baseURL string) (string, string) {
+	t.Helper()
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := crypto.PubkeyToAddress(priv.PublicKey).Hex()
+	return Authenticate(t, baseURL, priv, addr), addr
+}
+
+// Pair pairs the holder of tokA with addrB, whose token is tokB, and
+// returns the pair ID.
+func Pair(t testing.TB, baseURL, tokA, tokB, addrB string) string {
+	t.Helper()
+	_, result, err := PostJSON(baseURL+"/v1/pair/create", map[string]string{"partner": addrB}, tokA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result["id"].(string)
+	resp, result, err := PostJSON(baseURL+"/v1/pair/accept", map[string]string{"id": id}, tokB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pair accept: %d %v", resp.StatusCode, result)
+	}
+	return id
+}
@@ -1,131 +1,448 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/valli0x/signature-escrow/auth"
+	"github.com/valli0x/signature-escrow/storage"
 )
 
-type sessionRegistry struct {
-	mu sync.Mutex
-	m  map[string]sessionEntry
+const (
+	sessionPrefix = "sessions/"
+	sessionTTL    = 15 * time.Minute
+
+	sessionClaimed   = "claimed"
+	sessionCancelled = "cancelled"
+)
+
+// SessionOwner is the pair a session is bound to: only its members may
+// cancel the session once it is claimed, or read its status.
+type SessionOwner struct {
+	Pair    string
+	Members []string
+}
+
+// Has reports whether addr is a member of the owner.
+func (o SessionOwner) Has(addr string) bool {
+	return slices.ContainsFunc(o.Members, func(m string) bool { return strings.EqualFold(m, addr) })
+}
+
+// SessionRegistry resolves the race between the partner claiming a keygen
+// session and the initiator cancelling it: whichever arrives first wins.
+// The first of them binds the session to its owner. A claim fails once
+// the session is cancelled or claimed by another pair. A cancel after the
+// claim is a no-op, unless addr is a member of the claiming pair: then it
+// holds and reports claimed, and the clients watching the session's status
+// stop its runs. Entries expire after sessionTTL.
+type SessionRegistry interface {
+	Claim(ctx context.Context, id string, owner SessionOwner) (bool, error)
+	Cancel(ctx context.Context, id, addr string, owner SessionOwner) (ok, claimed bool, err error)
+	// Status is sessionClaimed, sessionCancelled or "" for a session the
+	// registry does not know, and the owner of the session.
+	Status(ctx context.Context, id string) (string, SessionOwner, error)
+	// Sweep removes expired entries and returns how many it removed.
+	Sweep(ctx context.Context) (int, error)
+}
+
+// storedSession is a registry entry.
+type storedSession struct {
+	Status  string
+	At      int64
+	Pair    string
+	Members []string
+}
+
+func (e *storedSession) owner() SessionOwner {
+	return SessionOwner{Pair: e.Pair, Members: e.Members}
+}
+
+func (e *storedSession) expired() bool {
+	return time.Since(time.Unix(e.At, 0)) > sessionTTL
+}
+
+func newStoredSession(status string, owner SessionOwner) *storedSession {
+	return &storedSession{Status: status, At: time.Now().Unix(), Pair: owner.Pair, Members: owner.Members}
+}
+
+// claimSession returns the entry a claim by owner leaves of e, nil for an
+// unknown session, or nil if the claim fails.
+func claimSession(e *storedSession, owner SessionOwner) *storedSession {
+	if e != nil && (e.Status == sessionCancelled || e.Pair != owner.Pair) {
+		return nil
+	}
+	return newStoredSession(sessionClaimed, owner)
+}
+
+// cancelSession returns the entry a cancel by addr leaves of e, or nil if
+// the cancel is a no-op, and whether the session was claimed.
+func cancelSession(e *storedSession, addr string, owner SessionOwner) (*storedSession, bool) {
+	switch {
+	case e == nil:
+		return newStoredSession(sessionCancelled, owner), false
+	case e.Status == sessionCancelled:
+		return e, false
+	case !e.owner().Has(addr):
+		return nil, false
+	}
+	return newStoredSession(sessionCancelled, e.owner()), true
 }
 
-type sessionEntry struct {
-	status string
-	at     time.Time
+// sessionRegistry is the process-local SessionRegistry.
+type sessionRegistry struct {
+	mu sync.Mutex
+	m  map[string]*storedSession
 }
 
 func newSessionRegistry() *sessionRegistry {
-	return &sessionRegistry{m: make(map[string]sessionEntry)}
+	return &sessionRegistry{m: make(map[string]*storedSession)}
 }
 
-func (r *sessionRegistry) prune() {
-	cutoff := time.Now().Add(-15 * time.Minute)
+func (r *sessionRegistry) prune() int {
+	removed := 0
 	for k, v := range r.m {
-		if v.at.Before(cutoff) {
+		if v.expired() {
 			delete(r.m, k)
+			removed++
 		}
 	}
+	return removed
 }
 
-func (r *sessionRegistry) claim(id string) bool {
+func (r *sessionRegistry) Claim(_ context.Context, id string, owner SessionOwner) (bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.prune()
-	if e, ok := r.m[id]; ok && e.status == "cancelled" {
-		return false
+	e := claimSession(r.m[id], owner)
+	if e == nil {
+		return false, nil
 	}
-	r.m[id] = sessionEntry{status: "claimed", at: time.Now()}
-	return true
+	r.m[id] = e
+	return true, nil
 }
 
-func (r *sessionRegistry) cancel(id string) bool {
+func (r *sessionRegistry) Cancel(_ context.Context, id, addr string, owner SessionOwner) (bool, bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.prune()
-	if e, ok := r.m[id]; ok && e.status == "claimed" {
-		return false
+	e, claimed := cancelSession(r.m[id], addr, owner)
+	if e == nil {
+		return false, false, nil
 	}
-	r.m[id] = sessionEntry{status: "cancelled", at: time.Now()}
-	return true
+	r.m[id] = e
+	return true, claimed, nil
+}
+
+func (r *sessionRegistry) Status(_ context.Context, id string) (string, SessionOwner, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune()
+	e, ok := r.m[id]
+	if !ok {
+		return "", SessionOwner{}, nil
+	}
+	return e.Status, e.owner(), nil
+}
+
+func (r *sessionRegistry) Sweep(_ context.Context) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.prune(), nil
+}
+
+// storageSessions is a SessionRegistry shared by all replicas over one
+// storage. Each decision runs under storage.Lock on the session key.
+type storageSessions struct {
+	stor storage.Storage
+}
+
+func newStorageSessions(stor storage.Storage) *storageSessions {
+	return &storageSessions{stor: stor}
+}
+
+func (r *storageSessions) load(ctx context.Context, key string) (*storedSession, error) {
+	data, err := r.stor.Get(ctx, key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	e := &storedSession{}
+	if err := cbor.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	if e.expired() {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// update replaces the entry of id with what decide returns for it, unless
+// that is nil, and returns whether it did.
+func (r *storageSessions) update(ctx context.Context, id string, decide func(*storedSession) *storedSession) (bool, error) {
+	key := sessionPrefix + id
+	unlock, err := storage.Lock(ctx, r.stor, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	e, err := r.load(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	next := decide(e)
+	if next == nil {
+		return false, nil
+	}
+	data, err := cbor.Marshal(next)
+	if err != nil {
+		return false, err
+	}
+	return true, r.stor.Put(ctx, key, data)
+}
+
+func (r *storageSessions) Claim(ctx context.Context, id string, owner SessionOwner) (bool, error) {
+	return r.update(ctx, id, func(e *storedSession) *storedSession {
+		return claimSession(e, owner)
+	})
+}
+
+func (r *storageSessions) Cancel(ctx context.Context, id, addr string, owner SessionOwner) (bool, bool, error) {
+	var claimed bool
+	ok, err := r.update(ctx, id, func(e *storedSession) *storedSession {
+		var next *storedSession
+		next, claimed = cancelSession(e, addr, owner)
+		return next
+	})
+	return ok, claimed, err
+}
+
+func (r *storageSessions) Status(ctx context.Context, id string) (string, SessionOwner, error) {
+	e, err := r.load(ctx, sessionPrefix+id)
+	if err != nil || e == nil {
+		return "", SessionOwner{}, err
+	}
+	return e.Status, e.owner(), nil
+}
+
+func (r *storageSessions) Sweep(ctx context.Context) (int, error) {
+	keys, err := r.stor.List(ctx, sessionPrefix)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+		ok, err := r.sweepKey(ctx, sessionPrefix+k)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (r *storageSessions) sweepKey(ctx context.Context, key string) (bool, error) {
+	unlock, err := storage.Lock(ctx, r.stor, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	data, err := r.stor.Get(ctx, key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	e := &storedSession{}
+	if err := cbor.Unmarshal(data, e); err == nil && !e.expired() {
+		return false, nil
+	}
+	return true, r.stor.Delete(ctx, key)
 }
 
 type SessionRequest struct {
 	SessionID string `json:"session_id"`
+	// PairID is the caller's pair the session runs in. A claim needs it;
+	// a cancel without it binds a session nobody claimed to the caller.
+	PairID string `json:"pair_id,omitempty"`
 }
 
 type SessionResponse struct {
 	OK bool `json:"ok"`
 }
 
+type SessionCancelResponse struct {
+	OK bool `json:"ok"`
+	// Claimed is set when a member of the claiming pair cancelled a claimed
+	// session: its runs are stopped by the clients, which watch the
+	// session's status.
+	Claimed bool `json:"claimed"`
+}
+
+type SessionStatusResponse struct {
+	// Status is "claimed", "cancelled", or empty for a session the server
+	// does not know or that expired.
+	Status string `json:"status"`
+}
+
+// decodeSession reads a SessionRequest of the caller and returns it with
+// the caller's address.
+func decodeSession(w http.ResponseWriter, r *http.Request) (*SessionRequest, string, bool) {
+	addr := auth.AddressFromContext(r.Context())
+	if addr == "" {
+		respondError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, "", false
+	}
+	var req SessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return nil, "", false
+	}
+	if req.SessionID == "" {
+		respondError(w, http.StatusBadRequest, errors.New("session_id is required"))
+		return nil, "", false
+	}
+	return &req, addr, true
+}
+
+// pairOwner returns the owner of a session run in pair id, of which addr
+// must be a member.
+func (s *Server) pairOwner(w http.ResponseWriter, r *http.Request, id, addr string) (SessionOwner, bool) {
+	pair, err := loadPair(s.stor, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+		return SessionOwner{}, false
+	}
+	if pair == nil {
+		respondError(w, http.StatusNotFound, fmt.Errorf("pair not found"))
+		return SessionOwner{}, false
+	}
+	owner := SessionOwner{Pair: pair.ID, Members: []string{pair.Initiator, pair.Partner}}
+	if !owner.Has(addr) {
+		respondError(w, http.StatusForbidden, fmt.Errorf("you are not part of this pair"))
+		return SessionOwner{}, false
+	}
+	if !auth.PairAllowed(r.Context(), pair.ID) {
+		respondError(w, http.StatusForbidden, fmt.Errorf("api key is not valid for this pair"))
+		return SessionOwner{}, false
+	}
+	return owner, true
+}
+
 // sessionClaim lets the partner claim a keygen session before running its half.
 //
 // @Summary      Claim a keygen session
-// @Description  The partner calls this before running its keygen half. ok=true means proceed; ok=false means the initiator already cancelled.
+// @Description  The partner calls this before running its keygen half, with the pair the keygen runs in; the claim binds the session to that pair. ok=true means proceed; ok=false means the initiator already cancelled, or another pair claimed the session.
 // @Tags         session
 // @Accept       json
 // @Produce      json
-// @Param        body  body      SessionRequest  true  "Session ID"
+// @Param        body  body      SessionRequest  true  "Session ID and pair ID"
 // @Success      200   {object}  SessionResponse
 // @Failure      400   {object}  ErrorResponse
 // @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
 // @Security     BearerAuth
 // @Router       /v1/session/claim [post]
 func (s *Server) sessionClaim() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		addr := auth.AddressFromContext(r.Context())
-		if addr == "" {
-			respondError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		req, addr, ok := decodeSession(w, r)
+		if !ok {
+			return
+		}
+		if req.PairID == "" {
+			respondError(w, http.StatusBadRequest, errors.New("pair_id is required"))
 			return
 		}
-		var req SessionRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		owner, ok := s.pairOwner(w, r, req.PairID, addr)
+		if !ok {
 			return
 		}
-		if req.SessionID == "" {
-			respondError(w, http.StatusBadRequest, errors.New("session_id is required"))
+		claimed, err := s.sessions.Claim(r.Context(), req.SessionID, owner)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
 			return
 		}
-		respondOk(w, map[string]bool{"ok": s.sessions.claim(req.SessionID)})
+		respondOk(w, map[string]bool{"ok": claimed})
 	}
 }
 
 // sessionCancel lets the initiator cancel a keygen session.
 //
 // @Summary      Cancel a keygen session
-// @Description  The initiator calls this to cancel. ok=true means cancelled; ok=false means the partner already claimed (too late to cancel).
+// @Description  The initiator calls this to cancel. ok=true means cancelled; ok=false means the partner already claimed the session (too late to cancel). A member of the pair that claimed the session cancels it all the same: the response then says claimed=true, and the clients watching its status stop their runs, so the other parties abort. A cancel before any claim binds the session to pair_id, or to the caller without it.
 // @Tags         session
 // @Accept       json
 // @Produce      json
-// @Param        body  body      SessionRequest  true  "Session ID"
-// @Success      200   {object}  SessionResponse
+// @Param        body  body      SessionRequest  true  "Session ID and, optionally, pair ID"
+// @Success      200   {object}  SessionCancelResponse
 // @Failure      400   {object}  ErrorResponse
 // @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
 // @Security     BearerAuth
 // @Router       /v1/session/cancel [post]
 func (s *Server) sessionCancel() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		addr := auth.AddressFromContext(r.Context())
-		if addr == "" {
-			respondError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		req, addr, ok := decodeSession(w, r)
+		if !ok {
+			return
+		}
+		owner := SessionOwner{Members: []string{addr}}
+		if req.PairID != "" {
+			if owner, ok = s.pairOwner(w, r, req.PairID, addr); !ok {
+				return
+			}
+		}
+		cancelled, claimed, err := s.sessions.Cancel(r.Context(), req.SessionID, addr, owner)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		respondOk(w, SessionCancelResponse{OK: cancelled, Claimed: claimed})
+	}
+}
+
+// sessionStatus tells a client whether a session it runs was cancelled.
+//
+// @Summary      Keygen session status
+// @Description  Returns whether session_id is claimed or cancelled. Only the members of the pair the session is bound to may read it. Clients poll it for the sessions they run, with an API key with the mailbox scope, and stop the runs of a cancelled one.
+// @Tags         session
+// @Accept       json
+// @Produce      json
+// @Param        body  body      SessionRequest  true  "Session ID"
+// @Success      200   {object}  SessionStatusResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Security     BearerAuth
+// @Router       /v1/session/status [post]
+func (s *Server) sessionStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, addr, ok := decodeSession(w, r)
+		if !ok {
 			return
 		}
-		var req SessionRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		status, owner, err := s.sessions.Status(r.Context(), req.SessionID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
 			return
 		}
-		if req.SessionID == "" {
-			respondError(w, http.StatusBadRequest, errors.New("session_id is required"))
+		if status != "" && (!owner.Has(addr) || !auth.PairAllowed(r.Context(), owner.Pair)) {
+			respondError(w, http.StatusForbidden, fmt.Errorf("you are not part of this session"))
 			return
 		}
-		respondOk(w, map[string]bool{"ok": s.sessions.cancel(req.SessionID)})
+		respondOk(w, SessionStatusResponse{Status: status})
 	}
 }
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/valli0x/signature-escrow/auth"
+	"github.com/valli0x/signature-escrow/validation"
+)
+
+const sharedPrefix = "shared/"
+
+// SharedAccount is a 2-of-2 MPC ECDSA account of an accepted pair. Once
+// registered, an MPC signature by the shared key logs in as its address.
+type SharedAccount struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"public_key"`
+	PairID    string `json:"pair_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type SharedRegisterRequest struct {
+	PairID string `json:"pair_id"`
+	// PublicKey is the compressed secp256k1 shared key, hex.
+	PublicKey string `json:"public_key"`
+	// Signature is the CMP-native signature ([33B R][32B S], hex) of
+	// SharedAccountMessage, proving the pair controls the key.
+	Signature string `json:"signature"`
+}
+
+// SharedAccountMessage is the text a pair signs with its shared key to
+// register it. It is hashed as an EIP-191 personal message.
+func SharedAccountMessage(address, pairID string) string {
+	return fmt.Sprintf("Register MPC shared account %s for pair %s", strings.ToLower(address), pairID)
+}
+
+func loadSharedAccount(ctx context.Context, s *Server, address string) (*SharedAccount, error) {
+	data, err := s.stor.Get(ctx, sharedPrefix+strings.ToLower(address))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	acc := &SharedAccount{}
+	if err := cbor.Unmarshal(data, acc); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// SharedPublicKey implements auth.SharedAccounts.
+func (s *Server) SharedPublicKey(ctx context.Context, address common.Address) ([]byte, error) {
+	acc, err := loadSharedAccount(ctx, s, address.Hex())
+	if err != nil || acc == nil {
+		return nil, err
+	}
+	return hex.DecodeString(acc.PublicKey)
+}
+
+// sharedRegister registers the MPC shared account of an accepted pair.
+//
+// @Summary      Register an MPC shared account
+// @Description  Registers the 2-of-2 ECDSA key of an accepted pair. The request carries a CMP signature by the shared key over SharedAccountMessage(address, pair_id). Afterwards an MPC signature of a login message authenticates as the shared address.
+// @Tags         pair
+// @Accept       json
+// @Produce      json
+// @Param        body  body      SharedRegisterRequest  true  "Shared key and proof"
+// @Success      200   {object}  SharedAccount
+// @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      409   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Security     BearerAuth
+// @Router       /v1/pair/shared [post]
+func (s *Server) sharedRegister() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SharedRegisterRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.PairID == "" || req.PublicKey == "" || req.Signature == "" {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("pair_id, public_key and signature are required"))
+			return
+		}
+
+		myAddr := auth.AddressFromContext(r.Context())
+		pair, err := loadPair(s.stor, req.PairID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if pair == nil {
+			respondError(w, http.StatusNotFound, fmt.Errorf("pair not found"))
+			return
+		}
+		if !strings.EqualFold(pair.Initiator, myAddr) && !strings.EqualFold(pair.Partner, myAddr) {
+			respondError(w, http.StatusForbidden, fmt.Errorf("you are not part of this pair"))
+			return
+		}
+		if pair.Status != PairStatusAccepted {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("pair is not accepted"))
+			return
+		}
+
+		pub, err := hex.DecodeString(strings.TrimPrefix(req.PublicKey, "0x"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid public key"))
+			return
+		}
+		ecPub, err := crypto.DecompressPubkey(pub)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid public key: %w", err))
+			return
+		}
+		address := crypto.PubkeyToAddress(*ecPub).Hex()
+
+		sig, err := hex.DecodeString(strings.TrimPrefix(req.Signature, "0x"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid signature"))
+			return
+		}
+		hash := accounts.TextHash([]byte(SharedAccountMessage(address, pair.ID)))
+		if ok, err := validation.Validate(validation.ECDSA, pub, hash, sig); err != nil || !ok {
+			respondError(w, http.StatusUnauthorized, fmt.Errorf("signature verification failed"))
+			return
+		}
+
+		existing, err := loadSharedAccount(r.Context(), s, address)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+		if existing != nil {
+			if existing.PairID != pair.ID {
+				respondError(w, http.StatusConflict, fmt.Errorf("shared account is registered to another pair"))
+				return
+			}
+			respondOk(w, existing)
+			return
+		}
+
+		acc := &SharedAccount{
+			Address:   address,
+			PublicKey: hex.EncodeToString(pub),
+			PairID:    pair.ID,
+			CreatedAt: time.Now().Unix(),
+		}
+		data, err := cbor.Marshal(acc)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("marshal error"))
+			return
+		}
+		if err := s.stor.Put(r.Context(), sharedPrefix+strings.ToLower(address), data); err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("storage error"))
+			return
+		}
+
+		s.logger.Info("shared account registered", "address", address, "pair", pair.ID, "by", myAddr)
+		respondOk(w, acc)
+	}
+}
@@ -47,6 +47,9 @@ func (s *Server) authorizeTimeboxAccess(r *http.Request, pairID string) (*Pair,
 	if !pairContains(pair, caller) {
 		return nil, errors.New("caller is not a member of this pair")
 	}
+	if !auth.PairAllowed(r.Context(), pairID) {
+		return nil, errors.New("api key is not valid for this pair")
+	}
 	return pair, nil
 }
 
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"strings"
+)
+
+// Op is one write of a batch: a Put of Value, or a Delete.
+type Op struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// Batcher is implemented by storages that can apply several writes
+// atomically: after a crash either all of them or none are visible.
+type Batcher interface {
+	Batch(ctx context.Context, ops []Op) error
+}
+
+// Batch applies ops atomically when stor is a Batcher and one by one, in
+// order, otherwise.
+func Batch(ctx context.Context, stor Storage, ops []Op) error {
+	if b, ok := stor.(Batcher); ok {
+		return b.Batch(ctx, ops)
+	}
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = stor.Delete(ctx, op.Key)
+		} else {
+			err = stor.Put(ctx, op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy copies every key of src into dst, values verbatim, and returns how
+// many keys it copied. Encrypted values stay encrypted under the same
+// password, so pass the unwrapped storages.
+func Copy(ctx context.Context, dst, src Storage) (int, error) {
+	n := 0
+	err := Walk(ctx, src, "", func(key string) error {
+		value, err := src.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		if err := dst.Put(ctx, key, value); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Walk calls fn with every key under prefix, descending into sub-prefixes,
+// in lexical order. It stops at the first error.
+func Walk(ctx context.Context, stor Storage, prefix string, fn func(key string) error) error {
+	keys, err := stor.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") {
+			err = Walk(ctx, stor, prefix+k, fn)
+		} else {
+			err = fn(prefix + k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// BoltFileName is the database file a BoltStorage keeps in its path.
+	BoltFileName = "storage.db"
+
+	boltOpenTimeout = 5 * time.Second
+)
+
+var boltBucket = []byte("kv")
+
+// BoltStorage keeps every key in a single bbolt file. Writes are
+// transactional and Batch applies several of them atomically, so related
+// records survive a crash together. bbolt locks the file for one process:
+// replicas cannot share a BoltStorage, and Lock is process-local.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// NewBoltStorage opens (or creates) path/storage.db. The logger is accepted
+// for symmetry with NewFileStorage.
+func NewBoltStorage(config map[string]string, _ *slog.Logger) (*BoltStorage, error) {
+	dir := config["path"]
+	if dir == "" {
+		return nil, fmt.Errorf("'path' must be set")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, BoltFileName), 0o600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", BoltFileName, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+func (b *BoltStorage) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltStorage) Put(ctx context.Context, key string, value []byte) error {
+	return b.Batch(ctx, []Op{{Key: key, Value: value}})
+}
+
+func (b *BoltStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var out []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltBucket).Get([]byte(key)); v != nil {
+			out = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (b *BoltStorage) Delete(ctx context.Context, key string) error {
+	return b.Batch(ctx, []Op{{Key: key, Delete: true}})
+}
+
+func (b *BoltStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	return b.ListPage(ctx, prefix, "", 0)
+}
+
+// ListPage seeks the cursor to the page, so a page costs its own length.
+func (b *BoltStorage) ListPage(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		keys = listSorted(boltCursor{tx.Bucket(boltBucket).Cursor()}, prefix, after, limit)
+		return nil
+	})
+	return keys, err
+}
+
+type boltCursor struct{ c *bolt.Cursor }
+
+func (c boltCursor) Seek(key string) (string, bool) {
+	k, _ := c.c.Seek([]byte(key))
+	return string(k), k != nil
+}
+
+func (c boltCursor) Next() (string, bool) {
+	k, _ := c.c.Next()
+	return string(k), k != nil
+}
+
+func (b *BoltStorage) Batch(ctx context.Context, ops []Op) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, op := range ops {
+			var err error
+			if op.Delete {
+				err = bucket.Delete([]byte(op.Key))
+			} else {
+				err = bucket.Put([]byte(op.Key), op.Value)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", op.Key, err)
+			}
+		}
+		return nil
+	})
+}
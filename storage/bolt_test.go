@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func newTestBolt(t *testing.T) *BoltStorage {
+	t.Helper()
+	b, err := NewBoltStorage(map[string]string{"path": t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestBoltStorage(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+
+	for _, k := range []string{"p/c", "p/a", "p/d/x", "p/d/y", "p/d-e", "p/b", "q"} {
+		if err := b.Put(ctx, k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := b.Get(ctx, "p/d/x"); err != nil || string(v) != "p/d/x" {
+		t.Fatalf("Get: %q, %v", v, err)
+	}
+	if v, err := b.Get(ctx, "missing"); err != nil || v != nil {
+		t.Fatalf("Get missing: %q, %v", v, err)
+	}
+
+	keys, err := b.List(ctx, "p/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c", "d-e", "d/"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("List: %v, want %v", keys, want)
+	}
+	if keys, _ := b.List(ctx, ""); !reflect.DeepEqual(keys, []string{"p/", "q"}) {
+		t.Fatalf("List root: %v", keys)
+	}
+
+	if err := b.Delete(ctx, "p/d/x"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := b.List(ctx, "p/d/"); !reflect.DeepEqual(keys, []string{"y"}) {
+		t.Fatalf("List after delete: %v", keys)
+	}
+}
+
+func TestBoltBatchIsAtomic(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+
+	if err := Batch(ctx, b, []Op{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("2")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty key fails inside the transaction, so the delete before it
+	// must be rolled back.
+	err := Batch(ctx, b, []Op{
+		{Key: "a", Delete: true},
+		{Key: "", Value: []byte("x")},
+	})
+	if err == nil {
+		t.Fatal("batch with an empty key succeeded")
+	}
+	if v, _ := b.Get(ctx, "a"); string(v) != "1" {
+		t.Fatalf("partial batch applied: a=%q", v)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := Batch(canceled, b, []Op{{Key: "c", Value: []byte("3")}}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled batch: %v", err)
+	}
+}
+
+func TestCopyFileToBolt(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	fs, err := NewFileStorage(map[string]string{"path": t.TempDir()}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _ := NewEncryptedStorage(fs, "pass")
+
+	ctx := context.Background()
+	want := map[string][]byte{
+		"pair/x":                []byte("pair"),
+		"pair/by-addr/0xabc/x":  {},
+		"accounts/eth/alice":    []byte("alice"),
+		"accounts/eth/bob/meta": []byte("bob"),
+	}
+	for k, v := range want {
+		if err := src.Put(ctx, k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := newTestBolt(t)
+	n, err := Copy(ctx, b, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < len(want) {
+		t.Fatalf("copied %d keys, want at least %d", n, len(want))
+	}
+
+	// The copy is still encrypted under the same password.
+	dst, err := NewEncryptedStorage(b, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range want {
+		got, err := dst.Get(ctx, k)
+		if err != nil || !bytes.Equal(got, v) {
+			t.Errorf("%s: %q, %v", k, got, err)
+		}
+	}
+	if raw, _ := b.Get(ctx, "accounts/eth/alice"); bytes.Equal(raw, []byte("alice")) {
+		t.Error("value stored in plaintext")
+	}
+
+	// Batches through EncryptedStorage reach bolt in one transaction.
+	if err := Batch(ctx, dst, []Op{
+		IndexAddOp("pair/by-addr/0xabc", "y"),
+		{Key: "pair/x", Delete: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := IndexList(ctx, dst, "pair/by-addr/0xabc"); !reflect.DeepEqual(ids, []string{"x", "y"}) {
+		t.Fatalf("index: %v", ids)
+	}
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInjected is the error a Fault returns when it sets none of its own.
+var ErrInjected = errors.New("storage: injected fault")
+
+// FaultOp selects the operations a Fault applies to.
+type FaultOp uint8
+
+const (
+	FaultGet FaultOp = 1 << iota
+	FaultPut
+	FaultDelete
+	FaultList
+
+	FaultWrite = FaultPut | FaultDelete
+	FaultAll   = FaultGet | FaultWrite | FaultList
+)
+
+// Fault describes a misbehaviour of the keys under Prefix. Writes of a batch
+// are checked one by one.
+type Fault struct {
+	Prefix string
+	// Ops are the operations affected; zero means FaultAll.
+	Ops FaultOp
+	// Latency delays every affected call, failing or not.
+	Latency time.Duration
+	// Fail makes affected calls return Err, or ErrInjected if Err is nil.
+	Fail bool
+	Err  error
+	// Probability is the chance that an affected call fails; zero means
+	// every call.
+	Probability float64
+	// Count stops the fault after failing that many calls; zero means no
+	// limit.
+	Count int
+	// Partial makes a failing write apply the writes of its batch before
+	// it, and a failing Put store the first half of its value, like a
+	// backend that crashed mid-write.
+	Partial bool
+}
+
+type activeFault struct {
+	Fault
+	failed int
+}
+
+// FaultyStorage wraps a Storage and injects the faults registered with
+// Inject, so tests can reach the error paths of code built on storage.
+type FaultyStorage struct {
+	inner Storage
+
+	mu     sync.Mutex
+	faults []*activeFault
+}
+
+func NewFaultyStorage(inner Storage) *FaultyStorage {
+	return &FaultyStorage{inner: inner}
+}
+
+// Inject adds a fault and returns a function that removes it.
+func (f *FaultyStorage) Inject(fault Fault) (remove func()) {
+	if fault.Ops == 0 {
+		fault.Ops = FaultAll
+	}
+	af := &activeFault{Fault: fault}
+	f.mu.Lock()
+	f.faults = append(f.faults, af)
+	f.mu.Unlock()
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, x := range f.faults {
+			if x == af {
+				f.faults = append(f.faults[:i], f.faults[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Clear removes every fault.
+func (f *FaultyStorage) Clear() {
+	f.mu.Lock()
+	f.faults = nil
+	f.mu.Unlock()
+}
+
+// check returns the delay and the outcome of an op on key.
+func (f *FaultyStorage) check(op FaultOp, key string) (time.Duration, *Fault, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var delay time.Duration
+	for _, af := range f.faults {
+		if af.Ops&op == 0 || !strings.HasPrefix(key, af.Prefix) {
+			continue
+		}
+		delay += af.Latency
+		if !af.Fail || (af.Count > 0 && af.failed >= af.Count) {
+			continue
+		}
+		if af.Probability > 0 && rand.Float64() >= af.Probability {
+			continue
+		}
+		af.failed++
+		err := af.Err
+		if err == nil {
+			err = ErrInjected
+		}
+		fault := af.Fault
+		return delay, &fault, err
+	}
+	return delay, nil, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *FaultyStorage) Put(ctx context.Context, key string, value []byte) error {
+	return f.Batch(ctx, []Op{{Key: key, Value: value}})
+}
+
+func (f *FaultyStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	delay, _, err := f.check(FaultGet, key)
+	if err := sleep(ctx, delay); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.inner.Get(ctx, key)
+}
+
+func (f *FaultyStorage) Delete(ctx context.Context, key string) error {
+	return f.Batch(ctx, []Op{{Key: key, Delete: true}})
+}
+
+func (f *FaultyStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	delay, _, err := f.check(FaultList, prefix)
+	if err := sleep(ctx, delay); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.inner.List(ctx, prefix)
+}
+
+func (f *FaultyStorage) ListPage(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	delay, _, err := f.check(FaultList, prefix)
+	if err := sleep(ctx, delay); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ListPage(ctx, f.inner, prefix, after, limit)
+}
+
+// Batch is atomic when the wrapped storage is, unless a Partial fault
+// fires.
+func (f *FaultyStorage) Batch(ctx context.Context, ops []Op) error {
+	var delay time.Duration
+	for i, op := range ops {
+		kind := FaultPut
+		if op.Delete {
+			kind = FaultDelete
+		}
+		d, fault, err := f.check(kind, op.Key)
+		delay += d
+		if err == nil {
+			continue
+		}
+		if serr := sleep(ctx, delay); serr != nil {
+			return serr
+		}
+		if fault.Partial {
+			done := ops[:i:i]
+			if !op.Delete {
+				done = append(done, Op{Key: op.Key, Value: op.Value[:len(op.Value)/2]})
+			}
+			if perr := Batch(ctx, f.inner, done); perr != nil {
+				return perr
+			}
+		}
+		return err
+	}
+	if err := sleep(ctx, delay); err != nil {
+		return err
+	}
+	return Batch(ctx, f.inner, ops)
+}
+
+func (f *FaultyStorage) Lock(ctx context.Context, key string) (func(), error) {
+	return Lock(ctx, f.inner, key)
+}
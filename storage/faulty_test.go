@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFaultyStorage(t *testing.T) {
+	inner := NewMemoryStorage()
+	f := NewFaultyStorage(inner)
+	ctx := context.Background()
+
+	boom := errors.New("boom")
+	remove := f.Inject(Fault{Prefix: "a/", Ops: FaultPut, Fail: true, Err: boom})
+	if err := f.Put(ctx, "a/x", []byte("x")); !errors.Is(err, boom) {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := f.Put(ctx, "b/x", []byte("x")); err != nil {
+		t.Fatalf("Put outside the prefix: %v", err)
+	}
+	if _, err := f.Get(ctx, "a/x"); err != nil {
+		t.Fatalf("Get is not affected: %v", err)
+	}
+	// A failing write fails the whole batch.
+	if err := Batch(ctx, f, []Op{{Key: "b/y", Value: []byte("y")}, {Key: "a/y", Value: []byte("y")}}); err == nil {
+		t.Fatal("batch with a failing write succeeded")
+	}
+	if v, _ := inner.Get(ctx, "b/y"); v != nil {
+		t.Fatal("write before the failing one applied")
+	}
+	remove()
+	if err := f.Put(ctx, "a/x", []byte("x")); err != nil {
+		t.Fatalf("Put after remove: %v", err)
+	}
+
+	// Partial writes.
+	f.Inject(Fault{Prefix: "p/", Ops: FaultWrite, Fail: true, Partial: true, Count: 1})
+	if err := Batch(ctx, f, []Op{{Key: "b/z", Value: []byte("z")}, {Key: "p/x", Value: []byte("abcd")}, {Key: "b/w", Value: []byte("w")}}); !errors.Is(err, ErrInjected) {
+		t.Fatalf("partial batch: %v", err)
+	}
+	if v, _ := inner.Get(ctx, "b/z"); string(v) != "z" {
+		t.Fatal("write before the failing one not applied")
+	}
+	if v, _ := inner.Get(ctx, "p/x"); string(v) != "ab" {
+		t.Fatalf("torn write: %q", v)
+	}
+	if v, _ := inner.Get(ctx, "b/w"); v != nil {
+		t.Fatal("write after the failing one applied")
+	}
+	if err := f.Put(ctx, "p/x", []byte("abcd")); err != nil {
+		t.Fatalf("Put after Count failures: %v", err)
+	}
+
+	f.Clear()
+	f.Inject(Fault{Prefix: "slow/", Latency: 50 * time.Millisecond})
+	start := time.Now()
+	if _, err := f.Get(ctx, "slow/x"); err != nil || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("latency: %v after %v", err, time.Since(start))
+	}
+	short, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	if _, err := f.List(short, "slow/"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("latency past the deadline: %v", err)
+	}
+
+	f.Clear()
+	f.Inject(Fault{Fail: true, Probability: 0.5})
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if _, err := f.Get(ctx, "k"); err != nil {
+			failed++
+		}
+	}
+	if failed == 0 || failed == 200 {
+		t.Fatalf("probability 0.5 failed %d of 200 calls", failed)
+	}
+}
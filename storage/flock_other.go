@@ -0,0 +1,11 @@
+//go:build !unix
+
+package storage
+
+import "context"
+
+// Lock falls back to a process-local lock where flock(2) is unavailable;
+// such a storage must not be shared by several processes.
+func (f *FileStorage) Lock(ctx context.Context, key string) (func(), error) {
+	return localLocks.Lock(ctx, key)
+}
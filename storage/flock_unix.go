@@ -0,0 +1,69 @@
+//go:build unix
+
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Lock takes an exclusive flock(2) on a per-key lock file under the storage
+// path. The kernel drops it if the process dies, so there are no stale locks.
+// The holder removes the file as it unlocks, so lock files do not pile up;
+// a waiter that then gets the lock on the removed file starts over.
+func (f *FileStorage) Lock(ctx context.Context, key string) (func(), error) {
+	dir := filepath.Join(f.path, lockDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, lockName(key))
+
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		if err := flock(ctx, file); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if current(file, path) {
+			return func() {
+				_ = os.Remove(path)
+				_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+				file.Close()
+			}, nil
+		}
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}
+}
+
+// flock waits for the exclusive lock on file, or for ctx.
+func flock(ctx context.Context, file *os.File) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// current reports whether file is still the one at path, not one the
+// previous holder removed.
+func current(file *os.File, path string) bool {
+	held, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	named, err := os.Stat(path)
+	return err == nil && os.SameFile(held, named)
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Pager is implemented by storages that keep their keys in order and can
+// list one page without walking the whole prefix.
+type Pager interface {
+	ListPage(ctx context.Context, prefix, after string, limit int) ([]string, error)
+}
+
+// ListPage returns at most limit keys under prefix that sort after after, so
+// a large prefix can be walked with after set to the last key of the previous
+// page. A limit of zero or less returns the rest. Storages that are not
+// Pagers list the whole prefix for every page.
+func ListPage(ctx context.Context, stor Storage, prefix, after string, limit int) ([]string, error) {
+	if p, ok := stor.(Pager); ok {
+		return p.ListPage(ctx, prefix, after, limit)
+	}
+	keys, err := stor.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if after != "" {
+		keys = keys[sort.Search(len(keys), func(i int) bool { return keys[i] > after }):]
+	}
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+// cursor walks the keys of an ordered storage.
+type cursor interface {
+	// Seek moves to the first key at or after key; ok is false past the end.
+	Seek(key string) (k string, ok bool)
+	Next() (k string, ok bool)
+}
+
+// listSorted lists the keys under prefix after after, at most limit, the
+// way List does, seeking past each sub-prefix instead of walking it.
+func listSorted(c cursor, prefix, after string, limit int) []string {
+	var keys []string
+	k, ok := c.Seek(prefix + after)
+	for ok && strings.HasPrefix(k, prefix) && (limit <= 0 || len(keys) < limit) {
+		rest := k[len(prefix):]
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			if sub := rest[:i+1]; sub > after {
+				keys = append(keys, sub)
+			}
+			k, ok = c.Seek(prefix + rest[:i] + "0") // '0' follows '/'
+			continue
+		}
+		if rest > after {
+			keys = append(keys, rest)
+		}
+		k, ok = c.Next()
+	}
+	return keys
+}
+
+// An index is a set of IDs kept as marker keys under "<key>/<id>", so adding
+// or removing one ID is a single write and two writers never clobber each
+// other. Older versions stored the set as one CBOR []string blob at <key>;
+// such a blob is converted to markers on first access.
+
+// IndexAdd adds id to the index at key.
+func IndexAdd(ctx context.Context, stor Storage, key, id string) error {
+	if err := MigrateIndex(ctx, stor, key); err != nil {
+		return err
+	}
+	return stor.Put(ctx, key+"/"+id, []byte{})
+}
+
+// IndexRemove removes id from the index at key.
+func IndexRemove(ctx context.Context, stor Storage, key, id string) error {
+	if err := MigrateIndex(ctx, stor, key); err != nil {
+		return err
+	}
+	return stor.Delete(ctx, key+"/"+id)
+}
+
+// IndexAddOp and IndexRemoveOp are IndexAdd and IndexRemove as batch
+// operations. They do not convert a legacy blob, which is harmless for an
+// add (the blob is merged on the next read) but would resurrect a removed
+// ID: call MigrateIndex before batching an IndexRemoveOp.
+func IndexAddOp(key, id string) Op {
+	return Op{Key: key + "/" + id, Value: []byte{}}
+}
+
+func IndexRemoveOp(key, id string) Op {
+	return Op{Key: key + "/" + id, Delete: true}
+}
+
+// IndexList returns the IDs in the index at key, in lexical order.
+func IndexList(ctx context.Context, stor Storage, key string) ([]string, error) {
+	if err := MigrateIndex(ctx, stor, key); err != nil {
+		return nil, err
+	}
+	keys, err := stor.List(ctx, key+"/")
+	if err != nil {
+		return nil, err
+	}
+	ids := keys[:0]
+	for _, k := range keys {
+		if !strings.HasSuffix(k, "/") {
+			ids = append(ids, k)
+		}
+	}
+	return ids, nil
+}
+
+// MigrateIndex converts a legacy index blob at key to marker keys.
+func MigrateIndex(ctx context.Context, stor Storage, key string) error {
+	data, err := stor.Get(ctx, key)
+	if err != nil || data == nil {
+		return err
+	}
+
+	unlock, err := Lock(ctx, stor, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Another writer may have converted it while we waited.
+	if data, err = stor.Get(ctx, key); err != nil || data == nil {
+		return err
+	}
+	var ids []string
+	if err := cbor.Unmarshal(data, &ids); err != nil {
+		return err
+	}
+	ops := make([]Op, 0, len(ids)+1)
+	for _, id := range ids {
+		ops = append(ops, IndexAddOp(key, id))
+	}
+	return Batch(ctx, stor, append(ops, Op{Key: key, Delete: true}))
+}
+
+// MigrateIndexes converts every legacy index blob directly under prefix.
+func MigrateIndexes(ctx context.Context, stor Storage, prefix string) error {
+	keys, err := stor.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+		if err := MigrateIndex(ctx, stor, prefix+k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
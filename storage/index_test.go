@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestListPage(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	fs, err := NewFileStorage(map[string]string{"path": t.TempDir()}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := NewBoltStorage(map[string]string{"path": t.TempDir()}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	encrypted, _ := NewEncryptedStorage(NewMemoryStorage(), "pass")
+
+	for name, stor := range map[string]Storage{
+		"file": fs, "memory": NewMemoryStorage(), "bolt": bs, "encrypted": encrypted,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, k := range []string{"p/c", "p/a", "p/e", "p/d/x", "p/d/y", "p/b", "q/a"} {
+				if err := stor.Put(ctx, k, []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			all, err := stor.List(ctx, "p/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a", "b", "c", "d/", "e"}; !reflect.DeepEqual(all, want) {
+				t.Fatalf("List: %v, want %v", all, want)
+			}
+
+			var pages [][]string
+			after := ""
+			for {
+				page, err := ListPage(ctx, stor, "p/", after, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page) == 0 {
+					break
+				}
+				pages = append(pages, page)
+				after = page[len(page)-1]
+			}
+			if want := [][]string{{"a", "b"}, {"c", "d/"}, {"e"}}; !reflect.DeepEqual(pages, want) {
+				t.Fatalf("pages: %v, want %v", pages, want)
+			}
+
+			// The keyring of an encrypted storage stays hidden in pages of
+			// the root.
+			if root, _ := ListPage(ctx, stor, "", "", 1); !reflect.DeepEqual(root, []string{"p/"}) {
+				t.Fatalf("root page: %v", root)
+			}
+		})
+	}
+}
+
+func TestIndexMigratesLegacyBlob(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	stor, err := NewFileStorage(map[string]string{"path": t.TempDir()}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	legacy, _ := cbor.Marshal([]string{"b", "a"})
+	if err := stor.Put(ctx, "pair/by-addr/0xabc", legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := IndexAdd(ctx, stor, "pair/by-addr/0xabc", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := IndexRemove(ctx, stor, "pair/by-addr/0xabc", "b"); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := IndexList(ctx, stor, "pair/by-addr/0xabc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "c"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("index: %v, want %v", ids, want)
+	}
+	if data, _ := stor.Get(ctx, "pair/by-addr/0xabc"); data != nil {
+		t.Fatal("legacy blob not removed")
+	}
+
+	// Removing the last ID leaves nothing behind.
+	for _, id := range ids {
+		_ = IndexRemove(ctx, stor, "pair/by-addr/0xabc", id)
+	}
+	if keys, _ := stor.List(ctx, "pair/by-addr/"); len(keys) != 0 {
+		t.Fatalf("empty index still listed: %v", keys)
+	}
+}
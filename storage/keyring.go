@@ -0,0 +1,473 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/argon2"
+)
+
+// EncryptedStorage seals values with random data keys. The data keys live in
+// a keyring record, each one sealed with a key-encryption key derived from the
+// password by Argon2id with a random salt, and every value names the data key
+// ("term") it was sealed with. Changing the password rewraps the keyring;
+// Rekey also starts a new data key and moves every value onto it while the
+// storage stays in use.
+
+// KeyringKey is where an EncryptedStorage keeps its keyring in the backend.
+// The record is not encrypted and is hidden from List.
+const KeyringKey = "_keyring"
+
+const (
+	keyringVersion = 1
+	kdfArgon2id    = "argon2id"
+
+	// legacyTerm is the unsalted sha256(pass) key of data written before the
+	// keyring existed. Such values carry no header.
+	legacyTerm uint32 = 0
+
+	dataKeySize = 32
+	saltSize    = 16
+)
+
+var (
+	// ErrWrongPassword is returned when the password does not open the
+	// keyring.
+	ErrWrongPassword = errors.New("storage: wrong password")
+	// ErrRekeyed is returned when another process changed the password and
+	// this one can no longer read the keyring.
+	ErrRekeyed = errors.New("storage: keyring was rekeyed, restart with the new password")
+)
+
+// KDFParams are the Argon2id costs recorded with the salt in the keyring.
+type KDFParams struct {
+	Alg     string `cbor:"alg"`
+	Salt    []byte `cbor:"salt"`
+	Time    uint32 `cbor:"time"`
+	Memory  uint32 `cbor:"memory"` // KiB
+	Threads uint8  `cbor:"threads"`
+	// A key split into unseal keys (Alg "shamir") records how many were
+	// made and needed, and a hash of each so a wrong one is refused before
+	// the threshold is reached.
+	Shares    uint8    `cbor:"shares,omitempty"`
+	Threshold uint8    `cbor:"threshold,omitempty"`
+	Checks    [][]byte `cbor:"checks,omitempty"`
+}
+
+// defaultKDF follows the second recommended option of RFC 9106.
+var defaultKDF = KDFParams{Alg: kdfArgon2id, Time: 3, Memory: 64 * 1024, Threads: 4}
+
+type keyring struct {
+	Version int    `cbor:"version"`
+	Active  uint32 `cbor:"active"`
+	Current wrap   `cbor:"current"`
+	// Previous wraps the same data keys under the password in use before the
+	// last Rekey, so processes still running with it can load the new data
+	// key. It is dropped once every value has been re-encrypted.
+	Previous *wrap `cbor:"previous,omitempty"`
+	// Migrated is set by Reencrypt once every value is sealed in the current
+	// format. From then on legacy and version 1 values, which carry no
+	// associated data, no longer open.
+	Migrated bool `cbor:"migrated,omitempty"`
+}
+
+type wrap struct {
+	KDF  KDFParams         `cbor:"kdf"`
+	Keys map[uint32][]byte `cbor:"keys"` // term -> data key sealed with the KEK
+}
+
+// kek is a key-encryption key and the salt it was derived with, which tells
+// which wrap of a keyring it opens.
+type kek struct {
+	aead cipher.AEAD
+	salt []byte
+}
+
+// Upper bounds on KDFParams read from outside, so a crafted record cannot
+// make a process spend unbounded memory or time.
+const (
+	maxKDFTime   = 16
+	maxKDFMemory = 1024 * 1024 // 1 GiB
+)
+
+// NewKDFParams returns the default Argon2id costs with a fresh salt.
+func NewKDFParams() (KDFParams, error) {
+	params := defaultKDF
+	params.Salt = make([]byte, saltSize)
+	_, err := io.ReadFull(rand.Reader, params.Salt)
+	return params, err
+}
+
+// Key derives a 256-bit key from pass.
+func (p KDFParams) Key(pass string) ([]byte, error) {
+	if p.Alg == kdfShamir {
+		return nil, ErrSealed
+	}
+	if p.Alg != kdfArgon2id {
+		return nil, fmt.Errorf("storage: unknown kdf %q", p.Alg)
+	}
+	if p.Time == 0 || p.Time > maxKDFTime || p.Memory == 0 || p.Memory > maxKDFMemory || p.Threads == 0 || len(p.Salt) == 0 {
+		return nil, fmt.Errorf("storage: kdf parameters out of range")
+	}
+	return argon2.IDKey([]byte(pass), p.Salt, p.Time, p.Memory, p.Threads, dataKeySize), nil
+}
+
+func deriveKEK(pass string, params KDFParams) (*kek, error) {
+	key, err := params.Key(pass)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &kek{aead: aead, salt: params.Salt}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func termAD(term uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte("storage-data-key/"), term)
+}
+
+func (k *kek) wrapKeys(params KDFParams, keys map[uint32][]byte) (wrap, error) {
+	w := wrap{KDF: params, Keys: make(map[uint32][]byte, len(keys))}
+	for term, key := range keys {
+		nonce := make([]byte, k.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return wrap{}, err
+		}
+		w.Keys[term] = k.aead.Seal(nonce, nonce, key, termAD(term))
+	}
+	return w, nil
+}
+
+func (k *kek) unwrapKeys(w wrap) (map[uint32][]byte, error) {
+	keys := make(map[uint32][]byte, len(w.Keys))
+	ns := k.aead.NonceSize()
+	for term, sealed := range w.Keys {
+		if len(sealed) < ns {
+			return nil, ErrWrongPassword
+		}
+		key, err := k.aead.Open(nil, sealed[:ns], sealed[ns:], termAD(term))
+		if err != nil {
+			return nil, ErrWrongPassword
+		}
+		keys[term] = key
+	}
+	return keys, nil
+}
+
+// unwrap opens whichever wrap of kr was made with k.
+func (k *kek) unwrap(kr *keyring) (map[uint32][]byte, error) {
+	if bytes.Equal(kr.Current.KDF.Salt, k.salt) {
+		return k.unwrapKeys(kr.Current)
+	}
+	if kr.Previous != nil && bytes.Equal(kr.Previous.KDF.Salt, k.salt) {
+		return k.unwrapKeys(*kr.Previous)
+	}
+	return nil, ErrRekeyed
+}
+
+func loadKeyring(ctx context.Context, backend Storage) (*keyring, error) {
+	data, err := backend.Get(ctx, KeyringKey)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	kr := &keyring{}
+	if err := cbor.Unmarshal(data, kr); err != nil {
+		return nil, fmt.Errorf("storage: keyring: %w", err)
+	}
+	if kr.Version != keyringVersion {
+		return nil, fmt.Errorf("storage: keyring version %d not supported", kr.Version)
+	}
+	return kr, nil
+}
+
+func storeKeyring(ctx context.Context, backend Storage, kr *keyring) error {
+	data, err := cbor.Marshal(kr)
+	if err != nil {
+		return err
+	}
+	return backend.Put(ctx, KeyringKey, data)
+}
+
+// openKeyring loads the keyring with pass, creating it on first use. When the
+// backend already holds values from before the keyring, the legacy key is
+// checked against one of them and kept as term 0.
+func openKeyring(ctx context.Context, backend Storage, pass string) (*kek, *keyring, map[uint32][]byte, error) {
+	kr, err := loadKeyring(ctx, backend)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if kr == nil {
+		unlock, err := Lock(ctx, backend, KeyringKey)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer unlock()
+		if kr, err = loadKeyring(ctx, backend); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if kr != nil {
+		// During a Rekey the old password still opens Previous.
+		wraps := []wrap{kr.Current}
+		if kr.Previous != nil {
+			wraps = append(wraps, *kr.Previous)
+		}
+		for _, w := range wraps {
+			k, err := deriveKEK(pass, w.KDF)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if keys, err := k.unwrapKeys(w); err == nil {
+				return k, kr, keys, nil
+			}
+		}
+		return nil, nil, nil, ErrWrongPassword
+	}
+
+	keys := map[uint32][]byte{1: randomKey()}
+	legacy, err := legacyKey(ctx, backend, pass)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if legacy != nil {
+		keys[legacyTerm] = legacy
+	}
+	params, err := NewKDFParams()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	k, err := deriveKEK(pass, params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	w, err := k.wrapKeys(params, keys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	kr = &keyring{Version: keyringVersion, Active: 1, Current: w}
+	if err := storeKeyring(ctx, backend, kr); err != nil {
+		return nil, nil, nil, err
+	}
+	return k, kr, keys, nil
+}
+
+// legacyKey returns sha256(pass) if the backend holds values, after checking
+// that it opens the first of them, or nil for an empty backend.
+func legacyKey(ctx context.Context, backend Storage, pass string) ([]byte, error) {
+	var sample []byte
+	errFound := errors.New("found")
+	err := Walk(ctx, backend, "", func(key string) error {
+		value, err := backend.Get(ctx, key)
+		if err != nil || len(value) == 0 {
+			return err
+		}
+		sample = value
+		return errFound
+	})
+	if err != nil && err != errFound {
+		return nil, err
+	}
+	if sample == nil {
+		return nil, nil
+	}
+	key := sha256.Sum256([]byte(pass))
+	aead, err := newAEAD(key[:])
+	if err != nil {
+		return nil, err
+	}
+	ns := aead.NonceSize()
+	if len(sample) < ns {
+		return nil, ErrWrongPassword
+	}
+	if _, err := aead.Open(nil, sample[:ns], sample[ns:], nil); err != nil {
+		return nil, ErrWrongPassword
+	}
+	return key[:], nil
+}
+
+func randomKey() []byte {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Rekey switches the storage to newPass and a fresh data key, then
+// re-encrypts every value (see Reencrypt) and returns how many it rewrote.
+// Reads and writes keep working meanwhile, including in other processes
+// still running with the old password; restart those with newPass once it
+// returns. If Rekey is interrupted, open the storage with newPass and call
+// Reencrypt to finish.
+func (e *EncryptedStorage) Rekey(ctx context.Context, newPass string) (int, error) {
+	if err := e.rotate(ctx, newPass); err != nil {
+		return 0, err
+	}
+	return e.Reencrypt(ctx)
+}
+
+// rotate wraps the keyring under newPass, keeping the old password's wrap as
+// Previous, and makes a fresh data key active.
+func (e *EncryptedStorage) rotate(ctx context.Context, newPass string) error {
+	params, err := NewKDFParams()
+	if err != nil {
+		return err
+	}
+	newKEK, err := deriveKEK(newPass, params)
+	if err != nil {
+		return err
+	}
+	return e.rotateTo(ctx, newKEK, params)
+}
+
+// rotateTo is rotate for a KEK that is already derived.
+func (e *EncryptedStorage) rotateTo(ctx context.Context, newKEK *kek, params KDFParams) error {
+	if err := e.updateKeyring(ctx, func(kr *keyring, keys map[uint32][]byte) error {
+		if !bytes.Equal(kr.Current.KDF.Salt, e.kek.salt) {
+			return ErrRekeyed
+		}
+		term := kr.Active + 1
+		for t := range keys {
+			if t >= term {
+				term = t + 1
+			}
+		}
+		keys[term] = randomKey()
+
+		current, err := newKEK.wrapKeys(params, keys)
+		if err != nil {
+			return err
+		}
+		previous, err := e.kek.wrapKeys(kr.Current.KDF, keys)
+		if err != nil {
+			return err
+		}
+		kr.Active, kr.Current, kr.Previous = term, current, &previous
+		return nil
+	}); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.kek = newKEK
+	e.mu.Unlock()
+	return nil
+}
+
+// Reencrypt rewrites every value not sealed with the active data key, then
+// drops the other data keys, the legacy key among them, and the old
+// password's wrap from the keyring, and marks it migrated so values without
+// associated data are refused from then on. It returns how many values it
+// rewrote. Values a process still on the old
+// password writes after this point cannot be read.
+func (e *EncryptedStorage) Reencrypt(ctx context.Context) (int, error) {
+	n := 0
+	err := Walk(ctx, e.backend, "", func(key string) error {
+		if key == KeyringKey {
+			return nil
+		}
+		done, err := e.reseal(ctx, key, nil)
+		if done {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, e.updateKeyring(ctx, func(kr *keyring, keys map[uint32][]byte) error {
+		for term := range keys {
+			if term != kr.Active {
+				delete(keys, term)
+				delete(kr.Current.Keys, term)
+			}
+		}
+		kr.Previous = nil
+		kr.Migrated = true
+		return nil
+	})
+}
+
+// updateKeyring reloads the keyring under its lock, lets fn change it and the
+// data keys, and stores it and installs the keys.
+func (e *EncryptedStorage) updateKeyring(ctx context.Context, fn func(kr *keyring, keys map[uint32][]byte) error) error {
+	unlock, err := Lock(ctx, e.backend, KeyringKey)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	kr, err := loadKeyring(ctx, e.backend)
+	if err != nil {
+		return err
+	}
+	if kr == nil {
+		return errors.New("storage: keyring missing")
+	}
+	keys, err := e.kek.unwrap(kr)
+	if err != nil {
+		return err
+	}
+	if err := fn(kr, keys); err != nil {
+		return err
+	}
+	if err := storeKeyring(ctx, e.backend, kr); err != nil {
+		return err
+	}
+	return e.install(kr, keys)
+}
+
+// reload picks up a keyring changed by another process.
+func (e *EncryptedStorage) reload(ctx context.Context) error {
+	kr, err := loadKeyring(ctx, e.backend)
+	if err != nil || kr == nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	keys, err := e.kek.unwrap(kr)
+	if err != nil {
+		return err
+	}
+	return e.install(kr, keys)
+}
+
+// install replaces the data keys with those of kr; e.mu must be held.
+func (e *EncryptedStorage) install(kr *keyring, keys map[uint32][]byte) error {
+	active := kr.Active
+	aeads := make(map[uint32]cipher.AEAD, len(keys))
+	for term, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		aeads[term] = aead
+	}
+	if aeads[active] == nil {
+		return fmt.Errorf("storage: keyring has no active key %d", active)
+	}
+	e.active, e.keys, e.migrated = active, aeads, kr.Migrated
+	return nil
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// legacySeal encrypts value the way EncryptedStorage did before the keyring.
+func legacySeal(t *testing.T, pass string, value []byte) []byte {
+	t.Helper()
+	key := sha256.Sum256([]byte(pass))
+	block, _ := aes.NewCipher(key[:])
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	_, _ = rand.Read(nonce)
+	return gcm.Seal(nonce, nonce, value, nil)
+}
+
+func rawTerm(t *testing.T, stor Storage, key string) uint32 {
+	t.Helper()
+	raw, err := stor.Get(context.Background(), key)
+	if err != nil || len(raw) < sealedHeaderSize || raw[0] != sealedVersion {
+		t.Fatalf("%s: not a sealed value: %x, %v", key, raw, err)
+	}
+	return binary.BigEndian.Uint32(raw[1:5])
+}
+
+func TestEncryptedStorageKeyring(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+
+	enc, err := NewEncryptedStorage(b, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Put(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if term := rawTerm(t, b, "k"); term != 1 {
+		t.Fatalf("term %d", term)
+	}
+
+	kr, err := loadKeyring(ctx, b)
+	if err != nil || kr == nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	if kr.Current.KDF.Alg != kdfArgon2id || len(kr.Current.KDF.Salt) != saltSize || kr.Current.KDF.Memory == 0 {
+		t.Fatalf("kdf params: %+v", kr.Current.KDF)
+	}
+	if _, ok := kr.Current.Keys[legacyTerm]; ok {
+		t.Fatal("legacy key kept for a new store")
+	}
+	if keys, _ := enc.List(ctx, ""); len(keys) != 1 || keys[0] != "k" {
+		t.Fatalf("keyring visible in List: %v", keys)
+	}
+
+	if _, err := NewEncryptedStorage(b, "wrong"); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("wrong password: %v", err)
+	}
+	again, err := NewEncryptedStorage(b, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := again.Get(ctx, "k"); err != nil || string(v) != "v" {
+		t.Fatalf("reopen: %q, %v", v, err)
+	}
+}
+
+func TestEncryptedStorageMigratesLegacy(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+	for _, k := range []string{"a", "b/c"} {
+		if err := b.Put(ctx, k, legacySeal(t, "pass", []byte(k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewEncryptedStorage(b, "wrong"); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("wrong password over legacy data: %v", err)
+	}
+	enc, err := NewEncryptedStorage(b, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := enc.Get(ctx, "a"); err != nil || string(v) != "a" {
+		t.Fatalf("legacy read: %q, %v", v, err)
+	}
+	// The read re-encrypts the value in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		raw, _ := b.Get(ctx, "a")
+		if raw[0] == sealedVersion && binary.BigEndian.Uint32(raw[1:5]) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("legacy value not migrated on access")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	n, err := enc.Reencrypt(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("Reencrypt: %d, %v", n, err)
+	}
+	if v, err := enc.Get(ctx, "b/c"); err != nil || string(v) != "b/c" {
+		t.Fatalf("after Reencrypt: %q, %v", v, err)
+	}
+	kr, _ := loadKeyring(ctx, b)
+	if _, ok := kr.Current.Keys[legacyTerm]; ok || !kr.Migrated {
+		t.Fatal("legacy key not retired")
+	}
+
+	// Once migrated, a legacy value put in place of another no longer opens.
+	_ = b.Put(ctx, "a", legacySeal(t, "pass", []byte("b/c")))
+	if _, err := enc.Get(ctx, "a"); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("legacy value after Reencrypt: %v", err)
+	}
+}
+
+func TestEncryptedStorageRekey(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+
+	a, err := NewEncryptedStorage(b, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"x", "y/z"} {
+		if err := a.Put(ctx, k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another process on the old password.
+	other, err := NewEncryptedStorage(b, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.rotate(ctx, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Put(ctx, "w", []byte("w")); err != nil {
+		t.Fatal(err)
+	}
+	if term := rawTerm(t, b, "w"); term != 2 {
+		t.Fatalf("term after rotate: %d", term)
+	}
+	// It picks up the new data key through the old password's wrap, and the
+	// old password still opens the storage until re-encryption finishes.
+	if v, err := other.Get(ctx, "w"); err != nil || string(v) != "w" {
+		t.Fatalf("old-password reader mid-rekey: %q, %v", v, err)
+	}
+	if _, err := NewEncryptedStorage(b, "old"); err != nil {
+		t.Fatalf("old password mid-rekey: %v", err)
+	}
+
+	n, err := a.Reencrypt(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("Reencrypt: %d, %v", n, err)
+	}
+	if _, err := NewEncryptedStorage(b, "old"); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("old password after rekey: %v", err)
+	}
+	reopened, err := NewEncryptedStorage(b, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"x", "y/z", "w"} {
+		if v, err := reopened.Get(ctx, k); err != nil || string(v) != k {
+			t.Errorf("%s: %q, %v", k, v, err)
+		}
+		if term := rawTerm(t, b, k); term != 2 {
+			t.Errorf("%s: term %d", k, term)
+		}
+	}
+	kr, _ := loadKeyring(ctx, b)
+	if len(kr.Current.Keys) != 1 || kr.Previous != nil {
+		t.Fatalf("keyring not trimmed: %d keys, previous %v", len(kr.Current.Keys), kr.Previous != nil)
+	}
+}
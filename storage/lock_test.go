@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStorageLockAcrossInstances(t *testing.T) {
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	a, err := NewFileStorage(map[string]string{"path": dir}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewFileStorage(map[string]string{"path": dir}, logger)
+
+	ctx := context.Background()
+	unlock, err := Lock(ctx, a, "escrow/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second instance over the same path stands in for another replica.
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := Lock(short, b, "escrow/1"); err == nil {
+		t.Fatal("lock acquired twice")
+	}
+	other, err := Lock(ctx, b, "escrow/2")
+	if err != nil {
+		t.Fatalf("independent key blocked: %v", err)
+	}
+	other()
+
+	unlock()
+	again, err := Lock(ctx, b, "escrow/1")
+	if err != nil {
+		t.Fatalf("lock not released: %v", err)
+	}
+	again()
+
+	if keys, _ := a.List(ctx, ""); len(keys) != 0 {
+		t.Fatalf("lock files visible in List: %v", keys)
+	}
+	if files, _ := os.ReadDir(filepath.Join(dir, lockDir)); len(files) != 0 {
+		t.Fatalf("%d lock files left behind", len(files))
+	}
+}
+
+func TestLockSerializesReadModifyWrite(t *testing.T) {
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	fs, _ := NewFileStorage(map[string]string{"path": dir}, logger)
+	enc, _ := NewEncryptedStorage(fs, "pass")
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := Lock(ctx, enc, "counter")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+			v, _ := enc.Get(ctx, "counter")
+			_ = enc.Put(ctx, "counter", append(v, 'x'))
+		}()
+	}
+	wg.Wait()
+
+	v, _ := enc.Get(ctx, "counter")
+	if len(v) != 20 {
+		t.Fatalf("lost updates: %d of 20", len(v))
+	}
+	if files, _ := os.ReadDir(filepath.Join(dir, lockDir)); len(files) != 0 {
+		t.Fatalf("%d lock files left behind", len(files))
+	}
+}
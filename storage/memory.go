@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// MemoryStorage keeps every key in a map. It is safe for concurrent use and
+// Batch is atomic, but everything is lost with the process: use it for tests
+// and throwaway dev servers.
+type MemoryStorage struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+	// keys are the keys of data in order, for List and ListPage.
+	keys []string
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{data: make(map[string][]byte)}
+}
+
+func (m *MemoryStorage) Put(ctx context.Context, key string, value []byte) error {
+	return m.Batch(ctx, []Op{{Key: key, Value: value}})
+}
+
+func (m *MemoryStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.data[key]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (m *MemoryStorage) Delete(ctx context.Context, key string) error {
+	return m.Batch(ctx, []Op{{Key: key, Delete: true}})
+}
+
+func (m *MemoryStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	return m.ListPage(ctx, prefix, "", 0)
+}
+
+func (m *MemoryStorage) ListPage(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return listSorted(&memoryCursor{keys: m.keys}, prefix, after, limit), nil
+}
+
+type memoryCursor struct {
+	keys []string
+	i    int
+}
+
+func (c *memoryCursor) Seek(key string) (string, bool) {
+	c.i, _ = slices.BinarySearch(c.keys, key)
+	return c.at()
+}
+
+func (c *memoryCursor) Next() (string, bool) {
+	c.i++
+	return c.at()
+}
+
+func (c *memoryCursor) at() (string, bool) {
+	if c.i >= len(c.keys) {
+		return "", false
+	}
+	return c.keys[c.i], true
+}
+
+// replace swaps in data, as a restored snapshot.
+func (m *MemoryStorage) replace(data map[string][]byte) {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	m.mu.Lock()
+	m.data, m.keys = data, keys
+	m.mu.Unlock()
+}
+
+func (m *MemoryStorage) Batch(ctx context.Context, ops []Op) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, op := range ops {
+		i, found := slices.BinarySearch(m.keys, op.Key)
+		if op.Delete {
+			delete(m.data, op.Key)
+			if found {
+				m.keys = slices.Delete(m.keys, i, i+1)
+			}
+		} else {
+			m.data[op.Key] = append([]byte{}, op.Value...)
+			if !found {
+				m.keys = slices.Insert(m.keys, i, op.Key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	m := NewMemoryStorage()
+	ctx := context.Background()
+
+	for _, k := range []string{"p/c", "p/a", "p/d/x", "p/d/y", "p/d-e", "p/b", "q"} {
+		if err := m.Put(ctx, k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys, _ := m.List(ctx, "p/"); !reflect.DeepEqual(keys, []string{"a", "b", "c", "d-e", "d/"}) {
+		t.Fatalf("List: %v", keys)
+	}
+	if keys, _ := m.List(ctx, ""); !reflect.DeepEqual(keys, []string{"p/", "q"}) {
+		t.Fatalf("List root: %v", keys)
+	}
+
+	// Values are copied in and out.
+	v, _ := m.Get(ctx, "q")
+	v[0] = 'x'
+	if v, _ := m.Get(ctx, "q"); string(v) != "q" {
+		t.Fatalf("stored value changed through Get: %q", v)
+	}
+	if err := m.Put(ctx, "empty", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.Get(ctx, "empty"); err != nil || v == nil {
+		t.Fatalf("empty value read as missing: %v, %v", v, err)
+	}
+	_ = m.Delete(ctx, "p/d/x")
+	if v, _ := m.Get(ctx, "p/d/x"); v != nil {
+		t.Fatalf("deleted value: %q", v)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("c/%d/%d", i, j)
+				_ = m.Put(ctx, key, []byte(key))
+				_, _ = m.Get(ctx, key)
+				_, _ = m.List(ctx, "c/")
+			}
+		}(i)
+	}
+	wg.Wait()
+	if keys, _ := m.List(ctx, "c/3/"); len(keys) != 100 {
+		t.Fatalf("concurrent writes: %d keys", len(keys))
+	}
+}
@@ -0,0 +1,895 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// RaftStorage replicates the store over a Raft group, so that several
+// server nodes share it and it survives the loss of a minority of them.
+// Every read and write goes through the leader: a follower forwards it over
+// the same port the Raft traffic uses. Writes return once committed and
+// applied, and reads see every write that returned before them. Lock is
+// cluster-wide and held in the replicated state, so it survives a failover.
+// Nodes authenticate each other with a shared secret.
+//
+// The applied state lives in memory and is rebuilt from the last snapshot
+// and the log on start.
+type RaftStorage struct {
+	id        string
+	advertise string
+	raft      *raft.Raft
+	fsm       *raftFSM
+	ln        net.Listener
+	stream    *raftStream
+	trans     *raft.NetworkTransport
+	logs      *raftboltdb.BoltStore
+	secret    []byte
+	logger    *slog.Logger
+	lockTTL   time.Duration
+
+	// leases are the tokens of the locks this node holds, by key, which
+	// fence the writes under them.
+	leaseMu sync.Mutex
+	leases  map[string]uint64
+	closed  chan struct{}
+
+	// readyTerm is the term in which this node, as leader, last applied
+	// every entry committed before it took over.
+	readyTerm atomic.Uint64
+	closeOnce sync.Once
+}
+
+// RaftConfig configures one node of a RaftStorage cluster.
+type RaftConfig struct {
+	// NodeID names the node; it must not change across restarts.
+	NodeID string
+	// Addr is where the node listens for Raft traffic and forwarded
+	// requests; Advertise is how other nodes reach it and defaults to the
+	// listener's address.
+	Addr      string
+	Advertise string
+	// Dir holds the Raft log and the snapshots.
+	Dir string
+	// Secret is shared by every node of the cluster. A connection to the
+	// Raft port that cannot prove it knows the secret is dropped.
+	Secret []byte
+	// Bootstrap forms a new cluster with this node as its only member when
+	// Dir holds no state yet.
+	Bootstrap bool
+	// Join is the address of a member to ask for admission when Dir holds
+	// no state yet.
+	Join string
+	// SnapshotThreshold is how many log entries trigger a snapshot; zero
+	// keeps the Raft default.
+	SnapshotThreshold uint64
+	// LockTTL is how long a lock lease outlives its last renewal; zero
+	// keeps raftLockTTL.
+	LockTTL time.Duration
+	Logger  *slog.Logger
+}
+
+const (
+	RaftLogFileName = "raft.db"
+
+	raftOpTimeout      = 10 * time.Second
+	raftJoinTimeout    = 30 * time.Second
+	raftRetryInterval  = 50 * time.Millisecond
+	raftLockTTL        = 30 * time.Second
+	raftSnapshotRetain = 2
+
+	// The first byte of a connection to a node says what it carries.
+	raftConnRaft    byte = 'R'
+	raftConnForward byte = 'F'
+)
+
+// ErrRaftNoLeader is returned when no leader could be reached in time.
+var ErrRaftNoLeader = errors.New("storage: raft: no leader")
+
+// NewRaftStorage starts a node. With Bootstrap it may serve at once; with
+// Join it returns once a member admitted it; a node restarting from Dir
+// rejoins on its own.
+func NewRaftStorage(cfg RaftConfig) (*RaftStorage, error) {
+	if cfg.NodeID == "" || cfg.Addr == "" || cfg.Dir == "" || len(cfg.Secret) == 0 {
+		return nil, fmt.Errorf("storage: raft: node id, addr, dir and secret must be set")
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	if cfg.LockTTL <= 0 {
+		cfg.LockTTL = raftLockTTL
+	}
+
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	advertise := cfg.Advertise
+	if advertise == "" {
+		advertise = ln.Addr().String()
+	}
+	r := &RaftStorage{
+		id:        cfg.NodeID,
+		advertise: advertise,
+		fsm:       newRaftFSM(),
+		ln:        ln,
+		stream:    newRaftStream(ln, advertise, cfg.Secret),
+		secret:    cfg.Secret,
+		logger:    logger,
+		lockTTL:   cfg.LockTTL,
+		leases:    map[string]uint64{},
+		closed:    make(chan struct{}),
+	}
+	hlog := hclog.New(&hclog.LoggerOptions{
+		Name:        "raft",
+		Level:       hclog.Info,
+		Output:      raftLogWriter{logger},
+		DisableTime: true,
+	})
+
+	fail := func(err error) (*RaftStorage, error) {
+		r.Close()
+		return nil, err
+	}
+	if r.logs, err = raftboltdb.New(raftboltdb.Options{Path: filepath.Join(cfg.Dir, RaftLogFileName)}); err != nil {
+		return fail(err)
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(cfg.Dir, raftSnapshotRetain, hlog)
+	if err != nil {
+		return fail(err)
+	}
+	r.trans = raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+		Stream:  r.stream,
+		MaxPool: 3,
+		Timeout: raftOpTimeout,
+		Logger:  hlog,
+	})
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(cfg.NodeID)
+	conf.Logger = hlog
+	if cfg.SnapshotThreshold > 0 {
+		conf.SnapshotThreshold = cfg.SnapshotThreshold
+	}
+	existing, err := raft.HasExistingState(r.logs, r.logs, snaps)
+	if err != nil {
+		return fail(err)
+	}
+	if r.raft, err = raft.NewRaft(conf, r.fsm, r.logs, r.logs, snaps, r.trans); err != nil {
+		return fail(err)
+	}
+	go r.serve()
+
+	switch {
+	case existing:
+	case cfg.Bootstrap:
+		err := r.raft.BootstrapCluster(raft.Configuration{Servers: []raft.Server{
+			{ID: conf.LocalID, Address: raft.ServerAddress(advertise)},
+		}}).Error()
+		if err != nil {
+			return fail(fmt.Errorf("storage: raft: bootstrap: %w", err))
+		}
+	case cfg.Join != "":
+		ctx, cancel := context.WithTimeout(context.Background(), raftJoinTimeout)
+		defer cancel()
+		if err := RaftJoin(ctx, cfg.Join, cfg.Secret, cfg.NodeID, advertise); err != nil {
+			return fail(fmt.Errorf("storage: raft: join %s: %w", cfg.Join, err))
+		}
+	default:
+		return fail(fmt.Errorf("storage: raft: no state in %s; set bootstrap or join", cfg.Dir))
+	}
+	return r, nil
+}
+
+// Close stops the node. The others carry on, electing a new leader if
+// needed; use Leave to remove it from the cluster for good.
+func (r *RaftStorage) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		if r.raft != nil {
+			err = r.raft.Shutdown().Error()
+		}
+		if r.trans != nil {
+			r.trans.Close()
+		} else {
+			r.stream.Close()
+		}
+		r.ln.Close()
+		if r.logs != nil {
+			if cerr := r.logs.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address other nodes reach this one on.
+func (r *RaftStorage) Addr() string {
+	return r.advertise
+}
+
+// Leader returns the ID of the current leader, empty during an election.
+func (r *RaftStorage) Leader() string {
+	_, id := r.raft.LeaderWithID()
+	return string(id)
+}
+
+// Join adds a voting member.
+func (r *RaftStorage) Join(ctx context.Context, id, addr string) error {
+	_, err := r.do(ctx, &raftRequest{Kind: raftReqJoin, ID: id, Addr: addr})
+	return err
+}
+
+// Leave removes a member.
+func (r *RaftStorage) Leave(ctx context.Context, id string) error {
+	_, err := r.do(ctx, &raftRequest{Kind: raftReqLeave, ID: id})
+	return err
+}
+
+func (r *RaftStorage) Put(ctx context.Context, key string, value []byte) error {
+	return r.Batch(ctx, []Op{{Key: key, Value: value}})
+}
+
+func (r *RaftStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := r.do(ctx, &raftRequest{Kind: raftReqGet, Key: key})
+	if err != nil || !resp.Found {
+		return nil, err
+	}
+	if resp.Value == nil {
+		return []byte{}, nil
+	}
+	return resp.Value, nil
+}
+
+func (r *RaftStorage) Delete(ctx context.Context, key string) error {
+	return r.Batch(ctx, []Op{{Key: key, Delete: true}})
+}
+
+func (r *RaftStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	return r.ListPage(ctx, prefix, "", 0)
+}
+
+func (r *RaftStorage) ListPage(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	resp, err := r.do(ctx, &raftRequest{Kind: raftReqList, Key: prefix, After: after, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+// Batch commits ops as one log entry, so they apply atomically on every
+// node. Ops on a key this node holds a lock on, or under it, carry the
+// lease's token, and the batch fails with ErrLeaseLost if the lease has
+// expired or passed to another holder since.
+func (r *RaftStorage) Batch(ctx context.Context, ops []Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	_, err := r.do(ctx, &raftRequest{Kind: raftReqBatch, Ops: ops, Fence: r.fence(ops)})
+	return err
+}
+
+// ErrLeaseLost is returned for a write under a lock whose lease was lost.
+var ErrLeaseLost = errors.New("storage: raft: lock lease lost")
+
+// Lock takes a lease on key in the replicated state and renews it until
+// unlock. A lease its holder stops renewing, because it died or lost touch
+// with the cluster, expires after the configured LockTTL.
+func (r *RaftStorage) Lock(ctx context.Context, key string) (func(), error) {
+	for {
+		resp, err := r.do(ctx, &raftRequest{Kind: raftReqLock, Key: key, TTL: r.lockTTL})
+		if err != nil {
+			return nil, err
+		}
+		if token := resp.Token; token != 0 {
+			r.leaseMu.Lock()
+			r.leases[key] = token
+			r.leaseMu.Unlock()
+			stop := make(chan struct{})
+			go r.renew(key, token, stop)
+
+			return func() {
+				close(stop)
+				r.leaseMu.Lock()
+				delete(r.leases, key)
+				r.leaseMu.Unlock()
+				ctx, cancel := context.WithTimeout(context.Background(), raftOpTimeout)
+				defer cancel()
+				if _, err := r.do(ctx, &raftRequest{Kind: raftReqUnlock, Key: key, Token: token}); err != nil {
+					r.logger.Warn("raft unlock failed, the lease will expire", "key", key, "error", err)
+				}
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(raftRetryInterval):
+		}
+	}
+}
+
+// renew extends the lease token holds on key every third of its TTL
+// until stop is closed or the lease is lost.
+func (r *RaftStorage) renew(key string, token uint64, stop <-chan struct{}) {
+	ticker := time.NewTicker(r.lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-r.closed:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), raftOpTimeout)
+		resp, err := r.do(ctx, &raftRequest{Kind: raftReqRenew, Key: key, Token: token, TTL: r.lockTTL})
+		cancel()
+		switch {
+		case err != nil:
+			r.logger.Warn("raft lease renewal failed", "key", key, "error", err)
+		case resp.Token == 0:
+			r.logger.Warn("raft lease lost", "key", key)
+			return
+		}
+	}
+}
+
+// fence returns the leases this node holds on the keys of ops or above
+// them.
+func (r *RaftStorage) fence(ops []Op) []raftFence {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	var fence []raftFence
+	for key, token := range r.leases {
+		for _, op := range ops {
+			if op.Key == key || strings.HasPrefix(op.Key, key+"/") {
+				fence = append(fence, raftFence{Key: key, Token: token})
+				break
+			}
+		}
+	}
+	return fence
+}
+
+// Requests a node handles for another, or for itself when it leads.
+const (
+	raftReqBatch  = "batch"
+	raftReqGet    = "get"
+	raftReqList   = "list"
+	raftReqLock   = "lock"
+	raftReqUnlock = "unlock"
+	raftReqRenew  = "renew"
+	raftReqJoin   = "join"
+	raftReqLeave  = "leave"
+)
+
+type raftRequest struct {
+	Kind    string        `json:"kind"`
+	Key     string        `json:"key,omitempty"`
+	After   string        `json:"after,omitempty"`
+	Limit   int           `json:"limit,omitempty"`
+	Ops     []Op          `json:"ops,omitempty"`
+	Fence   []raftFence   `json:"fence,omitempty"`
+	Token   uint64        `json:"token,omitempty"`
+	ID      string        `json:"id,omitempty"`
+	Addr    string        `json:"addr,omitempty"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+	TTL     time.Duration `json:"ttl,omitempty"`
+}
+
+type raftResponse struct {
+	Value     []byte   `json:"value,omitempty"`
+	Found     bool     `json:"found,omitempty"`
+	Keys      []string `json:"keys,omitempty"`
+	Token     uint64   `json:"token,omitempty"`
+	Err       string   `json:"err,omitempty"`
+	LeaseLost bool     `json:"lease_lost,omitempty"`
+	NotLeader bool     `json:"not_leader,omitempty"`
+}
+
+// raftFence is a lease a write is made under.
+type raftFence struct {
+	Key   string `json:"key"`
+	Token uint64 `json:"token"`
+}
+
+// do runs req on the leader, forwarding it if this node is not the leader
+// and retrying through elections until ctx is done.
+func (r *RaftStorage) do(ctx context.Context, req *raftRequest) (*raftResponse, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, raftOpTimeout)
+		defer cancel()
+	}
+	for {
+		var resp *raftResponse
+		if r.raft.State() == raft.Leader {
+			resp = r.handle(ctx, req)
+		} else if addr, _ := r.raft.LeaderWithID(); addr != "" {
+			var err error
+			if resp, err = raftForward(ctx, string(addr), r.secret, req); err != nil {
+				r.logger.Debug("raft forward failed", "leader", addr, "error", err)
+				resp = nil
+			}
+		}
+		if resp != nil && !resp.NotLeader {
+			if resp.LeaseLost {
+				return nil, ErrLeaseLost
+			}
+			if resp.Err != "" {
+				return nil, errors.New(resp.Err)
+			}
+			return resp, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", ErrRaftNoLeader, ctx.Err())
+		case <-time.After(raftRetryInterval):
+		}
+	}
+}
+
+// handle runs req on this node if it leads.
+func (r *RaftStorage) handle(ctx context.Context, req *raftRequest) *raftResponse {
+	resp := &raftResponse{}
+	var err error
+	switch req.Kind {
+	case raftReqBatch:
+		_, err = r.apply(ctx, &raftCommand{Kind: raftCmdBatch, Ops: req.Ops, Fence: req.Fence, At: time.Now().UnixNano()})
+	case raftReqLock:
+		var v any
+		if v, err = r.apply(ctx, &raftCommand{Kind: raftCmdLock, Key: req.Key, TTL: int64(req.TTL), At: time.Now().UnixNano()}); err == nil {
+			resp.Token = v.(uint64)
+		}
+	case raftReqRenew:
+		var v any
+		if v, err = r.apply(ctx, &raftCommand{Kind: raftCmdRenew, Key: req.Key, Token: req.Token, TTL: int64(req.TTL), At: time.Now().UnixNano()}); err == nil {
+			resp.Token = v.(uint64)
+		}
+	case raftReqUnlock:
+		_, err = r.apply(ctx, &raftCommand{Kind: raftCmdUnlock, Key: req.Key, Token: req.Token})
+	case raftReqGet:
+		if err = r.readBarrier(ctx); err == nil {
+			resp.Value, resp.Found = r.fsm.get(req.Key)
+		}
+	case raftReqList:
+		if err = r.readBarrier(ctx); err == nil {
+			resp.Keys, err = r.fsm.data.ListPage(context.Background(), req.Key, req.After, req.Limit)
+		}
+	case raftReqJoin:
+		err = r.raft.AddVoter(raft.ServerID(req.ID), raft.ServerAddress(req.Addr), 0, raftTimeout(ctx)).Error()
+	case raftReqLeave:
+		err = r.raft.RemoveServer(raft.ServerID(req.ID), 0, raftTimeout(ctx)).Error()
+	default:
+		err = fmt.Errorf("storage: raft: unknown request %q", req.Kind)
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrLeaseLost):
+		resp.LeaseLost = true
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost),
+		errors.Is(err, raft.ErrLeadershipTransferInProgress), errors.Is(err, errRaftStaleTerm):
+		resp.NotLeader = true
+	default:
+		resp.Err = err.Error()
+	}
+	return resp
+}
+
+var errRaftStaleTerm = errors.New("storage: raft: term changed during read")
+
+// readBarrier makes sure a read on the leader sees every committed write:
+// once per term it waits for the entries of earlier terms to apply, and
+// every read confirms the node still leads.
+func (r *RaftStorage) readBarrier(ctx context.Context) error {
+	term := r.raft.CurrentTerm()
+	if r.readyTerm.Load() != term {
+		if err := r.raft.Barrier(raftTimeout(ctx)).Error(); err != nil {
+			return err
+		}
+		r.readyTerm.Store(term)
+	}
+	if err := r.raft.VerifyLeader().Error(); err != nil {
+		return err
+	}
+	if r.raft.CurrentTerm() != term {
+		return errRaftStaleTerm
+	}
+	return nil
+}
+
+func (r *RaftStorage) apply(ctx context.Context, cmd *raftCommand) (any, error) {
+	data, err := cbor.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	f := r.raft.Apply(data, raftTimeout(ctx))
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	if err, ok := f.Response().(error); ok {
+		return nil, err
+	}
+	return f.Response(), nil
+}
+
+func raftTimeout(ctx context.Context) time.Duration {
+	if dl, ok := ctx.Deadline(); ok {
+		return time.Until(dl)
+	}
+	return raftOpTimeout
+}
+
+// serve accepts connections and routes them by their first byte.
+func (r *RaftStorage) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_ = conn.SetDeadline(time.Now().Add(raftOpTimeout))
+			var kind [1]byte
+			if _, err := io.ReadFull(conn, kind[:]); err != nil {
+				conn.Close()
+				return
+			}
+			if kind[0] != raftConnRaft && kind[0] != raftConnForward {
+				conn.Close()
+				return
+			}
+			sess, err := raftAccept(conn, r.secret, kind[0])
+			if err != nil {
+				r.logger.Warn("raft connection refused", "remote", conn.RemoteAddr(), "error", err)
+				conn.Close()
+				return
+			}
+			_ = conn.SetDeadline(time.Time{})
+			if kind[0] == raftConnRaft {
+				r.stream.push(conn)
+			} else {
+				r.serveForward(conn, sess)
+			}
+		}()
+	}
+}
+
+// serveForward answers one request from another node. Membership changes
+// are passed on to the leader, since the node asking may not know it yet.
+func (r *RaftStorage) serveForward(conn net.Conn, sess *raftSession) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(raftOpTimeout))
+	var req raftRequest
+	if err := sess.read(conn, raftMACRequest, &req); err != nil {
+		return
+	}
+	timeout := req.Timeout
+	if timeout <= 0 || timeout > raftOpTimeout {
+		timeout = raftOpTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var resp *raftResponse
+	switch req.Kind {
+	case raftReqJoin, raftReqLeave:
+		var err error
+		if resp, err = r.do(ctx, &req); err != nil {
+			resp = &raftResponse{Err: err.Error()}
+		}
+	default:
+		if r.raft.State() == raft.Leader {
+			resp = r.handle(ctx, &req)
+		} else {
+			resp = &raftResponse{NotLeader: true}
+		}
+	}
+	_ = sess.write(conn, raftMACResponse, resp)
+}
+
+// raftForward sends req to the node at addr.
+func raftForward(ctx context.Context, addr string, secret []byte, req *raftRequest) (*raftResponse, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	fwd := *req
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+		fwd.Timeout = time.Until(dl)
+	}
+	sess, err := raftConnect(conn, secret, raftConnForward)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.write(conn, raftMACRequest, &fwd); err != nil {
+		return nil, err
+	}
+	var resp raftResponse
+	if err := sess.read(conn, raftMACResponse, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RaftJoin asks the member at addr to admit node id, reachable at
+// nodeAddr, retrying until ctx is done. secret is the cluster's.
+func RaftJoin(ctx context.Context, addr string, secret []byte, id, nodeAddr string) error {
+	return raftAdmin(ctx, addr, secret, &raftRequest{Kind: raftReqJoin, ID: id, Addr: nodeAddr})
+}
+
+// RaftRemove asks the member at addr to remove node id from the cluster.
+func RaftRemove(ctx context.Context, addr string, secret []byte, id string) error {
+	return raftAdmin(ctx, addr, secret, &raftRequest{Kind: raftReqLeave, ID: id})
+}
+
+func raftAdmin(ctx context.Context, addr string, secret []byte, req *raftRequest) error {
+	for {
+		resp, err := raftForward(ctx, addr, secret, req)
+		if errors.Is(err, ErrRaftAuth) {
+			return err
+		}
+		if err == nil {
+			if resp.Err != "" {
+				return errors.New(resp.Err)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(raftRetryInterval):
+		}
+	}
+}
+
+// raftStream is the raft.StreamLayer over the connections serve routes to
+// Raft.
+type raftStream struct {
+	ln        net.Listener
+	advertise raftAddr
+	secret    []byte
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newRaftStream(ln net.Listener, advertise string, secret []byte) *raftStream {
+	return &raftStream{
+		ln:        ln,
+		advertise: raftAddr(advertise),
+		secret:    secret,
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (s *raftStream) push(conn net.Conn) {
+	select {
+	case s.conns <- conn:
+	case <-s.closed:
+		conn.Close()
+	}
+}
+
+func (s *raftStream) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *raftStream) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *raftStream) Addr() net.Addr {
+	return s.advertise
+}
+
+func (s *raftStream) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(addr), timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := raftConnect(conn, s.secret, raftConnRaft); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+type raftAddr string
+
+func (a raftAddr) Network() string { return "tcp" }
+func (a raftAddr) String() string  { return string(a) }
+
+// raftLogWriter passes the Raft library's log lines to slog.
+type raftLogWriter struct {
+	logger *slog.Logger
+}
+
+func (w raftLogWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSpace(string(p)), "component", "raft")
+	return len(p), nil
+}
+
+// Commands of the replicated log.
+const (
+	raftCmdBatch byte = iota + 1
+	raftCmdLock
+	raftCmdUnlock
+	raftCmdRenew
+)
+
+type raftCommand struct {
+	Kind  byte        `json:"kind"`
+	Ops   []Op        `json:"ops,omitempty"`
+	Fence []raftFence `json:"fence,omitempty"`
+	Key   string      `json:"key,omitempty"`
+	Token uint64      `json:"token,omitempty"`
+	// At is the leader's clock when it proposed a lock, a renewal or a
+	// fenced batch, so every node computes the same expiry.
+	At int64 `json:"at,omitempty"`
+	// TTL is the lease duration the holder asked for; entries written
+	// before it was recorded use raftLockTTL.
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// expires returns when a lease taken or renewed by cmd runs out.
+func (cmd *raftCommand) expires() int64 {
+	if cmd.TTL <= 0 {
+		return cmd.At + int64(raftLockTTL)
+	}
+	return cmd.At + cmd.TTL
+}
+
+type raftLease struct {
+	Token   uint64 `json:"token"`
+	Expires int64  `json:"expires"`
+}
+
+// raftFSM is the replicated state: the key-value data and the lock leases.
+type raftFSM struct {
+	data *MemoryStorage
+
+	mu     sync.Mutex
+	leases map[string]raftLease
+}
+
+func newRaftFSM() *raftFSM {
+	return &raftFSM{data: NewMemoryStorage(), leases: map[string]raftLease{}}
+}
+
+func (f *raftFSM) get(key string) ([]byte, bool) {
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+	v, ok := f.data.data[key]
+	return append([]byte(nil), v...), ok
+}
+
+// Apply returns the lease token for a lock or a renewal, zero if the key is
+// held by another or the lease was lost, ErrLeaseLost for a batch fenced by
+// a lost lease, and an error for an entry it cannot decode.
+func (f *raftFSM) Apply(l *raft.Log) any {
+	var cmd raftCommand
+	if err := cbor.Unmarshal(l.Data, &cmd); err != nil {
+		return fmt.Errorf("storage: raft: log entry %d: %w", l.Index, err)
+	}
+	switch cmd.Kind {
+	case raftCmdBatch:
+		f.mu.Lock()
+		for _, fence := range cmd.Fence {
+			if held, ok := f.leases[fence.Key]; !ok || held.Token != fence.Token || held.Expires <= cmd.At {
+				f.mu.Unlock()
+				return ErrLeaseLost
+			}
+		}
+		f.mu.Unlock()
+		return f.data.Batch(context.Background(), cmd.Ops)
+	case raftCmdLock:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if held, ok := f.leases[cmd.Key]; ok && held.Expires > cmd.At {
+			return uint64(0)
+		}
+		f.leases[cmd.Key] = raftLease{Token: l.Index, Expires: cmd.expires()}
+		return l.Index
+	case raftCmdRenew:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		held, ok := f.leases[cmd.Key]
+		if !ok || held.Token != cmd.Token || held.Expires <= cmd.At {
+			return uint64(0)
+		}
+		f.leases[cmd.Key] = raftLease{Token: held.Token, Expires: cmd.expires()}
+		return held.Token
+	case raftCmdUnlock:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.leases[cmd.Key].Token == cmd.Token {
+			delete(f.leases, cmd.Key)
+		}
+		return nil
+	}
+	return fmt.Errorf("storage: raft: log entry %d: unknown command %d", l.Index, cmd.Kind)
+}
+
+type raftState struct {
+	Data   map[string][]byte    `json:"data"`
+	Leases map[string]raftLease `json:"leases"`
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	st := &raftState{Data: map[string][]byte{}, Leases: map[string]raftLease{}}
+	f.data.mu.RLock()
+	for k, v := range f.data.data {
+		st.Data[k] = v
+	}
+	f.data.mu.RUnlock()
+	f.mu.Lock()
+	for k, v := range f.leases {
+		st.Leases[k] = v
+	}
+	f.mu.Unlock()
+	return st, nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var st raftState
+	if err := cbor.NewDecoder(rc).Decode(&st); err != nil {
+		return err
+	}
+	if st.Data == nil {
+		st.Data = map[string][]byte{}
+	}
+	if st.Leases == nil {
+		st.Leases = map[string]raftLease{}
+	}
+	f.data.replace(st.Data)
+	f.mu.Lock()
+	f.leases = st.Leases
+	f.mu.Unlock()
+	return nil
+}
+
+// Persist implements raft.FSMSnapshot. Values are never modified in place,
+// so sharing them with the live state is safe.
+func (st *raftState) Persist(sink raft.SnapshotSink) error {
+	if err := cbor.NewEncoder(sink).Encode(st); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (st *raftState) Release() {}
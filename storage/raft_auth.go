@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Every connection to the Raft port starts with a handshake that proves to
+// both ends that the other knows the cluster secret:
+//
+//	dialer:   kind || client nonce
+//	listener: server nonce || mac('S')
+//	dialer:   mac('C')
+//
+// where mac(role) is HMAC-SHA256 under the secret of the role, the kind and
+// both nonces. Forwarded requests and their responses then travel with a
+// MAC of their own, bound to the same nonces, so none can be altered or
+// replayed on another connection.
+const (
+	raftNonceSize = 16
+
+	raftMACServer   byte = 'S'
+	raftMACClient   byte = 'C'
+	raftMACRequest  byte = 'Q'
+	raftMACResponse byte = 'A'
+)
+
+// ErrRaftAuth is returned when a node does not prove it knows the cluster
+// secret.
+var ErrRaftAuth = errors.New("storage: raft: peer failed authentication")
+
+// raftSession is an authenticated connection to or from another node.
+type raftSession struct {
+	secret []byte
+	kind   byte
+	client [raftNonceSize]byte
+	server [raftNonceSize]byte
+}
+
+func (s *raftSession) mac(role byte, body []byte) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte{role, s.kind})
+	h.Write(s.client[:])
+	h.Write(s.server[:])
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// raftConnect runs the dialer's side of the handshake on conn.
+func raftConnect(conn io.ReadWriter, secret []byte, kind byte) (*raftSession, error) {
+	s := &raftSession{secret: secret, kind: kind}
+	if _, err := io.ReadFull(rand.Reader, s.client[:]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append([]byte{kind}, s.client[:]...)); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, raftNonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	copy(s.server[:], reply)
+	if !hmac.Equal(reply[raftNonceSize:], s.mac(raftMACServer, nil)) {
+		return nil, ErrRaftAuth
+	}
+	if _, err := conn.Write(s.mac(raftMACClient, nil)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// raftAccept runs the listener's side of the handshake on conn, whose kind
+// byte was read already.
+func raftAccept(conn io.ReadWriter, secret []byte, kind byte) (*raftSession, error) {
+	s := &raftSession{secret: secret, kind: kind}
+	if _, err := io.ReadFull(conn, s.client[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, s.server[:]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(s.server[:], s.mac(raftMACServer, nil)...)); err != nil {
+		return nil, err
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(proof, s.mac(raftMACClient, nil)) {
+		return nil, ErrRaftAuth
+	}
+	return s, nil
+}
+
+// raftMessage is a forwarded request or response and its MAC.
+type raftMessage struct {
+	Body []byte `json:"body"`
+	MAC  []byte `json:"mac"`
+}
+
+func (s *raftSession) write(w io.Writer, role byte, v any) error {
+	body, err := cbor.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return cbor.NewEncoder(w).Encode(&raftMessage{Body: body, MAC: s.mac(role, body)})
+}
+
+func (s *raftSession) read(r io.Reader, role byte, v any) error {
+	var msg raftMessage
+	if err := cbor.NewDecoder(r).Decode(&msg); err != nil {
+		return err
+	}
+	if !hmac.Equal(msg.MAC, s.mac(role, msg.Body)) {
+		return ErrRaftAuth
+	}
+	return cbor.Unmarshal(msg.Body, v)
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var raftTestSecret = []byte("cluster secret")
+
+type raftTestNode struct {
+	*RaftStorage
+	cfg RaftConfig
+}
+
+// newRaftCluster starts n nodes on loopback, the first bootstrapping and the
+// others joining it.
+func newRaftCluster(t *testing.T, n int) []*raftTestNode {
+	t.Helper()
+	nodes := make([]*raftTestNode, n)
+	for i := range nodes {
+		cfg := RaftConfig{
+			NodeID:            string(rune('a' + i)),
+			Addr:              "127.0.0.1:0",
+			Dir:               t.TempDir(),
+			Secret:            raftTestSecret,
+			SnapshotThreshold: 16,
+		}
+		if i == 0 {
+			cfg.Bootstrap = true
+		} else {
+			cfg.Join = nodes[0].Addr()
+		}
+		nodes[i] = startRaftNode(t, cfg)
+	}
+	return nodes
+}
+
+func startRaftNode(t *testing.T, cfg RaftConfig) *raftTestNode {
+	t.Helper()
+	r, err := NewRaftStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	// Restarts must listen where the cluster knows the node.
+	cfg.Addr = r.Addr()
+	return &raftTestNode{RaftStorage: r, cfg: cfg}
+}
+
+func leaderOf(t *testing.T, nodes []*raftTestNode) int {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, n := range nodes {
+			if n != nil && n.raft.State() == raft.Leader {
+				return i
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no leader")
+	return -1
+}
+
+func TestRaftStorage(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+	ctx := context.Background()
+	lead := leaderOf(t, nodes)
+	f1, f2 := nodes[(lead+1)%3], nodes[(lead+2)%3]
+
+	// A write through one follower is visible through the other at once.
+	if err := f1.Put(ctx, "p/a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := f2.Get(ctx, "p/a"); err != nil || string(v) != "1" {
+		t.Fatalf("read after write: %q, %v", v, err)
+	}
+	if err := Batch(ctx, f2, []Op{{Key: "p/b/c", Value: []byte{}}, {Key: "p/a", Delete: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := f1.List(ctx, "p/"); !reflect.DeepEqual(keys, []string{"b/"}) {
+		t.Fatalf("List: %v", keys)
+	}
+	if v, err := f1.Get(ctx, "p/b/c"); err != nil || v == nil || len(v) != 0 {
+		t.Fatalf("empty value: %q, %v", v, err)
+	}
+	if v, err := f1.Get(ctx, "p/a"); err != nil || v != nil {
+		t.Fatalf("deleted key: %q, %v", v, err)
+	}
+
+	// Locks are cluster-wide.
+	unlock, err := f1.Lock(ctx, "escrow/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	if _, err := f2.Lock(short, "escrow/x"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("second holder: %v", err)
+	}
+	unlock()
+	unlock2, err := f2.Lock(ctx, "escrow/x")
+	if err != nil {
+		t.Fatalf("lock after unlock: %v", err)
+	}
+	unlock2()
+}
+
+func TestRaftStorageFailover(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+	ctx := context.Background()
+	for i := 0; i < 40; i++ {
+		if err := nodes[i%3].Put(ctx, fmt.Sprintf("k/%02d", i), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Never released.
+	if _, err := nodes[0].Lock(ctx, "held"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing the leader loses neither data nor leases.
+	lead := leaderOf(t, nodes)
+	if err := nodes[lead].raft.Snapshot().Error(); err != nil {
+		t.Fatal(err)
+	}
+	old := nodes[lead]
+	old.Close()
+	nodes[lead] = nil
+	survivor := nodes[(lead+1)%3]
+	if v, err := survivor.Get(ctx, "k/26"); err != nil || len(v) != 1 || v[0] != 26 {
+		t.Fatalf("read after failover: %v, %v", v, err)
+	}
+	short, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	if _, err := survivor.Lock(short, "held"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lease lost in failover: %v", err)
+	}
+	if err := survivor.Put(ctx, "after", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old leader restarts from its snapshot and log and catches up.
+	restarted := startRaftNode(t, old.cfg)
+	nodes[lead] = restarted
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if v, _ := restarted.fsm.get("after"); string(v) == "x" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("restarted node did not catch up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if v, _ := restarted.fsm.get("k/26"); len(v) != 1 || v[0] != 26 {
+		t.Fatalf("restarted node state: %v", v)
+	}
+
+	// Membership changes.
+	if err := survivor.Leave(ctx, restarted.id); err != nil {
+		t.Fatal(err)
+	}
+	cfg := survivor.raft.GetConfiguration()
+	if err := cfg.Error(); err != nil || len(cfg.Configuration().Servers) != 2 {
+		t.Fatalf("configuration after leave: %v, %v", cfg.Configuration().Servers, err)
+	}
+}
+
+func TestRaftLeaseFencing(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+	ctx := context.Background()
+	lead := leaderOf(t, nodes)
+	holder := nodes[(lead+1)%3]
+
+	unlock, err := holder.Lock(ctx, "escrow/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if err := holder.Put(ctx, "escrow/x/deposit", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lease passes to another holder, as if this one had stalled past
+	// its expiry: its writes under the lock are refused, others are not.
+	stolen := time.Now().Add(2 * raftLockTTL).UnixNano()
+	if _, err := nodes[lead].apply(ctx, &raftCommand{Kind: raftCmdLock, Key: "escrow/x", At: stolen}); err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.Put(ctx, "escrow/x/deposit", []byte("2")); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("write under a lost lease: %v", err)
+	}
+	if v, _ := holder.Get(ctx, "escrow/x/deposit"); string(v) != "1" {
+		t.Fatalf("fenced write applied: %q", v)
+	}
+	if err := holder.Put(ctx, "escrow/y", []byte("1")); err != nil {
+		t.Fatalf("write outside the lock: %v", err)
+	}
+	if resp, err := holder.do(ctx, &raftRequest{Kind: raftReqRenew, Key: "escrow/x", Token: holder.leases["escrow/x"]}); err != nil || resp.Token != 0 {
+		t.Fatalf("renewed a lost lease: %+v, %v", resp, err)
+	}
+}
+
+func TestRaftAuth(t *testing.T) {
+	nodes := newRaftCluster(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	leaderOf(t, nodes)
+
+	req := &raftRequest{Kind: raftReqGet, Key: "k"}
+	if _, err := raftForward(ctx, nodes[0].Addr(), []byte("wrong"), req); !errors.Is(err, ErrRaftAuth) {
+		t.Fatalf("forward with the wrong secret: %v", err)
+	}
+	if err := RaftJoin(ctx, nodes[0].Addr(), []byte("wrong"), "x", "127.0.0.1:1"); !errors.Is(err, ErrRaftAuth) {
+		t.Fatalf("join with the wrong secret: %v", err)
+	}
+	if _, err := raftForward(ctx, nodes[0].Addr(), raftTestSecret, req); err != nil {
+		t.Fatalf("forward with the secret: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// A store's layout is described by a Schema: an ordered list of migrations,
+// numbered from 1, each taking the data from the previous version to its
+// own. The version a store is at is kept in the record at SchemaKey; a store
+// without one predates versioning and is at version 0.
+
+// SchemaKey holds the schema record of a store.
+const SchemaKey = "_schema"
+
+// ErrSchemaTooNew is returned for a store written by a newer binary.
+var ErrSchemaTooNew = errors.New("storage: schema is newer than this binary")
+
+// Migration moves a store from Version-1 to Version. Apply must be safe to
+// run again on data it already moved: the record is only updated after it
+// returns, so a crash in between runs it a second time.
+type Migration struct {
+	Version int
+	Name    string
+	Apply   func(ctx context.Context, stor Storage) error
+}
+
+// Schema is the list of migrations of one kind of store, such as "client"
+// or "server".
+type Schema struct {
+	Store      string
+	Migrations []Migration
+}
+
+// Latest returns the version the store is at once every migration ran.
+func (s Schema) Latest() int {
+	return len(s.Migrations)
+}
+
+func (s Schema) validate() error {
+	for i, m := range s.Migrations {
+		if m.Version != i+1 || m.Apply == nil {
+			return fmt.Errorf("storage: %s schema: migration %d (%s) out of order", s.Store, i+1, m.Name)
+		}
+	}
+	return nil
+}
+
+type schemaRecord struct {
+	Store   string             `json:"store"`
+	Version int                `json:"version"`
+	Applied []appliedMigration `json:"applied"`
+}
+
+type appliedMigration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	At      int64  `json:"at"`
+}
+
+func loadSchemaRecord(ctx context.Context, stor Storage) (*schemaRecord, error) {
+	data, err := stor.Get(ctx, SchemaKey)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var rec schemaRecord
+	if err := cbor.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("storage: schema record: %w", err)
+	}
+	return &rec, nil
+}
+
+func putSchemaRecord(ctx context.Context, stor Storage, rec *schemaRecord) error {
+	data, err := cbor.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return stor.Put(ctx, SchemaKey, data)
+}
+
+// SchemaVersion returns the schema version of stor, zero when it has no
+// record.
+func SchemaVersion(ctx context.Context, stor Storage) (int, error) {
+	rec, err := loadSchemaRecord(ctx, stor)
+	if err != nil || rec == nil {
+		return 0, err
+	}
+	return rec.Version, nil
+}
+
+// MigrateOptions control Migrate.
+type MigrateOptions struct {
+	// DryRun only reports the pending migrations.
+	DryRun bool
+	// Backup, if set, is called once before the first migration runs. An
+	// error stops the migration with nothing changed.
+	Backup func(ctx context.Context, from int) error
+	Logger *slog.Logger
+}
+
+// MigrateResult describes what Migrate found and did.
+type MigrateResult struct {
+	From    int
+	To      int
+	Pending []Migration
+}
+
+// Migrate brings stor to the latest version of schema. An empty store is
+// stamped with the latest version without running anything. Migrations run
+// under the lock on SchemaKey, so replicas starting together run each of
+// them once; the record is updated after every step, so an interrupted run
+// resumes where it stopped.
+func Migrate(ctx context.Context, stor Storage, schema Schema, opts MigrateOptions) (*MigrateResult, error) {
+	if err := schema.validate(); err != nil {
+		return nil, err
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+
+	unlock, err := Lock(ctx, stor, SchemaKey)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	rec, err := loadSchemaRecord(ctx, stor)
+	if err != nil {
+		return nil, err
+	}
+	fresh := rec == nil
+	if fresh {
+		keys, err := stor.List(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		rec = &schemaRecord{Store: schema.Store}
+		if len(keys) == 0 {
+			rec.Version = schema.Latest()
+		}
+	}
+	if rec.Store != schema.Store {
+		return nil, fmt.Errorf("storage: store holds %s data, not %s", rec.Store, schema.Store)
+	}
+	if rec.Version > schema.Latest() {
+		return nil, fmt.Errorf("%w: version %d, this binary knows %d", ErrSchemaTooNew, rec.Version, schema.Latest())
+	}
+
+	res := &MigrateResult{From: rec.Version, To: rec.Version, Pending: schema.Migrations[rec.Version:]}
+	if opts.DryRun {
+		return res, nil
+	}
+	if len(res.Pending) == 0 {
+		if fresh {
+			return res, putSchemaRecord(ctx, stor, rec)
+		}
+		return res, nil
+	}
+
+	if opts.Backup != nil {
+		if err := opts.Backup(ctx, rec.Version); err != nil {
+			return res, fmt.Errorf("storage: backup before migrating: %w", err)
+		}
+	}
+	for _, m := range res.Pending {
+		logger.Info("applying storage migration", "store", schema.Store, "version", m.Version, "name", m.Name)
+		if err := m.Apply(ctx, stor); err != nil {
+			return res, fmt.Errorf("storage: migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		rec.Version = m.Version
+		rec.Applied = append(rec.Applied, appliedMigration{Version: m.Version, Name: m.Name, At: time.Now().Unix()})
+		if err := putSchemaRecord(ctx, stor, rec); err != nil {
+			return res, err
+		}
+		res.To = m.Version
+	}
+	return res, nil
+}
+
+// Snapshot copies the values of stor verbatim into a new file storage at
+// path and returns how many keys it copied. The values of an
+// EncryptedStorage are copied sealed, so the snapshot opens with the same
+// password.
+func Snapshot(ctx context.Context, stor Storage, path string, logger *slog.Logger) (int, error) {
+	dst, err := NewFileStorage(map[string]string{"path": path}, logger)
+	if err != nil {
+		return 0, err
+	}
+	if keys, err := dst.List(ctx, ""); err != nil {
+		return 0, err
+	} else if len(keys) != 0 {
+		return 0, fmt.Errorf("%s is not empty", path)
+	}
+	if enc, ok := stor.(*EncryptedStorage); ok {
+		stor = enc.backend
+	}
+	return Copy(ctx, dst, stor)
+}
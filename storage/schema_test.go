@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	var ran []int
+	failAt := 0
+	step := func(v int) Migration {
+		return Migration{Version: v, Name: "step", Apply: func(ctx context.Context, stor Storage) error {
+			if v == failAt {
+				return errors.New("boom")
+			}
+			ran = append(ran, v)
+			return stor.Put(ctx, "k", []byte{byte(v)})
+		}}
+	}
+	schema := Schema{Store: "test", Migrations: []Migration{step(1), step(2), step(3)}}
+
+	// A new store starts at the latest version.
+	fresh := newTestBolt(t)
+	if res, err := Migrate(ctx, fresh, schema, MigrateOptions{}); err != nil || res.To != 3 || len(ran) != 0 {
+		t.Fatalf("fresh store: %+v, %v, ran %v", res, err, ran)
+	}
+	if v, _ := SchemaVersion(ctx, fresh); v != 3 {
+		t.Fatalf("fresh store version %d", v)
+	}
+
+	// Data without a record is at version 0.
+	old := newTestBolt(t)
+	_ = old.Put(ctx, "k", []byte{0})
+	res, err := Migrate(ctx, old, schema, MigrateOptions{DryRun: true})
+	if err != nil || res.From != 0 || len(res.Pending) != 3 || len(ran) != 0 {
+		t.Fatalf("dry run: %+v, %v, ran %v", res, err, ran)
+	}
+	if v, _ := old.Get(ctx, SchemaKey); v != nil {
+		t.Fatal("dry run wrote the schema record")
+	}
+
+	failAt = 2
+	backups := 0
+	opts := MigrateOptions{Backup: func(ctx context.Context, from int) error {
+		backups++
+		return nil
+	}}
+	if _, err := Migrate(ctx, old, schema, opts); err == nil {
+		t.Fatal("failed migration reported success")
+	}
+	if v, _ := SchemaVersion(ctx, old); v != 1 {
+		t.Fatalf("version after failure %d", v)
+	}
+	failAt = 0
+	if res, err := Migrate(ctx, old, schema, opts); err != nil || res.From != 1 || res.To != 3 {
+		t.Fatalf("resume: %+v, %v", res, err)
+	}
+	if len(ran) != 3 || ran[1] != 2 || backups != 2 {
+		t.Fatalf("ran %v, %d backups", ran, backups)
+	}
+	if res, err := Migrate(ctx, old, schema, opts); err != nil || len(res.Pending) != 0 || backups != 2 {
+		t.Fatalf("up to date: %+v, %v, %d backups", res, err, backups)
+	}
+
+	if _, err := Migrate(ctx, old, Schema{Store: "test", Migrations: schema.Migrations[:2]}, MigrateOptions{}); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("older binary: %v", err)
+	}
+	if _, err := Migrate(ctx, old, Schema{Store: "other"}, MigrateOptions{}); err == nil {
+		t.Fatal("store of another kind accepted")
+	}
+	if _, err := Migrate(ctx, newTestBolt(t), Schema{Store: "test", Migrations: []Migration{step(2)}}, MigrateOptions{}); err == nil {
+		t.Fatal("misnumbered migration accepted")
+	}
+}
+
+func TestSnapshotKeepsValuesSealed(t *testing.T) {
+	ctx := context.Background()
+	enc, err := NewEncryptedStorage(newTestBolt(t), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = enc.Put(ctx, "a/b", []byte("secret"))
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if _, err := Snapshot(ctx, enc, path, logger); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := NewFileStorage(map[string]string{"path": path}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := raw.Get(ctx, "a/b"); v == nil || string(v) == "secret" {
+		t.Fatalf("snapshot value: %q", v)
+	}
+	restored, err := NewEncryptedStorage(raw, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := restored.Get(ctx, "a/b"); err != nil || string(v) != "secret" {
+		t.Fatalf("restored: %q, %v", v, err)
+	}
+	if _, err := Snapshot(ctx, enc, path, logger); err == nil {
+		t.Fatal("snapshot over existing data")
+	}
+}
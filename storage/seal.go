@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A sealed keyring wraps the data keys with a random master key instead of
+// one derived from a password. The master key is never stored: InitSeal
+// splits it into unseal keys, and Unseal opens the storage once enough of
+// them are put back together.
+
+const kdfShamir = "shamir"
+
+var (
+	// ErrSealed is returned when a password is used on a keyring that is
+	// opened with unseal keys.
+	ErrSealed = errors.New("storage: keyring is sealed, open it with unseal keys")
+	// ErrSealInitialized is returned by InitSeal for a keyring that already
+	// has unseal keys.
+	ErrSealInitialized = errors.New("storage: unseal keys already initialized")
+	// ErrNotSealed is returned by Unseal for a backend without unseal keys.
+	ErrNotSealed = errors.New("storage: keyring has no unseal keys")
+	// ErrUnsealKeys is returned when the unseal keys do not open the keyring.
+	ErrUnsealKeys = errors.New("storage: unseal keys do not open the keyring")
+)
+
+// SealInfo describes the unseal keys of a keyring.
+type SealInfo struct {
+	Shares    int
+	Threshold int
+
+	salt   []byte
+	checks [][]byte
+}
+
+// Check reports whether key is one of the unseal keys.
+func (s *SealInfo) Check(key []byte) bool {
+	sum := unsealCheck(s.salt, key)
+	for _, c := range s.checks {
+		if subtle.ConstantTimeCompare(sum, c) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func unsealCheck(salt, key []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("storage-unseal-key/"))
+	h.Write(salt)
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// sealWrap returns the wrap of kr made with unseal keys, if any.
+func sealWrap(kr *keyring) *wrap {
+	if kr.Current.KDF.Alg == kdfShamir {
+		return &kr.Current
+	}
+	if kr.Previous != nil && kr.Previous.KDF.Alg == kdfShamir {
+		return kr.Previous
+	}
+	return nil
+}
+
+// LoadSealInfo returns the unseal key settings of backend, or nil if its
+// keyring is missing or opened with a password.
+func LoadSealInfo(ctx context.Context, backend Storage) (*SealInfo, error) {
+	kr, err := loadKeyring(ctx, backend)
+	if err != nil || kr == nil {
+		return nil, err
+	}
+	w := sealWrap(kr)
+	if w == nil {
+		return nil, nil
+	}
+	return &SealInfo{
+		Shares:    int(w.KDF.Shares),
+		Threshold: int(w.KDF.Threshold),
+		salt:      w.KDF.Salt,
+		checks:    w.KDF.Checks,
+	}, nil
+}
+
+// InitSeal moves backend to a random master key split into shares unseal
+// keys, threshold of which open it, and returns the keys. They are not
+// stored anywhere: hand them out and forget them. A backend encrypted with
+// pass is rekeyed onto the master key and re-encrypted; with an empty pass
+// the backend must hold nothing yet.
+func InitSeal(ctx context.Context, backend Storage, pass string, shares, threshold int) ([][]byte, error) {
+	master := randomKey()
+	defer clear(master)
+	keys, err := splitSecret(master, shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+	params := KDFParams{Alg: kdfShamir, Salt: make([]byte, saltSize), Shares: uint8(shares), Threshold: uint8(threshold)}
+	if _, err := io.ReadFull(rand.Reader, params.Salt); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		params.Checks = append(params.Checks, unsealCheck(params.Salt, key))
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	k := &kek{aead: aead, salt: params.Salt}
+
+	if pass != "" {
+		e, err := NewEncryptedStorage(backend, pass)
+		if errors.Is(err, ErrSealed) {
+			return nil, ErrSealInitialized
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := e.rotateTo(ctx, k, params); err != nil {
+			return nil, err
+		}
+		if _, err := e.Reencrypt(ctx); err != nil {
+			return nil, fmt.Errorf("storage: re-encrypt under the master key: %w", err)
+		}
+		return keys, nil
+	}
+
+	unlock, err := Lock(ctx, backend, KeyringKey)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	kr, err := loadKeyring(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	if kr != nil {
+		if sealWrap(kr) != nil {
+			return nil, ErrSealInitialized
+		}
+		return nil, ErrWrongPassword
+	}
+	existing, err := backend.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) != 0 {
+		return nil, errors.New("storage: backend holds unencrypted values, initialize an empty one")
+	}
+	w, err := k.wrapKeys(params, map[uint32][]byte{1: randomKey()})
+	if err != nil {
+		return nil, err
+	}
+	if err := storeKeyring(ctx, backend, &keyring{Version: keyringVersion, Active: 1, Current: w}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Unseal opens a keyring made by InitSeal with at least its threshold of
+// unseal keys.
+func Unseal(ctx context.Context, backend Storage, keys [][]byte) (*EncryptedStorage, error) {
+	kr, err := loadKeyring(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	if kr == nil {
+		return nil, ErrNotSealed
+	}
+	w := sealWrap(kr)
+	if w == nil {
+		return nil, ErrNotSealed
+	}
+	if len(keys) < int(w.KDF.Threshold) {
+		return nil, fmt.Errorf("storage: %d of %d unseal keys", len(keys), w.KDF.Threshold)
+	}
+	master, err := combineShares(keys)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(master)
+	if len(master) != dataKeySize {
+		return nil, ErrUnsealKeys
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	k := &kek{aead: aead, salt: w.KDF.Salt}
+	dataKeys, err := k.unwrapKeys(*w)
+	if err != nil {
+		return nil, ErrUnsealKeys
+	}
+	e := &EncryptedStorage{backend: backend, kek: k}
+	if err := e.install(kr, dataKeys); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestShamirSplitCombine(t *testing.T) {
+	secret := randomKey()
+	shares, err := splitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var picked [][]byte
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		got, err := combineShares(picked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Fatalf("shares %v: wrong secret", subset)
+		}
+	}
+	if got, _ := combineShares(shares[:2]); bytes.Equal(got, secret) {
+		t.Fatal("two of three shares recovered the secret")
+	}
+	if _, err := combineShares([][]byte{shares[0], shares[0]}); err == nil {
+		t.Fatal("duplicate share accepted")
+	}
+	if _, err := splitSecret(secret, 2, 3); err == nil {
+		t.Fatal("threshold above shares accepted")
+	}
+}
+
+func TestSealUnseal(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryStorage()
+
+	keys, err := InitSeal(ctx, b, "", 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InitSeal(ctx, b, "", 3, 2); !errors.Is(err, ErrSealInitialized) {
+		t.Fatalf("second init: %v", err)
+	}
+	info, err := LoadSealInfo(ctx, b)
+	if err != nil || info == nil || info.Shares != 3 || info.Threshold != 2 {
+		t.Fatalf("seal info %+v, %v", info, err)
+	}
+	if !info.Check(keys[1]) || info.Check(append([]byte{}, keys[1][1:]...)) {
+		t.Fatal("key check")
+	}
+
+	enc, err := Unseal(ctx, b, [][]byte{keys[0], keys[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Put(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err = Unseal(ctx, b, [][]byte{keys[2], keys[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := enc.Get(ctx, "k"); err != nil || string(v) != "v" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+	if _, err := Unseal(ctx, b, keys[:1]); err == nil {
+		t.Fatal("unsealed below the threshold")
+	}
+	other, _ := splitSecret(randomKey(), 3, 2)
+	if _, err := Unseal(ctx, b, other[:2]); !errors.Is(err, ErrUnsealKeys) {
+		t.Fatalf("foreign keys: %v", err)
+	}
+	if _, err := NewEncryptedStorage(b, "pass"); !errors.Is(err, ErrSealed) {
+		t.Fatalf("password on a sealed keyring: %v", err)
+	}
+}
+
+func TestInitSealFromPassword(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryStorage()
+	enc, err := NewEncryptedStorage(b, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Put(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InitSeal(ctx, b, "wrong", 3, 2); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("wrong password: %v", err)
+	}
+	if _, err := InitSeal(ctx, b, "", 3, 2); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("no password: %v", err)
+	}
+	keys, err := InitSeal(ctx, b, "pass", 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if term := rawTerm(t, b, "k"); term != 2 {
+		t.Fatalf("value not re-encrypted: term %d", term)
+	}
+	if _, err := NewEncryptedStorage(b, "pass"); !errors.Is(err, ErrSealed) {
+		t.Fatalf("old password: %v", err)
+	}
+	if _, err := InitSeal(ctx, b, "pass", 3, 2); !errors.Is(err, ErrSealInitialized) {
+		t.Fatalf("second init: %v", err)
+	}
+
+	enc, err = Unseal(ctx, b, keys[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := enc.Get(ctx, "k"); err != nil || string(v) != "v" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Shamir secret sharing over GF(2^8), byte by byte. A share is the
+// polynomial values for every byte of the secret followed by its x
+// coordinate, so shares of an n-byte secret are n+1 bytes long.
+
+const maxShares = 255
+
+var errBadShares = errors.New("storage: malformed unseal keys")
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, without branching on
+// its operands.
+func gfMul(a, b byte) byte {
+	var p byte
+	for range 8 {
+		p ^= a & -(b & 1)
+		hi := a >> 7
+		a = a<<1 ^ 0x1b&-hi
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns a^254, the inverse of a non-zero a.
+func gfInv(a byte) byte {
+	r := a
+	for range 6 {
+		a = gfMul(a, a)
+		r = gfMul(r, a)
+	}
+	return gfMul(r, r)
+}
+
+// splitSecret splits secret into parts shares, any threshold of which
+// recover it.
+func splitSecret(secret []byte, parts, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("storage: empty secret")
+	}
+	if threshold < 2 || parts < threshold || parts > maxShares {
+		return nil, fmt.Errorf("storage: need 2 <= threshold <= shares <= %d", maxShares)
+	}
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coef := make([]byte, threshold)
+	for j, s := range secret {
+		coef[0] = s
+		if _, err := io.ReadFull(rand.Reader, coef[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			x := share[len(secret)]
+			// Horner's rule from the highest coefficient.
+			var y byte
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coef[k]
+			}
+			share[j] = y
+		}
+	}
+	clear(coef)
+	return shares, nil
+}
+
+// combineShares interpolates the secret from shares. With fewer shares than
+// the threshold it returns unrelated bytes; the caller must check the
+// result.
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errBadShares
+	}
+	n := len(shares[0]) - 1
+	if n < 1 {
+		return nil, errBadShares
+	}
+	xs := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, share := range shares {
+		if len(share) != n+1 {
+			return nil, errBadShares
+		}
+		x := share[n]
+		if x == 0 || seen[x] {
+			return nil, errBadShares
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	// Lagrange basis at zero: l_i = prod x_j / (x_j - x_i); minus is xor.
+	basis := make([]byte, len(shares))
+	for i := range shares {
+		num, den := byte(1), byte(1)
+		for j := range shares {
+			if i != j {
+				num = gfMul(num, xs[j])
+				den = gfMul(den, xs[j]^xs[i])
+			}
+		}
+		basis[i] = gfMul(num, gfInv(den))
+	}
+	secret := make([]byte, n)
+	for j := range secret {
+		var y byte
+		for i, share := range shares {
+			y ^= gfMul(share[j], basis[i])
+		}
+		secret[j] = y
+	}
+	return secret, nil
+}
@@ -1,15 +1,19 @@
 package storage
 
 import (
+	"bytes"
 	"context"
-	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/physical"
 	"github.com/valli0x/signature-escrow/storage/file"
@@ -19,18 +23,27 @@ type Storage interface {
 	Put(ctx context.Context, key string, value []byte) error
 	Get(ctx context.Context, key string) ([]byte, error)
 	Delete(ctx context.Context, key string) error
+	// List returns the keys directly under prefix in lexical order. Like the
+	// vault physical backends, sub-prefixes are returned once, with a
+	// trailing "/". Use ListPage to walk large prefixes in pages.
+	List(ctx context.Context, prefix string) ([]string, error)
 }
 
 type FileStorage struct {
 	backend physical.Backend
+	path    string
 }
 
+// lockDir holds the per-key lock files of a FileStorage. It is hidden from
+// List.
+const lockDir = ".locks"
+
 func NewFileStorage(config map[string]string, logger *slog.Logger) (*FileStorage, error) {
 	fb, err := file.NewFileBackend(config, logger)
 	if err != nil {
 		return nil, err
 	}
-	return &FileStorage{backend: fb}, nil
+	return &FileStorage{backend: fb, path: config["path"]}, nil
 }
 
 func (f *FileStorage) Put(ctx context.Context, key string, value []byte) error {
@@ -53,38 +66,94 @@ func (f *FileStorage) Delete(ctx context.Context, key string) error {
 	return f.backend.Delete(ctx, key)
 }
 
+func (f *FileStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := f.backend.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		out := keys[:0]
+		for _, k := range keys {
+			if k != lockDir+"/" {
+				out = append(out, k)
+			}
+		}
+		keys = out
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
 type EncryptedStorage struct {
 	backend Storage
-	gcm     cipher.AEAD
-	nonceSz int
+
+	mu     sync.RWMutex
+	kek    *kek
+	active uint32
+	keys   map[uint32]cipher.AEAD
+	// migrated is set once Reencrypt has rewritten every value, after which
+	// values sealed without associated data are refused.
+	migrated bool
+
+	// migrating holds the keys being re-encrypted after a read found them
+	// in an older format or under an older data key.
+	migrating sync.Map
+
+	versions versions
 }
 
+// Sealed values start with a format version and the big-endian term of
+// their data key:
+//
+//	1 || term || nonce || ciphertext
+//	2 || term || counter || nonce || ciphertext
+//
+// Version 2 authenticates its header and the storage key as associated
+// data, so a value moved to another key no longer opens, and carries the
+// key's version counter (zero when not tracked). Values written before the
+// keyring are a bare nonce and ciphertext.
+const (
+	sealedV1      byte = 1
+	sealedV2      byte = 2
+	sealedVersion      = sealedV2
+
+	sealedV1HeaderSize = 5
+	sealedHeaderSize   = 13
+	migrateTimeout     = 30 * time.Second
+)
+
+// ErrDecrypt is returned for a value that does not open under its key: it
+// was damaged, written with another password or moved from another key.
+var ErrDecrypt = errors.New("storage: cannot decrypt value")
+
+// sealedMeta describes how a value was sealed.
+type sealedMeta struct {
+	version byte
+	term    uint32
+	counter uint64
+}
+
+// NewEncryptedStorage opens the keyring of backend with pass, creating it if
+// the backend has none, and returns ErrWrongPassword if pass does not fit.
 func NewEncryptedStorage(backend Storage, pass string) (*EncryptedStorage, error) {
-	key := sha256.Sum256([]byte(pass))
-	block, err := aes.NewCipher(key[:])
+	k, kr, keys, err := openKeyring(context.Background(), backend, pass)
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
+	e := &EncryptedStorage{backend: backend, kek: k}
+	if err := e.install(kr, keys); err != nil {
 		return nil, err
 	}
-	return &EncryptedStorage{
-		backend: backend,
-		gcm:     gcm,
-		nonceSz: gcm.NonceSize(),
-	}, nil
+	return e, nil
 }
 
 func (e *EncryptedStorage) Put(ctx context.Context, key string, value []byte) error {
-	nonce := make([]byte, e.nonceSz)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return err
-	}
-	ciphertext := e.gcm.Seal(nonce, nonce, value, nil)
-	return e.backend.Put(ctx, key, ciphertext)
+	return e.Batch(ctx, []Op{{Key: key, Value: value}})
 }
 
+// Get decrypts the value at key, checking its version counter if the key is
+// tracked (see TrackVersions). A value in an older format or under an older
+// data key is returned as is and re-encrypted in the background.
 func (e *EncryptedStorage) Get(ctx context.Context, key string) ([]byte, error) {
 	ciphertext, err := e.backend.Get(ctx, key)
 	if err != nil {
@@ -93,16 +162,242 @@ func (e *EncryptedStorage) Get(ctx context.Context, key string) ([]byte, error)
 	if ciphertext == nil {
 		return nil, nil
 	}
-	if len(ciphertext) < e.nonceSz {
-		return nil, errors.New("ciphertext too short")
+	value, meta, err := e.open(ctx, key, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkVersion(ctx, key, meta.counter); err != nil {
+		return nil, err
 	}
-	nonce := ciphertext[:e.nonceSz]
-	data := ciphertext[e.nonceSz:]
-	return e.gcm.Open(nil, nonce, data, nil)
+	if meta.version != sealedVersion || meta.term != e.activeTerm() {
+		e.migrateLater(key, ciphertext)
+	}
+	return value, nil
 }
 
 func (e *EncryptedStorage) Delete(ctx context.Context, key string) error {
-	return e.backend.Delete(ctx, key)
+	if !e.versions.tracked(key) {
+		return e.backend.Delete(ctx, key)
+	}
+	return e.Batch(ctx, []Op{{Key: key, Delete: true}})
+}
+
+func (e *EncryptedStorage) activeTerm() uint32 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.active
+}
+
+func (e *EncryptedStorage) seal(key string, counter uint64, value []byte) ([]byte, error) {
+	e.mu.RLock()
+	term, aead := e.active, e.keys[e.active]
+	e.mu.RUnlock()
+
+	out := make([]byte, sealedHeaderSize+aead.NonceSize(), sealedHeaderSize+aead.NonceSize()+len(value)+aead.Overhead())
+	out[0] = sealedV2
+	binary.BigEndian.PutUint32(out[1:5], term)
+	binary.BigEndian.PutUint64(out[5:sealedHeaderSize], counter)
+	nonce := out[sealedHeaderSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, value, sealedAD(out[:sealedHeaderSize], key)), nil
+}
+
+func sealedAD(header []byte, key string) []byte {
+	return append(append(make([]byte, 0, len(header)+len(key)), header...), key...)
+}
+
+// open decrypts the value sealed at key. A term this process does not know
+// yet makes it reload the keyring, since another process may have rekeyed.
+func (e *EncryptedStorage) open(ctx context.Context, key string, ciphertext []byte) ([]byte, sealedMeta, error) {
+	if len(ciphertext) > 0 && (ciphertext[0] == sealedV1 || ciphertext[0] == sealedV2) {
+		meta := sealedMeta{version: ciphertext[0]}
+		headerSize := sealedV1HeaderSize
+		if meta.version == sealedV2 {
+			headerSize = sealedHeaderSize
+		}
+		if len(ciphertext) > headerSize {
+			meta.term = binary.BigEndian.Uint32(ciphertext[1:5])
+			var ad []byte
+			if meta.version == sealedV2 {
+				meta.counter = binary.BigEndian.Uint64(ciphertext[5:sealedHeaderSize])
+				ad = sealedAD(ciphertext[:sealedHeaderSize], key)
+			} else if e.isMigrated() {
+				return nil, sealedMeta{}, ErrDecrypt
+			}
+			aead := e.key(meta.term)
+			if aead == nil && meta.term != legacyTerm {
+				if err := e.reload(ctx); err != nil {
+					return nil, sealedMeta{}, err
+				}
+				aead = e.key(meta.term)
+			}
+			if aead != nil && meta.term != legacyTerm && len(ciphertext) >= headerSize+aead.NonceSize() {
+				body := ciphertext[headerSize:]
+				if value, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], ad); err == nil {
+					return value, meta, nil
+				}
+			}
+		}
+	}
+
+	// A legacy value, which may begin with a version byte by chance. It is
+	// bound to nothing, so it is only accepted until Reencrypt has run.
+	aead := e.key(legacyTerm)
+	if aead == nil || e.isMigrated() || len(ciphertext) < aead.NonceSize() {
+		return nil, sealedMeta{}, ErrDecrypt
+	}
+	value, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, sealedMeta{}, ErrDecrypt
+	}
+	return value, sealedMeta{term: legacyTerm}, nil
+}
+
+func (e *EncryptedStorage) isMigrated() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.migrated
+}
+
+func (e *EncryptedStorage) key(term uint32) cipher.AEAD {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.keys[term]
+}
+
+// migrateLater re-encrypts key in the background. It cannot happen inline:
+// the caller of Get may hold the key's lock.
+func (e *EncryptedStorage) migrateLater(key string, old []byte) {
+	if _, busy := e.migrating.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	go func() {
+		defer e.migrating.Delete(key)
+		ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+		defer cancel()
+		_, _ = e.reseal(ctx, key, old)
+	}()
+}
+
+// reseal re-encrypts the value at key in the current format with the active
+// data key, keeping its version counter, under the key's lock. If old is
+// set, a value that changed since it was read as old is left alone. It
+// reports whether it wrote.
+func (e *EncryptedStorage) reseal(ctx context.Context, key string, old []byte) (bool, error) {
+	unlock, err := Lock(ctx, e.backend, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	ciphertext, err := e.backend.Get(ctx, key)
+	if err != nil || ciphertext == nil {
+		return false, err
+	}
+	if old != nil && !bytes.Equal(ciphertext, old) {
+		return false, nil
+	}
+	value, meta, err := e.open(ctx, key, ciphertext)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	if meta.version == sealedVersion && meta.term == e.activeTerm() {
+		return false, nil
+	}
+	sealed, err := e.seal(key, meta.counter, value)
+	if err != nil {
+		return false, err
+	}
+	return true, e.backend.Put(ctx, key, sealed)
+}
+
+// Batch encrypts the values, bumps the version counters of tracked keys and
+// hands the batch to the backend.
+func (e *EncryptedStorage) Batch(ctx context.Context, ops []Op) error {
+	sealed := make([]Op, 0, len(ops))
+	bumped := map[string]uint64{}
+	for _, op := range ops {
+		var counter uint64
+		if e.versions.tracked(op.Key) {
+			next, err := e.nextVersion(ctx, op.Key, bumped[op.Key])
+			if err != nil {
+				return err
+			}
+			counter, bumped[op.Key] = next, next
+		}
+		if !op.Delete {
+			ciphertext, err := e.seal(op.Key, counter, op.Value)
+			if err != nil {
+				return err
+			}
+			op.Value = ciphertext
+		}
+		sealed = append(sealed, op)
+		if counter != 0 {
+			record, err := e.versionRecord(op.Key, counter)
+			if err != nil {
+				return err
+			}
+			sealed = append(sealed, record)
+		}
+	}
+	if err := Batch(ctx, e.backend, sealed); err != nil {
+		return err
+	}
+	for key, counter := range bumped {
+		e.versions.observe(key, counter)
+	}
+	return nil
+}
+
+// Only values are encrypted. Key names are stored in the clear (they are IDs
+// and addresses, not secrets), so listing and locking pass through.
+func (e *EncryptedStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := e.backend.List(ctx, prefix)
+	if err != nil || prefix != "" {
+		return keys, err
+	}
+	return hideInternal(keys), nil
+}
+
+func (e *EncryptedStorage) ListPage(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	if prefix != "" {
+		return ListPage(ctx, e.backend, prefix, after, limit)
+	}
+	// Hidden keys leave a page short: fill it from the next one.
+	var out []string
+	for {
+		keys, err := ListPage(ctx, e.backend, prefix, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, hideInternal(keys)...)
+		if limit <= 0 || len(keys) < limit || len(out) >= limit {
+			if limit > 0 && len(out) > limit {
+				out = out[:limit]
+			}
+			return out, nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// hideInternal drops the keyring and version records from a listing of the
+// root.
+func hideInternal(keys []string) []string {
+	out := keys[:0]
+	for _, k := range keys {
+		if k != KeyringKey && k != versionsPrefix {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func (e *EncryptedStorage) Lock(ctx context.Context, key string) (func(), error) {
+	return Lock(ctx, e.backend, key)
 }
 
 func clearPath(path string) string {
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Version counters let an EncryptedStorage notice a value rolled back to an
+// older copy, such as a spent presignature restored from a backup of the
+// data directory. Every write to a tracked key, deletes included, takes the
+// next counter; the counter is sealed into the value and also kept in a
+// record under versionsPrefix. A value whose counter is below its record, or
+// below the highest counter this process has seen for the key, is refused.
+// Rolling back a value and its record together is only caught by a process
+// that saw the newer counter.
+
+// versionsPrefix holds the version records. It is hidden from List.
+const versionsPrefix = "_versions/"
+
+// ErrRollback is returned for a tracked value older than one already
+// written.
+var ErrRollback = errors.New("storage: stale value, rollback detected")
+
+type versions struct {
+	mu       sync.Mutex
+	prefixes []string
+	seen     map[string]uint64
+}
+
+func (v *versions) tracked(key string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, p := range v.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *versions) highest(key string) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.seen[key]
+}
+
+func (v *versions) observe(key string, counter uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if counter > v.seen[key] {
+		v.seen[key] = counter
+	}
+}
+
+// TrackVersions turns on version counters for keys under the given
+// prefixes. Call it before the storage is shared; values already stored
+// count as version zero until their next write.
+func (e *EncryptedStorage) TrackVersions(prefixes ...string) {
+	e.versions.mu.Lock()
+	defer e.versions.mu.Unlock()
+	e.versions.prefixes = append(e.versions.prefixes, prefixes...)
+	if e.versions.seen == nil {
+		e.versions.seen = make(map[string]uint64)
+	}
+}
+
+// recordedVersion reads the version record of key, zero if there is none.
+func (e *EncryptedStorage) recordedVersion(ctx context.Context, key string) (uint64, error) {
+	recordKey := versionsPrefix + key
+	ciphertext, err := e.backend.Get(ctx, recordKey)
+	if err != nil || ciphertext == nil {
+		return 0, err
+	}
+	data, _, err := e.open(ctx, recordKey, ciphertext)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", recordKey, err)
+	}
+	if len(data) != 8 {
+		return 0, fmt.Errorf("%s: bad version record", recordKey)
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+func (e *EncryptedStorage) versionRecord(key string, counter uint64) (Op, error) {
+	recordKey := versionsPrefix + key
+	sealed, err := e.seal(recordKey, 0, binary.BigEndian.AppendUint64(nil, counter))
+	if err != nil {
+		return Op{}, err
+	}
+	return Op{Key: recordKey, Value: sealed}, nil
+}
+
+// nextVersion returns the counter for the next write to key: one past the
+// record, the highest counter seen and floor.
+func (e *EncryptedStorage) nextVersion(ctx context.Context, key string, floor uint64) (uint64, error) {
+	recorded, err := e.recordedVersion(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return max(recorded, e.versions.highest(key), floor) + 1, nil
+}
+
+// checkVersion refuses a tracked value whose counter is older than its
+// record or than what this process has seen. A counter ahead of the record
+// is accepted: without atomic batches a crash can land between the value and
+// its record.
+func (e *EncryptedStorage) checkVersion(ctx context.Context, key string, counter uint64) error {
+	if !e.versions.tracked(key) {
+		return nil
+	}
+	recorded, err := e.recordedVersion(ctx, key)
+	if err != nil {
+		return err
+	}
+	if counter < recorded || counter < e.versions.highest(key) {
+		return fmt.Errorf("%s: %w", key, ErrRollback)
+	}
+	e.versions.observe(key, counter)
+	return nil
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestEncryptedStorageBindsKeys(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+	enc, err := NewEncryptedStorage(b, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = enc.Put(ctx, "accounts/a/conf-ecdsa", []byte("a"))
+	_ = enc.Put(ctx, "accounts/b/conf-ecdsa", []byte("b"))
+	raw, _ := b.Get(ctx, "accounts/a/conf-ecdsa")
+	_ = b.Put(ctx, "accounts/b/conf-ecdsa", raw)
+	if _, err := enc.Get(ctx, "accounts/b/conf-ecdsa"); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("value moved to another key: %v", err)
+	}
+	_ = enc.Delete(ctx, "accounts/b/conf-ecdsa")
+
+	// Version 1 values, sealed without associated data, still open and are
+	// rewritten in the current format.
+	aead := enc.key(enc.activeTerm())
+	v1 := make([]byte, sealedV1HeaderSize+aead.NonceSize())
+	v1[0] = sealedV1
+	binary.BigEndian.PutUint32(v1[1:5], enc.activeTerm())
+	_, _ = rand.Read(v1[sealedV1HeaderSize:])
+	v1 = aead.Seal(v1, v1[sealedV1HeaderSize:], []byte("old"), nil)
+	_ = b.Put(ctx, "v1", v1)
+	if v, err := enc.Get(ctx, "v1"); err != nil || string(v) != "old" {
+		t.Fatalf("version 1 value: %q, %v", v, err)
+	}
+	if n, err := enc.Reencrypt(ctx); err != nil || n != 1 {
+		t.Fatalf("Reencrypt: %d, %v", n, err)
+	}
+	if raw, _ := b.Get(ctx, "v1"); raw[0] != sealedV2 {
+		t.Fatalf("version 1 value not rewritten: %d", raw[0])
+	}
+	// After that they are refused.
+	_ = b.Put(ctx, "v1", v1)
+	if _, err := enc.Get(ctx, "v1"); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("version 1 value after Reencrypt: %v", err)
+	}
+}
+
+func TestEncryptedStorageDetectsRollback(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+	open := func() *EncryptedStorage {
+		enc, err := NewEncryptedStorage(b, "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.TrackVersions("accounts/")
+		return enc
+	}
+	enc := open()
+
+	const key = "accounts/a/presig-ecdsa"
+	_ = enc.Put(ctx, key, []byte("presig 1"))
+	oldValue, _ := b.Get(ctx, key)
+	oldRecord, _ := b.Get(ctx, versionsPrefix+key)
+	_ = enc.Put(ctx, key, []byte("presig 2"))
+
+	_ = b.Put(ctx, key, oldValue)
+	if _, err := enc.Get(ctx, key); !errors.Is(err, ErrRollback) {
+		t.Fatalf("rolled back value: %v", err)
+	}
+	if _, err := open().Get(ctx, key); !errors.Is(err, ErrRollback) {
+		t.Fatalf("rolled back value, fresh process: %v", err)
+	}
+
+	// Restoring the record as well only fools a process that never saw the
+	// newer counter.
+	_ = b.Put(ctx, versionsPrefix+key, oldRecord)
+	if _, err := enc.Get(ctx, key); !errors.Is(err, ErrRollback) {
+		t.Fatalf("rolled back value and record: %v", err)
+	}
+	if v, err := open().Get(ctx, key); err != nil || string(v) != "presig 1" {
+		t.Fatalf("fresh process: %q, %v", v, err)
+	}
+
+	// A deleted presignature cannot be brought back.
+	enc = open()
+	_ = enc.Put(ctx, key, []byte("presig 3"))
+	spent, _ := b.Get(ctx, key)
+	if err := enc.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	_ = b.Put(ctx, key, spent)
+	if _, err := open().Get(ctx, key); !errors.Is(err, ErrRollback) {
+		t.Fatalf("restored deleted value: %v", err)
+	}
+
+	// Untracked keys are not counted, and records are not listed.
+	_ = enc.Put(ctx, "pair/x", []byte("x"))
+	if raw, _ := b.Get(ctx, versionsPrefix+"pair/x"); raw != nil {
+		t.Fatal("untracked key has a version record")
+	}
+	if keys, _ := enc.List(ctx, ""); len(keys) != 2 || keys[0] != "accounts/" || keys[1] != "pair/" {
+		t.Fatalf("List: %v", keys)
+	}
+}